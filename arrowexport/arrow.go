@@ -0,0 +1,288 @@
+// Package arrowexport streams the results of gorq query plans into
+// Apache Arrow record batches and Parquet files.  It is kept out of
+// the main packages so that only projects that use it depend on
+// Arrow.
+package arrowexport
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/apache/arrow/go/v14/parquet"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+	"github.com/outdoorsy/gorq/plans"
+)
+
+// DefaultBatchSize is the number of rows in each record batch when a
+// batch size of zero is requested.
+const DefaultBatchSize = 10000
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	bytesType       = reflect.TypeOf([]byte(nil))
+	nullStringType  = reflect.TypeOf(sql.NullString{})
+	nullInt64Type   = reflect.TypeOf(sql.NullInt64{})
+	nullFloat64Type = reflect.TypeOf(sql.NullFloat64{})
+	nullBoolType    = reflect.TypeOf(sql.NullBool{})
+	nullTimeType    = reflect.TypeOf(sql.NullTime{})
+)
+
+// Schema returns the Arrow schema for the columns that plan selects.
+// Column types are taken from the Go types of the fields that the
+// columns are mapped to; types with no Arrow equivalent are exported
+// as strings.  Every field is nullable.  Columns with the same name in
+// different tables (e.g. the id column of joined tables) are named
+// with their table as a prefix, e.g. invoice_id.
+func Schema(plan *plans.QueryPlan) *arrow.Schema {
+	columns := plan.SelectedColumns()
+	names := fieldNames(columns)
+	fields := make([]arrow.Field, 0, len(columns))
+	for i, col := range columns {
+		fields = append(fields, arrow.Field{Name: names[i], Type: arrowType(col.Field), Nullable: true})
+	}
+	return arrow.NewSchema(fields, nil)
+}
+
+// fieldNames returns a unique field name for each of columns.
+func fieldNames(columns []plans.SelectedColumn) []string {
+	names := make([]string, len(columns))
+	counts := make(map[string]int, len(columns))
+	for i, col := range columns {
+		names[i] = col.Alias
+		if names[i] == "" {
+			names[i] = col.Column.ColumnName
+		}
+		counts[names[i]]++
+	}
+	used := make(map[string]bool, len(columns))
+	for i, col := range columns {
+		name := names[i]
+		if counts[name] > 1 && col.Table != "" {
+			name = col.Table + "_" + name
+		}
+		for base, n := name, 2; used[name]; n++ {
+			name = base + "_" + strconv.Itoa(n)
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// arrowType returns the Arrow type for the field that fieldPtr points
+// to.
+func arrowType(fieldPtr interface{}) arrow.DataType {
+	t := reflect.TypeOf(fieldPtr)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return arrow.BinaryTypes.String
+	}
+	switch t {
+	case timeType, nullTimeType:
+		return arrow.FixedWidthTypes.Timestamp_us
+	case bytesType:
+		return arrow.BinaryTypes.Binary
+	case nullStringType:
+		return arrow.BinaryTypes.String
+	case nullInt64Type:
+		return arrow.PrimitiveTypes.Int64
+	case nullFloat64Type:
+		return arrow.PrimitiveTypes.Float64
+	case nullBoolType:
+		return arrow.FixedWidthTypes.Boolean
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return arrow.PrimitiveTypes.Int64
+	case reflect.Float32, reflect.Float64:
+		return arrow.PrimitiveTypes.Float64
+	case reflect.Bool:
+		return arrow.FixedWidthTypes.Boolean
+	}
+	return arrow.BinaryTypes.String
+}
+
+// Records executes plan's select statement and calls fn with a record
+// batch for every batchSize rows (or DefaultBatchSize, if batchSize is
+// zero), streaming rows from the database as they are read.  Each
+// record is released after fn returns, so fn must call Retain on any
+// record that it needs to hold on to.
+func Records(plan *plans.QueryPlan, batchSize int, fn func(arrow.Record) error) error {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	builder := array.NewRecordBuilder(memory.NewGoAllocator(), Schema(plan))
+	defer builder.Release()
+	rows := 0
+	flush := func() error {
+		record := builder.NewRecord()
+		defer record.Release()
+		rows = 0
+		return fn(record)
+	}
+	err := plan.EachRow(func(values []interface{}) error {
+		for i, value := range values {
+			if err := appendValue(builder.Field(i), value); err != nil {
+				return fmt.Errorf("arrowexport: column %s: %s", builder.Schema().Field(i).Name, err)
+			}
+		}
+		rows++
+		if rows < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// WriteParquet executes plan's select statement and writes the
+// results to w as a Parquet file, using record batches of batchSize
+// rows as row groups.
+func WriteParquet(plan *plans.QueryPlan, w io.Writer, batchSize int) error {
+	writer, err := pqarrow.NewFileWriter(Schema(plan), w, parquet.NewWriterProperties(), pqarrow.DefaultWriterProps())
+	if err != nil {
+		return err
+	}
+	err = Records(plan, batchSize, writer.Write)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// appendValue appends a value scanned from the database to builder,
+// converting it to the builder's type.  Drivers differ in the types
+// they return (e.g. MySQL returns most values as []byte), so string
+// forms of each type are parsed.
+func appendValue(builder array.Builder, value interface{}) error {
+	if value == nil {
+		builder.AppendNull()
+		return nil
+	}
+	switch b := builder.(type) {
+	case *array.Int64Builder:
+		switch v := value.(type) {
+		case int64:
+			b.Append(v)
+		case []byte:
+			i, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return err
+			}
+			b.Append(i)
+		default:
+			return fmt.Errorf("cannot convert %T to int64", value)
+		}
+	case *array.Float64Builder:
+		switch v := value.(type) {
+		case float64:
+			b.Append(v)
+		case int64:
+			b.Append(float64(v))
+		case []byte:
+			f, err := strconv.ParseFloat(string(v), 64)
+			if err != nil {
+				return err
+			}
+			b.Append(f)
+		default:
+			return fmt.Errorf("cannot convert %T to float64", value)
+		}
+	case *array.BooleanBuilder:
+		switch v := value.(type) {
+		case bool:
+			b.Append(v)
+		case int64:
+			b.Append(v != 0)
+		case []byte:
+			parsed, err := strconv.ParseBool(string(v))
+			if err != nil {
+				return err
+			}
+			b.Append(parsed)
+		default:
+			return fmt.Errorf("cannot convert %T to bool", value)
+		}
+	case *array.TimestampBuilder:
+		switch v := value.(type) {
+		case time.Time:
+			b.Append(arrow.Timestamp(v.UnixMicro()))
+		case []byte:
+			t, err := parseTimestamp(string(v))
+			if err != nil {
+				return err
+			}
+			b.Append(arrow.Timestamp(t.UnixMicro()))
+		case string:
+			t, err := parseTimestamp(v)
+			if err != nil {
+				return err
+			}
+			b.Append(arrow.Timestamp(t.UnixMicro()))
+		default:
+			return fmt.Errorf("cannot convert %T to a timestamp", value)
+		}
+	case *array.BinaryBuilder:
+		switch v := value.(type) {
+		case []byte:
+			b.Append(v)
+		case string:
+			b.AppendString(v)
+		default:
+			b.AppendString(fmt.Sprint(value))
+		}
+	case *array.StringBuilder:
+		switch v := value.(type) {
+		case []byte:
+			b.Append(string(v))
+		case string:
+			b.Append(v)
+		default:
+			b.Append(fmt.Sprint(value))
+		}
+	default:
+		return fmt.Errorf("unsupported arrow builder %T", builder)
+	}
+	return nil
+}
+
+// timestampFormats are the formats that parseTimestamp accepts: those
+// that MySQL (without parseTime) and SQLite return timestamps in.
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTimestamp parses a timestamp that a driver returned as text.
+// Timestamps without a time zone are assumed to be in UTC.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSuffix(s, "Z")
+	for _, format := range timestampFormats {
+		if t, err := time.ParseInLocation(format, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a timestamp", s)
+}
@@ -0,0 +1,72 @@
+package arrowexport
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/plans"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArrowType(t *testing.T) {
+	var row struct {
+		Id      int64
+		Score   *float64
+		Paid    bool
+		Created time.Time
+		Memo    sql.NullString
+		Raw     []byte
+		Other   struct{}
+	}
+	assert.Equal(t, arrow.PrimitiveTypes.Int64, arrowType(&row.Id))
+	assert.Equal(t, arrow.PrimitiveTypes.Float64, arrowType(&row.Score))
+	assert.Equal(t, arrow.FixedWidthTypes.Boolean, arrowType(&row.Paid))
+	assert.Equal(t, arrow.FixedWidthTypes.Timestamp_us, arrowType(&row.Created))
+	assert.Equal(t, arrow.BinaryTypes.String, arrowType(&row.Memo))
+	assert.Equal(t, arrow.BinaryTypes.Binary, arrowType(&row.Raw))
+	assert.Equal(t, arrow.BinaryTypes.String, arrowType(&row.Other))
+}
+
+func TestAppendValue(t *testing.T) {
+	builder := array.NewInt64Builder(memory.NewGoAllocator())
+	defer builder.Release()
+	assert.NoError(t, appendValue(builder, int64(1)))
+	assert.NoError(t, appendValue(builder, []byte("2")))
+	assert.NoError(t, appendValue(builder, nil))
+	assert.Error(t, appendValue(builder, "three"))
+	values := builder.NewInt64Array()
+	defer values.Release()
+	assert.Equal(t, 3, values.Len())
+	assert.Equal(t, int64(2), values.Value(1))
+	assert.True(t, values.IsNull(2))
+}
+
+func TestAppendTimestamp(t *testing.T) {
+	builder := array.NewTimestampBuilder(memory.NewGoAllocator(), arrow.FixedWidthTypes.Timestamp_us.(*arrow.TimestampType))
+	defer builder.Release()
+	expected := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, appendValue(builder, expected))
+	assert.NoError(t, appendValue(builder, []byte("2020-01-02 03:04:05")))
+	assert.NoError(t, appendValue(builder, "2020-01-02 03:04:05+00:00"))
+	assert.Error(t, appendValue(builder, "yesterday"))
+	values := builder.NewTimestampArray()
+	defer values.Release()
+	for i := 0; i < values.Len(); i++ {
+		assert.Equal(t, arrow.Timestamp(expected.UnixMicro()), values.Value(i))
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+	columns := []plans.SelectedColumn{
+		{Table: "invoice", Column: &gorp.ColumnMap{ColumnName: "id"}},
+		{Table: "person", Column: &gorp.ColumnMap{ColumnName: "id"}},
+		{Table: "person", Column: &gorp.ColumnMap{ColumnName: "name"}},
+		{Table: "person", Column: &gorp.ColumnMap{ColumnName: "invoice_id"}},
+	}
+	assert.Equal(t, []string{"invoice_id", "person_id", "name", "invoice_id_2"}, fieldNames(columns))
+}
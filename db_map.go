@@ -2,6 +2,7 @@ package gorq
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"reflect"
@@ -12,6 +13,9 @@ import (
 	"github.com/outdoorsy/gorq/plans"
 )
 
+// ErrNotFound is returned by SelectOne when no rows match the query.
+var ErrNotFound = plans.ErrNotFound
+
 // SqlExecutor is any type that can execute SQL statements.  Gorq's
 // SqlExecutor matches that of gorp, but has some additional methods.
 type SqlExecutor interface {
@@ -25,10 +29,91 @@ type SqlExecutor interface {
 }
 
 // DbMap embeds "github.com/outdoorsy/gorp".DbMap and adds query
-// methods to it.
+// methods to it.  It is the main entry point of gorq: queries created
+// by its Query methods (and by its transactions) share the settings
+// applied using Configure and the rest of its methods, e.g. join
+// strategies, policies, and hooks, so that they don't have to be
+// repeated at every call site.  See New.
 type DbMap struct {
 	gorp.DbMap
-	joinOps []plans.JoinOp
+	options plans.Options
+}
+
+// New returns a DbMap for db using dialect, with config applied to
+// every query that it creates.  It is equivalent to setting the Db and
+// Dialect fields of a new DbMap and calling Configure.  Tables, join
+// strategies, hooks, and the like should be added to the returned
+// DbMap before it is used.
+func New(db *sql.DB, dialect gorp.Dialect, config Config) *DbMap {
+	m := &DbMap{DbMap: gorp.DbMap{Db: db, Dialect: dialect}}
+	m.Configure(config)
+	return m
+}
+
+// A Config holds defaults that a DbMap applies to every query that it
+// creates, so that call sites don't have to remember to apply them.
+// See DbMap.Configure.
+type Config struct {
+	// DefaultLimit caps the results of select statements which don't
+	// set their own limit.  See plans.Options.DefaultLimit.
+	DefaultLimit int64
+
+	// Timeout limits how long each statement may run.
+	Timeout time.Duration
+
+	// TenantScope, if non-nil, has its Policy added to every query,
+	// so that queries against its scoped tables without a tenant in
+	// their context will fail.
+	TenantScope *TenantScope
+
+	// RequireWhere prevents queries from updating or deleting every
+	// row of a table.  See plans.ErrNoWhere.
+	RequireWhere bool
+
+	// Limits are the limits that every statement is checked against
+	// before executing.  See plans.Limits.
+	Limits plans.Limits
+
+	// CommentTags are appended to every statement as an SQL comment,
+	// using values from the query's context.  See
+	// plans.Options.CommentTags.
+	CommentTags   []plans.CommentTag
+	CommentFormat plans.CommentFormat
+
+	// NoInlining binds values that would otherwise be inlined as
+	// literals, so that statement statistics (e.g. from
+	// pg_stat_statements) aren't split by them.  See
+	// plans.Options.NoInlining.
+	NoInlining bool
+
+	// ReadOnly makes every query read-only, e.g. for a DbMap that is
+	// handed to reporting code.  Only queries are affected; gorp's own
+	// methods (Insert, Exec, etc) can still write.  See
+	// plans.ErrReadOnly.
+	ReadOnly bool
+
+	// ReferenceJoinType sets the join type for joins made by
+	// AutoJoin and for join strategies' JoinSpecs without a Type.
+	// See plans.Options.ReferenceJoinType.
+	ReferenceJoinType string
+}
+
+// Configure applies config to every query created from this DbMap
+// (and its transactions) from now on.  It should be called once, while
+// setting up the DbMap.
+func (m *DbMap) Configure(config Config) {
+	m.options.DefaultLimit = config.DefaultLimit
+	m.options.Timeout = config.Timeout
+	m.options.RequireWhere = config.RequireWhere
+	m.options.Limits = config.Limits
+	m.options.CommentTags = config.CommentTags
+	m.options.CommentFormat = config.CommentFormat
+	m.options.NoInlining = config.NoInlining
+	m.options.ReadOnly = config.ReadOnly
+	m.options.ReferenceJoinType = config.ReferenceJoinType
+	if config.TenantScope != nil {
+		m.AddPolicy(config.TenantScope.Policy)
+	}
 }
 
 func (m *DbMap) JoinOp(target, fieldPtrOrName interface{}, op plans.JoinFunc) error {
@@ -36,21 +121,237 @@ func (m *DbMap) JoinOp(target, fieldPtrOrName interface{}, op plans.JoinFunc) er
 		err   error
 		newOp = plans.JoinOp{}
 	)
-	if newOp.Table, err = m.TableFor(reflect.TypeOf(target), false); err != nil {
+	if newOp.Table, newOp.Column, err = m.column(target, fieldPtrOrName); err != nil {
 		return err
 	}
-	if newOp.Column = newOp.Table.ColMap(fieldPtrOrName); newOp.Column == nil {
-		return errors.New("No column found for the passed in field name or pointer")
-	}
 	newOp.Join = op
-	m.joinOps = append(m.joinOps, newOp)
+	m.options.JoinOps = append(m.options.JoinOps, newOp)
+	return nil
+}
+
+// JoinStrategy registers strategy as the plans.JoinStrategy for the
+// field or column fieldPtrOrName of target.  It will be used whenever
+// the field is requested using AddField.
+func (m *DbMap) JoinStrategy(target, fieldPtrOrName interface{}, strategy plans.JoinStrategy) error {
+	table, col, err := m.column(target, fieldPtrOrName)
+	if err != nil {
+		return err
+	}
+	m.options.JoinOps = append(m.options.JoinOps, plans.JoinOp{Table: table, Column: col, Strategy: strategy})
 	return nil
 }
 
 // Returns the []plan.JoinOp for the DbMap. Useful for creating a
 // plans.Query with a gorp.SqlExecutor.
 func (m *DbMap) JoinOps() []plans.JoinOp {
-	return m.joinOps
+	return m.options.JoinOps
+}
+
+// Options returns the plans.Options that the DbMap uses for every
+// query it creates.  Useful for creating a plans.QueryWithOptions
+// with a gorp.SqlExecutor.
+func (m *DbMap) Options() plans.Options {
+	return m.options
+}
+
+// QueryTraceOn turns on logging of the statements executed by
+// queries created from this DbMap.  Unlike gorp's TraceOn, arguments
+// bound against columns registered with Sensitive will not be
+// logged.
+func (m *DbMap) QueryTraceOn(prefix string, logger plans.Logger) {
+	m.options.LogPrefix = prefix
+	m.options.Logger = logger
+}
+
+// QueryTraceOff turns off logging of the statements executed by
+// queries created from this DbMap.
+func (m *DbMap) QueryTraceOff() {
+	m.options.Logger = nil
+}
+
+// Sensitive marks the column for the passed in field as sensitive.
+// Queries will log plans.Redacted in place of any argument bound
+// against a sensitive column.
+func (m *DbMap) Sensitive(target, fieldPtrOrName interface{}) error {
+	_, col, err := m.column(target, fieldPtrOrName)
+	if err != nil {
+		return err
+	}
+	m.options.SensitiveColumns = append(m.options.SensitiveColumns, col)
+	return nil
+}
+
+// Lazy marks the column for the passed in field as lazy.  Queries
+// will leave it out of select statements unless it is requested
+// using Fields or AddField, and its value can be loaded on demand
+// using LoadFields.
+func (m *DbMap) Lazy(target, fieldPtrOrName interface{}) error {
+	_, col, err := m.column(target, fieldPtrOrName)
+	if err != nil {
+		return err
+	}
+	m.options.LazyColumns = append(m.options.LazyColumns, col)
+	return nil
+}
+
+// Computed registers expression as the SQL for the passed in field,
+// which must be tagged with db:"-".  Queries will select it into that
+// field, and use it in place of a column when the field is used in
+// filters or ordering.  See plans.Options.ComputedColumns for the
+// expression syntax.
+func (m *DbMap) Computed(target, fieldPtrOrName interface{}, expression string) error {
+	_, col, err := m.column(target, fieldPtrOrName)
+	if err != nil {
+		return err
+	}
+	if !col.Transient {
+		return errors.New("gorq: Computed columns must be mapped to transient fields")
+	}
+	if m.options.ComputedColumns == nil {
+		m.options.ComputedColumns = make(map[*gorp.ColumnMap]string)
+	}
+	m.options.ComputedColumns[col] = expression
+	return nil
+}
+
+// IndexExpression registers expression as the canonical form of the
+// computed column for the passed in field in an expression index.
+// Queries will use it in place of the computed column's expression in
+// where and having clauses, so that the database can use the index.
+// See plans.Options.IndexExpressions.
+func (m *DbMap) IndexExpression(target, fieldPtrOrName interface{}, expression string) error {
+	_, col, err := m.column(target, fieldPtrOrName)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.options.ComputedColumns[col]; !ok {
+		return errors.New("gorq: Index expressions can only be registered for computed columns")
+	}
+	if m.options.IndexExpressions == nil {
+		m.options.IndexExpressions = make(map[*gorp.ColumnMap]string)
+	}
+	m.options.IndexExpressions[col] = expression
+	return nil
+}
+
+// LoadFields loads the values of fieldPtrs, which must point to
+// fields of row, from the database row with the same primary key as
+// row.  See plans.LoadFields.
+func (m *DbMap) LoadFields(row interface{}, fieldPtrs ...interface{}) error {
+	gorpMap := &m.DbMap
+	return plans.LoadFields(gorpMap, gorpMap, m.options, row, fieldPtrs...)
+}
+
+// AddPolicy adds a policy that will be run before every statement
+// executed by queries created from this DbMap.  See plans.PolicyFunc
+// for details.
+func (m *DbMap) AddPolicy(policy plans.PolicyFunc) {
+	m.options.Policies = append(m.options.Policies, policy)
+}
+
+// OnChange adds a hook that will be called after every INSERT,
+// UPDATE, or DELETE statement successfully executed by queries
+// created from this DbMap.  See plans.Change for details.
+//
+// Changes made by queries created from a Transaction started by Begin
+// or BeginContext are held until the transaction is committed, and are only passed to hooks once the
+// commit succeeds; changes from a transaction that is rolled back are
+// discarded.  Changes that are rolled back to a savepoint are still
+// passed to hooks if the transaction is committed.
+func (m *DbMap) OnChange(hook plans.ChangeFunc) {
+	m.options.ChangeHooks = append(m.options.ChangeHooks, hook)
+}
+
+// OnWarning adds a hook that will be called before every statement
+// executed by queries created from this DbMap which have warnings, so
+// that they can be collected centrally.  See plans.QueryPlan.Warnings.
+func (m *DbMap) OnWarning(hook plans.WarningFunc) {
+	m.options.WarningHooks = append(m.options.WarningHooks, hook)
+}
+
+// AdviseIndexes explains every distinct statement executed by queries
+// created from this DbMap, reporting sequential scans of large tables
+// to advisor.  It is meant for development environments; see
+// plans.IndexAdvisor.
+func (m *DbMap) AdviseIndexes(advisor *plans.IndexAdvisor) {
+	m.options.IndexAdvisor = advisor
+}
+
+// AddRewriter adds a rewriter that will be applied to every statement
+// executed by queries created from this DbMap.  See plans.Rewriter.
+func (m *DbMap) AddRewriter(rewriter plans.Rewriter) {
+	m.options.Rewriters = append(m.options.Rewriters, rewriter)
+}
+
+// AddView maps the struct type of i to the view named name, so that
+// it can be used as a query target like a table.  Views are mapped
+// separately from gorp's tables, so that gorp never creates tables
+// for them: the view, and any INSTEAD OF triggers needed to insert,
+// update, or delete rows through it, must be created by the
+// application.  Use SetKeys on the returned table map to give the
+// view a primary key.  See plans.Options.Views.
+func (m *DbMap) AddView(i interface{}, name string) *gorp.TableMap {
+	if m.options.Views == nil {
+		m.options.Views = &gorp.DbMap{Db: m.Db, Dialect: m.Dialect, TypeConverter: m.TypeConverter}
+	}
+	return m.options.Views.AddTableWithName(i, name)
+}
+
+// SetIdentifierPolicy sets how queries created from this DbMap will
+// quote table, column, and alias names.  See plans.IdentifierPolicy.
+func (m *DbMap) SetIdentifierPolicy(policy plans.IdentifierPolicy) {
+	m.options.Identifiers = policy
+}
+
+// SetLimits sets the limits that queries created from this DbMap will
+// be checked against before executing.  See plans.Limits.
+func (m *DbMap) SetLimits(limits plans.Limits) {
+	m.options.Limits = limits
+}
+
+// AllowOperators allows queries created from this DbMap to use ops
+// in filters.Op filters, in addition to the operators that are
+// allowed for its dialect.
+func (m *DbMap) AllowOperators(ops ...string) {
+	m.options.Operators = append(m.options.Operators, ops...)
+}
+
+// LimitHeavyQueries limits the number of queries marked as heavy
+// (see plans.QueryPlan.Heavy) that may execute at the same time to
+// n.  Heavy queries beyond the limit wait for a slot, or for their
+// context to be done.
+func (m *DbMap) LimitHeavyQueries(n int) {
+	m.options.HeavySemaphore = plans.NewSemaphore(n)
+}
+
+// SetJSONEncoder sets the encoder that queries created from this
+// DbMap will use in place of encoding/json when exporting results.
+// See plans.JSONEncoder.
+func (m *DbMap) SetJSONEncoder(encoder plans.JSONEncoder) {
+	m.options.JSONEncoder = encoder
+}
+
+// JSONHook registers hook to encode exported values of the same type
+// as example, in place of the DbMap's JSON encoder.
+func (m *DbMap) JSONHook(example interface{}, hook plans.JSONHook) {
+	if m.options.JSONHooks == nil {
+		m.options.JSONHooks = make(map[reflect.Type]plans.JSONHook)
+	}
+	m.options.JSONHooks[reflect.TypeOf(example)] = hook
+}
+
+// column looks up the table for target and the column for
+// fieldPtrOrName within that table.
+func (m *DbMap) column(target, fieldPtrOrName interface{}) (*gorp.TableMap, *gorp.ColumnMap, error) {
+	table, err := m.tableFor(reflect.TypeOf(target))
+	if err != nil {
+		return nil, nil, err
+	}
+	col := table.ColMap(fieldPtrOrName)
+	if col == nil {
+		return nil, nil, errors.New("No column found for the passed in field name or pointer")
+	}
+	return table, col, nil
 }
 
 // Query returns a Query type, which can be used to generate and run
@@ -88,13 +389,22 @@ func (m *DbMap) JoinOps() []plans.JoinOp {
 // capable of.
 func (m *DbMap) Query(target interface{}) interfaces.Query {
 	gorpMap := &m.DbMap
-	return plans.Query(gorpMap, gorpMap, target, m.joinOps...)
+	return plans.QueryWithOptions(gorpMap, gorpMap, target, m.options)
+}
+
+// QueryFromSpec creates a query for target from spec, using the
+// DbMap's options.  See plans.QueryPlan.Spec.
+func (m *DbMap) QueryFromSpec(target interface{}, spec *plans.Spec) (interfaces.SelectQuery, error) {
+	gorpMap := &m.DbMap
+	return plans.QueryFromSpec(gorpMap, gorpMap, target, spec, m.options)
 }
 
 func (m *DbMap) QueryContext(ctx context.Context, target interface{}) interfaces.Query {
 	gorpMap := &m.DbMap
 	gorpMap = gorpMap.WithContext(ctx).(*gorp.DbMap)
-	return plans.Query(gorpMap, gorpMap, target, m.joinOps...)
+	options := m.options
+	options.Context = ctx
+	return plans.QueryWithOptions(gorpMap, gorpMap, target, options)
 }
 
 func (m *DbMap) AttachContext(ctx context.Context) SqlExecutor {
@@ -121,7 +431,7 @@ func (m *DbMap) Begin(timeout time.Duration) (*Transaction, error) {
 		}
 	}
 
-	return &Transaction{Transaction: *t, dbmap: m}, nil
+	return &Transaction{Transaction: *t, dbmap: m, deferChanges: true}, nil
 }
 
 // BeginContext acts just like "github.com/outdoorsy/gorp".DbMap.BeginContext,
@@ -141,7 +451,7 @@ func (m *DbMap) BeginContext(ctx context.Context, timeout time.Duration) (*Trans
 		}
 	}
 
-	return &Transaction{Transaction: *t, dbmap: m}, nil
+	return &Transaction{Transaction: *t, dbmap: m, deferChanges: true}, nil
 }
 
 // WithTX creates a new transaction, calls your function with that transaction
@@ -226,23 +536,82 @@ func (m *DbMap) WithTXContext(ctx context.Context, fn func(tx *Transaction) erro
 	return nil
 }
 
+// WithSnapshot calls fn with a read-only transaction, so that every
+// query that fn creates using q sees the same snapshot of the
+// database.  This keeps related queries, like the count and the rows
+// of a paginated export, consistent with each other even while other
+// transactions write to the same tables.
+//
+// Queries created using q are read-only (see Config.ReadOnly), so
+// statements other than SELECT return plans.ErrReadOnly.  On
+// postgresql, the transaction also uses the REPEATABLE READ isolation
+// level and is marked READ ONLY, so that raw statements executed
+// using q can't write either; MySQL (using InnoDB) and SQLite
+// transactions already read from a single snapshot by default, but
+// don't prevent raw writes.  The transaction is always rolled back once
+// fn returns, and the error from fn is returned.
+func (m *DbMap) WithSnapshot(fn func(q SqlExecutor) error) error {
+	return m.WithSnapshotContext(context.Background(), fn)
+}
+
+// WithSnapshotContext is WithSnapshot, using ctx for the transaction.
+func (m *DbMap) WithSnapshotContext(ctx context.Context, fn func(q SqlExecutor) error) error {
+	tx, err := m.BeginContext(ctx, 0)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	tx.readOnly = true
+
+	if _, ok := m.Dialect.(gorp.PostgresDialect); ok {
+		_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY")
+		if err != nil {
+			return err
+		}
+	}
+
+	return fn(tx)
+}
+
 func (m *DbMap) table(target interface{}) *gorp.TableMap {
 	t := reflect.TypeOf(target)
 	if t.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
-	table, err := m.TableFor(t, false)
+	table, err := m.tableFor(t)
 	if err != nil {
 		return nil
 	}
 	return table
 }
 
+// tableFor looks up the table or view (see AddView) that t is mapped
+// to.
+func (m *DbMap) tableFor(t reflect.Type) (*gorp.TableMap, error) {
+	table, err := m.TableFor(t, false)
+	if err != nil && m.options.Views != nil {
+		if view, viewErr := m.options.Views.TableFor(t, false); viewErr == nil {
+			return view, nil
+		}
+	}
+	return table, err
+}
+
 // Transaction embeds "github.com/outdoorsy/gorp".Transaction and
 // adds query methods to it.
 type Transaction struct {
 	gorp.Transaction
 	dbmap *DbMap
+
+	// readOnly makes the transaction's queries read-only, as
+	// Config.ReadOnly does for a DbMap's queries.
+	readOnly bool
+
+	// deferChanges is set for transactions started by the DbMap, so
+	// that the changes made by their queries are held in changes
+	// until they are committed (see DbMap.OnChange).
+	deferChanges bool
+	changes      []plans.Change
 }
 
 // AttachContext is a no-op and returns the same object.
@@ -251,16 +620,66 @@ func (t *Transaction) AttachContext(ctx context.Context) SqlExecutor {
 	return t
 }
 
-// QueryContext just calls .Query. Transactions must be started using BeginContext for a
-// context to be used.
+// QueryContext runs a query within a transaction.  Transactions must
+// be started using BeginContext for a context to be used for
+// execution; ctx is only passed along to policies.
 func (t *Transaction) QueryContext(ctx context.Context, target interface{}) interfaces.Query {
-	return t.Query(target)
+	options := t.options()
+	options.Context = ctx
+	return plans.QueryWithOptions(&t.dbmap.DbMap, &t.Transaction, target, options)
 }
 
 // Query runs a query within a transaction.  See DbMap.Query for full
 // documentation.
 func (t *Transaction) Query(target interface{}) interfaces.Query {
-	return plans.Query(&t.dbmap.DbMap, &t.Transaction, target, t.dbmap.joinOps...)
+	return plans.QueryWithOptions(&t.dbmap.DbMap, &t.Transaction, target, t.options())
+}
+
+// LoadFields loads the values of fieldPtrs within the transaction.
+// See DbMap.LoadFields.
+func (t *Transaction) LoadFields(row interface{}, fieldPtrs ...interface{}) error {
+	return plans.LoadFields(&t.dbmap.DbMap, &t.Transaction, t.options(), row, fieldPtrs...)
+}
+
+// options returns the options that the transaction's queries are
+// created with.
+func (t *Transaction) options() plans.Options {
+	options := t.dbmap.options
+	if t.readOnly {
+		options.ReadOnly = true
+	}
+	if t.deferChanges && len(options.ChangeHooks) > 0 {
+		options.ChangeHooks = []plans.ChangeFunc{t.deferChange}
+	}
+	return options
+}
+
+// deferChange holds change until the transaction is committed.
+func (t *Transaction) deferChange(change plans.Change) {
+	t.changes = append(t.changes, change)
+}
+
+// Commit commits the transaction, and then passes the changes made by
+// its queries to the DbMap's change hooks.
+func (t *Transaction) Commit() error {
+	if err := t.Transaction.Commit(); err != nil {
+		return err
+	}
+	changes := t.changes
+	t.changes = nil
+	for _, change := range changes {
+		for _, hook := range t.dbmap.options.ChangeHooks {
+			hook(change)
+		}
+	}
+	return nil
+}
+
+// Rollback rolls back the transaction, discarding the changes made by
+// its queries without passing them to the DbMap's change hooks.
+func (t *Transaction) Rollback() error {
+	t.changes = nil
+	return t.Transaction.Rollback()
 }
 
 // DbMap is used to get a reference to the underlying dbmap the Transaction is using to do its work.
@@ -279,13 +698,13 @@ func GorpToGorq(exec gorp.SqlExecutor, m *DbMap) SqlExecutor {
 			DbMap: *e.GetDbMap(),
 		}
 		if m != nil {
-			dbMap.joinOps = m.joinOps
+			dbMap.options = m.options
 		}
 		return &Transaction{Transaction: *e, dbmap: &dbMap}
 	case *gorp.DbMap:
 		dbMap := &DbMap{DbMap: *e}
 		if m != nil {
-			dbMap.joinOps = m.joinOps
+			dbMap.options = m.options
 		}
 		return dbMap
 	// let's handle gorq types too, just in case it accidentally gets in here
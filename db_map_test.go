@@ -3,12 +3,14 @@ package gorq
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
 	"github.com/outdoorsy/gorq/interfaces"
 	"github.com/outdoorsy/gorq/plans"
 	"github.com/stretchr/testify/suite"
@@ -112,6 +114,223 @@ func (suite *DbMapTestSuite) TestAttachContext() {
 	})
 }
 
+func (suite *DbMapTestSuite) TestConfigure() {
+	dbMap := new(DbMap)
+	dbMap.Configure(Config{
+		DefaultLimit: 100,
+		Timeout:      time.Second,
+		TenantScope:  NewTenantScope("tenant"),
+		RequireWhere: true,
+		ReadOnly:     true,
+		Limits:       plans.Limits{MaxJoins: 3},
+
+		ReferenceJoinType: "inner",
+	})
+	options := dbMap.Options()
+	suite.Equal(int64(100), options.DefaultLimit)
+	suite.Equal(time.Second, options.Timeout)
+	suite.True(options.RequireWhere)
+	suite.True(options.ReadOnly)
+	suite.Equal("inner", options.ReferenceJoinType)
+	suite.Equal(3, options.Limits.MaxJoins)
+	suite.Len(options.Policies, 1, "The tenant scope's policy should be added to every query")
+}
+
+func (suite *DbMapTestSuite) TestNew() {
+	connection, err := sql.Open("sqlite3", "/tmp/gorptest.bin")
+	suite.Require().NoError(err)
+	dbMap := New(connection, gorp.SqliteDialect{}, Config{DefaultLimit: 10})
+	suite.Equal(connection, dbMap.Db)
+	suite.Equal(gorp.SqliteDialect{}, dbMap.Dialect)
+	suite.Equal(int64(10), dbMap.Options().DefaultLimit, "New should apply its config")
+}
+
+func (suite *DbMapTestSuite) TestWithSnapshot() {
+	dbMap := suite.Exec.(*DbMap)
+	err := dbMap.WithSnapshot(func(q SqlExecutor) error {
+		suite.IsType((*Transaction)(nil), q)
+		ref := new(ValidStruct)
+		err := q.Query(ref).Assign(&ref.ExportedValue, "snapshot").Insert()
+		suite.True(errors.Is(err, plans.ErrReadOnly), "Queries in a snapshot should be read-only, not %v", err)
+		return nil
+	})
+	suite.NoError(err)
+
+	expected := errors.New("snapshot failed")
+	err = dbMap.WithSnapshot(func(q SqlExecutor) error {
+		return expected
+	})
+	suite.Equal(expected, err, "WithSnapshot should return the error from its function")
+}
+
+type tenantKey struct{}
+
+type TenantAccount struct {
+	Id       int64
+	TenantId string
+}
+
+type TenantNote struct {
+	Id        int64
+	AccountId int64
+	TenantId  string
+}
+
+func (suite *DbMapTestSuite) TestTenantScopeLeftJoin() {
+	connection, err := sql.Open("sqlite3", "/tmp/gorptest.bin")
+	suite.Require().NoError(err)
+	dbMap := New(connection, gorp.SqliteDialect{}, Config{})
+	dbMap.AddTable(TenantAccount{}).SetKeys(true, "Id")
+	dbMap.AddTable(TenantNote{}).SetKeys(true, "Id")
+	suite.Require().NoError(dbMap.CreateTablesIfNotExists())
+	defer dbMap.DropTables()
+	scope := NewTenantScope(tenantKey{})
+	suite.Require().NoError(scope.Scope(dbMap, TenantAccount{}, "TenantId"))
+	suite.Require().NoError(scope.Scope(dbMap, TenantNote{}, "TenantId"))
+	dbMap.AddPolicy(scope.Policy)
+
+	account := &TenantAccount{TenantId: "a"}
+	suite.Require().NoError(dbMap.Insert(account))
+	suite.Require().NoError(dbMap.Insert(&TenantNote{AccountId: account.Id, TenantId: "b"}))
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "a")
+	ref := new(TenantAccount)
+	note := new(TenantNote)
+	count, err := dbMap.QueryContext(ctx, ref).
+		LeftJoin(note).
+		On(filters.Equal(&note.AccountId, &ref.Id)).
+		Count()
+	if suite.NoError(err) {
+		suite.Equal(int64(1), count, "Left joins to scoped tables with no rows for the tenant should still return the plan's rows")
+	}
+}
+
+func (suite *DbMapTestSuite) TestTenantScopeUpsertAll() {
+	connection, err := sql.Open("sqlite3", "/tmp/gorptest.bin")
+	suite.Require().NoError(err)
+	dbMap := New(connection, gorp.SqliteDialect{}, Config{})
+	dbMap.AddTable(TenantAccount{}).SetKeys(true, "Id")
+	suite.Require().NoError(dbMap.CreateTablesIfNotExists())
+	defer dbMap.DropTables()
+	scope := NewTenantScope(tenantKey{})
+	suite.Require().NoError(scope.Scope(dbMap, TenantAccount{}, "TenantId"))
+	dbMap.AddPolicy(scope.Policy)
+
+	account := &TenantAccount{TenantId: "a"}
+	suite.Require().NoError(dbMap.Insert(account))
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "b")
+	ref := new(TenantAccount)
+	upserted, err := dbMap.QueryContext(ctx, ref).(*plans.QueryPlan).
+		UpsertAll([]TenantAccount{{Id: account.Id, TenantId: "b"}}, []interface{}{&ref.Id}, nil)
+	if suite.NoError(err) {
+		suite.Equal(int64(0), upserted, "Upserts should not update rows belonging to other tenants")
+	}
+	existing, err := dbMap.Get(TenantAccount{}, account.Id)
+	if suite.NoError(err) {
+		suite.Equal("a", existing.(*TenantAccount).TenantId)
+	}
+}
+
+func (suite *DbMapTestSuite) TestTenantScopeUpsert() {
+	connection, err := sql.Open("sqlite3", "/tmp/gorptest.bin")
+	suite.Require().NoError(err)
+	dbMap := New(connection, gorp.SqliteDialect{}, Config{})
+	dbMap.AddTable(TenantAccount{}).SetKeys(true, "Id")
+	suite.Require().NoError(dbMap.CreateTablesIfNotExists())
+	defer dbMap.DropTables()
+	scope := NewTenantScope(tenantKey{})
+	suite.Require().NoError(scope.Scope(dbMap, TenantAccount{}, "TenantId"))
+	dbMap.AddPolicy(scope.Policy)
+
+	account := &TenantAccount{TenantId: "a"}
+	suite.Require().NoError(dbMap.Insert(account))
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "b")
+	ref := new(TenantAccount)
+	upserted, err := dbMap.QueryContext(ctx, ref).
+		Assign(&ref.Id, account.Id).
+		Assign(&ref.TenantId, "b").
+		Upsert([]interface{}{&ref.Id})
+	if suite.NoError(err) {
+		suite.Equal(int64(0), upserted, "Upserts should not update rows belonging to other tenants")
+	}
+	existing, err := dbMap.Get(TenantAccount{}, account.Id)
+	if suite.NoError(err) {
+		suite.Equal("a", existing.(*TenantAccount).TenantId)
+	}
+
+	mysql := New(connection, gorp.MySQLDialect{}, Config{})
+	mysql.AddTable(TenantAccount{}).SetKeys(true, "Id")
+	mysqlScope := NewTenantScope(tenantKey{})
+	suite.Require().NoError(mysqlScope.Scope(mysql, TenantAccount{}, "TenantId"))
+	mysql.AddPolicy(mysqlScope.Policy)
+	_, err = mysql.QueryContext(ctx, ref).
+		Assign(&ref.Id, account.Id).
+		Assign(&ref.TenantId, "b").
+		Upsert([]interface{}{&ref.Id})
+	suite.Error(err, "MySQL upserts should be rejected when update policies add filters")
+}
+
+type TimedEvent struct {
+	Id       int64
+	Occurred time.Time
+}
+
+func (suite *DbMapTestSuite) TestTimeMinMax() {
+	connection, err := sql.Open("sqlite3", "/tmp/gorptest.bin")
+	suite.Require().NoError(err)
+	dbMap := New(connection, gorp.SqliteDialect{}, Config{})
+	dbMap.AddTable(TimedEvent{}).SetKeys(true, "Id")
+	suite.Require().NoError(dbMap.CreateTablesIfNotExists())
+	defer dbMap.DropTables()
+
+	first := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	last := first.Add(48 * time.Hour)
+	suite.Require().NoError(dbMap.Insert(&TimedEvent{Occurred: last}, &TimedEvent{Occurred: first}))
+
+	ref := new(TimedEvent)
+	smallest, err := plans.Min(dbMap.Query(ref), &ref.Occurred)
+	if suite.NoError(err) && suite.NotNil(smallest) {
+		suite.True(first.Equal(*smallest), "Min should return the earliest time, not %v", *smallest)
+	}
+	largest, err := plans.Max(dbMap.Query(ref), &ref.Occurred)
+	if suite.NoError(err) && suite.NotNil(largest) {
+		suite.True(last.Equal(*largest), "Max should return the latest time, not %v", *largest)
+	}
+	none, err := plans.Min(dbMap.Query(ref).Where().Equal(&ref.Id, -1), &ref.Occurred)
+	if suite.NoError(err) {
+		suite.Nil(none, "Min should return nil when there are no values")
+	}
+}
+
+func (suite *DbMapTestSuite) TestOnChangeAfterCommit() {
+	connection, err := sql.Open("sqlite3", "/tmp/gorptest.bin")
+	suite.Require().NoError(err)
+	dbMap := New(connection, gorp.SqliteDialect{}, Config{})
+	dbMap.AddTable(TimedEvent{}).SetKeys(true, "Id")
+	suite.Require().NoError(dbMap.CreateTablesIfNotExists())
+	defer dbMap.DropTables()
+	var changes []plans.Change
+	dbMap.OnChange(func(change plans.Change) {
+		changes = append(changes, change)
+	})
+
+	ref := new(TimedEvent)
+	tx, err := dbMap.Begin(0)
+	suite.Require().NoError(err)
+	suite.Require().NoError(tx.Query(ref).Assign(&ref.Occurred, time.Now()).Insert())
+	suite.Empty(changes, "Changes should not be passed to hooks before the transaction is committed")
+	suite.Require().NoError(tx.Commit())
+	suite.Len(changes, 1, "Changes should be passed to hooks once the transaction is committed")
+
+	tx, err = dbMap.Begin(0)
+	suite.Require().NoError(err)
+	suite.Require().NoError(tx.Query(ref).Assign(&ref.Occurred, time.Now()).Insert())
+	suite.Require().NoError(tx.Rollback())
+	suite.Len(changes, 1, "Changes should be discarded when the transaction is rolled back")
+}
+
 type TransactionTestSuite struct {
 	QueryTestSuite
 }
@@ -0,0 +1,26 @@
+// Package dialects contains wrappers for gorp dialects whose SQL
+// differs from the standard SQL that gorq generates, e.g. in their
+// limit clauses.
+package dialects
+
+import "github.com/outdoorsy/gorp"
+
+// Wrap returns the wrapper for dialect from this package, or dialect
+// itself if it doesn't need one.  Query plans wrap their DbMap's
+// dialect on their own, without modifying the DbMap, so Wrap is only
+// needed by code that type switches on a dialect and wants to see the
+// same type that plans use, e.g.
+//
+//     dbMap := &gorp.DbMap{Db: db, Dialect: dialects.Wrap(gorp.SqliteDialect{})}
+//
+// which should be done once, while setting up the DbMap, since gorp
+// doesn't expect its dialect to change while it's in use.
+func Wrap(dialect gorp.Dialect) gorp.Dialect {
+	switch src := dialect.(type) {
+	case gorp.MySQLDialect:
+		return MySQLDialect{src}
+	case gorp.SqliteDialect:
+		return SqliteDialect{src}
+	}
+	return dialect
+}
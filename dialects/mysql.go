@@ -13,3 +13,7 @@ type MySQLDialect struct {
 func (dialect MySQLDialect) Limit(bindVar interface{}) string {
 	return fmt.Sprintf("limit %s", bindVar)
 }
+
+func (dialect MySQLDialect) DefaultValues() string {
+	return "() values ()"
+}
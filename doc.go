@@ -0,0 +1,22 @@
+// Package gorq is a query language for gorp.  Queries are built using
+// pointers to the fields of a reference struct, so that typos in
+// column names are compile errors, e.g.
+//
+//     dbMap := gorq.New(db, gorp.PostgresDialect{}, gorq.Config{
+//         DefaultLimit: 100,
+//         Timeout:      5 * time.Second,
+//     })
+//     dbMap.AddTableWithName(Invoice{}, "invoices")
+//
+//     ref := new(Invoice)
+//     results, err := dbMap.Query(ref).
+//         Where().
+//         Equal(&ref.PersonId, personId).
+//         Select()
+//
+// DbMap (and its transactions) should be used to create queries, since
+// it applies the same settings to all of them.  The plans package
+// contains the query types themselves, along with plans.Query for
+// creating them from a plain gorp.DbMap; the interfaces package
+// describes what each query type can do.
+package gorq
@@ -0,0 +1,66 @@
+package extensions
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+)
+
+// PostgresCopier is implemented by postgres query plans, to load rows
+// using postgresql's COPY protocol.
+type PostgresCopier interface {
+	CopyFrom(slicePtr interface{}) (int64, error)
+}
+
+// CopyFrom loads every element of the slice that slicePtr points to
+// (or the slice itself) into the plan's table using COPY ... FROM
+// STDIN, which is much faster than INSERT statements for large
+// numbers of rows.  Example:
+//
+//     ref := new(Listing)
+//     copied, err := dbMap.Query(ref).(extensions.PostgresCopier).CopyFrom(&listings)
+//
+// Elements must be of the plan's reference struct type (or pointers
+// to it).  As with InsertAll, auto-increment keys are left for the
+// database to generate, and are not stored back in the rows.  The
+// rows are sent using the driver's CopyIn support (as in lib/pq's
+// CopyIn), within the plan's transaction, or a transaction of their
+// own if the plan wasn't created from one; drivers without CopyIn
+// support will return an error from the prepared statement.
+func (plan *PostgresExtendedQueryPlan) CopyFrom(slicePtr interface{}) (int64, error) {
+	src, err := plan.CopySource(indirect(slicePtr))
+	if err != nil {
+		return -1, err
+	}
+	if src.Len() == 0 {
+		return 0, nil
+	}
+	query := "copy " + src.Table + " (" + strings.Join(src.Columns, ", ") + ") from stdin"
+	err = src.Exec(query, func(stmt *sql.Stmt) error {
+		err := src.Each(func(values []interface{}) error {
+			_, err := stmt.Exec(values...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// Executing the statement without arguments flushes the
+		// buffered rows to the server.
+		_, err = stmt.Exec()
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return int64(src.Len()), nil
+}
+
+// indirect returns the value that v points to, if it is a non-nil
+// pointer, or v otherwise.
+func indirect(v interface{}) interface{} {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return v
+	}
+	return value.Elem().Interface()
+}
@@ -59,3 +59,27 @@ func JSONObjectFieldText(value interface{}, fields ...string) filters.SqlWrapper
 func JSONObjectField(value interface{}, fields ...string) filters.SqlWrapper {
 	return jsonObjectFieldWrapper{actualValue: value, fields: fields}
 }
+
+type intervalWrapper struct {
+	interval string
+}
+
+func (wrapper intervalWrapper) ActualValue() interface{} {
+	return wrapper.interval
+}
+
+func (wrapper intervalWrapper) WrapSql(sqlValue string) string {
+	return fmt.Sprintf("cast(%s as interval)", sqlValue)
+}
+
+// Interval returns a filters.SqlWrapper for a postgres interval, for
+// use in date arithmetic.  For example, to join child rows created
+// more than a day after their parent was updated:
+//
+//     q.Join(child).
+//         On().
+//         Equal(&child.ParentId, &parent.Id).
+//         Greater(&child.CreatedAt, gorq.Plus(&parent.UpdatedAt, extensions.Interval("1 day")))
+func Interval(interval string) filters.SqlWrapper {
+	return intervalWrapper{interval: interval}
+}
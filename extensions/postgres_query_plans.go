@@ -67,6 +67,7 @@ type PostgresAssignQuery interface {
 	PostgresAssignJoiner
 	interfaces.AssignWherer
 	interfaces.Inserter
+	interfaces.Upserter
 	interfaces.Updater
 }
 
@@ -105,6 +106,7 @@ type PostgresAssignJoinQuery interface {
 type Postgres interface {
 	PostgresAssigner
 	PostgresJoiner
+	PostgresCopier
 	interfaces.Wherer
 	interfaces.SelectManipulator
 	interfaces.Deleter
@@ -75,6 +75,11 @@ func (filter *CombinedFilter) where(separator string, values ...string) string {
 	return s
 }
 
+// SubFilters returns the filters that this filter combines.
+func (filter *CombinedFilter) SubFilters() []Filter {
+	return filter.subFilters
+}
+
 // Add adds one or more filters to the slice of sub-filters.
 func (filter *CombinedFilter) Add(filters ...Filter) {
 	filter.subFilters = append(filter.subFilters, filters...)
@@ -217,6 +222,11 @@ func (filter *NotFilter) ActualValues() []interface{} {
 	return filter.filter.ActualValues()
 }
 
+// SubFilters returns the filter that this filter inverts.
+func (filter *NotFilter) SubFilters() []Filter {
+	return []Filter{filter.filter}
+}
+
 func (filter *NotFilter) Where(values ...string) string {
 	return "not " + filter.filter.Where(values...)
 }
@@ -0,0 +1,32 @@
+package filters
+
+// An OperatorFilter is a filter that compares two values using an
+// arbitrary operator.  Plans will refuse to execute an
+// OperatorFilter unless its operator has been allowed for the
+// database dialect in use.
+type OperatorFilter struct {
+	Left     interface{}
+	Operator string
+	Right    interface{}
+}
+
+func (filter *OperatorFilter) ActualValues() []interface{} {
+	return []interface{}{filter.Left, filter.Right}
+}
+
+func (filter *OperatorFilter) Where(values ...string) string {
+	return values[0] + " " + filter.Operator + " " + values[1]
+}
+
+// Op returns a filter for fieldPtr operator value, for operators that
+// don't have their own filter type (e.g. ~ or SIMILAR TO in
+// postgresql, or <=> in MySQL).  The operators that are allowed for
+// each dialect are listed in the plans package; any others must be
+// allowed explicitly (see plans.Options.Operators).
+func Op(fieldPtr interface{}, operator string, value interface{}) Filter {
+	return &OperatorFilter{
+		Left:     fieldPtr,
+		Operator: operator,
+		Right:    value,
+	}
+}
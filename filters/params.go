@@ -0,0 +1,19 @@
+package filters
+
+// A Param is a named placeholder for a value which will be supplied
+// when the query is executed, rather than when the filter is
+// created.  It may be used anywhere that a value is accepted, which
+// allows filter definitions to be shared between queries.  Example:
+//
+//     var recentlyPaid = filters.And(
+//         filters.True(&ref.IsPaid),
+//         filters.Greater(&ref.PaidAt, filters.Param("since")),
+//     )
+//
+//     q := dbMap.Query(ref).Where(recentlyPaid)
+//     q.Bind(map[string]interface{}{"since": yesterday})
+//     results, err := q.Select()
+//
+// Executing a query with a Param that has not been bound will return
+// an error.
+type Param string
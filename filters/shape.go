@@ -0,0 +1,63 @@
+package filters
+
+import "strconv"
+
+// A Shaper is a filter that can describe the parts of its generated
+// SQL that do not depend on the strings passed to Where, such as its
+// operator and the number of values it has.  Two filters of the same
+// type with the same shape must generate the same SQL when passed
+// the same values.  Plans use this to cache generated where clauses;
+// only the filter types in this package are trusted to implement it
+// correctly.
+type Shaper interface {
+	Shape() string
+}
+
+// Shape is empty for combined filters; their shape is the shape of
+// their sub-filters.
+func (filter *CombinedFilter) Shape() string {
+	return ""
+}
+
+func (filter *InFilter) Shape() string {
+	return strconv.Itoa(len(filter.valueList))
+}
+
+func (filter *NotInFilter) Shape() string {
+	return strconv.Itoa(len(filter.valueList))
+}
+
+func (filter *ComparisonFilter) Shape() string {
+	if filter.RightMod != nil {
+		return filter.Comparison + filter.RightMod()
+	}
+	return filter.Comparison
+}
+
+func (filter *ConversionFilter) Shape() string {
+	return filter.Comparison + "::" + filter.to
+}
+
+func (filter *SingleFilter) Shape() string {
+	return ""
+}
+
+func (filter *NotFilter) Shape() string {
+	return ""
+}
+
+func (filter *OperatorFilter) Shape() string {
+	return filter.Operator
+}
+
+func (filter *TupleInFilter) Shape() string {
+	shape := strconv.Itoa(len(filter.fields))
+	for _, t := range filter.tuples {
+		shape += "," + strconv.Itoa(len(t))
+	}
+	return shape
+}
+
+func (filter *TupleComparisonFilter) Shape() string {
+	return filter.Comparison + strconv.Itoa(len(filter.Left)) + "," + strconv.Itoa(len(filter.Right))
+}
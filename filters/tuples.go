@@ -0,0 +1,93 @@
+package filters
+
+import "strings"
+
+// tuple formats values as a row value, e.g. (a, b).
+func tuple(values []string) string {
+	return "(" + strings.Join(values, ", ") + ")"
+}
+
+// A TupleInFilter is a filter for (field1, field2, ...) IN ((value1,
+// value2, ...), ...).
+type TupleInFilter struct {
+	fields []interface{}
+	tuples [][]interface{}
+}
+
+func (filter *TupleInFilter) ActualValues() []interface{} {
+	values := make([]interface{}, 0, len(filter.fields)*(len(filter.tuples)+1))
+	values = append(values, filter.fields...)
+	for _, t := range filter.tuples {
+		values = append(values, t...)
+	}
+	return values
+}
+
+func (filter *TupleInFilter) Where(values ...string) string {
+	idx := len(filter.fields)
+	tuples := make([]string, 0, len(filter.tuples))
+	for _, t := range filter.tuples {
+		tuples = append(tuples, tuple(values[idx:idx+len(t)]))
+		idx += len(t)
+	}
+	return tuple(values[:len(filter.fields)]) + " IN (" + strings.Join(tuples, ", ") + ")"
+}
+
+// A TupleComparisonFilter is a filter that compares two row values,
+// e.g. (field1, field2) > (value1, value2).
+type TupleComparisonFilter struct {
+	Left       []interface{}
+	Comparison string
+	Right      []interface{}
+}
+
+func (filter *TupleComparisonFilter) ActualValues() []interface{} {
+	values := make([]interface{}, 0, len(filter.Left)+len(filter.Right))
+	values = append(values, filter.Left...)
+	return append(values, filter.Right...)
+}
+
+func (filter *TupleComparisonFilter) Where(values ...string) string {
+	return tuple(values[:len(filter.Left)]) + " " + filter.Comparison + " " + tuple(values[len(filter.Left):])
+}
+
+// TupleIn returns a filter for (fieldPtrs...) IN ((tuple...), ...),
+// for looking up rows by composite keys.  Each tuple must have the
+// same number of values as there are fieldPtrs.  Example:
+//
+//     filters.TupleIn([]interface{}{&ref.OrgId, &ref.Number}, [][]interface{}{
+//         {1, "INV-1"},
+//         {2, "INV-7"},
+//     })
+func TupleIn(fieldPtrs []interface{}, tuples [][]interface{}) Filter {
+	return &TupleInFilter{
+		fields: fieldPtrs,
+		tuples: tuples,
+	}
+}
+
+// TupleGreater returns a filter for (fieldPtrs...) > (values...),
+// which compares the values in order, like sorting on multiple
+// columns.  This is mostly useful for keyset pagination over
+// composite keys.
+func TupleGreater(fieldPtrs []interface{}, values ...interface{}) Filter {
+	return &TupleComparisonFilter{Left: fieldPtrs, Comparison: ">", Right: values}
+}
+
+// TupleGreaterOrEqual returns a filter for (fieldPtrs...) >=
+// (values...).  See TupleGreater.
+func TupleGreaterOrEqual(fieldPtrs []interface{}, values ...interface{}) Filter {
+	return &TupleComparisonFilter{Left: fieldPtrs, Comparison: ">=", Right: values}
+}
+
+// TupleLess returns a filter for (fieldPtrs...) < (values...).  See
+// TupleGreater.
+func TupleLess(fieldPtrs []interface{}, values ...interface{}) Filter {
+	return &TupleComparisonFilter{Left: fieldPtrs, Comparison: "<", Right: values}
+}
+
+// TupleLessOrEqual returns a filter for (fieldPtrs...) <=
+// (values...).  See TupleGreater.
+func TupleLessOrEqual(fieldPtrs []interface{}, values ...interface{}) Filter {
+	return &TupleComparisonFilter{Left: fieldPtrs, Comparison: "<=", Right: values}
+}
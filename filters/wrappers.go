@@ -23,3 +23,69 @@ type MultiSqlWrapper interface {
 	// whatever SQL this SqlWrapper needs to add to the query.
 	WrapSql(...string) string
 }
+
+// An Aggregate is a SqlWrapper or MultiSqlWrapper that wraps its
+// values in an aggregate function, like count() or sum().  Plans use
+// it to tell aggregate and non-aggregate selections apart when
+// validating grouped queries.
+type Aggregate interface {
+	Aggregate()
+}
+
+// quantifiedWrapper wraps a value in ANY(...) or ALL(...).
+type quantifiedWrapper struct {
+	actualValue interface{}
+	quantifier  string
+}
+
+func (wrapper quantifiedWrapper) ActualValue() interface{} {
+	return wrapper.actualValue
+}
+
+func (wrapper quantifiedWrapper) WrapSql(sqlValue string) string {
+	if enclosed(sqlValue) {
+		// Sub-queries are already enclosed in parentheses, and
+		// ANY((select ...)) would be treated as a single value.
+		return wrapper.quantifier + sqlValue
+	}
+	return wrapper.quantifier + "(" + sqlValue + ")"
+}
+
+// enclosed returns whether or not the entirety of sqlValue is
+// enclosed in a single pair of parentheses.
+func enclosed(sqlValue string) bool {
+	if len(sqlValue) < 2 || sqlValue[0] != '(' || sqlValue[len(sqlValue)-1] != ')' {
+		return false
+	}
+	depth := 0
+	for i, c := range sqlValue {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i != len(sqlValue)-1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// AnyOf returns a SqlWrapper for ANY(value), for use as the right hand
+// side of a comparison.  The value may be a sub-query or (in
+// postgresql) an array parameter.  Examples:
+//
+//     // "ref"."id" = ANY($1)
+//     filters.Equal(&ref.Id, filters.AnyOf(pq.Array(ids)))
+//
+//     // "ref"."total" > ANY(select ...)
+//     filters.Greater(&ref.Total, filters.AnyOf(subQuery))
+func AnyOf(value interface{}) SqlWrapper {
+	return quantifiedWrapper{actualValue: value, quantifier: "ANY"}
+}
+
+// AllOf returns a SqlWrapper for ALL(value).  See AnyOf.
+func AllOf(value interface{}) SqlWrapper {
+	return quantifiedWrapper{actualValue: value, quantifier: "ALL"}
+}
@@ -0,0 +1,305 @@
+// Package gorqtest provides tools for testing code that uses gorq
+// without a live database.
+//
+// Example:
+//
+//	dbMap := &gorq.DbMap{DbMap: gorp.DbMap{Dialect: gorp.PostgresDialect{}}}
+//	dbMap.AddTable(Model{})
+//	exec := gorqtest.NewExecutor(dbMap)
+//	exec.ReturnRows(&Model{Id: 1})
+//
+//	// codeUnderTest takes a gorq.SqlExecutor
+//	models, err := codeUnderTest(exec)
+//
+//	exec.AssertExecuted(t, `select "model"."id" as "id" from "model" where "model"."id" = $1`, 1)
+package gorqtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq"
+	"github.com/outdoorsy/gorq/interfaces"
+	"github.com/outdoorsy/gorq/plans"
+)
+
+// A Statement is a statement that was passed to an Executor.
+type Statement struct {
+	Query string
+	Args  []interface{}
+}
+
+// Result is the sql.Result returned from Executor.Exec.
+type Result struct {
+	InsertedID int64
+	Affected   int64
+}
+
+func (r Result) LastInsertId() (int64, error) {
+	return r.InsertedID, nil
+}
+
+func (r Result) RowsAffected() (int64, error) {
+	return r.Affected, nil
+}
+
+var _ gorq.SqlExecutor = (*Executor)(nil)
+
+// response is a canned response for a single statement.
+type response struct {
+	rows   []interface{}
+	value  interface{}
+	result Result
+	err    error
+}
+
+// An Executor is a gorq.SqlExecutor which records the statements
+// that it is asked to execute instead of sending them to a database.
+// Each statement consumes the next canned response (see ReturnRows,
+// ReturnValue, ReturnResult, and ReturnError); once there are no
+// responses left, statements return empty results.
+//
+// gorp's CRUD methods (Get, Insert, Update, and Delete) are not
+// supported, since they don't go through gorq.
+type Executor struct {
+	dbMap *gorq.DbMap
+
+	lock       sync.Mutex
+	statements []Statement
+	responses  []response
+}
+
+// NewExecutor returns an Executor which uses m for its table and
+// column mappings (and query options).  m does not need a database
+// connection, but its Dialect must be set.
+func NewExecutor(m *gorq.DbMap) *Executor {
+	return &Executor{dbMap: m}
+}
+
+// ReturnRows queues a response containing rows.  Each row should be
+// a pointer to the type that the statement will be selecting.
+func (e *Executor) ReturnRows(rows ...interface{}) *Executor {
+	return e.respond(response{rows: rows})
+}
+
+// ReturnValue queues a response containing a single value, for use
+// with statements that select a single value (like Count()).
+func (e *Executor) ReturnValue(value interface{}) *Executor {
+	return e.respond(response{value: value})
+}
+
+// ReturnResult queues a response for a statement that doesn't return
+// rows, like an update or delete.
+func (e *Executor) ReturnResult(lastInsertID, rowsAffected int64) *Executor {
+	return e.respond(response{result: Result{InsertedID: lastInsertID, Affected: rowsAffected}})
+}
+
+// ReturnError queues a response that fails with err.
+func (e *Executor) ReturnError(err error) *Executor {
+	return e.respond(response{err: err})
+}
+
+func (e *Executor) respond(r response) *Executor {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.responses = append(e.responses, r)
+	return e
+}
+
+// Statements returns all statements that have been executed, in
+// order.
+func (e *Executor) Statements() []Statement {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]Statement(nil), e.statements...)
+}
+
+// Reset discards all recorded statements and queued responses.
+func (e *Executor) Reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.statements = nil
+	e.responses = nil
+}
+
+// record records a statement and returns the response for it.
+func (e *Executor) record(query string, args []interface{}) response {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.statements = append(e.statements, Statement{Query: query, Args: args})
+	if len(e.responses) == 0 {
+		return response{}
+	}
+	r := e.responses[0]
+	e.responses = e.responses[1:]
+	return r
+}
+
+// Query returns a query against target which will be executed by e.
+func (e *Executor) Query(target interface{}) interfaces.Query {
+	return plans.QueryWithOptions(&e.dbMap.DbMap, e, target, e.dbMap.Options())
+}
+
+// QueryContext is Query, but passes ctx along to the query's
+// policies.
+func (e *Executor) QueryContext(ctx context.Context, target interface{}) interfaces.Query {
+	options := e.dbMap.Options()
+	options.Context = ctx
+	return plans.QueryWithOptions(&e.dbMap.DbMap, e, target, options)
+}
+
+// AttachContext returns e, since nothing is actually executed.
+func (e *Executor) AttachContext(ctx context.Context) gorq.SqlExecutor {
+	return e
+}
+
+// WithContext returns e, since nothing is actually executed.
+func (e *Executor) WithContext(ctx context.Context) gorp.SqlExecutor {
+	return e
+}
+
+func (e *Executor) Get(i interface{}, keys ...interface{}) (interface{}, error) {
+	return nil, errors.New("gorqtest: Get is not supported")
+}
+
+func (e *Executor) Insert(list ...interface{}) error {
+	return errors.New("gorqtest: Insert is not supported")
+}
+
+func (e *Executor) Update(list ...interface{}) (int64, error) {
+	return -1, errors.New("gorqtest: Update is not supported")
+}
+
+func (e *Executor) Delete(list ...interface{}) (int64, error) {
+	return -1, errors.New("gorqtest: Delete is not supported")
+}
+
+// Exec records query and returns the next canned result.
+func (e *Executor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	r := e.record(query, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.result, nil
+}
+
+// Select records query and returns the next canned rows.  Like gorp,
+// if i is a pointer to a slice, the rows will be appended to it
+// instead of returned.
+func (e *Executor) Select(i interface{}, query string, args ...interface{}) ([]interface{}, error) {
+	r := e.record(query, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	target := reflect.ValueOf(i)
+	if target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Slice {
+		return r.rows, nil
+	}
+	slice := target.Elem()
+	for _, row := range r.rows {
+		value, err := convert(reflect.ValueOf(row), slice.Type().Elem())
+		if err != nil {
+			return nil, err
+		}
+		slice.Set(reflect.Append(slice, value))
+	}
+	return nil, nil
+}
+
+// SelectOne records query and stores the first canned row (or the
+// canned value) in holder.  If there is neither, it returns
+// sql.ErrNoRows.
+func (e *Executor) SelectOne(holder interface{}, query string, args ...interface{}) error {
+	r := e.record(query, args)
+	if r.err != nil {
+		return r.err
+	}
+	var src reflect.Value
+	switch {
+	case len(r.rows) > 0:
+		src = reflect.ValueOf(r.rows[0])
+	case r.value != nil:
+		src = reflect.ValueOf(r.value)
+	default:
+		return sql.ErrNoRows
+	}
+	target := reflect.ValueOf(holder)
+	if target.Kind() != reflect.Ptr {
+		return fmt.Errorf("gorqtest: SelectOne requires a pointer, got %T", holder)
+	}
+	value, err := convert(src, target.Elem().Type())
+	if err != nil {
+		return err
+	}
+	target.Elem().Set(value)
+	return nil
+}
+
+func (e *Executor) SelectInt(query string, args ...interface{}) (int64, error) {
+	var v sql.NullInt64
+	err := e.selectValue(&v, query, args)
+	return v.Int64, err
+}
+
+func (e *Executor) SelectNullInt(query string, args ...interface{}) (sql.NullInt64, error) {
+	var v sql.NullInt64
+	err := e.selectValue(&v, query, args)
+	return v, err
+}
+
+func (e *Executor) SelectFloat(query string, args ...interface{}) (float64, error) {
+	var v sql.NullFloat64
+	err := e.selectValue(&v, query, args)
+	return v.Float64, err
+}
+
+func (e *Executor) SelectNullFloat(query string, args ...interface{}) (sql.NullFloat64, error) {
+	var v sql.NullFloat64
+	err := e.selectValue(&v, query, args)
+	return v, err
+}
+
+func (e *Executor) SelectStr(query string, args ...interface{}) (string, error) {
+	var v sql.NullString
+	err := e.selectValue(&v, query, args)
+	return v.String, err
+}
+
+func (e *Executor) SelectNullStr(query string, args ...interface{}) (sql.NullString, error) {
+	var v sql.NullString
+	err := e.selectValue(&v, query, args)
+	return v, err
+}
+
+// selectValue records query and scans the next canned value into
+// target.  A missing value is scanned as NULL.
+func (e *Executor) selectValue(target sql.Scanner, query string, args []interface{}) error {
+	r := e.record(query, args)
+	if r.err != nil {
+		return r.err
+	}
+	return target.Scan(r.value)
+}
+
+// convert converts v to typ, dereferencing or taking the address of
+// v as needed.
+func convert(v reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	switch {
+	case v.Type().AssignableTo(typ):
+		return v, nil
+	case v.Kind() == reflect.Ptr && v.Type().Elem().AssignableTo(typ):
+		return v.Elem(), nil
+	case typ.Kind() == reflect.Ptr && v.Type().AssignableTo(typ.Elem()):
+		ptr := reflect.New(typ.Elem())
+		ptr.Elem().Set(v)
+		return ptr, nil
+	case v.Type().ConvertibleTo(typ):
+		return v.Convert(typ), nil
+	}
+	return reflect.Value{}, fmt.Errorf("gorqtest: Cannot use canned value of type %s as %s", v.Type(), typ)
+}
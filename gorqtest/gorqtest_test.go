@@ -0,0 +1,79 @@
+package gorqtest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq"
+	"github.com/stretchr/testify/suite"
+)
+
+type Model struct {
+	Id   int64
+	Name string
+}
+
+type GorqTestSuite struct {
+	suite.Suite
+	Exec *Executor
+}
+
+func (suite *GorqTestSuite) SetupTest() {
+	dbMap := new(gorq.DbMap)
+	dbMap.Dialect = gorp.PostgresDialect{}
+	dbMap.AddTable(Model{}).SetKeys(false, "Id")
+	suite.Exec = NewExecutor(dbMap)
+}
+
+func (suite *GorqTestSuite) TestNormalize() {
+	suite.Equal(`select "t"."name", ? from "t" where "t"."id" in (?, ?) and "t"."name" <> ?`,
+		Normalize(" SELECT  \"t\".\"Name\" ,$1\n\tFROM \"t\" WHERE \"t\".\"Id\" IN ( ? , :3 ) and \"t\".\"Name\"<>$4; "))
+	suite.Equal("select 'Mixed Case  $1'", Normalize("select 'Mixed Case  $1'"))
+}
+
+func (suite *GorqTestSuite) TestSelect() {
+	suite.Exec.ReturnRows(&Model{Id: 1, Name: "first"}, &Model{Id: 2, Name: "second"})
+	ref := new(Model)
+	results, err := suite.Exec.Query(ref).
+		Where().
+		Equal(&ref.Name, "first").
+		Select()
+	suite.Require().NoError(err)
+	suite.Equal(2, len(results))
+	suite.Exec.AssertLast(suite.T(),
+		`select "Model"."Id" as "Id", "Model"."Name" as "Name" from "Model" where "Model"."Name" = $1`,
+		"first")
+}
+
+func (suite *GorqTestSuite) TestSelectToTarget() {
+	suite.Exec.ReturnRows(Model{Id: 1})
+	ref := new(Model)
+	var models []*Model
+	err := suite.Exec.Query(ref).SelectToTarget(&models)
+	suite.Require().NoError(err)
+	if suite.Equal(1, len(models)) {
+		suite.Equal(int64(1), models[0].Id)
+	}
+}
+
+func (suite *GorqTestSuite) TestCannedValuesAndErrors() {
+	errCanned := errors.New("canned")
+	suite.Exec.ReturnValue(5).ReturnError(errCanned)
+	ref := new(Model)
+
+	count, err := suite.Exec.Query(ref).Count()
+	suite.NoError(err)
+	suite.Equal(int64(5), count)
+
+	_, err = suite.Exec.Query(ref).Where().Equal(&ref.Id, 1).Delete()
+	suite.Equal(errCanned, err)
+
+	suite.Equal(2, len(suite.Exec.Statements()))
+	suite.Exec.Reset()
+	suite.Equal(0, len(suite.Exec.Statements()))
+}
+
+func TestGorqTestSuite(t *testing.T) {
+	suite.Run(t, new(GorqTestSuite))
+}
@@ -0,0 +1,146 @@
+package gorqtest
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// operators are the characters that make up comparison operators,
+// which Normalize surrounds with spaces.
+const operators = "=<>!"
+
+// TestingT is the subset of *testing.T used by the assertion helpers.
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Normalize returns a normalized version of query, so that generated
+// SQL can be compared without depending on formatting details.
+// Specifically, it:
+//
+//   - Collapses all whitespace to single spaces, and removes it from
+//     the start and end of the query, after opening parentheses, and
+//     before closing parentheses and commas.  Commas are always
+//     followed by a single space, and comparison operators are always
+//     surrounded by single spaces.
+//   - Converts everything except string literals to lower case,
+//     including quoted identifiers.
+//   - Replaces bind variables ($1, ?, :1, etc) with ?.
+//   - Removes any trailing semicolon.
+func Normalize(query string) string {
+	buf := &bytes.Buffer{}
+	var quote rune
+	space := false
+	runes := []rune(strings.TrimSpace(query))
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if quote != 0 {
+			if quote != '\'' {
+				r = unicode.ToLower(r)
+			}
+			buf.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if space {
+			if !strings.ContainsRune(",)", r) && !bytes.HasSuffix(buf.Bytes(), []byte("(")) {
+				buf.WriteRune(' ')
+			}
+			space = false
+		}
+		switch {
+		case r == ',':
+			buf.WriteRune(r)
+			space = true
+		case strings.ContainsRune(operators, r):
+			if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte(" ")) {
+				buf.WriteRune(' ')
+			}
+			for ; i+1 < len(runes) && strings.ContainsRune(operators, runes[i+1]); i++ {
+				buf.WriteRune(r)
+				r = runes[i+1]
+			}
+			buf.WriteRune(r)
+			space = true
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+			buf.WriteRune(r)
+		case (r == '$' || r == ':') && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			for i+1 < len(runes) && unicode.IsDigit(runes[i+1]) {
+				i++
+			}
+			buf.WriteRune('?')
+		default:
+			buf.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return strings.TrimSuffix(buf.String(), ";")
+}
+
+// SQLEqual returns whether or not expected and actual are the same
+// after being normalized.
+func SQLEqual(expected, actual string) bool {
+	return Normalize(expected) == Normalize(actual)
+}
+
+// AssertSQL reports an error on t if expected and actual are not the
+// same after being normalized.
+func AssertSQL(t TestingT, expected, actual string) bool {
+	if SQLEqual(expected, actual) {
+		return true
+	}
+	t.Errorf("Unexpected SQL:\n\texpected: %s\n\tactual:   %s", Normalize(expected), Normalize(actual))
+	return false
+}
+
+// AssertExecuted reports an error on t if e has not executed a
+// statement matching query (after normalization) with exactly args.
+func (e *Executor) AssertExecuted(t TestingT, query string, args ...interface{}) bool {
+	statements := e.Statements()
+	for _, statement := range statements {
+		if SQLEqual(query, statement.Query) && argsEqual(args, statement.Args) {
+			return true
+		}
+	}
+	executed := make([]string, 0, len(statements))
+	for _, statement := range statements {
+		executed = append(executed, Normalize(statement.Query))
+	}
+	t.Errorf("Expected statement was not executed:\n\texpected: %s %v\n\texecuted:\n\t\t%s",
+		Normalize(query), args, strings.Join(executed, "\n\t\t"))
+	return false
+}
+
+// AssertLast reports an error on t if the last statement executed by
+// e does not match query (after normalization) and args.
+func (e *Executor) AssertLast(t TestingT, query string, args ...interface{}) bool {
+	statements := e.Statements()
+	if len(statements) == 0 {
+		t.Errorf("Expected statement was not executed: no statements have been executed")
+		return false
+	}
+	last := statements[len(statements)-1]
+	if !AssertSQL(t, query, last.Query) {
+		return false
+	}
+	if !argsEqual(args, last.Args) {
+		t.Errorf("Unexpected arguments:\n\texpected: %v\n\tactual:   %v", args, last.Args)
+		return false
+	}
+	return true
+}
+
+func argsEqual(expected, actual []interface{}) bool {
+	if len(expected) == 0 && len(actual) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(expected, actual)
+}
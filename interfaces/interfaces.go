@@ -1,6 +1,10 @@
 package interfaces
 
 import (
+	"context"
+	"io"
+	"time"
+
 	"github.com/outdoorsy/gorq/filters"
 )
 
@@ -11,6 +15,21 @@ type NonstandardLimiter interface {
 	Limit(interface{}) string
 }
 
+// A NonstandardDefaultValuer is a type of query dialect that doesn't
+// support the SQL standard method of inserting a row of default
+// values (i.e. DEFAULT VALUES).  It instead returns its own clause.
+type NonstandardDefaultValuer interface {
+	DefaultValues() string
+}
+
+// A Binder is a query that can have values bound to the
+// filters.Param values in its filters.
+type Binder interface {
+	// Bind sets the values of parameters by name.  Values must be
+	// bound before the query is executed.
+	Bind(params map[string]interface{})
+}
+
 // A Truncater is a query that can execute TRUNCATE TABLE statements.
 type Truncater interface {
 	// Truncate will wipe all data within the requested table.
@@ -22,6 +41,28 @@ type Updater interface {
 	// Update executes an update statement and returns the updated row
 	// count and any errors encountered.
 	Update() (rowsUpdated int64, err error)
+
+	// UpdateContext is Update, executed with ctx.
+	UpdateContext(ctx context.Context) (rowsUpdated int64, err error)
+}
+
+// A BulkUpdater is a query that can update many rows with different
+// values in a single UPDATE statement.
+type BulkUpdater interface {
+	// BulkUpdate sets the columns for updateFieldPtrs to the values
+	// in each element of rows, for the table rows that match it on
+	// the columns for keyFieldPtrs.  It returns the updated row count
+	// and any errors encountered.
+	BulkUpdate(rows interface{}, keyFieldPtrs, updateFieldPtrs []interface{}) (rowsUpdated int64, err error)
+}
+
+// A CompareAndSwapper is a query that can update a column only if it
+// still holds an expected value.
+type CompareAndSwapper interface {
+	// UpdateWhereCurrent sets the column for fieldPtr to newValue in
+	// the rows where it is expectedValue, and returns whether or not
+	// any rows were updated.
+	UpdateWhereCurrent(fieldPtr, expectedValue, newValue interface{}) (swapped bool, err error)
 }
 
 // A Deleter is a query that can execute DELETE statements.
@@ -29,13 +70,75 @@ type Deleter interface {
 	// Delete executes a delete statement and returns the deleted row
 	// count and any errors encountered.
 	Delete() (rowsDeleted int64, err error)
+
+	// DeleteContext is Delete, executed with ctx.
+	DeleteContext(ctx context.Context) (rowsDeleted int64, err error)
+
+	// DeleteInBatches executes delete statements that each delete up
+	// to batchSize rows, pausing between them, until no matching rows
+	// remain.  It returns the total deleted row count and any errors
+	// encountered.
+	DeleteInBatches(batchSize int64, pause time.Duration) (rowsDeleted int64, err error)
 }
 
 // An Inserter is a query that can execute INSERT statements.
 type Inserter interface {
 	// Insert executes an insert statement and returns any errors
-	// encountered.
+	// encountered.  If the reference struct's table has an
+	// auto-increment key which was not assigned a value, the
+	// generated key will be stored in the reference struct.
 	Insert() error
+
+	// InsertContext is Insert, executed with ctx.
+	InsertContext(ctx context.Context) error
+}
+
+// A BulkInserter is a query that can insert many rows using
+// multi-row INSERT statements.
+type BulkInserter interface {
+	// InsertAll inserts every element of rows, as few statements as
+	// possible, and returns the inserted row count and any errors
+	// encountered.
+	InsertAll(rows interface{}) (rowsInserted int64, err error)
+}
+
+// An Upserter is a query that can execute INSERT statements which
+// update the conflicting row instead of failing on a conflict.
+type Upserter interface {
+	// Upsert executes an insert statement which, if the row conflicts
+	// with an existing row on the columns for conflictFieldPtrs,
+	// updates that row's columns for updateFieldPtrs (or every
+	// assigned column, if none are passed) instead.  It returns the
+	// number of rows affected.
+	Upsert(conflictFieldPtrs []interface{}, updateFieldPtrs ...interface{}) (int64, error)
+}
+
+// A DefaultInserter is a query that can execute INSERT statements
+// without assigning any values.
+type DefaultInserter interface {
+	// InsertDefaults executes an insert statement that leaves every
+	// column at its default value and returns any errors
+	// encountered.  As with Insert, a generated auto-increment key
+	// will be stored in the reference struct.
+	InsertDefaults() error
+}
+
+// Rows is a cursor over the rows returned by a select statement.  It
+// works like sql.Rows, but Result returns a value of the query's
+// reference struct type instead of scanning into variables.
+type Rows interface {
+	// Next advances the cursor to the next row, returning false when
+	// there are no more rows or an error occurred.
+	Next() bool
+
+	// Result returns the row that the cursor is on.
+	Result() interface{}
+
+	// Err returns the error, if any, that ended the iteration.
+	Err() error
+
+	// Close closes the cursor.
+	Close() error
 }
 
 // A Selector is a query that can execute SELECT statements.
@@ -46,17 +149,91 @@ type Selector interface {
 	// the query.
 	Select() (results []interface{}, err error)
 
+	// SelectContext is Select, executed with ctx.  Canceling ctx
+	// aborts the statement.
+	SelectContext(ctx context.Context) (results []interface{}, err error)
+
+	// SelectOne executes the select statement, limited to one row,
+	// and scans the row into the reference struct.  If no rows match,
+	// it returns gorq.ErrNotFound.
+	SelectOne() error
+
 	// SelectToTarget executes the select statement and returns any
 	// errors encountered.  The resulting rows will be appended to the
 	// passed in target, which must be a pointer to a slice.
 	SelectToTarget(target interface{}) error
 
+	// Iterate executes the select statement and calls fn with each
+	// resulting row as it is read, stopping at the first error.
+	Iterate(fn func(result interface{}) error) error
+
+	// Rows executes the select statement and returns a cursor over the
+	// resulting rows, which are read as the cursor is advanced.
+	Rows() (Rows, error)
+
+	// SelectToChannel executes the select statement and sends each
+	// resulting row on the passed in channel as it is read, closing
+	// the channel when it is done.
+	SelectToChannel(ch interface{}) error
+
+	// SelectPartitioned executes the select statement as n concurrent
+	// statements, each selecting one range of the key column that
+	// keyFieldPtr points to, and returns the combined results.
+	SelectPartitioned(keyFieldPtr interface{}, n int) (results []interface{}, err error)
+
+	// EachPartitioned is like SelectPartitioned, but passes each
+	// resulting row to fn as it is read.  fn is called concurrently,
+	// so it must be safe for concurrent use.
+	EachPartitioned(keyFieldPtr interface{}, n int, fn func(result interface{}) error) error
+
 	// Count executes a select statement that just returns a count of
 	// the number of rows that would be returned.
 	Count() (int64, error)
 
+	// CountContext is Count, executed with ctx.
+	CountContext(ctx context.Context) (int64, error)
+
+	// Truncated returns whether or not the results of the last select
+	// statement were truncated at the query's maximum number of rows.
+	Truncated() bool
+
+	// Bucketize executes a select statement that counts the rows in
+	// each bucket of the values of a column, appending the counts to
+	// the slice that target points to.  See plans.QueryPlan.Bucketize.
+	Bucketize(fieldPtr interface{}, widthOrEdges interface{}, target interface{}) error
+
+	// Sum, SumInt, Avg, and CountDistinct execute select statements
+	// that aggregate the values of the column that fieldPtr points to
+	// over the rows that match the query.  See plans.QueryPlan.Sum,
+	// and plans.Min and plans.Max for the smallest and largest values.
+	Sum(fieldPtr interface{}) (float64, error)
+	SumInt(fieldPtr interface{}) (int64, error)
+	Avg(fieldPtr interface{}) (float64, error)
+	CountDistinct(fieldPtr interface{}) (int64, error)
+
 	// Distinct adds the DISTINCT keyword to the resulting SELECT statement
 	Distinct(...interface{})
+
+	Binder
+
+	// Validate checks the select statement for common mistakes (for
+	// example, selecting columns that are not grouped in a grouped
+	// query) and returns a description of each one found, without
+	// executing anything.
+	Validate() []string
+
+	// Warnings checks the query for issues that are likely to make
+	// it slow (for example, a LIKE pattern with a leading wildcard)
+	// and returns a description of each one found, without
+	// executing anything.
+	Warnings() []string
+
+	// ExportCSV and ExportNDJSON execute the select statement and
+	// stream the resulting rows to the passed in writer, without
+	// scanning them into structs.  Selected column aliases are used
+	// as the headers (or keys) of the exported data.
+	ExportCSV(io.Writer) error
+	ExportNDJSON(io.Writer) error
 }
 
 // A SelectManipulator is a query that will return a list of results
@@ -77,6 +254,10 @@ type SelectManipulator interface {
 	// struct.
 	GroupBy(fieldPtr interface{}) SelectQuery
 
+	// Having adds filters to the having clause of a grouped query,
+	// which are combined in an AndFilter.
+	Having(...filters.Filter) SelectQuery
+
 	// Limit limits the result list to a maximum length.
 	Limit(int64) SelectQuery
 
@@ -86,6 +267,10 @@ type SelectManipulator interface {
 	// of matching results.
 	DiscardLimit() SelectQuery
 
+	// MaxRows sets the maximum number of rows that the query may
+	// return, overriding the default.  See plans.Limits.MaxRows.
+	MaxRows(int) SelectQuery
+
 	// Offset sets the starting point of the result list.
 	Offset(int64) SelectQuery
 
@@ -103,6 +288,14 @@ type Assigner interface {
 	// second argument is always the value that is going to be
 	// assigned.
 	Assign(fieldPtr interface{}, value interface{}) AssignQuery
+
+	// AssignJSONPath assigns a value to a path within a JSON column,
+	// and AssignArrayAppend appends a value to an array column,
+	// without rewriting the rest of the column's value.  They are
+	// only supported by update statements.  See
+	// plans.QueryPlan.AssignJSONPath.
+	AssignJSONPath(fieldPtr interface{}, path string, value interface{}) AssignQuery
+	AssignArrayAppend(fieldPtr interface{}, value interface{}) AssignQuery
 }
 
 // FieldLimiter can limit the number of fields included in a select
@@ -114,6 +307,10 @@ type FieldLimiter interface {
 // FieldAdder can add more fields to the selection statement.
 type FieldAdder interface {
 	AddField(field interface{}) SelectionQuery
+
+	// SelectAs selects value (usually a wrapper, like an aggregate)
+	// into the passed in field of the reference struct.
+	SelectAs(field interface{}, value interface{}) SelectionQuery
 }
 
 // A Joiner is a query that can add tables as join clauses.
@@ -188,9 +385,14 @@ type UpdateQuery interface {
 	True(fieldPtr interface{}) UpdateQuery
 	False(fieldPtr interface{}) UpdateQuery
 
+	// OrWhere starts a new branch of the where clause, which will be
+	// combined with the previous branches using OR.
+	OrWhere(...filters.Filter) UpdateQuery
+
 	// An UpdateQuery has both assignments and a where clause, which
 	// means that it must be an update statement.
 	Updater
+	Binder
 }
 
 // An AssignQuery is a query that has assigned values.  It must be an
@@ -199,6 +401,7 @@ type AssignQuery interface {
 	Assigner
 	AssignWherer
 	Inserter
+	Upserter
 	Updater
 }
 
@@ -273,9 +476,19 @@ type WhereQuery interface {
 	False(fieldPtr interface{}) WhereQuery
 	ConvertTo(filter filters.Filter, to string) WhereQuery
 
+	// OrWhere starts a new branch of the where clause.  Filters
+	// within each branch are combined using AND, and the branches are
+	// combined using OR, so that (A AND B) OR (C AND D) can be built
+	// incrementally.
+	OrWhere(...filters.Filter) WhereQuery
+
 	// A WhereQuery is returned when Where() has been called before
-	// Assign(), which means it must be a select or delete statement.
+	// Assign(), which means it must be a select or delete statement
+	// (or a bulk update, which takes its values from rows rather than
+	// assignments).
 	SelectManipulator
+	BulkUpdater
+	CompareAndSwapper
 	Deleter
 	Selector
 }
@@ -379,6 +592,8 @@ type Query interface {
 	// On the other hand, they should be checking the count they get
 	// back to ensure they deleted exactly what they wanted to delete.
 	SelectManipulator
+	BulkUpdater
+	CompareAndSwapper
 	Deleter
 	Selector
 
@@ -386,4 +601,12 @@ type Query interface {
 	// query plan.  If anything has been assigned or added to a where
 	// clause or join statement, it is no longer available.
 	Truncater
+
+	// InsertDefaults is only available before anything has been
+	// assigned, for the same reasons as Truncate.
+	DefaultInserter
+
+	// InsertAll takes its values from rows, so it is only available
+	// before anything has been assigned.
+	BulkInserter
 }
@@ -0,0 +1,314 @@
+package plans
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// An IndexAdvisor explains the statements that plans execute, looking
+// for sequential scans of large tables, and reports each one along
+// with an index that would avoid it.  It runs an extra EXPLAIN (and
+// possibly a count of the scanned table) the first time that it sees
+// each statement, so it is meant for development and test
+// environments rather than production.  Statements which can't be
+// explained are skipped.  See Options.IndexAdvisor.
+type IndexAdvisor struct {
+	// MinRows is the number of rows that a table must have (or be
+	// estimated to have) before scans of it are reported.
+	MinRows int64
+
+	// Report is called for each scan that is found.
+	Report func(IndexAdvice)
+
+	lock sync.Mutex
+	seen map[string]bool
+}
+
+// An IndexAdvice describes a sequential scan of a table found by an
+// IndexAdvisor.
+type IndexAdvice struct {
+	// Query is the statement that scans the table.
+	Query string
+
+	// Table is the name of the scanned table, and Rows is the number
+	// of rows that it has (or is estimated to have).
+	Table string
+	Rows  int64
+
+	// Index is a CREATE INDEX statement for the columns of Table
+	// that Query filters or joins on.  It is empty if Query doesn't
+	// filter the table at all, in which case no index would help.
+	Index string
+}
+
+// tableScan is a sequential scan of a table found in the output of
+// EXPLAIN.  rows is -1 if the dialect doesn't estimate it.
+type tableScan struct {
+	table string
+	alias string
+	rows  int64
+}
+
+// adviseIndexes explains query (statement, as rewritten by the plan's
+// rewriters), reporting any sequential scans of large tables to the
+// plan's index advisor.  Each statement is only explained the first
+// time it is seen, regardless of its comments.  Only select, insert,
+// update, and delete statements are explained, since EXPLAIN rejects
+// anything else (e.g. COPY), and a failed statement aborts the rest of
+// a postgresql transaction.
+func (plan *QueryPlan) adviseIndexes(statement, query string, args []interface{}) {
+	advisor := plan.indexAdvisor
+	if advisor == nil || advisor.Report == nil || !explainable(query) || !advisor.firstSight(statement) {
+		return
+	}
+	scans, err := plan.explainScans(query, args)
+	if err != nil {
+		return
+	}
+	for _, scan := range scans {
+		if scan.rows < 0 {
+			if scan.rows, err = plan.tableRows(scan.table); err != nil {
+				continue
+			}
+		}
+		if scan.rows < advisor.MinRows {
+			continue
+		}
+		advisor.Report(IndexAdvice{
+			Query: query,
+			Table: scan.table,
+			Rows:  scan.rows,
+			Index: plan.suggestIndex(scan),
+		})
+	}
+}
+
+// explainable returns whether or not query is a statement that
+// EXPLAIN accepts.
+func explainable(query string) bool {
+	query = strings.TrimLeft(query, " \t\r\n(")
+	for strings.HasPrefix(query, "/*") {
+		end := strings.Index(query, "*/")
+		if end < 0 {
+			return false
+		}
+		query = strings.TrimLeft(query[end+2:], " \t\r\n(")
+	}
+	end := strings.IndexAny(query, " \t\r\n(")
+	if end < 0 {
+		end = len(query)
+	}
+	switch strings.ToLower(query[:end]) {
+	case "select", "with", "insert", "update", "delete":
+		return true
+	}
+	return false
+}
+
+// firstSight returns whether or not query has not been seen by the
+// advisor before, marking it as seen.
+func (advisor *IndexAdvisor) firstSight(query string) bool {
+	advisor.lock.Lock()
+	defer advisor.lock.Unlock()
+	if advisor.seen[query] {
+		return false
+	}
+	if advisor.seen == nil {
+		advisor.seen = make(map[string]bool)
+	}
+	advisor.seen[query] = true
+	return true
+}
+
+// explainScans runs EXPLAIN for query and returns the sequential scans
+// in its output.
+func (plan *QueryPlan) explainScans(query string, args []interface{}) ([]tableScan, error) {
+	switch plan.dialect.(type) {
+	case gorp.PostgresDialect:
+		explained, err := plan.explain("EXPLAIN (FORMAT JSON) "+query, args)
+		if err != nil || len(explained) == 0 {
+			return nil, err
+		}
+		var nodes []struct{ Plan explainNode }
+		for _, value := range explained[0] {
+			if err := json.Unmarshal([]byte(value), &nodes); err != nil {
+				return nil, err
+			}
+		}
+		var scans []tableScan
+		for _, node := range nodes {
+			scans = node.Plan.seqScans(scans)
+		}
+		return scans, nil
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		explained, err := plan.explain("EXPLAIN "+query, args)
+		if err != nil {
+			return nil, err
+		}
+		var scans []tableScan
+		for _, row := range explained {
+			if row["type"] != "ALL" {
+				continue
+			}
+			rows, err := strconv.ParseInt(row["rows"], 10, 64)
+			if err != nil {
+				rows = -1
+			}
+			scans = append(scans, tableScan{table: row["table"], alias: row["table"], rows: rows})
+		}
+		return scans, nil
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		explained, err := plan.explain("EXPLAIN QUERY PLAN "+query, args)
+		if err != nil {
+			return nil, err
+		}
+		var scans []tableScan
+		for _, row := range explained {
+			// e.g. "SCAN invoices", "SCAN TABLE invoices AS i", or
+			// "SCAN i USING INDEX ..." (which isn't a table scan).
+			words := strings.Fields(row["detail"])
+			if len(words) < 2 || words[0] != "SCAN" || strings.Contains(row["detail"], " USING ") {
+				continue
+			}
+			if words[1] == "TABLE" {
+				words = words[1:]
+			}
+			scan := tableScan{table: words[1], alias: words[1], rows: -1}
+			if len(words) >= 4 && words[2] == "AS" {
+				scan.alias = words[3]
+			}
+			scans = append(scans, scan)
+		}
+		return scans, nil
+	}
+	return nil, nil
+}
+
+// explainNode is a node in postgresql's JSON EXPLAIN output.
+type explainNode struct {
+	NodeType string        `json:"Node Type"`
+	Relation string        `json:"Relation Name"`
+	Alias    string        `json:"Alias"`
+	Plans    []explainNode `json:"Plans"`
+}
+
+// seqScans appends the sequential scans in node and its children to
+// scans.
+func (node explainNode) seqScans(scans []tableScan) []tableScan {
+	if node.NodeType == "Seq Scan" {
+		scans = append(scans, tableScan{table: node.Relation, alias: node.Alias, rows: -1})
+	}
+	for _, child := range node.Plans {
+		scans = child.seqScans(scans)
+	}
+	return scans
+}
+
+// explain runs an EXPLAIN statement, returning each row of its output
+// as a map of column names to values.
+func (plan *QueryPlan) explain(query string, args []interface{}) ([]map[string]string, error) {
+	querier, ok := plan.executor.(rowQuerier)
+	if !ok {
+		return nil, nil
+	}
+	rows, err := querier.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var explained []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		holders := make([]interface{}, len(columns))
+		for i := range values {
+			holders[i] = &values[i]
+		}
+		if err := rows.Scan(holders...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(columns))
+		for i, column := range columns {
+			row[strings.ToLower(column)] = values[i].String
+		}
+		explained = append(explained, row)
+	}
+	return explained, rows.Err()
+}
+
+// tableRows returns the number of rows in table: postgresql's
+// estimate, if the table has been analyzed, or an exact count.
+func (plan *QueryPlan) tableRows(table string) (int64, error) {
+	if _, ok := plan.dialect.(gorp.PostgresDialect); ok {
+		estimate, err := plan.executor.SelectInt("select reltuples::bigint from pg_class where oid = to_regclass($1)", plan.quoteField(table))
+		if err == nil && estimate >= 0 {
+			return estimate, nil
+		}
+	}
+	return plan.executor.SelectInt("select count(*) from " + plan.quoteField(table))
+}
+
+// suggestIndex returns a CREATE INDEX statement for the columns of the
+// scanned table that the plan filters or joins on, or an empty string
+// if it doesn't use any.
+func (plan *QueryPlan) suggestIndex(scan tableScan) string {
+	var values []interface{}
+	if where := plan.whereFilter(); where != nil {
+		values = append(values, where.ActualValues()...)
+	}
+	for _, join := range plan.joins {
+		values = append(values, join.ActualValues()...)
+	}
+	var columns []string
+	used := make(map[string]bool)
+	for _, m := range plan.filteredColumns(values) {
+		if m.tableName != scan.alias || m.column.Transient || used[m.column.ColumnName] {
+			continue
+		}
+		used[m.column.ColumnName] = true
+		columns = append(columns, m.column.ColumnName)
+	}
+	if len(columns) == 0 {
+		return ""
+	}
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, plan.quoteField(column))
+	}
+	name := "idx_" + scan.table + "_" + strings.Join(columns, "_")
+	return "create index " + plan.quoteField(name) + " on " + plan.quoteField(scan.table) + " (" + strings.Join(quoted, ", ") + ")"
+}
+
+// filteredColumns returns the column mappings of any field pointers in
+// values, including those wrapped by filters.SqlWrapper and
+// filters.MultiSqlWrapper values.
+func (plan *QueryPlan) filteredColumns(values []interface{}) []*fieldColumnMap {
+	var columns []*fieldColumnMap
+	for _, value := range values {
+		switch src := value.(type) {
+		case filters.SqlWrapper:
+			columns = append(columns, plan.filteredColumns([]interface{}{src.ActualValue()})...)
+		case filters.MultiSqlWrapper:
+			columns = append(columns, plan.filteredColumns(src.ActualValues())...)
+		default:
+			if value == nil || reflect.TypeOf(value).Kind() != reflect.Ptr {
+				continue
+			}
+			if m, err := plan.colMap.fieldMapForPointer(value); err == nil {
+				columns = append(columns, m)
+			}
+		}
+	}
+	return columns
+}
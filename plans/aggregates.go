@@ -0,0 +1,223 @@
+package plans
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// aggregateQuery returns a select statement for function applied to
+// the column that fieldPtr points to, over the rows that match the
+// plan's joins and where clause (its order, limit, and offset are
+// ignored).  If distinct is true, only distinct values are
+// aggregated.
+func (plan *QueryPlan) aggregateQuery(function string, distinct bool, fieldPtr interface{}) (string, error) {
+	plan.resetArgs()
+	if len(plan.Errors) > 0 {
+		return "", plan.Errors[0]
+	}
+	if len(plan.compounds) > 0 {
+		return "", errors.New("gorq: Aggregates cannot be computed over compound queries")
+	}
+	if len(plan.groupBy) > 0 {
+		return "", errors.New("gorq: Aggregates cannot be computed over grouped queries")
+	}
+	if err := plan.checkPolicies(SelectOperation); err != nil {
+		return "", err
+	}
+	buffer := plan.getBuffer()
+	if err := plan.writeWith(buffer); err != nil {
+		bufPool.Put(buffer)
+		return "", err
+	}
+	column, err := plan.argOrColumn(fieldPtr)
+	if err != nil {
+		bufPool.Put(buffer)
+		return "", err
+	}
+	buffer.WriteString("select ")
+	buffer.WriteString(function)
+	buffer.WriteString("(")
+	if distinct {
+		buffer.WriteString("distinct ")
+	}
+	buffer.WriteString(column)
+	buffer.WriteString(")")
+	if err := plan.writeFromWhere(buffer); err != nil {
+		bufPool.Put(buffer)
+		return "", err
+	}
+	query := buffer.String()
+	plan.putBuffer(buffer)
+	return query, nil
+}
+
+// aggregateFloat executes function over the column that fieldPtr
+// points to, returning zero if the result is null (i.e. there were
+// no non-null values).
+func (plan *QueryPlan) aggregateFloat(function string, fieldPtr interface{}) (float64, error) {
+	var result sql.NullFloat64
+	if err := plan.aggregateInto(&result, function, fieldPtr); err != nil {
+		return 0, err
+	}
+	return result.Float64, nil
+}
+
+// aggregator is implemented by *QueryPlan and any types that embed
+// it.
+type aggregator interface {
+	interfaces.Selector
+	aggregateInto(dest interface{}, function string, fieldPtr interface{}) error
+}
+
+// aggregateInto executes function over the column that fieldPtr
+// points to, scanning the result into dest.
+func (plan *QueryPlan) aggregateInto(dest interface{}, function string, fieldPtr interface{}) error {
+	query, err := plan.aggregateQuery(function, false, fieldPtr)
+	if err != nil {
+		return err
+	}
+	return plan.selectScalar(dest, query, plan.getArgs()...)
+}
+
+// aggregateValue executes function over the column that fieldPtr
+// points to, returning the result as a value of the field's type, or
+// nil if the result is null.
+func aggregateValue[T any](q interfaces.Selector, function string, fieldPtr *T) (*T, error) {
+	plan, ok := q.(aggregator)
+	if !ok {
+		return nil, fmt.Errorf("gorq: Cannot compute the %s of %T", function, q)
+	}
+	if t, isTime := interface{}(fieldPtr).(*time.Time); isTime {
+		var result nullTime
+		if err := plan.aggregateInto(&result, function, t); err != nil {
+			return nil, err
+		}
+		if !result.Valid {
+			return nil, nil
+		}
+		return interface{}(&result.Time).(*T), nil
+	}
+	// Scanning into a pointer to the field's type leaves it nil for
+	// null results.
+	var result *T
+	if err := plan.aggregateInto(&result, function, fieldPtr); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// timestampFormats are the formats that nullTime parses timestamps
+// in, which are the formats that sqlite stores them in.
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// nullTime scans nullable timestamps, including those that drivers
+// return as text (e.g. sqlite's results for aggregates, which have no
+// declared column type).
+type nullTime struct {
+	time.Time
+	Valid bool
+}
+
+func (t *nullTime) Scan(value interface{}) error {
+	switch src := value.(type) {
+	case nil:
+		t.Time, t.Valid = time.Time{}, false
+		return nil
+	case time.Time:
+		t.Time, t.Valid = src, true
+		return nil
+	case []byte:
+		value = string(src)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("gorq: Cannot scan %T as a time.Time", value)
+	}
+	s = strings.TrimSuffix(s, "Z")
+	for _, format := range timestampFormats {
+		if parsed, err := time.ParseInLocation(format, s, time.UTC); err == nil {
+			t.Time, t.Valid = parsed, true
+			return nil
+		}
+	}
+	return fmt.Errorf("gorq: Cannot parse %q as a time.Time", s)
+}
+
+// Sum executes a select statement that returns the sum of the values
+// of the column that fieldPtr points to, over the rows that the plan
+// would select.  If there are no non-null values, Sum returns zero.
+// Sums of integer columns should use SumInt, since a float64 can't
+// represent every int64.
+func (plan *QueryPlan) Sum(fieldPtr interface{}) (float64, error) {
+	return plan.aggregateFloat("sum", fieldPtr)
+}
+
+// SumInt is Sum for columns with an integer type, returning the sum
+// as an int64.
+func (plan *QueryPlan) SumInt(fieldPtr interface{}) (int64, error) {
+	switch reflect.TypeOf(fieldPtr).Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return 0, fmt.Errorf("gorq: SumInt requires a pointer to an integer field, not %T", fieldPtr)
+	}
+	var result sql.NullInt64
+	if err := plan.aggregateInto(&result, "sum", fieldPtr); err != nil {
+		return 0, err
+	}
+	return result.Int64, nil
+}
+
+// Avg executes a select statement that returns the average of the
+// values of the column that fieldPtr points to, over the rows that
+// the plan would select.  If there are no non-null values, Avg returns
+// zero.
+func (plan *QueryPlan) Avg(fieldPtr interface{}) (float64, error) {
+	return plan.aggregateFloat("avg", fieldPtr)
+}
+
+// Min executes q's select statement, returning the smallest value of
+// the column that fieldPtr points to over the rows that q would
+// select, or nil if there are no non-null values.  Example:
+//
+//     ref := new(Invoice)
+//     q := dbMap.Query(ref).Where().Equal(&ref.PersonId, personId)
+//     first, err := plans.Min(q, &ref.Created)
+//     // first is a *time.Time
+//
+// The DbMap's TypeConverter is not used to scan the result.
+func Min[T any](q interfaces.Selector, fieldPtr *T) (*T, error) {
+	return aggregateValue(q, "min", fieldPtr)
+}
+
+// Max is Min, but returns the largest value of the column.
+func Max[T any](q interfaces.Selector, fieldPtr *T) (*T, error) {
+	return aggregateValue(q, "max", fieldPtr)
+}
+
+// CountDistinct executes a select statement that returns the number
+// of distinct non-null values of the column that fieldPtr points to,
+// over the rows that the plan would select.
+func (plan *QueryPlan) CountDistinct(fieldPtr interface{}) (int64, error) {
+	query, err := plan.aggregateQuery("count", true, fieldPtr)
+	if err != nil {
+		return -1, err
+	}
+	return plan.selectInt(query, plan.getArgs()...)
+}
@@ -0,0 +1,134 @@
+package plans
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// An assignExpr is an expression that an assigned value is wrapped in
+// when it is assigned to a column in an update statement, e.g. to set
+// a path within a JSON document.
+type assignExpr struct {
+	function string
+	path     []string
+}
+
+// AssignJSONPath assigns value to the key at path (a dot-separated
+// list of keys, e.g. "address.city") within the JSON document stored
+// in the column that fieldPtr points to, rather than replacing the
+// whole document.  Example:
+//
+//     ref := new(Listing)
+//     _, err := dbMap.Query(ref).
+//         AssignJSONPath(&ref.Meta, "pricing.nightly", 150).
+//         Where().Equal(&ref.Id, id).
+//         Update()
+//
+// Value is encoded using the plan's JSONEncoder, and the document is
+// updated using jsonb_set on postgresql and json_set on MySQL and
+// SQLite.  As with those functions, the last key in path is added if
+// it is missing, but the keys before it must already exist.  Null
+// documents are treated as empty objects.  Keys may only contain
+// letters, digits, and underscores.  Only Update supports path
+// assignments; Insert and Upsert return an error.
+func (plan *QueryPlan) AssignJSONPath(fieldPtr interface{}, path string, value interface{}) interfaces.AssignQuery {
+	assignPlan := &AssignQueryPlan{QueryPlan: plan}
+	return assignPlan.AssignJSONPath(fieldPtr, path, value)
+}
+
+// AssignArrayAppend appends value to the array stored in the column
+// that fieldPtr points to, using array_append.  It is only supported
+// on postgresql, and (like AssignJSONPath) only by Update.
+func (plan *QueryPlan) AssignArrayAppend(fieldPtr interface{}, value interface{}) interfaces.AssignQuery {
+	assignPlan := &AssignQueryPlan{QueryPlan: plan}
+	return assignPlan.AssignArrayAppend(fieldPtr, value)
+}
+
+func (plan *AssignQueryPlan) AssignJSONPath(fieldPtr interface{}, path string, value interface{}) interfaces.AssignQuery {
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if !isJSONKey(key) {
+			plan.Errors = append(plan.Errors, fmt.Errorf("gorq: Invalid key %q in JSON path %q", key, path))
+			return plan
+		}
+	}
+	encoded, err := plan.marshalJSON(value)
+	if err != nil {
+		plan.Errors = append(plan.Errors, err)
+		return plan
+	}
+	return plan.assign(fieldPtr, string(encoded), &assignExpr{function: "json_set", path: keys})
+}
+
+func (plan *AssignQueryPlan) AssignArrayAppend(fieldPtr interface{}, value interface{}) interfaces.AssignQuery {
+	if _, ok := plan.dialect.(gorp.PostgresDialect); !ok {
+		plan.Errors = append(plan.Errors, errors.New("gorq: Array appends are only supported on postgresql"))
+		return plan
+	}
+	value, err := plan.toDb(value)
+	if err != nil {
+		plan.Errors = append(plan.Errors, err)
+		return plan
+	}
+	return plan.assign(fieldPtr, value, &assignExpr{function: "array_append"})
+}
+
+// isJSONKey returns whether or not key can be used as a key in a JSON
+// path without quoting.
+func isJSONKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// checkAssignExprs returns an error if any of the plan's assignments
+// use an expression, for statements which don't support them.
+func (plan *QueryPlan) checkAssignExprs() error {
+	for _, expr := range plan.assignExprs {
+		if expr != nil {
+			return errors.New("gorq: JSON path and array assignments are only supported by Update")
+		}
+	}
+	return nil
+}
+
+// assignedValue returns the SQL for the value of the i'th assignment
+// in an update statement: its bind variable, wrapped in the
+// assignment's expression if it has one.
+func (plan *QueryPlan) assignedValue(i int) string {
+	bindVar := plan.assignBindVars[i]
+	if i >= len(plan.assignExprs) || plan.assignExprs[i] == nil {
+		return bindVar
+	}
+	expr := plan.assignExprs[i]
+	column := plan.QuotedTable() + "." + plan.assignCols[i]
+	if expr.function == "array_append" {
+		return "array_append(" + column + ", " + bindVar + ")"
+	}
+	switch plan.dialect.(type) {
+	case gorp.PostgresDialect:
+		return "jsonb_set(coalesce(" + column + ", '{}'), '{" + strings.Join(expr.path, ",") + "}', " + bindVar + "::jsonb)"
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		return "json_set(coalesce(" + column + ", '{}'), '" + jsonPath(expr.path) + "', cast(" + bindVar + " as json))"
+	default:
+		return "json_set(coalesce(" + column + ", '{}'), '" + jsonPath(expr.path) + "', json(" + bindVar + "))"
+	}
+}
+
+// jsonPath returns the MySQL/SQLite JSON path for keys.
+func jsonPath(keys []string) string {
+	return `$."` + strings.Join(keys, `"."`) + `"`
+}
@@ -0,0 +1,145 @@
+package plans
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// A BatchSpec describes a to-many association that a JoinStrategy
+// loads using one more select statement for all of a plan's results
+// (or one per maximum number of bind variables), instead of joining
+// it, which would repeat each result once per child.  The field being
+// joined must be a slice (usually tagged `db:"-"`) of the children's
+// reference struct type, or of pointers to it.  For example:
+//
+//     type loadItems struct{ dbMap *gorq.DbMap }
+//
+//     func (s loadItems) Join(parent, field interface{}) *plans.JoinSpec {
+//         invoice := parent.(*Invoice)
+//         return &plans.JoinSpec{Batch: &plans.BatchSpec{
+//             ParentKey: &invoice.Id,
+//             Children: func() (interfaces.Selector, interface{}) {
+//                 item := new(LineItem)
+//                 return s.dbMap.Query(item), &item.InvoiceId
+//             },
+//         }}
+//     }
+//
+// Select, SelectOne, and SelectToTarget load batched associations.
+type BatchSpec struct {
+	// ParentKey is a pointer to the field of the plan's reference
+	// struct that the children refer to.
+	ParentKey interface{}
+
+	// Children returns a new query for the children, along with a
+	// pointer to the field of its reference struct that refers to
+	// ParentKey, which must have the same type.  It is called for
+	// each statement, since the query is filtered to the parents'
+	// keys.
+	Children func() (query interfaces.Selector, childKeyPtr interface{})
+}
+
+// A batchJoin is a to-many association of a plan, loaded into field
+// using spec.
+type batchJoin struct {
+	field interface{}
+	spec  *BatchSpec
+}
+
+// loadBatches loads the plan's batched associations into results,
+// which are pointers to the plan's reference struct type.
+func (plan *QueryPlan) loadBatches(results []interface{}) error {
+	if len(results) == 0 {
+		return nil
+	}
+	for _, batch := range plan.batches {
+		if err := plan.loadBatch(batch, results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBatch loads batch's children for results.
+func (plan *QueryPlan) loadBatch(batch batchJoin, results []interface{}) error {
+	keyIndex, err := plan.fieldIndex(batch.spec.ParentKey)
+	if err != nil {
+		return err
+	}
+	sliceIndex, err := plan.fieldIndex(batch.field)
+	if err != nil {
+		return err
+	}
+	sliceType := reflect.TypeOf(batch.field).Elem()
+	if sliceType.Kind() != reflect.Slice {
+		return fmt.Errorf("gorq: Batched associations must be loaded into slices, not %s", sliceType)
+	}
+	keyType := reflect.TypeOf(batch.spec.ParentKey).Elem()
+	seen := make(map[interface{}]bool, len(results))
+	keys := make([]interface{}, 0, len(results))
+	for _, result := range results {
+		// Keys behind nil pointers (e.g. in left joined structs)
+		// don't have any children.
+		if key := fieldOrNilByIndex(reflect.ValueOf(result).Elem(), keyIndex); key.Type() == keyType && !seen[key.Interface()] {
+			seen[key.Interface()] = true
+			keys = append(keys, key.Interface())
+		}
+	}
+
+	children := make(map[interface{}][]reflect.Value, len(keys))
+	for max := plan.maxBindArgs(); len(keys) > 0; {
+		chunk := keys
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		keys = keys[len(chunk):]
+		query, childKeyPtr := batch.spec.Children()
+		child, ok := query.(childSelector)
+		if !ok {
+			return fmt.Errorf("gorq: Cannot load children using %T", query)
+		}
+		if reflect.TypeOf(childKeyPtr) != reflect.TypeOf(batch.spec.ParentKey) {
+			return errors.New("gorq: The keys of batched children must have the same type as their parents' keys")
+		}
+		childIndex, err := child.fieldIndex(childKeyPtr)
+		if err != nil {
+			return err
+		}
+		child.andWhere(filters.In(childKeyPtr, chunk...))
+		rows, err := child.Select()
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			rowVal := reflect.ValueOf(row)
+			if key := fieldOrNilByIndex(rowVal.Elem(), childIndex); key.Type() == keyType {
+				children[key.Interface()] = append(children[key.Interface()], rowVal)
+			}
+		}
+	}
+
+	for _, result := range results {
+		parent := reflect.ValueOf(result).Elem()
+		key := fieldOrNilByIndex(parent, keyIndex)
+		if key.Type() != keyType {
+			continue
+		}
+		rows := children[key.Interface()]
+		loaded := reflect.MakeSlice(sliceType, 0, len(rows))
+		for _, row := range rows {
+			if sliceType.Elem().Kind() != reflect.Ptr {
+				row = row.Elem()
+			}
+			if !row.Type().AssignableTo(sliceType.Elem()) {
+				return fmt.Errorf("gorq: Cannot load children of type %s into %s", row.Type(), sliceType)
+			}
+			loaded = reflect.Append(loaded, row)
+		}
+		fieldByIndex(parent, sliceIndex).Set(loaded)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package plans
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+)
+
+// batchDeleteQuery returns a DELETE statement that deletes up to
+// batchSize of the rows matching the plan's where clause.  Dialects
+// without LIMIT on DELETE statements match rows against a sub-select
+// of their row identifiers: ctid on postgresql, rowid on sqlite, and
+// the primary key elsewhere (including views, which have neither).
+func (plan *QueryPlan) batchDeleteQuery(batchSize int64) (string, error) {
+	quotedTable := plan.quoteTable(plan.table.SchemaName, plan.table.TableName)
+	whereClause, err := plan.whereClause()
+	if err != nil {
+		return "", err
+	}
+	// The batch size is bound rather than inlined, so that batches of
+	// different sizes share a statement.
+	limit := " limit " + plan.dialect.BindVar(plan.argLen)
+	plan.appendArgs(batchSize)
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufPool.Put(buffer)
+	buffer.WriteString("delete from ")
+	buffer.WriteString(quotedTable)
+	switch plan.dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		buffer.WriteString(whereClause)
+		buffer.WriteString(limit)
+		return buffer.String(), nil
+	}
+	var rowId string
+	switch plan.dialect.(type) {
+	case gorp.PostgresDialect:
+		rowId = "ctid"
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		rowId = "rowid"
+	}
+	if plan.targetsView() {
+		// Views have no ctid or rowid.
+		rowId = ""
+	}
+	if rowId == "" {
+		keys := plan.keyColumns()
+		if len(keys) != 1 {
+			return "", fmt.Errorf("gorq: Batched deletes for dialect %T require a single column primary key", plan.dialect)
+		}
+		rowId = plan.quoteField(keys[0].ColumnName)
+	}
+	buffer.WriteString(" where ")
+	buffer.WriteString(rowId)
+	buffer.WriteString(" in (select ")
+	buffer.WriteString(rowId)
+	buffer.WriteString(" from ")
+	buffer.WriteString(quotedTable)
+	buffer.WriteString(whereClause)
+	buffer.WriteString(limit)
+	buffer.WriteString(")")
+	return buffer.String(), nil
+}
+
+// DeleteInBatches runs this query plan as a series of DELETE
+// statements, each deleting up to batchSize matching rows, until a
+// statement deletes fewer than batchSize rows.  It sleeps for pause
+// between statements (or returns early if the plan's context is done),
+// so that other statements can take the locks that each batch
+// releases.  It returns the total number of rows deleted, which will
+// include any batches that were deleted before an error occurred.
+//
+// Batches are not deleted in a transaction unless the plan's executor
+// is one, in which case locks are not released between batches.
+func (plan *QueryPlan) DeleteInBatches(batchSize int64, pause time.Duration) (int64, error) {
+	if err := plan.checkWritable(); err != nil {
+		return -1, err
+	}
+	if len(plan.Errors) > 0 {
+		return -1, plan.Errors[0]
+	}
+	if batchSize < 1 {
+		return -1, errors.New("gorq: Batched deletes need a batch size of at least one")
+	}
+	if len(plan.joins) > 0 {
+		return -1, errors.New("gorq: Batched deletes cannot be joined to other tables")
+	}
+	if err := plan.checkWhere(); err != nil {
+		return -1, err
+	}
+	ctx := plan.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var total int64
+	for {
+		plan.resetArgs()
+		if err := plan.checkPolicies(DeleteOperation); err != nil {
+			return total, err
+		}
+		query, err := plan.batchDeleteQuery(batchSize)
+		if err != nil {
+			return total, err
+		}
+		rows, err := plan.execChange(DeleteOperation, query)
+		if err != nil {
+			return total, err
+		}
+		total += rows
+		if rows < batchSize {
+			return total, nil
+		}
+		if pause <= 0 {
+			continue
+		}
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return total, ctx.Err()
+		}
+	}
+}
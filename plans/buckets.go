@@ -0,0 +1,145 @@
+package plans
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+)
+
+// A Bucket is the default element type for the results of Bucketize.
+// Any struct with "bucket" and "count" columns may be used instead,
+// e.g. to scan bucket values which aren't integers.
+type Bucket struct {
+	Bucket int64 `db:"bucket"`
+	Count  int64 `db:"count"`
+}
+
+// selectBuckets executes a statement which counts the rows matching
+// the plan's where clause for each value of bucketExpr, scanning the
+// results into target in bucket order.  The arguments for with (the
+// plan's WITH clause) and bucketExpr must already be bound.
+func (plan *QueryPlan) selectBuckets(with, bucketExpr string, target interface{}) error {
+	buffer := plan.getBuffer()
+	buffer.WriteString(with)
+	buffer.WriteString("select ")
+	buffer.WriteString(bucketExpr)
+	buffer.WriteString(" as ")
+	buffer.WriteString(plan.quoteField("bucket"))
+	buffer.WriteString(", count(*) as ")
+	buffer.WriteString(plan.quoteField("count"))
+	if err := plan.writeFromWhere(buffer); err != nil {
+		bufPool.Put(buffer)
+		return err
+	}
+	buffer.WriteString(" group by 1 order by 1")
+	query := buffer.String()
+	plan.putBuffer(buffer)
+	_, err := plan.selectTo(target, query, plan.getArgs()...)
+	return err
+}
+
+// floorDiv returns an expression for floor(column / divisor), binding
+// divisor as an argument.  Sqlite has no floor() function (without
+// its math extension), so casts are used to round towards negative
+// infinity instead.
+func (plan *QueryPlan) floorDiv(column string, divisor interface{}) (string, error) {
+	quotient := func() (string, error) {
+		bindVar, err := plan.argOrColumn(divisor)
+		return "(" + column + " * 1.0 / " + bindVar + ")", err
+	}
+	switch plan.dialect.(type) {
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		var parts [3]string
+		for i := range parts {
+			part, err := quotient()
+			if err != nil {
+				return "", err
+			}
+			parts[i] = part
+		}
+		return "(cast(" + parts[0] + " as integer) - (" + parts[1] + " < cast(" + parts[2] + " as integer)))", nil
+	}
+	q, err := quotient()
+	if err != nil {
+		return "", err
+	}
+	return "floor(" + q + ")", nil
+}
+
+// Bucketize counts the rows matching the plan's where clause in each
+// bucket of the values of the column for fieldPtr, appending one
+// element per non-empty bucket to the slice that target points to
+// (usually a *[]plans.Bucket).  widthOrEdges may be:
+//
+//   - A number, to use buckets of that width starting from zero.  A
+//     value v is in bucket floor(v / width), so each bucket's lower
+//     bound is its bucket number multiplied by width.
+//   - A slice of ascending edges, to use buckets between them.  A
+//     value v is in bucket i if edges[i-1] <= v < edges[i]; values
+//     below the first edge are in bucket 0, and values at or above the
+//     last edge are in bucket len(edges).
+//
+// Example:
+//
+//     var histogram []plans.Bucket
+//     err := dbMap.Query(ref).
+//         Where().
+//         Greater(&ref.Created, since).
+//         Bucketize(&ref.Price, []int{50, 100, 200, 500}, &histogram)
+//
+// Buckets are numbered the same way for every dialect.  The plan's
+// order by, group by, limit, and offset clauses are ignored.
+func (plan *QueryPlan) Bucketize(fieldPtr interface{}, widthOrEdges interface{}, target interface{}) error {
+	plan.resetArgs()
+	if len(plan.Errors) > 0 {
+		return plan.Errors[0]
+	}
+	if err := plan.checkPolicies(SelectOperation); err != nil {
+		return err
+	}
+	with := new(bytes.Buffer)
+	if err := plan.writeWith(with); err != nil {
+		return err
+	}
+	column, err := plan.argOrColumn(fieldPtr)
+	if err != nil {
+		return err
+	}
+	spec := reflect.ValueOf(widthOrEdges)
+	var bucketExpr string
+	switch spec.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if spec.Convert(reflect.TypeOf(float64(0))).Float() <= 0 {
+			return errors.New("gorq: Bucket widths must be positive")
+		}
+		bucketExpr, err = plan.floorDiv(column, widthOrEdges)
+		if err != nil {
+			return err
+		}
+	case reflect.Slice, reflect.Array:
+		if spec.Len() == 0 {
+			return errors.New("gorq: Bucketize needs at least one bucket edge")
+		}
+		buffer := new(bytes.Buffer)
+		buffer.WriteString("case")
+		for i := 0; i < spec.Len(); i++ {
+			edge, err := plan.argOrColumn(spec.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+			buffer.WriteString(" when " + column + " < " + edge + " then " + strconv.Itoa(i))
+		}
+		buffer.WriteString(" else " + strconv.Itoa(spec.Len()) + " end")
+		bucketExpr = buffer.String()
+	default:
+		return fmt.Errorf("gorq: Cannot bucketize using %T; use a width or a slice of edges", widthOrEdges)
+	}
+	return plan.selectBuckets(with.String(), bucketExpr, target)
+}
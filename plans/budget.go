@@ -0,0 +1,179 @@
+package plans
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Budget limits the number of statements, and the total time spent
+// executing them, for all plans created with a context.  Any limit
+// that is zero is not enforced.  See WithBudget.
+type Budget struct {
+	// MaxQueries is the maximum number of statements that may be
+	// executed.
+	MaxQueries int
+
+	// MaxDuration is the maximum total time that may be spent
+	// executing statements.  It is checked before each statement, so
+	// the statement that exceeds it will still complete.
+	MaxDuration time.Duration
+
+	// LogOnly causes budget violations to be logged using the plan's
+	// logger, instead of preventing the statement from executing.
+	LogOnly bool
+}
+
+// A BudgetError is returned when a statement is executed with a
+// context whose Budget has been exceeded.
+type BudgetError struct {
+	// Exceeded is the name of the field in Budget that was exceeded.
+	Exceeded string
+
+	// Queries and Duration are the number of statements executed
+	// (including the rejected one) and the time spent executing them.
+	Queries  int
+	Duration time.Duration
+}
+
+func (err *BudgetError) Error() string {
+	return fmt.Sprintf("gorq: Query budget exceeds %s (%d queries in %s)", err.Exceeded, err.Queries, err.Duration)
+}
+
+type budgetKey struct{}
+
+// budgetUsage tracks the statements executed against a Budget.
+type budgetUsage struct {
+	sync.Mutex
+	budget   Budget
+	queries  int
+	duration time.Duration
+}
+
+// WithBudget returns a copy of ctx which enforces budget for every
+// plan created with it (e.g. using gorq.DbMap.QueryContext).  Usage
+// is shared by every plan using the returned context, so it is
+// usually created once per request.
+func WithBudget(ctx context.Context, budget Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, &budgetUsage{budget: budget})
+}
+
+// BudgetUsage returns the number of statements executed, and the time
+// spent executing them, for a context created by WithBudget.
+func BudgetUsage(ctx context.Context) (queries int, duration time.Duration) {
+	usage, ok := ctx.Value(budgetKey{}).(*budgetUsage)
+	if !ok {
+		return 0, 0
+	}
+	usage.Lock()
+	defer usage.Unlock()
+	return usage.queries, usage.duration
+}
+
+// start records a statement against the budget, returning a
+// *BudgetError if the budget has been exceeded.
+func (usage *budgetUsage) start() error {
+	usage.Lock()
+	defer usage.Unlock()
+	usage.queries++
+	exceeded := ""
+	switch {
+	case usage.budget.MaxQueries > 0 && usage.queries > usage.budget.MaxQueries:
+		exceeded = "MaxQueries"
+	case usage.budget.MaxDuration > 0 && usage.duration > usage.budget.MaxDuration:
+		exceeded = "MaxDuration"
+	default:
+		return nil
+	}
+	return &BudgetError{Exceeded: exceeded, Queries: usage.queries, Duration: usage.duration}
+}
+
+// add records time spent executing a statement.
+func (usage *budgetUsage) add(d time.Duration) {
+	usage.Lock()
+	usage.duration += d
+	usage.Unlock()
+}
+
+// A Semaphore limits the number of heavy plans (see QueryPlan.Heavy)
+// that may execute statements at the same time.  Plans wait for a
+// free slot, or for their context to be done.
+type Semaphore chan struct{}
+
+// NewSemaphore returns a Semaphore which allows n concurrent heavy
+// statements.  If n is not positive, it returns nil, which doesn't
+// limit heavy statements at all.
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(Semaphore, n)
+}
+
+// Heavy marks the plan as a heavy query, so that its statements are
+// limited by the Semaphore in its Options (if it has one).
+func (plan *QueryPlan) Heavy() *QueryPlan {
+	plan.heavy = true
+	return plan
+}
+
+// withTimeout applies the plan's timeout (see Options.Timeout) to
+// ctx, and switches the plan's executor to one using the resulting
+// context.  The returned function restores the original executor and
+// releases the context.
+func (plan *QueryPlan) withTimeout(ctx context.Context) (context.Context, func()) {
+	if plan.timeout <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithTimeout(ctx, plan.timeout)
+	exec := plan.executor
+	plan.executor = exec.WithContext(ctx)
+	return ctx, func() {
+		plan.executor = exec
+		cancel()
+	}
+}
+
+// begin is called before the plan executes a statement.  It enforces
+// the budget of the plan's context, its heavy query semaphore, and its
+// timeout, returning a function that must be called once the
+// statement has completed.
+func (plan *QueryPlan) begin() (done func(), err error) {
+	ctx := plan.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, restore := plan.withTimeout(ctx)
+	usage, _ := ctx.Value(budgetKey{}).(*budgetUsage)
+	if usage != nil {
+		if err := usage.start(); err != nil {
+			if !usage.budget.LogOnly {
+				restore()
+				return nil, err
+			}
+			if plan.logger != nil {
+				plan.logger.Printf("%s%s", plan.logPrefix, err)
+			}
+		}
+	}
+	sem := plan.heavySemaphore
+	if plan.heavy && sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			restore()
+			return nil, ctx.Err()
+		}
+	}
+	start := time.Now()
+	return func() {
+		if usage != nil {
+			usage.add(time.Since(start))
+		}
+		if plan.heavy && sem != nil {
+			<-sem
+		}
+		restore()
+	}, nil
+}
@@ -0,0 +1,387 @@
+package plans
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+)
+
+// A bulkColumn is a column that is read from each row passed to
+// BulkUpdate.
+type bulkColumn struct {
+	column *gorp.ColumnMap
+	quoted string
+	index  []int
+}
+
+// bulkColumns looks up the columns of the plan's table for fieldPtrs,
+// which must point to fields of the plan's reference struct.
+func (plan *QueryPlan) bulkColumns(fieldPtrs []interface{}) ([]bulkColumn, error) {
+	cols := make([]bulkColumn, 0, len(fieldPtrs))
+	for _, fieldPtr := range fieldPtrs {
+		m, err := plan.colMap.fieldMapForPointer(fieldPtr)
+		if err != nil {
+			return nil, err
+		}
+		if m.parentMap != nil || m.parent != plan.target.Interface() {
+			return nil, errors.New("gorq: Bulk updates can only use fields of the plan's reference struct")
+		}
+		cols = append(cols, bulkColumn{
+			column: m.column,
+			quoted: m.quotedColumn,
+			index:  m.column.FieldIndex(),
+		})
+	}
+	return cols, nil
+}
+
+// bulkRows returns the rows in rows, which must be a slice of values
+// (or pointers to values) of the plan's reference struct type.
+func (plan *QueryPlan) bulkRows(rows interface{}) ([]reflect.Value, error) {
+	slice := reflect.ValueOf(rows)
+	if slice.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("gorq: Bulk updates require a slice of rows, not %T", rows)
+	}
+	structType := plan.target.Type().Elem()
+	values := make([]reflect.Value, 0, slice.Len())
+	for i := 0; i < slice.Len(); i++ {
+		row := reflect.Indirect(slice.Index(i))
+		if row.Type() != structType {
+			return nil, fmt.Errorf("gorq: Cannot bulk update a row of type %s in the table for %s", row.Type(), structType)
+		}
+		values = append(values, row)
+	}
+	return values, nil
+}
+
+// bulkArg binds the value of col in row as an argument, returning its
+// bind variable.
+func (plan *QueryPlan) bulkArg(row reflect.Value, col bulkColumn) (string, error) {
+	value, err := plan.toDb(fieldOrNilByIndex(row, col.index).Interface())
+	if err != nil {
+		return "", err
+	}
+	start := plan.argCount()
+	bindVar := plan.dialect.BindVar(start)
+	plan.appendArgs(value)
+	if plan.isSensitive(col.column) {
+		plan.markSensitive(start, start+1)
+	}
+	return bindVar, nil
+}
+
+// InsertAll inserts every element of rows (a slice of the plan's
+// reference struct type, or pointers to it) using multi-row INSERT
+// statements, e.g.
+//
+//     ref := new(Listing)
+//     inserted, err := dbMap.Query(ref).InsertAll(listings)
+//
+// Every mapped column is inserted, except for auto-increment keys,
+// which are left for the database to generate (and are not stored
+// back in rows).  Rows are split across as few statements as the
+// dialect's limit on bind arguments (or Limits.MaxArgs, if it is
+// lower) allows; the statements are not executed in a transaction of
+// their own, so callers that need all or none of the rows inserted
+// should use one.  Tables with no columns to insert besides an
+// auto-increment key are rejected; use InsertDefaults for those.
+func (plan *QueryPlan) InsertAll(rows interface{}) (int64, error) {
+	if err := plan.checkWritable(); err != nil {
+		return -1, err
+	}
+	plan.resetArgs()
+	if len(plan.Errors) > 0 {
+		return -1, plan.Errors[0]
+	}
+	if len(plan.assignCols) > 0 {
+		return -1, errors.New("gorq: Bulk inserts cannot be combined with assignments")
+	}
+	values, err := plan.bulkRows(rows)
+	if err != nil {
+		return -1, err
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	if err := plan.checkPolicies(InsertOperation); err != nil {
+		return -1, err
+	}
+	cols := plan.insertColumns(nil)
+	if len(cols) == 0 {
+		return -1, errors.New("gorq: Bulk inserts require at least one column that isn't an auto-increment key; use InsertDefaults instead")
+	}
+	batchSize := plan.maxBindArgs() / len(cols)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var inserted int64
+	for start := 0; start < len(values); start += batchSize {
+		end := start + batchSize
+		if end > len(values) {
+			end = len(values)
+		}
+		count, err := plan.insertBatch(values[start:end], cols)
+		if err != nil {
+			return inserted, err
+		}
+		inserted += count
+	}
+	return inserted, nil
+}
+
+// insertBatch inserts values using a single multi-row INSERT
+// statement.
+func (plan *QueryPlan) insertBatch(values []reflect.Value, cols []bulkColumn) (int64, error) {
+	plan.resetArgs()
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufPool.Put(buffer)
+	if err := plan.writeInsertRows(buffer, values, cols); err != nil {
+		return -1, err
+	}
+	return plan.execChange(InsertOperation, buffer.String())
+}
+
+// writeInsertRows writes an INSERT statement for the columns cols of
+// each of values to buffer, binding their values.
+func (plan *QueryPlan) writeInsertRows(buffer *bytes.Buffer, values []reflect.Value, cols []bulkColumn) error {
+	buffer.WriteString("insert into ")
+	buffer.WriteString(plan.quoteTable(plan.table.SchemaName, plan.table.TableName))
+	buffer.WriteString(" (")
+	for i, col := range cols {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(col.quoted)
+	}
+	buffer.WriteString(") values ")
+	for i, row := range values {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString("(")
+		for j, col := range cols {
+			if j > 0 {
+				buffer.WriteString(", ")
+			}
+			bindVar, err := plan.bulkArg(row, col)
+			if err != nil {
+				return err
+			}
+			buffer.WriteString(bindVar)
+		}
+		buffer.WriteString(")")
+	}
+	return nil
+}
+
+// maxBindArgs returns the number of bind arguments that a single
+// statement may have: the plan's MaxArgs limit, if it has one, or the
+// most that its dialect supports.
+func (plan *QueryPlan) maxBindArgs() int {
+	max := 65535
+	switch plan.dialect.(type) {
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		// SQLITE_MAX_VARIABLE_NUMBER defaults to 999 before sqlite
+		// 3.32.0.
+		max = 999
+	}
+	if plan.limits.MaxArgs > 0 && plan.limits.MaxArgs < max {
+		max = plan.limits.MaxArgs
+	}
+	return max
+}
+
+// BulkUpdate updates many rows of the plan's table in a single
+// statement, setting the columns for updateFieldPtrs to each row's
+// values in whichever row matches it on the columns for keyFieldPtrs.
+// Both sets of field pointers must point to fields of the plan's
+// reference struct, and rows must be a slice of (pointers to) the
+// reference struct type.  Example:
+//
+//     ref := new(Invoice)
+//     updated, err := dbMap.Query(ref).
+//         BulkUpdate(invoices, []interface{}{&ref.Id}, []interface{}{&ref.Memo, &ref.IsPaid})
+//
+// On postgresql, the rows are joined in as a VALUES list, using
+// UPDATE ... FROM; other dialects use a CASE expression for each
+// updated column.  Any filters in the plan's where clause are also
+// applied.  Every row becomes part of the statement, so large slices
+// should be split into batches by the caller.
+func (plan *QueryPlan) BulkUpdate(rows interface{}, keyFieldPtrs, updateFieldPtrs []interface{}) (int64, error) {
+	if err := plan.checkWritable(); err != nil {
+		return -1, err
+	}
+	plan.resetArgs()
+	if len(plan.Errors) > 0 {
+		return -1, plan.Errors[0]
+	}
+	if len(keyFieldPtrs) == 0 || len(updateFieldPtrs) == 0 {
+		return -1, errors.New("gorq: Bulk updates require at least one key field and one update field")
+	}
+	if len(plan.assignCols) > 0 || len(plan.joins) > 0 {
+		return -1, errors.New("gorq: Bulk updates cannot be combined with assignments or joins")
+	}
+	keys, err := plan.bulkColumns(keyFieldPtrs)
+	if err != nil {
+		return -1, err
+	}
+	updates, err := plan.bulkColumns(updateFieldPtrs)
+	if err != nil {
+		return -1, err
+	}
+	values, err := plan.bulkRows(rows)
+	if err != nil {
+		return -1, err
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	if err := plan.checkPolicies(UpdateOperation); err != nil {
+		return -1, err
+	}
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufPool.Put(buffer)
+	if _, ok := plan.dialect.(gorp.PostgresDialect); ok {
+		err = plan.writeBulkUpdateFrom(buffer, values, keys, updates)
+	} else {
+		err = plan.writeBulkUpdateCase(buffer, values, keys, updates)
+	}
+	if err != nil {
+		return -1, err
+	}
+	return plan.execChange(UpdateOperation, buffer.String())
+}
+
+// writeBulkUpdateFrom writes an UPDATE ... FROM (VALUES ...) statement
+// for BulkUpdate.  The values list is unioned with an empty select
+// from the table, so that postgresql types each value the same as its
+// column.
+func (plan *QueryPlan) writeBulkUpdateFrom(buffer *bytes.Buffer, values []reflect.Value, keys, updates []bulkColumn) error {
+	quotedTable := plan.quoteTable(plan.table.SchemaName, plan.table.TableName)
+	source := plan.quoteField("gorq_bulk")
+	cols := append(append([]bulkColumn(nil), keys...), updates...)
+	buffer.WriteString("update ")
+	buffer.WriteString(quotedTable)
+	buffer.WriteString(" set ")
+	for i, col := range updates {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(col.quoted + "=" + source + "." + col.quoted)
+	}
+	buffer.WriteString(" from (select ")
+	for i, col := range cols {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(col.quoted)
+	}
+	buffer.WriteString(" from " + quotedTable + " where false union all values ")
+	for i, row := range values {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString("(")
+		for j, col := range cols {
+			if j > 0 {
+				buffer.WriteString(", ")
+			}
+			bindVar, err := plan.bulkArg(row, col)
+			if err != nil {
+				return err
+			}
+			buffer.WriteString(bindVar)
+		}
+		buffer.WriteString(")")
+	}
+	buffer.WriteString(") as " + source)
+	whereClause, err := plan.whereClause()
+	if err != nil {
+		return err
+	}
+	if whereClause == "" {
+		buffer.WriteString(" where ")
+	} else {
+		buffer.WriteString(whereClause)
+		buffer.WriteString(" and ")
+	}
+	for i, col := range keys {
+		if i > 0 {
+			buffer.WriteString(" and ")
+		}
+		buffer.WriteString(quotedTable + "." + col.quoted + "=" + source + "." + col.quoted)
+	}
+	return nil
+}
+
+// writeBulkUpdateCase writes an UPDATE statement for BulkUpdate which
+// uses a CASE expression to choose each row's value for each updated
+// column.
+func (plan *QueryPlan) writeBulkUpdateCase(buffer *bytes.Buffer, values []reflect.Value, keys, updates []bulkColumn) error {
+	quotedTable := plan.quoteTable(plan.table.SchemaName, plan.table.TableName)
+	buffer.WriteString("update ")
+	buffer.WriteString(quotedTable)
+	buffer.WriteString(" set ")
+	for i, col := range updates {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(col.quoted + "=case")
+		for _, row := range values {
+			buffer.WriteString(" when ")
+			if err := plan.writeBulkKeyMatch(buffer, row, keys); err != nil {
+				return err
+			}
+			bindVar, err := plan.bulkArg(row, col)
+			if err != nil {
+				return err
+			}
+			buffer.WriteString(" then " + bindVar)
+		}
+		buffer.WriteString(" else " + col.quoted + " end")
+	}
+	whereClause, err := plan.whereClause()
+	if err != nil {
+		return err
+	}
+	if whereClause == "" {
+		buffer.WriteString(" where (")
+	} else {
+		buffer.WriteString(whereClause)
+		buffer.WriteString(" and (")
+	}
+	for i, row := range values {
+		if i > 0 {
+			buffer.WriteString(" or ")
+		}
+		buffer.WriteString("(")
+		if err := plan.writeBulkKeyMatch(buffer, row, keys); err != nil {
+			return err
+		}
+		buffer.WriteString(")")
+	}
+	buffer.WriteString(")")
+	return nil
+}
+
+// writeBulkKeyMatch writes a condition matching row's values for
+// keys.
+func (plan *QueryPlan) writeBulkKeyMatch(buffer *bytes.Buffer, row reflect.Value, keys []bulkColumn) error {
+	for i, col := range keys {
+		if i > 0 {
+			buffer.WriteString(" and ")
+		}
+		bindVar, err := plan.bulkArg(row, col)
+		if err != nil {
+			return err
+		}
+		buffer.WriteString(col.quoted + "=" + bindVar)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package plans
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/outdoorsy/gorp"
+)
+
+// A Change describes rows that were modified by a plan.
+type Change struct {
+	// Operation is InsertOperation, UpdateOperation, or
+	// DeleteOperation.
+	Operation Operation
+
+	// Table is the table that was modified.
+	Table *gorp.TableMap
+
+	// KeyColumns are the primary key columns of Table, in the same
+	// order as the values in each element of Keys.
+	KeyColumns []*gorp.ColumnMap
+
+	// Keys contains the primary key values of each modified row.  For
+	// updates and deletes, the keys can only be read back from
+	// dialects that support RETURNING clauses (i.e. postgresql); for
+	// other dialects, Keys will be nil and only RowsAffected will be
+	// set.
+	Keys [][]interface{}
+
+	// RowsAffected is the number of rows that were modified.
+	RowsAffected int64
+}
+
+// A ChangeFunc is called after a plan successfully executes an
+// INSERT, UPDATE, or DELETE statement.
+type ChangeFunc func(Change)
+
+// isPrimaryKey returns whether or not gorp has mapped col as part of
+// its table's primary key.  Like isAutoIncr, this has to be read via
+// reflection.
+func isPrimaryKey(col *gorp.ColumnMap) bool {
+	pk := reflect.ValueOf(col).Elem().FieldByName("isPK")
+	return pk.IsValid() && pk.Bool()
+}
+
+// keyColumns returns the primary key columns for the plan's table.
+func (plan *QueryPlan) keyColumns() []*gorp.ColumnMap {
+	var keys []*gorp.ColumnMap
+	for _, col := range plan.table.Columns {
+		if isPrimaryKey(col) {
+			keys = append(keys, col)
+		}
+	}
+	return keys
+}
+
+// supportsReturning returns whether or not the plan's dialect
+// supports RETURNING clauses on INSERT, UPDATE, and DELETE
+// statements.
+func (plan *QueryPlan) supportsReturning() bool {
+	_, ok := plan.dialect.(gorp.PostgresDialect)
+	return ok
+}
+
+// keyValues reads the values of cols from a value of the plan's
+// reference struct type.
+func keyValues(target reflect.Value, cols []*gorp.ColumnMap) []interface{} {
+	values := make([]interface{}, 0, len(cols))
+	for _, col := range cols {
+		values = append(values, fieldOrNilByIndex(target.Elem(), col.FieldIndex()).Interface())
+	}
+	return values
+}
+
+// insertedKeys returns the primary key of the row that was just
+// inserted, using assigned values where they exist and the reference
+// struct (which will hold any generated keys) otherwise.
+func (plan *QueryPlan) insertedKeys(cols []*gorp.ColumnMap) []interface{} {
+	values := keyValues(plan.target, cols)
+	for i, col := range cols {
+		for j, assigned := range plan.assignColMaps {
+			if assigned == col {
+				values[i] = plan.assignArgs[j]
+			}
+		}
+	}
+	return values
+}
+
+// ReturningInto causes the plan's UPDATE, DELETE, and multi-row
+// INSERT statements (Update, Delete, BulkUpdate, UpsertAll, etc) to
+// return every modified row, appending them to the slice that
+// slicePtr points to.  The slice's elements must be (pointers to) the
+// plan's reference struct type.  Example:
+//
+//     var updated []*Invoice
+//     ref := new(Invoice)
+//     q := dbMap.Query(ref).(*plans.QueryPlan).ReturningInto(&updated)
+//     _, err := q.BulkUpdate(invoices, []interface{}{&ref.Id}, []interface{}{&ref.Memo})
+//     // updated now holds every updated row, including any values
+//     // that were generated by the database.
+//
+// Rows can only be returned from dialects that support RETURNING
+// clauses (i.e. postgresql); other dialects will return an error
+// instead of executing statements.
+func (plan *QueryPlan) ReturningInto(slicePtr interface{}) *QueryPlan {
+	ptr := reflect.ValueOf(slicePtr)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Slice {
+		plan.Errors = append(plan.Errors, fmt.Errorf("gorq: ReturningInto requires a pointer to a slice, not %T", slicePtr))
+		return plan
+	}
+	if elemType := ptr.Elem().Type().Elem(); elemType != plan.target.Type() && elemType != plan.target.Type().Elem() {
+		plan.Errors = append(plan.Errors, fmt.Errorf("gorq: Cannot return rows of the table for %s into a slice of %s", plan.target.Type().Elem(), elemType))
+		return plan
+	}
+	plan.returningTarget = ptr
+	return plan
+}
+
+// execReturning executes a statement with a RETURNING clause for
+// every column of the plan's table, appending the returned rows to
+// the plan's returning target.
+func (plan *QueryPlan) execReturning(op Operation, query string, keyCols []*gorp.ColumnMap) (int64, error) {
+	if !plan.supportsReturning() {
+		return -1, fmt.Errorf("gorq: Rows cannot be returned from statements for dialect %T", plan.dialect)
+	}
+	query += " returning " + plan.quoteTable(plan.table.SchemaName, plan.table.TableName) + ".*"
+	slice := plan.returningTarget.Elem()
+	start := slice.Len()
+	if _, err := plan.selectTo(plan.returningTarget.Interface(), query, plan.getArgs()...); err != nil {
+		return -1, err
+	}
+	rows := int64(slice.Len() - start)
+	if len(plan.changeHooks) > 0 {
+		keys := make([][]interface{}, 0, rows)
+		for i := start; i < slice.Len(); i++ {
+			row := slice.Index(i)
+			if row.Kind() != reflect.Ptr {
+				row = row.Addr()
+			}
+			keys = append(keys, keyValues(row, keyCols))
+		}
+		plan.notify(Change{Operation: op, KeyColumns: keyCols, Keys: keys, RowsAffected: rows})
+	}
+	return rows, nil
+}
+
+// execChange executes an UPDATE or DELETE statement and returns the
+// number of rows affected.  If the plan has change hooks, it will
+// notify them of the change, reading back primary keys using a
+// RETURNING clause when the dialect supports it.
+func (plan *QueryPlan) execChange(op Operation, query string) (int64, error) {
+	keyCols := plan.keyColumns()
+	if plan.returningTarget.IsValid() {
+		return plan.execReturning(op, query, keyCols)
+	}
+	if len(plan.changeHooks) == 0 || !plan.supportsReturning() || len(keyCols) == 0 || plan.targetsView() {
+		res, err := plan.exec(query, plan.getArgs()...)
+		if err != nil {
+			return -1, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return -1, err
+		}
+		plan.notify(Change{Operation: op, RowsAffected: rows})
+		return rows, nil
+	}
+	quotedTable := plan.quoteTable(plan.table.SchemaName, plan.table.TableName)
+	returning := make([]string, 0, len(keyCols))
+	for _, col := range keyCols {
+		returning = append(returning, quotedTable+"."+plan.quoteField(col.ColumnName))
+	}
+	query += " returning " + strings.Join(returning, ", ")
+	results, err := plan.selectTo(plan.target.Interface(), query, plan.getArgs()...)
+	if err != nil {
+		return -1, err
+	}
+	keys := make([][]interface{}, 0, len(results))
+	for _, result := range results {
+		keys = append(keys, keyValues(reflect.ValueOf(result), keyCols))
+	}
+	rows := int64(len(results))
+	plan.notify(Change{Operation: op, KeyColumns: keyCols, Keys: keys, RowsAffected: rows})
+	return rows, nil
+}
+
+// notify passes change to all of the plan's change hooks.
+func (plan *QueryPlan) notify(change Change) {
+	if len(plan.changeHooks) == 0 {
+		return
+	}
+	change.Table = plan.table
+	for _, hook := range plan.changeHooks {
+		hook(change)
+	}
+}
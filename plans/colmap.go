@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/outdoorsy/gorp"
 )
@@ -47,12 +48,29 @@ type fieldColumnMap struct {
 	// column.
 	quotedColumn string
 
+	// tableName is the unquoted name (or alias) of the table that
+	// this column belongs to, used to disambiguate aliases.
+	tableName string
+
+	// fromSubQuery is true if this column is selected by a sub-query
+	// that the plan is selecting from or joining to.
+	fromSubQuery bool
+
 	// doSelect contains whether or not this column should be included
 	// in the fields requested in a select statement.
 	doSelect bool
 
-	// joinOp stores the JoinFunc (if any) related to this field.
-	join JoinFunc
+	// merged is true if this mapping was added by Merge for a field
+	// in another plan's reference struct, and duplicates an existing
+	// mapping.
+	merged bool
+
+	// join stores the JoinStrategy (if any) related to this field.
+	join JoinStrategy
+
+	// resolving is true while selectTarget is being converted to SQL,
+	// so that references to field within it resolve to the column.
+	resolving bool
 }
 
 type structColumnMap []*fieldColumnMap
@@ -79,6 +97,9 @@ func (structMap structColumnMap) LocateTableAndColumn(fieldPtr interface{}) (str
 	if err != nil {
 		return "", err
 	}
+	if computed, ok := fieldMap.selectTarget.(computedColumn); ok {
+		return computed.expr, nil
+	}
 	return fieldMap.quotedTable + "." + fieldMap.quotedColumn, nil
 }
 
@@ -100,8 +121,38 @@ func (structMap structColumnMap) fieldMapForPointer(fieldPtr interface{}) (*fiel
 	if err != nil {
 		return nil, err
 	}
-	if m.column.Transient && m.field == m.selectTarget {
+	if m.column.Transient && m.field == m.selectTarget && !m.fromSubQuery {
 		return nil, errors.New("gorp: Cannot run queries against transient columns")
 	}
 	return m, nil
 }
+
+// isAutoIncr returns whether or not gorp has mapped col as an
+// auto-increment key.  gorp doesn't export that information, so we
+// have to read it using reflection.
+func isAutoIncr(col *gorp.ColumnMap) bool {
+	autoIncr := reflect.ValueOf(col).Elem().FieldByName("isAutoIncr")
+	return autoIncr.IsValid() && autoIncr.Bool()
+}
+
+// uniqueAlias returns the alias that should be used for m in a select
+// list, given the (lower case) aliases that have already been used.
+// Aliases are compared case-insensitively, since that is how gorp
+// matches them to fields.  The first column to use an alias keeps it;
+// any later columns are disambiguated by prefixing their table name
+// (and, if that still collides, suffixing a number), so the result
+// only depends on the order of columns in the plan.  Since gorp can't
+// match renamed aliases to their fields, plans scan their own results
+// when any alias is renamed (see scansRows).
+func uniqueAlias(used map[string]bool, m *fieldColumnMap) string {
+	alias := m.alias
+	if used[strings.ToLower(alias)] {
+		base := m.tableName + "_" + m.alias
+		alias = base
+		for i := 2; used[strings.ToLower(alias)]; i++ {
+			alias = fmt.Sprintf("%s_%d", base, i)
+		}
+	}
+	used[strings.ToLower(alias)] = true
+	return alias
+}
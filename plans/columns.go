@@ -0,0 +1,73 @@
+package plans
+
+import (
+	"reflect"
+
+	"github.com/outdoorsy/gorp"
+)
+
+// A SelectedColumn describes one of the columns that a plan will
+// select.
+type SelectedColumn struct {
+	// Table is the name of the table (or the alias of the joined
+	// table or sub-query) that the column is selected from.
+	Table string
+
+	// Column is the gorp column that the value is scanned into.
+	Column *gorp.ColumnMap
+
+	// Alias is the alias that the column is selected as, or an empty
+	// string if it is selected without one.
+	Alias string
+
+	// Field is the pointer to the field in the plan's reference
+	// structs that the column is mapped to.
+	Field interface{}
+
+	// FieldName is the name of the Go struct field that Field points
+	// to.
+	FieldName string
+}
+
+// SelectedColumns returns the columns that the plan will select, in
+// the order that they will appear in the select statement.  This is
+// mostly useful for code that needs to describe a plan's results
+// without executing it, e.g. exporters and documentation generators.
+func (plan *QueryPlan) SelectedColumns() []SelectedColumn {
+	var selected []SelectedColumn
+	aliases := make(map[string]bool, len(plan.colMap))
+	for _, m := range plan.colMap {
+		if !m.doSelect {
+			continue
+		}
+		col := SelectedColumn{
+			Table:     m.tableName,
+			Column:    m.column,
+			Field:     m.field,
+			FieldName: fieldName(m),
+		}
+		if m.alias != "" {
+			col.Alias = uniqueAlias(aliases, m)
+		}
+		selected = append(selected, col)
+	}
+	return selected
+}
+
+// fieldName returns the name of the struct field that m maps, or an
+// empty string if it can't be found (e.g. for sub-query columns).
+func fieldName(m *fieldColumnMap) string {
+	t := reflect.TypeOf(m.parent)
+	name := ""
+	for _, i := range m.column.FieldIndex() {
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t == nil || t.Kind() != reflect.Struct || i >= t.NumField() {
+			return ""
+		}
+		field := t.Field(i)
+		name, t = field.Name, field.Type
+	}
+	return name
+}
@@ -0,0 +1,129 @@
+package plans
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// A CommentFormat controls how plans format the SQL comments that
+// they append to their statements.  See Options.CommentTags.
+type CommentFormat int
+
+const (
+	// PlainComments formats comments as /* name=value, name=value */,
+	// with tags in the order that they were configured.
+	PlainComments CommentFormat = iota
+
+	// SQLCommenter formats comments following the sqlcommenter
+	// specification, as /*name='value',name='value'*/, with names and
+	// values url-encoded and tags sorted by name.
+	SQLCommenter
+)
+
+// A CommentTag names a value that will be read from a plan's context
+// (using ContextKey) and included in the SQL comment appended to each
+// of its statements.
+type CommentTag struct {
+	Name       string
+	ContextKey interface{}
+}
+
+// commentTag is a CommentTag with its value read from the plan's
+// context.
+type commentTag struct {
+	name, value string
+}
+
+// sanitizeComment removes anything from value which could end a
+// comment early or split it across lines.
+func sanitizeComment(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '*' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// Comment adds text to an SQL comment appended to each statement that
+// the plan executes, e.g. to tag statements with the feature that
+// executes them:
+//
+//     q := dbMap.Query(ref).(*plans.QueryPlan).Comment("feature: invoice search")
+//
+// Anything in text which could end the comment early (or split it
+// across lines) is removed.  Comments added by more than one call are
+// separated by commas, and come before the comment for the plan's
+// comment tags (see Options.CommentTags).
+func (plan *QueryPlan) Comment(text string) *QueryPlan {
+	if text = strings.TrimSpace(sanitizeComment(text)); text != "" {
+		plan.comments = append(plan.comments, text)
+	}
+	return plan
+}
+
+// sqlComment returns the comments that should be appended to the
+// plan's statements (see Comment and Options.CommentTags), including a
+// leading space, or an empty string if it has none.
+func (plan *QueryPlan) sqlComment() string {
+	if len(plan.comments) == 0 {
+		return plan.tagComment()
+	}
+	return " /* " + strings.Join(plan.comments, ", ") + " */" + plan.tagComment()
+}
+
+// tagComment returns the comment for the plan's comment tags,
+// including a leading space, or an empty string if none of them have
+// values in its context.
+func (plan *QueryPlan) tagComment() string {
+	if len(plan.commentTags) == 0 || plan.ctx == nil {
+		return ""
+	}
+	tags := make([]commentTag, 0, len(plan.commentTags))
+	for _, tag := range plan.commentTags {
+		value := plan.ctx.Value(tag.ContextKey)
+		if value == nil {
+			continue
+		}
+		if str := fmt.Sprint(value); str != "" {
+			tags = append(tags, commentTag{name: tag.Name, value: str})
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	buffer := new(bytes.Buffer)
+	switch plan.commentFormat {
+	case SQLCommenter:
+		sort.Slice(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+		buffer.WriteString(" /*")
+		for i, tag := range tags {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			// url.QueryEscape encodes both '*' and quotes, so the
+			// comment can't be ended early.
+			buffer.WriteString(url.QueryEscape(tag.name))
+			buffer.WriteString("='")
+			buffer.WriteString(url.QueryEscape(tag.value))
+			buffer.WriteString("'")
+		}
+		buffer.WriteString("*/")
+	default:
+		buffer.WriteString(" /* ")
+		for i, tag := range tags {
+			if i > 0 {
+				buffer.WriteString(", ")
+			}
+			buffer.WriteString(sanitizeComment(tag.name))
+			buffer.WriteString("=")
+			buffer.WriteString(sanitizeComment(tag.value))
+		}
+		buffer.WriteString(" */")
+	}
+	return buffer.String()
+}
@@ -0,0 +1,211 @@
+package plans
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A compound is a query combined with a plan's select statement using
+// a set operation.
+type compound struct {
+	op    string
+	query subQuery
+}
+
+// Union combines the plan's select statement with other's using
+// UNION, e.g.
+//
+//     overdue := dbMap.Query(ref).Where().Less(&ref.Due, time.Now())
+//     flagged := dbMap.Query(other).Where().True(&other.Flagged)
+//     results, err := overdue.(*plans.QueryPlan).
+//         Union(flagged).
+//         OrderBy(&ref.Due, "desc").
+//         Limit(20).
+//         Select()
+//
+// other must select the same columns (by name, in the same order) as
+// the plan, and results are scanned into the plan's target.  Ordering,
+// limits, and offsets set on the plan apply to the combined statement,
+// so the plan may only be ordered by its selected fields; other can't
+// be ordered or limited, and can't have common tables (see With).
+// Combined statements can't be locked using ForUpdate.  Count counts
+// the rows of the combined statement.
+func (plan *QueryPlan) Union(other interface{}) *QueryPlan {
+	return plan.compound("union", other)
+}
+
+// UnionAll is Union, except that duplicate rows are kept.
+func (plan *QueryPlan) UnionAll(other interface{}) *QueryPlan {
+	return plan.compound("union all", other)
+}
+
+// Intersect is Union, except that only rows that both statements
+// select are kept.
+func (plan *QueryPlan) Intersect(other interface{}) *QueryPlan {
+	return plan.compound("intersect", other)
+}
+
+// Except is Union, except that only rows of the plan's statement that
+// other doesn't select are kept.
+func (plan *QueryPlan) Except(other interface{}) *QueryPlan {
+	return plan.compound("except", other)
+}
+
+func (plan *QueryPlan) compound(op string, other interface{}) *QueryPlan {
+	q, ok := other.(subQuery)
+	if !ok {
+		plan.Errors = append(plan.Errors, fmt.Errorf("gorq: Cannot %s a query plan with %T", op, other))
+		return plan
+	}
+	plan.compounds = append(plan.compounds, compound{op: op, query: q})
+	return plan
+}
+
+// selectedAliases returns the names of the columns that the plan's
+// select statement selects, in order.
+func (plan *QueryPlan) selectedAliases() []string {
+	aliases := make(map[string]bool, len(plan.colMap))
+	var selected []string
+	for _, m := range plan.colMap {
+		if !m.doSelect {
+			continue
+		}
+		if m.alias == "" {
+			selected = append(selected, m.column.ColumnName)
+			continue
+		}
+		selected = append(selected, uniqueAlias(aliases, m))
+	}
+	return selected
+}
+
+// compoundSelect generates the plan's select statement for use in a
+// compound statement that already has argOffset arguments.  Its
+// ordering and limits would apply to the whole compound statement (or
+// be a syntax error), so they aren't allowed.  Neither are WITH
+// clauses and locking clauses, which can't appear in the middle of a
+// compound statement.
+func (plan *QueryPlan) compoundSelect(argOffset int) (string, []interface{}, error) {
+	if len(plan.orderBy) > 0 || plan.limit > 0 || plan.offset > 0 {
+		return "", nil, errors.New("gorq: Queries combined with another query can't be ordered or limited; order or limit the combined query instead")
+	}
+	if len(plan.commonTables) > 0 {
+		return "", nil, errors.New("gorq: Queries combined with another query can't have common tables; add them to the combined query instead")
+	}
+	if plan.forUpdate {
+		return "", nil, errors.New("gorq: Queries combined with another query can't be locked for update")
+	}
+	plan.argOffset, plan.nested = argOffset, true
+	defer func() { plan.argOffset, plan.nested = 0, false }()
+	plan.resetArgs()
+	if err := plan.checkPolicies(SelectOperation); err != nil {
+		return "", nil, err
+	}
+	buffer := plan.getBuffer()
+	defer bufPool.Put(buffer)
+	if err := plan.writeSelectColumns(buffer); err != nil {
+		return "", nil, err
+	}
+	if err := plan.writeSelectBody(buffer); err != nil {
+		return "", nil, err
+	}
+	if err := plan.writeCompounds(buffer); err != nil {
+		return "", nil, err
+	}
+	return buffer.String(), plan.getArgs()[argOffset:], nil
+}
+
+// writeCompounds writes the queries combined with the plan's select
+// statement to buffer, binding their arguments.
+func (plan *QueryPlan) writeCompounds(buffer *bytes.Buffer) error {
+	if len(plan.compounds) == 0 {
+		return nil
+	}
+	if plan.forUpdate {
+		return errors.New("gorq: Combined queries can't be locked for update")
+	}
+	aliases := plan.selectedAliases()
+	for _, c := range plan.compounds {
+		if errs := c.query.errors(); len(errs) > 0 {
+			return errs[0]
+		}
+		if other := c.query.selectedAliases(); !sameColumns(aliases, other) {
+			return fmt.Errorf("gorq: Cannot %s queries selecting different columns: %v and %v", c.op, aliases, other)
+		}
+		query, args, err := c.query.compoundSelect(plan.argCount())
+		if err != nil {
+			return err
+		}
+		plan.appendArgs(args...)
+		buffer.WriteString(" ")
+		buffer.WriteString(c.op)
+		buffer.WriteString(" ")
+		buffer.WriteString(query)
+	}
+	return nil
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// compoundOrderBy returns the order by expression for o in a compound
+// statement, where only the selected columns can be referenced, using
+// their aliases.
+func (plan *QueryPlan) compoundOrderBy(o order) (string, error) {
+	if o.fieldOrWrapper == nil || reflect.TypeOf(o.fieldOrWrapper).Kind() != reflect.Ptr {
+		return "", errors.New("gorq: Combined queries can only be ordered by selected fields")
+	}
+	aliases := make(map[string]bool, len(plan.colMap))
+	for _, m := range plan.colMap {
+		if !m.doSelect {
+			continue
+		}
+		alias := m.column.ColumnName
+		if m.alias != "" {
+			alias = uniqueAlias(aliases, m)
+		}
+		if m.field != o.fieldOrWrapper {
+			continue
+		}
+		orderStr := plan.quoteField(alias)
+		switch direction := strings.ToLower(o.direction); direction {
+		case "asc", "desc":
+			orderStr += " " + direction
+		case "":
+		default:
+			return "", errors.New(`gorp: Order by direction must be empty string, "asc", or "desc"`)
+		}
+		return orderStr, nil
+	}
+	return "", errors.New("gorq: Combined queries can only be ordered by selected fields")
+}
+
+// writeCompoundCount writes a statement counting the rows of the
+// plan's compound statement to buffer.
+func (plan *QueryPlan) writeCompoundCount(buffer *bytes.Buffer) error {
+	buffer.WriteString("select count(*) from (")
+	if err := plan.writeSelectColumns(buffer); err != nil {
+		return err
+	}
+	if err := plan.writeSelectBody(buffer); err != nil {
+		return err
+	}
+	if err := plan.writeCompounds(buffer); err != nil {
+		return err
+	}
+	buffer.WriteString(") as ")
+	buffer.WriteString(plan.quoteField("compound"))
+	return nil
+}
@@ -0,0 +1,52 @@
+package plans
+
+import (
+	"regexp"
+
+	"github.com/outdoorsy/gorp"
+)
+
+// computedPlaceholder matches the column placeholders in computed
+// column expressions, e.g. {first_name}.
+var computedPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// computedColumn is the SQL for a computed column (see
+// Options.ComputedColumns), with its placeholders replaced by the
+// columns of the table that it was mapped for.  index is the SQL that
+// should be used in filters instead, if the column has an index
+// expression (see Options.IndexExpressions).
+type computedColumn struct {
+	expr  string
+	index string
+}
+
+// sql returns the SQL that should be used for c, depending on whether
+// or not it is being used in a filter.
+func (c computedColumn) sql(filtering bool) string {
+	if filtering && c.index != "" {
+		return c.index
+	}
+	return c.expr
+}
+
+// qualify replaces the placeholders in expr with the columns of the
+// table (or alias) quotedTable.
+func (plan *QueryPlan) qualify(expr, quotedTable string) string {
+	return computedPlaceholder.ReplaceAllStringFunc(expr, func(placeholder string) string {
+		return quotedTable + "." + plan.quoteField(placeholder[1:len(placeholder)-1])
+	})
+}
+
+// computedExpr returns the SQL for col if it is a computed column,
+// referencing columns of the table (or alias) quotedTable.
+func (plan *QueryPlan) computedExpr(col *gorp.ColumnMap, quotedTable string) (computedColumn, bool) {
+	expr, ok := plan.computedCols[col]
+	if !ok {
+		return computedColumn{}, false
+	}
+	computed := computedColumn{expr: "(" + plan.qualify(expr, quotedTable) + ")"}
+	if index, ok := plan.indexExprs[col]; ok {
+		computed.index = "(" + plan.qualify(index, quotedTable) + ")"
+	}
+	return computed, true
+}
@@ -0,0 +1,110 @@
+package plans
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A ConflictKind is a kind of conflict between concurrent
+// transactions that can cause a statement to fail.
+type ConflictKind int
+
+const (
+	// Deadlock means that the statement's transaction was chosen as
+	// the victim of a deadlock and rolled back.
+	Deadlock ConflictKind = iota + 1
+
+	// SerializationFailure means that the statement's transaction
+	// could not be serialized with concurrent transactions (e.g. in
+	// postgresql's REPEATABLE READ and SERIALIZABLE isolation levels).
+	SerializationFailure
+
+	// LockTimeout means that the statement gave up waiting for a
+	// lock: lock_timeout in postgresql, innodb_lock_wait_timeout in
+	// mysql, or a busy database in sqlite.
+	LockTimeout
+)
+
+func (kind ConflictKind) String() string {
+	switch kind {
+	case Deadlock:
+		return "deadlock"
+	case SerializationFailure:
+		return "serialization failure"
+	case LockTimeout:
+		return "lock timeout"
+	}
+	return "unknown conflict"
+}
+
+// A ConflictError is returned (in place of the driver's error) when a
+// statement executed by a plan fails because of a conflict with a
+// concurrent transaction.  These failures are transient, so the
+// transaction can usually be retried from the start; see IsRetryable.
+// A ConflictError matches the Err* conflict error of its kind using
+// errors.Is, and the driver's error is still available using
+// errors.As.
+type ConflictError struct {
+	Kind ConflictKind
+
+	// Err is the error returned by the driver.
+	Err error
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("gorq: %s: %v", err.Kind, err.Err)
+}
+
+func (err *ConflictError) Unwrap() error {
+	return err.Err
+}
+
+// Is returns whether or not target is the Err* conflict error for
+// err's kind.
+func (err *ConflictError) Is(target error) bool {
+	switch target {
+	case ErrDeadlock:
+		return err.Kind == Deadlock
+	case ErrSerializationFailure:
+		return err.Kind == SerializationFailure
+	case ErrLockTimeout:
+		return err.Kind == LockTimeout
+	}
+	return false
+}
+
+var (
+	ErrDeadlock             = errors.New("gorq: deadlock detected")
+	ErrSerializationFailure = errors.New("gorq: could not serialize access due to concurrent update")
+	ErrLockTimeout          = errors.New("gorq: timed out waiting for a lock")
+)
+
+var (
+	// postgresql SQLSTATE codes for conflicts.
+	sqlStateConflicts = map[string]ConflictKind{
+		"40P01": Deadlock,
+		"40001": SerializationFailure,
+		"55P03": LockTimeout,
+	}
+
+	// mysql error numbers for conflicts.
+	mysqlConflicts = map[int64]ConflictKind{
+		1213: Deadlock,
+		1205: LockTimeout,
+	}
+
+	// sqlite primary result codes for conflicts.
+	sqliteConflicts = map[int64]ConflictKind{
+		5: LockTimeout, // SQLITE_BUSY
+		6: LockTimeout, // SQLITE_LOCKED
+	}
+)
+
+// IsRetryable returns whether or not err (or an error that it wraps)
+// is a *ConflictError, meaning that the transaction that returned it
+// failed because of concurrent transactions and may succeed if it is
+// retried from the start.
+func IsRetryable(err error) bool {
+	var conflict *ConflictError
+	return errors.As(err, &conflict)
+}
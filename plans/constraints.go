@@ -0,0 +1,235 @@
+package plans
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// A ConstraintKind is a kind of constraint that a statement can
+// violate.
+type ConstraintKind int
+
+const (
+	UniqueConstraint ConstraintKind = iota + 1
+	ForeignKeyConstraint
+	CheckConstraint
+)
+
+func (kind ConstraintKind) String() string {
+	switch kind {
+	case UniqueConstraint:
+		return "unique"
+	case ForeignKeyConstraint:
+		return "foreign key"
+	case CheckConstraint:
+		return "check"
+	}
+	return "unknown"
+}
+
+// A ConstraintError is returned (in place of the driver's error) when
+// a statement executed by a plan violates a constraint.  It matches
+// the Err* constraint errors of its kind using errors.Is, e.g.
+//
+//     if errors.Is(err, plans.ErrUniqueViolation) {
+//         return ErrEmailTaken
+//     }
+//
+// and the driver's error is still available using errors.As.
+type ConstraintError struct {
+	Kind ConstraintKind
+
+	// Constraint is the name of the violated constraint, if the
+	// database reports it.  Sqlite reports the constrained columns
+	// (e.g. "users.email") for unique constraints instead, and
+	// nothing for foreign keys.
+	Constraint string
+
+	// Err is the error returned by the driver.
+	Err error
+}
+
+func (err *ConstraintError) Error() string {
+	if err.Constraint == "" {
+		return fmt.Sprintf("gorq: %s constraint violated: %v", err.Kind, err.Err)
+	}
+	return fmt.Sprintf("gorq: %s constraint %q violated: %v", err.Kind, err.Constraint, err.Err)
+}
+
+func (err *ConstraintError) Unwrap() error {
+	return err.Err
+}
+
+// Is returns whether or not target is the Err* constraint error for
+// err's kind.
+func (err *ConstraintError) Is(target error) bool {
+	switch target {
+	case ErrUniqueViolation:
+		return err.Kind == UniqueConstraint
+	case ErrForeignKeyViolation:
+		return err.Kind == ForeignKeyConstraint
+	case ErrCheckViolation:
+		return err.Kind == CheckConstraint
+	}
+	return false
+}
+
+var (
+	ErrUniqueViolation     = errors.New("gorq: unique constraint violated")
+	ErrForeignKeyViolation = errors.New("gorq: foreign key constraint violated")
+	ErrCheckViolation      = errors.New("gorq: check constraint violated")
+)
+
+var (
+	// postgresql SQLSTATE codes for constraint violations.
+	sqlStateConstraints = map[string]ConstraintKind{
+		"23505": UniqueConstraint,
+		"23503": ForeignKeyConstraint,
+		"23514": CheckConstraint,
+	}
+
+	// mysql error numbers for constraint violations.
+	mysqlConstraints = map[int64]ConstraintKind{
+		1062: UniqueConstraint,
+		1586: UniqueConstraint,
+		1216: ForeignKeyConstraint,
+		1217: ForeignKeyConstraint,
+		1451: ForeignKeyConstraint,
+		1452: ForeignKeyConstraint,
+		3819: CheckConstraint,
+	}
+
+	// sqlite extended result codes for constraint violations.
+	sqliteConstraints = map[int64]ConstraintKind{
+		1555: UniqueConstraint, // SQLITE_CONSTRAINT_PRIMARYKEY
+		2067: UniqueConstraint, // SQLITE_CONSTRAINT_UNIQUE
+		787:  ForeignKeyConstraint,
+		275:  CheckConstraint,
+	}
+
+	// constraintNames extract constraint names from mysql and sqlite
+	// error messages, which don't report them separately.
+	constraintNames = []*regexp.Regexp{
+		regexp.MustCompile("for key '([^']+)'"),
+		regexp.MustCompile("CONSTRAINT `([^`]+)`"),
+		regexp.MustCompile("[Cc]heck constraint '([^']+)'"),
+		regexp.MustCompile("constraint failed: (.+)$"),
+	}
+)
+
+// classifyError returns a *ConstraintError or *ConflictError
+// wrapping err if err is a driver error for a constraint violation or
+// a conflict with another transaction, or err otherwise.  Drivers are
+// recognized by the fields and methods of their error types, so that
+// none of them have to be imported: lib/pq and pgx (SQLSTATE codes),
+// go-sql-driver/mysql and mymysql (error numbers), and
+// mattn/go-sqlite3 (result codes).
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if classified := classifyDriverError(e, err); classified != nil {
+			return classified
+		}
+	}
+	return err
+}
+
+// classifyDriverError classifies e, which is err or an error that err
+// wraps, returning nil if it isn't a driver error that gorq knows.
+func classifyDriverError(e, err error) error {
+	if extended, ok := errorField(e, "ExtendedCode"); ok && isInt(extended) {
+		if kind, ok := sqliteConstraints[intValue(extended)]; ok {
+			return &ConstraintError{Kind: kind, Constraint: constraintName(e.Error()), Err: err}
+		}
+		if code, ok := errorField(e, "Code"); ok && isInt(code) {
+			if kind, ok := sqliteConflicts[intValue(code)]; ok {
+				return &ConflictError{Kind: kind, Err: err}
+			}
+		}
+		return nil
+	}
+	if state := sqlState(e); state != "" {
+		if kind, ok := sqlStateConstraints[state]; ok {
+			classified := &ConstraintError{Kind: kind, Err: err}
+			if constraint, ok := errorField(e, "Constraint", "ConstraintName"); ok && constraint.Kind() == reflect.String {
+				classified.Constraint = constraint.String()
+			}
+			return classified
+		}
+		if kind, ok := sqlStateConflicts[state]; ok {
+			return &ConflictError{Kind: kind, Err: err}
+		}
+		return nil
+	}
+	if number, ok := errorField(e, "Number", "Code"); ok && isInt(number) {
+		if kind, ok := mysqlConstraints[intValue(number)]; ok {
+			return &ConstraintError{Kind: kind, Constraint: constraintName(e.Error()), Err: err}
+		}
+		if kind, ok := mysqlConflicts[intValue(number)]; ok {
+			return &ConflictError{Kind: kind, Err: err}
+		}
+	}
+	return nil
+}
+
+// sqlState returns the SQLSTATE code of err, if it has one.
+func sqlState(err error) string {
+	if stater, ok := err.(interface{ SQLState() string }); ok {
+		return stater.SQLState()
+	}
+	if code, ok := errorField(err, "Code"); ok && code.Kind() == reflect.String {
+		return code.String()
+	}
+	return ""
+}
+
+// errorField returns the first of the named fields that err (or the
+// struct that it points to) has.
+func errorField(err error, names ...string) (reflect.Value, bool) {
+	v := reflect.ValueOf(err)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	for _, name := range names {
+		if field := v.FieldByName(name); field.IsValid() {
+			return field, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func intValue(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	}
+	return v.Int()
+}
+
+// constraintName returns the name of the violated constraint from an
+// error message, or an empty string if it can't find one.
+func constraintName(message string) string {
+	for _, pattern := range constraintNames {
+		if match := pattern.FindStringSubmatch(message); match != nil {
+			return strings.TrimSpace(match[1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package plans
+
+import "context"
+
+// withContext makes the plan execute statements with ctx until the
+// returned function is called: its executor is bound to ctx, so that
+// statements in flight are canceled along with it, and ctx replaces
+// the plan's context for everything else that reads it (budgets,
+// policies, comments, and so on).
+func (plan *QueryPlan) withContext(ctx context.Context) (restore func()) {
+	prevCtx, prevExecutor := plan.ctx, plan.executor
+	plan.ctx = ctx
+	plan.executor = plan.executor.WithContext(ctx)
+	return func() {
+		plan.ctx, plan.executor = prevCtx, prevExecutor
+	}
+}
+
+// SelectContext is Select, executed with ctx.  Canceling ctx (or
+// reaching its deadline) aborts the statement.
+func (plan *QueryPlan) SelectContext(ctx context.Context) ([]interface{}, error) {
+	defer plan.withContext(ctx)()
+	return plan.Select()
+}
+
+// CountContext is Count, executed with ctx.  See SelectContext.
+func (plan *QueryPlan) CountContext(ctx context.Context) (int64, error) {
+	defer plan.withContext(ctx)()
+	return plan.Count()
+}
+
+// InsertContext is Insert, executed with ctx.  See SelectContext.
+func (plan *QueryPlan) InsertContext(ctx context.Context) error {
+	defer plan.withContext(ctx)()
+	return plan.Insert()
+}
+
+// UpdateContext is Update, executed with ctx.  See SelectContext.
+func (plan *QueryPlan) UpdateContext(ctx context.Context) (int64, error) {
+	defer plan.withContext(ctx)()
+	return plan.Update()
+}
+
+// DeleteContext is Delete, executed with ctx.  See SelectContext.
+func (plan *QueryPlan) DeleteContext(ctx context.Context) (int64, error) {
+	defer plan.withContext(ctx)()
+	return plan.Delete()
+}
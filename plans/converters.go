@@ -0,0 +1,44 @@
+package plans
+
+import (
+	"database/sql/driver"
+	"reflect"
+)
+
+var converters = map[reflect.Type]func(interface{}) (interface{}, error){}
+
+// RegisterConverter registers fn to convert values of type T to
+// driver values whenever they are bound as arguments, e.g. by filters
+// and Assign, so that custom scalar types (money, enums, typed IDs)
+// can be passed to queries without implementing driver.Valuer or
+// being wrapped at each call site.  Example:
+//
+//     plans.RegisterConverter(func(c Cents) (driver.Value, error) {
+//         return int64(c), nil
+//     })
+//     q.Where().Greater(&ref.Total, Cents(500))
+//
+// Converters match T exactly; values of other types (including
+// pointers to T) are not converted.  Registered converters take
+// precedence over the DbMap's TypeConverter.  As with
+// RegisterExtension, converters should be registered during
+// initialization, before any queries are created.
+func RegisterConverter[T any](fn func(T) (driver.Value, error)) {
+	converters[reflect.TypeOf((*T)(nil)).Elem()] = func(value interface{}) (interface{}, error) {
+		return fn(value.(T))
+	}
+}
+
+// convert converts value using the converter registered for its
+// type, returning false if there is none.
+func convert(value interface{}) (interface{}, bool, error) {
+	if len(converters) == 0 || value == nil {
+		return value, false, nil
+	}
+	fn, ok := converters[reflect.TypeOf(value)]
+	if !ok {
+		return value, false, nil
+	}
+	converted, err := fn(value)
+	return converted, true, err
+}
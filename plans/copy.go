@@ -0,0 +1,150 @@
+package plans
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+
+	"github.com/outdoorsy/gorp"
+)
+
+// statementPreparer is implemented by executors (e.g. *gorp.DbMap and
+// *gorp.Transaction) that can create prepared statements.
+type statementPreparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// A CopySource holds rows that are being loaded into a plan's table
+// using a protocol other than INSERT statements, such as postgresql's
+// COPY.  Extensions that implement such protocols create one using
+// QueryPlan.CopySource.
+type CopySource struct {
+	// Table is the quoted name of the plan's table.
+	Table string
+
+	// Columns are the quoted names of the columns being loaded, in
+	// the same order as the values passed to Each.
+	Columns []string
+
+	plan *QueryPlan
+	rows []reflect.Value
+	cols []bulkColumn
+}
+
+// CopySource checks that rows (a slice of the plan's reference struct
+// type, or pointers to it) can be loaded into the plan's table, and
+// returns a CopySource for them.  As with InsertAll, auto-increment
+// keys are left for the database to generate.
+func (plan *QueryPlan) CopySource(rows interface{}) (*CopySource, error) {
+	if err := plan.checkWritable(); err != nil {
+		return nil, err
+	}
+	plan.resetArgs()
+	if len(plan.Errors) > 0 {
+		return nil, plan.Errors[0]
+	}
+	if len(plan.assignCols) > 0 {
+		return nil, errors.New("gorq: Bulk inserts cannot be combined with assignments")
+	}
+	values, err := plan.bulkRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.checkPolicies(InsertOperation); err != nil {
+		return nil, err
+	}
+	cols := plan.insertColumns(nil)
+	quoted := make([]string, 0, len(cols))
+	for _, col := range cols {
+		quoted = append(quoted, col.quoted)
+	}
+	return &CopySource{
+		Table:   plan.quoteTable(plan.table.SchemaName, plan.table.TableName),
+		Columns: quoted,
+		plan:    plan,
+		rows:    values,
+		cols:    cols,
+	}, nil
+}
+
+// Len returns the number of rows in src.
+func (src *CopySource) Len() int {
+	return len(src.rows)
+}
+
+// Each calls fn with the values of each row in src, converted using
+// the DbMap's TypeConverter.  The values slice is reused between
+// rows, so fn must copy anything that it needs to hold on to.  If fn
+// returns an error, iteration stops and the error is returned.
+func (src *CopySource) Each(fn func(values []interface{}) error) error {
+	values := make([]interface{}, len(src.cols))
+	for _, row := range src.rows {
+		for i, col := range src.cols {
+			value, err := src.plan.toDb(fieldOrNilByIndex(row, col.index).Interface())
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exec checks and logs query, prepares it using the plan's executor,
+// and calls fn with the prepared statement, which fn should use to
+// load every row in src.  The statement is always prepared within a
+// transaction: if the plan wasn't created from one, a transaction is
+// started for the call and committed when fn returns without an
+// error.  The plan's change hooks are then notified of the inserted
+// rows.
+func (src *CopySource) Exec(query string, fn func(stmt *sql.Stmt) error) error {
+	if err := src.exec(query, fn); err != nil {
+		return err
+	}
+	src.plan.notify(Change{Operation: InsertOperation, RowsAffected: int64(len(src.rows))})
+	return nil
+}
+
+// exec prepares query for Exec and calls fn with it.
+func (src *CopySource) exec(query string, fn func(stmt *sql.Stmt) error) (err error) {
+	plan := src.plan
+	if query, _, err = plan.prepare(query, nil); err != nil {
+		return err
+	}
+	done, err := plan.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	exec := plan.executor
+	if dbMap, ok := exec.(*gorp.DbMap); ok {
+		var tx *gorp.Transaction
+		if tx, err = dbMap.Begin(); err != nil {
+			return classifyError(err)
+		}
+		exec = tx
+		defer func() {
+			if err != nil {
+				tx.Rollback()
+				return
+			}
+			err = classifyError(tx.Commit())
+		}()
+	}
+	preparer, ok := exec.(statementPreparer)
+	if !ok {
+		return errors.New("gorq: The plan's executor does not support prepared statements")
+	}
+	stmt, err := preparer.Prepare(query)
+	if err != nil {
+		return classifyError(err)
+	}
+	if err := fn(stmt); err != nil {
+		stmt.Close()
+		return classifyError(err)
+	}
+	return classifyError(stmt.Close())
+}
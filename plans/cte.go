@@ -0,0 +1,218 @@
+package plans
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// A commonTable is a sub-query in a plan's WITH clause.
+type commonTable struct {
+	name  string
+	query subQuery
+
+	// step is the recursive part of a recursive common table (see
+	// WithRecursive), which is combined with query using UNION ALL.
+	step subQuery
+
+	// outer is set for common tables that the plan refers to, but
+	// which are defined by the statement that the plan is part of,
+	// i.e. the table that the step of a recursive common table
+	// refers to.
+	outer bool
+}
+
+// With adds sub (a query plan) to the WITH clause of the plan's select
+// statements, as a common table expression named name.  Wherever the
+// plan selects from or joins sub, it refers to it by name instead of
+// inlining it, e.g.
+//
+//     sub := new(Invoice)
+//     paid := dbMap.Query(sub).Where().True(&sub.IsPaid)
+//     ref := new(Person)
+//     q := dbMap.Query(ref).(*plans.QueryPlan).With("paid_invoices", paid)
+//     q.Join(paid).On(filters.Equal(&sub.PersonId, &ref.Id))
+//     // with "paid_invoices" as (select ...) select ... from "person"
+//     //     inner join "paid_invoices" as "invoice" on ...
+//
+// With must be called before sub is joined, since joins are mapped
+// immediately; a plan created with sub as its target may call With at
+// any time.  Select (including Count and the aggregate and bucket
+// methods), update, and delete statements have a WITH clause; MySQL
+// only supports WITH clauses from version 8.
+func (plan *QueryPlan) With(name string, sub interface{}) *QueryPlan {
+	q, ok := sub.(subQuery)
+	if !ok {
+		plan.Errors = append(plan.Errors, fmt.Errorf("gorq: With requires a query plan, not %T", sub))
+		return plan
+	}
+	plan.addCommonTable(commonTable{name: name, query: q})
+	return plan
+}
+
+// WithRecursive adds a recursive common table expression named name
+// to the WITH clause of the plan's statements, in the same way as
+// With.  Its rows are the rows of anchor, followed (using UNION ALL)
+// by the rows of step, which is repeated against the rows that it
+// last found until it finds no more.  Both must be query plans
+// selecting the same columns.  step refers to the rows found so far by
+// calling With(name, anchor) and then joining anchor, e.g. to select a
+// category and all of its descendants:
+//
+//     node := new(Category)
+//     anchor := dbMap.Query(node).Where().Equal(&node.Id, rootId)
+//     child := new(Category)
+//     step := dbMap.Query(child).(*plans.QueryPlan).With("tree", anchor)
+//     step.Join(anchor).On(filters.Equal(&child.ParentId, &node.Id))
+//     q := dbMap.Query(anchor).(*plans.QueryPlan).WithRecursive("tree", anchor, step)
+//     // with recursive "tree" as (select ... where "category"."id" = $1
+//     //     union all select ... inner join "tree" as "category_2" on ...)
+//     //     select ... from "tree" as "category"
+func (plan *QueryPlan) WithRecursive(name string, anchor, step interface{}) *QueryPlan {
+	q, ok := anchor.(subQuery)
+	if !ok {
+		plan.Errors = append(plan.Errors, fmt.Errorf("gorq: WithRecursive requires a query plan, not %T", anchor))
+		return plan
+	}
+	stepPlan, ok := step.(*QueryPlan)
+	if !ok {
+		plan.Errors = append(plan.Errors, fmt.Errorf("gorq: WithRecursive requires a query plan, not %T", step))
+		return plan
+	}
+	found := false
+	for i, table := range stepPlan.commonTables {
+		if table.name == name && table.query == q {
+			stepPlan.commonTables[i].outer = true
+			found = true
+		}
+	}
+	if !found {
+		plan.Errors = append(plan.Errors, fmt.Errorf("gorq: The step of recursive common table %s must refer to it using With", name))
+		return plan
+	}
+	plan.addCommonTable(commonTable{name: name, query: q, step: stepPlan})
+	return plan
+}
+
+// addCommonTable adds table to the plan's WITH clause, selecting from
+// it by name if the plan selects from its query.
+func (plan *QueryPlan) addCommonTable(table commonTable) {
+	plan.commonTables = append(plan.commonTables, table)
+	if plan.target.IsValid() && plan.target.Interface() == table.query {
+		plan.quotedTable = plan.commonTableClause(table.name, table.query.QuotedTable())
+	}
+}
+
+// commonTable returns the name of the common table for q, if q is in
+// the plan's WITH clause.
+func (plan *QueryPlan) commonTable(q subQuery) (string, bool) {
+	for _, table := range plan.commonTables {
+		if table.query == q {
+			return table.name, true
+		}
+	}
+	return "", false
+}
+
+// commonTableClause returns the from (or join) clause that refers to
+// the common table name using quotedAlias.
+func (plan *QueryPlan) commonTableClause(name, quotedAlias string) string {
+	quotedName := plan.quoteField(name)
+	if quotedName == quotedAlias {
+		return quotedName
+	}
+	return quotedName + " as " + quotedAlias
+}
+
+// writeWith writes the plan's WITH clause, if it has one, to buffer,
+// binding the arguments of its sub-queries.  It must be written before
+// anything else in the statement binds arguments.
+func (plan *QueryPlan) writeWith(buffer *bytes.Buffer) error {
+	written := 0
+	for _, table := range plan.commonTables {
+		if table.outer {
+			continue
+		}
+		if written == 0 {
+			buffer.WriteString("with ")
+			if plan.hasRecursiveTable() {
+				buffer.WriteString("recursive ")
+			}
+		} else {
+			buffer.WriteString(", ")
+		}
+		written++
+		buffer.WriteString(plan.quoteField(table.name))
+		buffer.WriteString(" as (")
+		if err := plan.writeCommonTableQuery(buffer, table.query); err != nil {
+			return err
+		}
+		if table.step != nil {
+			buffer.WriteString(" union all ")
+			if err := plan.writeCommonTableQuery(buffer, table.step); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString(")")
+	}
+	if written > 0 {
+		buffer.WriteString(" ")
+	}
+	return nil
+}
+
+// hasRecursiveTable returns whether or not any of the plan's common
+// tables are recursive.
+func (plan *QueryPlan) hasRecursiveTable() bool {
+	for _, table := range plan.commonTables {
+		if table.step != nil && !table.outer {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCommonTableQuery writes the select statement for q, a query in
+// the plan's WITH clause, to buffer, binding its arguments.
+func (plan *QueryPlan) writeCommonTableQuery(buffer *bytes.Buffer, q subQuery) error {
+	if errs := q.errors(); len(errs) > 0 {
+		return errs[0]
+	}
+	query, args, err := q.subSelectQuery(plan.argCount())
+	if err != nil {
+		return err
+	}
+	plan.appendArgs(args...)
+	buffer.WriteString(query)
+	return nil
+}
+
+// writeMutationWith writes the plan's WITH clause for an update or
+// delete statement.  The arguments of an update's assignments are
+// bound before anything else, so for dialects with positional bind
+// variables (which are not numbered), the WITH clause's arguments are
+// moved in front of them to match the order of the statement.
+func (plan *QueryPlan) writeMutationWith(buffer *bytes.Buffer) error {
+	start := plan.argCount()
+	if err := plan.writeWith(buffer); err != nil {
+		return err
+	}
+	if start == 0 || plan.dialect.BindVar(0) != plan.dialect.BindVar(1) {
+		return nil
+	}
+	plan.argLock.Lock()
+	defer plan.argLock.Unlock()
+	withArgs := append([]interface{}(nil), plan.args[start:]...)
+	if len(withArgs) == 0 {
+		return nil
+	}
+	copy(plan.args[len(withArgs):], plan.args[:start])
+	copy(plan.args, withArgs)
+	if len(plan.sensitiveArgs) > 0 {
+		moved := make(map[int]bool, len(plan.sensitiveArgs))
+		for i := range plan.sensitiveArgs {
+			moved[i+len(withArgs)] = true
+		}
+		plan.sensitiveArgs = moved
+	}
+	return nil
+}
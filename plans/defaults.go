@@ -0,0 +1,64 @@
+package plans
+
+import "errors"
+
+// ErrNoWhere is returned by plans with Options.RequireWhere set
+// instead of executing an UPDATE or DELETE statement without a where
+// clause.
+var ErrNoWhere = errors.New("gorq: Refusing to update or delete every row of a table without a where clause")
+
+// ErrReadOnly is returned by read-only plans (see QueryPlan.ReadOnly)
+// instead of executing any statement other than SELECT.
+var ErrReadOnly = errors.New("gorq: Refusing to write using a read-only query")
+
+// statementLimit returns the limit that the plan's select statement
+// should use: its own limit, or its default limit (see
+// Options.DefaultLimit) if it doesn't have one, capped one row above
+// its maximum number of rows (see Limits.MaxRows) so that exceeding
+// the maximum can be detected.  Sub-queries only use their own limit,
+// since a default would change their results.
+func (plan *QueryPlan) statementLimit() int64 {
+	if plan.nested {
+		return plan.limit
+	}
+	limit := plan.limit
+	if limit <= 0 {
+		limit = plan.defaultLimit
+	}
+	if max := int64(plan.rowLimit()); max > 0 && (limit <= 0 || limit > max) {
+		limit = max + 1
+	}
+	return limit
+}
+
+// checkWhere returns ErrNoWhere if the plan requires a where clause
+// for UPDATE and DELETE statements and doesn't have one.  Filters
+// added by policies don't count, since they usually scope statements
+// (e.g. to a tenant) rather than select rows.
+func (plan *QueryPlan) checkWhere() error {
+	if !plan.requireWhere {
+		return nil
+	}
+	if where := plan.whereBranches(); where == nil || isEmpty(where) {
+		return ErrNoWhere
+	}
+	return nil
+}
+
+// ReadOnly marks the plan as read-only, so that Insert, Update,
+// Delete, Truncate, and the plan's other methods which write return
+// ErrReadOnly without executing anything.  Plans created with
+// Options.ReadOnly are read-only from the start, and can't be made
+// writable.
+func (plan *QueryPlan) ReadOnly() *QueryPlan {
+	plan.readOnly = true
+	return plan
+}
+
+// checkWritable returns ErrReadOnly if the plan is read-only.
+func (plan *QueryPlan) checkWritable() error {
+	if plan.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package plans
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// rowQuerier is implemented by executors (e.g. *gorp.DbMap and
+// *gorp.Transaction) that can return a cursor over a query's rows.
+type rowQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryRows checks, logs, and executes the plan's select statement,
+// returning the cursor over its rows.  The caller must close the
+// returned rows, and then call done.
+func (plan *QueryPlan) queryRows() (rows *sql.Rows, done func(), err error) {
+	if _, ok := plan.executor.(rowQuerier); !ok {
+		return nil, nil, errors.New("gorq: The plan's executor does not support streaming rows")
+	}
+	query, err := plan.selectQuery()
+	if err != nil {
+		return nil, nil, err
+	}
+	args := plan.getArgs()
+	if query, args, err = plan.prepare(query, args); err != nil {
+		return nil, nil, err
+	}
+	done, err = plan.begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The executor may have been switched by begin, e.g. to apply a
+	// timeout.
+	querier, ok := plan.executor.(rowQuerier)
+	if !ok {
+		done()
+		return nil, nil, errors.New("gorq: The plan's executor does not support streaming rows")
+	}
+	rows, err = querier.Query(query, args...)
+	if err != nil {
+		done()
+		return nil, nil, classifyError(err)
+	}
+	return rows, done, nil
+}
+
+// exportHeaders returns the names that should be used for the plan's
+// selected columns in exported data: the alias that the column is
+// selected as, or its column name if it has none.
+func (plan *QueryPlan) exportHeaders() []string {
+	columns := plan.SelectedColumns()
+	headers := make([]string, 0, len(columns))
+	for _, col := range columns {
+		if col.Alias != "" {
+			headers = append(headers, col.Alias)
+			continue
+		}
+		headers = append(headers, col.Column.ColumnName)
+	}
+	return headers
+}
+
+// EachRow executes the plan's select statement and calls fn with the
+// raw values of each row, as returned by the database driver, in the
+// same order as SelectedColumns.  Rows are streamed from the database
+// as they are read, and the values slice is reused between rows, so
+// fn must copy anything that it needs to hold on to.  If fn returns
+// an error, iteration stops and the error is returned.
+func (plan *QueryPlan) EachRow(fn func(values []interface{}) error) error {
+	rows, done, err := plan.queryRows()
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ExportCSV executes the plan's select statement and writes the
+// results to w as CSV, streaming rows from the database as they are
+// read.  The first record contains the column headers, which are the
+// aliases of the selected columns.
+func (plan *QueryPlan) ExportCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(plan.exportHeaders()); err != nil {
+		return err
+	}
+	var record []string
+	err := plan.EachRow(func(values []interface{}) error {
+		record = record[:0]
+		for _, value := range values {
+			record = append(record, csvValue(value))
+		}
+		return writer.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ExportNDJSON executes the plan's select statement and writes the
+// results to w as newline-delimited JSON, one object per row, keyed
+// by the aliases of the selected columns.  Rows are streamed from the
+// database as they are read.  Values are encoded using the plan's
+// JSONHooks and JSONEncoder (see Options).
+func (plan *QueryPlan) ExportNDJSON(w io.Writer) error {
+	headers := plan.exportHeaders()
+	keys := make([][]byte, 0, len(headers))
+	for _, header := range headers {
+		key, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	buffer := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buffer)
+	return plan.EachRow(func(values []interface{}) error {
+		buffer.Reset()
+		buffer.WriteByte('{')
+		for i, value := range values {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if i < len(keys) {
+				buffer.Write(keys[i])
+			} else {
+				fmt.Fprintf(buffer, `"%d"`, i)
+			}
+			buffer.WriteByte(':')
+			if b, ok := value.([]byte); ok {
+				value = string(b)
+			}
+			encoded, err := plan.marshalJSON(value)
+			if err != nil {
+				return err
+			}
+			buffer.Write(encoded)
+		}
+		buffer.WriteString("}\n")
+		_, err := w.Write(buffer.Bytes())
+		return err
+	})
+}
+
+// csvValue formats a value scanned from the database for a CSV
+// record.  NULL values are written as empty strings.
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,191 @@
+package plans
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// fieldIndexer is implemented by *QueryPlan and any types that embed
+// it.
+type fieldIndexer interface {
+	interfaces.Selector
+	fieldIndex(fieldPtr interface{}) ([]int, error)
+}
+
+// childSelector is implemented by *QueryPlan and any types that embed
+// it.
+type childSelector interface {
+	fieldIndexer
+	andWhere(extra ...filters.Filter)
+	maxBindArgs() int
+}
+
+// chunkFilter is a filter whose wrapped filter can be replaced between
+// executions, so that a plan can select its rows in chunks.
+type chunkFilter struct {
+	filters.Filter
+}
+
+// fieldIndex returns the index of the field that fieldPtr points to
+// within the plan's reference struct, following any embedded structs
+// that were joined to.  Fields of separately joined reference structs
+// are not part of the plan's results, so they return an error.
+func (plan *QueryPlan) fieldIndex(fieldPtr interface{}) ([]int, error) {
+	m, err := plan.colMap.fieldMapForPointer(fieldPtr)
+	if err != nil {
+		return nil, err
+	}
+	var index []int
+	root := m
+	for p := m; p != nil; p = p.parentMap {
+		index = append(append([]int(nil), p.column.FieldIndex()...), index...)
+		root = p
+	}
+	if root.parent != plan.target.Interface() {
+		return nil, errors.New("gorq: Results can only be grouped by fields of the plan's reference struct")
+	}
+	return index, nil
+}
+
+// SelectGrouped executes q's select statement and groups the results
+// by the value of the field that keyFieldPtr points to, which must be
+// a field of q's reference struct.  T is the type of the results
+// (i.e. a pointer to the reference struct type).  Example:
+//
+//     ref := new(Invoice)
+//     q := dbMap.Query(ref).Where().True(&ref.IsPaid)
+//     byPerson, err := plans.SelectGrouped[*Invoice](q, &ref.PersonId)
+//     // byPerson is a map[int64][]*Invoice
+//
+// Results appear in each group in the order that they were returned
+// from the database.  If a key field is behind a nil pointer (e.g. in
+// a struct that was left joined to), its results are grouped under
+// the zero value of K.
+func SelectGrouped[T any, K comparable](q interfaces.Selector, keyFieldPtr *K) (map[K][]T, error) {
+	plan, ok := q.(fieldIndexer)
+	if !ok {
+		return nil, fmt.Errorf("gorq: Cannot group results of %T", q)
+	}
+	index, err := plan.fieldIndex(keyFieldPtr)
+	if err != nil {
+		return nil, err
+	}
+	results, err := plan.Select()
+	if err != nil {
+		return nil, err
+	}
+	keyType := reflect.TypeOf(keyFieldPtr).Elem()
+	grouped := make(map[K][]T)
+	for _, result := range results {
+		row, ok := result.(T)
+		if !ok {
+			return nil, fmt.Errorf("gorq: Cannot group result of type %T as %T", result, row)
+		}
+		var key K
+		if field := fieldOrNilByIndex(reflect.ValueOf(result).Elem(), index); field.Type() == keyType {
+			key = field.Interface().(K)
+		}
+		grouped[key] = append(grouped[key], row)
+	}
+	return grouped, nil
+}
+
+// SelectChildren adds a filter to child's where clause for rows whose
+// field that childKeyPtr points to is one of keys, executes its select
+// statement, and groups the results by that field, as SelectGrouped
+// does.  If keys is empty, nothing is executed.  If there are more
+// keys than the database can bind in one statement, child's select
+// statement is executed once for each chunk of keys.  See
+// SelectWithChildren.
+func SelectChildren[C any, K comparable](child interfaces.Selector, childKeyPtr *K, keys []K) (map[K][]C, error) {
+	plan, ok := child.(childSelector)
+	if !ok {
+		return nil, fmt.Errorf("gorq: Cannot select children using %T", child)
+	}
+	if len(keys) == 0 {
+		return make(map[K][]C), nil
+	}
+	seen := make(map[K]bool, len(keys))
+	values := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			values = append(values, key)
+		}
+	}
+	chunk := new(chunkFilter)
+	plan.andWhere(chunk)
+	children := make(map[K][]C, len(values))
+	for max := plan.maxBindArgs(); len(values) > 0; {
+		n := len(values)
+		if n > max {
+			n = max
+		}
+		chunk.Filter = filters.In(childKeyPtr, values[:n]...)
+		values = values[n:]
+		grouped, err := SelectGrouped[C](plan, childKeyPtr)
+		if err != nil {
+			return nil, err
+		}
+		for key, group := range grouped {
+			children[key] = group
+		}
+	}
+	return children, nil
+}
+
+// SelectWithChildren executes parent's select statement, and then
+// child's, limited to the rows whose field that childKeyPtr points to
+// matches the field that parentKeyPtr points to in one of the parents.
+// It returns the parents and their children, grouped by key, so that
+// one-to-many associations can be loaded using one statement per
+// association rather than one per parent.  Example:
+//
+//     ref, item := new(Invoice), new(LineItem)
+//     invoices, items, err := plans.SelectWithChildren[*Invoice, *LineItem](
+//         dbMap.Query(ref).Where().Equal(&ref.PersonId, personId), &ref.Id,
+//         dbMap.Query(item), &item.InvoiceId)
+//     for _, invoice := range invoices {
+//         invoice.Items = items[invoice.Id]
+//     }
+//
+// Other associations can be loaded for the same parents by passing
+// their keys to SelectChildren.  To see a consistent view of the
+// database across the statements, create both plans from the same
+// transaction.
+func SelectWithChildren[P, C any, K comparable](parent interfaces.Selector, parentKeyPtr *K, child interfaces.Selector, childKeyPtr *K) ([]P, map[K][]C, error) {
+	plan, ok := parent.(fieldIndexer)
+	if !ok {
+		return nil, nil, fmt.Errorf("gorq: Cannot select children of %T", parent)
+	}
+	index, err := plan.fieldIndex(parentKeyPtr)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := plan.Select()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyType := reflect.TypeOf(parentKeyPtr).Elem()
+	parents := make([]P, 0, len(results))
+	keys := make([]K, 0, len(results))
+	for _, result := range results {
+		row, ok := result.(P)
+		if !ok {
+			return nil, nil, fmt.Errorf("gorq: Cannot select result of type %T as %T", result, row)
+		}
+		parents = append(parents, row)
+		if field := fieldOrNilByIndex(reflect.ValueOf(result).Elem(), index); field.Type() == keyType {
+			keys = append(keys, field.Interface().(K))
+		}
+	}
+	children, err := SelectChildren[C](child, childKeyPtr, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parents, children, nil
+}
@@ -0,0 +1,71 @@
+package plans
+
+import (
+	"strings"
+
+	"github.com/outdoorsy/gorp"
+)
+
+// An IdentifierPolicy controls how a plan writes identifiers (table,
+// column, and alias names) in the SQL that it generates.
+type IdentifierPolicy int
+
+const (
+	// QuoteIdentifiers quotes identifiers using the dialect's quoting
+	// rules, leaving their case as it was mapped.  This is the
+	// default.
+	QuoteIdentifiers IdentifierPolicy = iota
+
+	// LowerIdentifiers folds identifiers to lower case before quoting
+	// them.  This is useful for mixed-case names in mappings against
+	// databases (like postgresql) which fold unquoted identifiers to
+	// lower case.
+	LowerIdentifiers
+
+	// RawIdentifiers writes identifiers exactly as they were mapped,
+	// without quoting them.
+	RawIdentifiers
+)
+
+// quoteField returns field (a column or alias name) as it should be
+// written in a query, according to the plan's IdentifierPolicy.
+func (plan *QueryPlan) quoteField(field string) string {
+	switch plan.identifiers {
+	case LowerIdentifiers:
+		return plan.dialect.QuoteField(strings.ToLower(field))
+	case RawIdentifiers:
+		return field
+	}
+	return plan.dialect.QuoteField(field)
+}
+
+// quoteTable returns the schema and table as they should be written
+// in a query, according to the plan's IdentifierPolicy.
+func (plan *QueryPlan) quoteTable(schema, table string) string {
+	switch plan.identifiers {
+	case LowerIdentifiers:
+		return plan.dialect.QuotedTableForQuery(strings.ToLower(schema), strings.ToLower(table))
+	case RawIdentifiers:
+		if schema == "" {
+			return table
+		}
+		return schema + "." + table
+	}
+	return plan.dialect.QuotedTableForQuery(schema, table)
+}
+
+// autoIncrInsertSuffix returns the dialect's suffix for inserts which
+// read back the generated value of col, with col written according to
+// the plan's IdentifierPolicy.  Dialects may write col quoted or
+// as-is, so both are replaced.
+func (plan *QueryPlan) autoIncrInsertSuffix(col *gorp.ColumnMap) string {
+	suffix := plan.dialect.AutoIncrInsertSuffix(col)
+	quoted := plan.quoteField(col.ColumnName)
+	if dialectQuoted := plan.dialect.QuoteField(col.ColumnName); strings.Contains(suffix, dialectQuoted) {
+		return strings.Replace(suffix, dialectQuoted, quoted, -1)
+	}
+	if strings.HasSuffix(suffix, " "+col.ColumnName) {
+		return strings.TrimSuffix(suffix, col.ColumnName) + quoted
+	}
+	return suffix
+}
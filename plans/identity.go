@@ -0,0 +1,189 @@
+package plans
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+type identityMapKey struct{}
+
+// identityKey identifies a single row of a table.
+type identityKey struct {
+	table *gorp.TableMap
+	key   string
+}
+
+// identityMap holds the instance that has been returned for each row
+// selected within a context.
+type identityMap struct {
+	lock sync.Mutex
+	rows map[identityKey]interface{}
+}
+
+// WithIdentityMap returns a copy of ctx with an identity map.  Within
+// a context with an identity map, every plan created with that
+// context (see DbMap.QueryContext) will return the same instance each
+// time Select returns a given row, with its fields updated to the
+// row's latest values.  Selects which only filter on a single column
+// primary key (e.g. Where().Equal(&ref.Id, id)) return the row's
+// existing instance without querying the database at all.
+//
+// Only plans that select every column of their table, and nothing
+// else, take part in the identity map; plans with joins, Fields,
+// Distinct, ForUpdate, GroupBy, compounds (e.g. Union), or common
+// table expressions are always executed as usual.  The
+// identity map lives as long as the context, so it is intended for
+// contexts that are scoped to a single request.
+func WithIdentityMap(ctx context.Context) context.Context {
+	return context.WithValue(ctx, identityMapKey{}, &identityMap{rows: make(map[identityKey]interface{})})
+}
+
+// identityMap returns the identity map of the plan's context, if the
+// plan can use it.
+func (plan *QueryPlan) identityMap() *identityMap {
+	if plan.ctx == nil {
+		return nil
+	}
+	identities, _ := plan.ctx.Value(identityMapKey{}).(*identityMap)
+	if identities == nil || !plan.selectsWholeRows() {
+		return nil
+	}
+	return identities
+}
+
+// selectsWholeRows returns whether or not the plan selects exactly
+// the columns of its table, one row at a time.
+func (plan *QueryPlan) selectsWholeRows() bool {
+	if _, isSubQuery := plan.target.Interface().(subQuery); isSubQuery {
+		return false
+	}
+	if len(plan.joins) > 0 || plan.forUpdate || len(plan.distinctFields) > 0 || len(plan.groupBy) > 0 {
+		return false
+	}
+	if len(plan.compounds) > 0 || len(plan.commonTables) > 0 {
+		return false
+	}
+	if _, isJoin := plan.filters.(*filters.JoinFilter); isJoin {
+		return false
+	}
+	for _, m := range plan.colMap {
+		ownColumn := m.parentMap == nil && m.parent == plan.target.Interface()
+		if ownColumn && plan.isLazy(plan.target.Type().Elem(), m.column) {
+			// Lazy columns may or may not be selected; identify only
+			// copies the columns that were.
+			continue
+		}
+		if m.doSelect != (ownColumn && !m.column.Transient) {
+			return false
+		}
+	}
+	return true
+}
+
+// identityKeyFor returns the identity map key for keys, the primary
+// key values of a row in the plan's table.  Each value is prefixed
+// with its length, so that composite keys such as ("ab", "c") and
+// ("a", "bc") don't share a key.
+func (plan *QueryPlan) identityKeyFor(keys []interface{}) identityKey {
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufPool.Put(buffer)
+	for _, k := range keys {
+		value := fmt.Sprint(k)
+		buffer.WriteString(strconv.Itoa(len(value)))
+		buffer.WriteString(":")
+		buffer.WriteString(value)
+	}
+	return identityKey{table: plan.table, key: buffer.String()}
+}
+
+// identify replaces each result with the instance that has already
+// been returned for its row, if there is one, after copying the
+// result's selected values into it.
+func (plan *QueryPlan) identify(identities *identityMap, results []interface{}) {
+	keyCols := plan.keyColumns()
+	if len(keyCols) == 0 {
+		return
+	}
+	var selected [][]int
+	for _, m := range plan.colMap {
+		if m.doSelect {
+			selected = append(selected, m.column.FieldIndex())
+		}
+	}
+	identities.lock.Lock()
+	defer identities.lock.Unlock()
+	for i, result := range results {
+		row := reflect.ValueOf(result)
+		key := plan.identityKeyFor(keyValues(row, keyCols))
+		existing, ok := identities.rows[key]
+		if !ok {
+			identities.rows[key] = result
+			continue
+		}
+		target := reflect.ValueOf(existing).Elem()
+		for _, index := range selected {
+			target.FieldByIndex(index).Set(row.Elem().FieldByIndex(index))
+		}
+		results[i] = existing
+	}
+}
+
+// identityLookup returns the existing instance of the row that the
+// plan selects, if its where clause only compares the table's primary
+// key to a value and the row is already in the identity map.
+func (plan *QueryPlan) identityLookup(identities *identityMap) (interface{}, bool) {
+	keyCols := plan.keyColumns()
+	if len(keyCols) != 1 || len(plan.orBranches) > 0 || plan.limit > 0 || plan.offset > 0 {
+		return nil, false
+	}
+	filter := plan.whereBranches()
+	// Only unwrap filters that combine their sub-filters; a NotFilter
+	// also has a single sub-filter, but inverts it.
+	for {
+		var subFilters []filters.Filter
+		switch combined := filter.(type) {
+		case *filters.AndFilter:
+			subFilters = combined.SubFilters()
+		case *filters.OrFilter:
+			subFilters = combined.SubFilters()
+		}
+		if len(subFilters) != 1 {
+			break
+		}
+		filter = subFilters[0]
+	}
+	comparison, ok := filter.(*filters.ComparisonFilter)
+	if !ok || comparison.Comparison != "=" || comparison.RightMod != nil {
+		return nil, false
+	}
+	m, err := plan.colMap.fieldMapForPointer(comparison.Left)
+	if err != nil || m.column != keyCols[0] || m.parentMap != nil {
+		return nil, false
+	}
+	switch comparison.Right.(type) {
+	case filters.SqlWrapper, filters.MultiSqlWrapper, filters.Param, subQuery:
+		return nil, false
+	}
+	if reflect.TypeOf(comparison.Right) != reflect.TypeOf(m.field).Elem() {
+		return nil, false
+	}
+
+	// Policies may add filters (or reject the statement entirely), so
+	// only skip the database when they have no objections.
+	plan.resetArgs()
+	if err := plan.checkPolicies(SelectOperation); err != nil || len(plan.policyFilters) > 0 {
+		return nil, false
+	}
+	identities.lock.Lock()
+	defer identities.lock.Unlock()
+	existing, ok := identities.rows[plan.identityKeyFor([]interface{}{comparison.Right})]
+	return existing, ok
+}
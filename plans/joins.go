@@ -0,0 +1,245 @@
+package plans
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// A JoinStrategy decides how a field is joined when it is requested
+// using AddField.  Strategies are registered for a table and column
+// using a JoinOp (or gorq.DbMap.JoinStrategy), and are called once
+// per AddField call with the reference struct that the field belongs
+// to (parent) and a pointer to the field itself (field).
+type JoinStrategy interface {
+	// Join returns the join to perform for field.  Returning nil (or
+	// a JoinSpec with a nil Target) means that the field should not
+	// be joined or selected.
+	Join(parent, field interface{}) *JoinSpec
+}
+
+// A JoinSpec describes a join performed for a JoinStrategy.
+type JoinSpec struct {
+	// Type is the type of join, e.g. "inner" or "left".  An empty
+	// Type is an inner join, unless Options.ReferenceJoinType is set;
+	// setting it to AutoJoinType chooses the join type from the
+	// field's nullability, as AutoJoin does.
+	Type string
+
+	// Target is the reference struct (or sub-query) to join to.  If
+	// it is a pointer to a field of parent, the join will use that
+	// field's alias and its columns will be selected, as when calling
+	// Join with a pointer to a mapped struct field.
+	Target interface{}
+
+	// Constraints are the filters for the join's on clause.  They are
+	// combined using AND.
+	Constraints []filters.Filter
+
+	// Select is the value that will be selected into field, usually a
+	// pointer to a field of Target or a filters.SqlWrapper around
+	// one.  If it is nil, field is selected as-is.
+	Select interface{}
+
+	// Fields limits the columns selected from Target to the passed in
+	// field pointers.  If it is empty, Target's columns are selected
+	// just as they would be by Join.
+	Fields []interface{}
+
+	// Alias, if set, is the name that Target is joined as, and that
+	// its columns are referenced by (including in Constraints), so
+	// that a strategy can join the same table more than once.
+	// Sub-queries include their alias in their SQL, so they can't be
+	// given another one.
+	Alias string
+
+	// Batch, if set, loads field as a to-many association using one
+	// more select statement for all of the plan's results, instead of
+	// joining it.  The other fields of the JoinSpec are ignored.
+	Batch *BatchSpec
+}
+
+// Join implements JoinStrategy for JoinFunc, so existing JoinFunc
+// values can be used anywhere a JoinStrategy is accepted.
+func (f JoinFunc) Join(parent, field interface{}) *JoinSpec {
+	joinType, joinTarget, selectionField, constraints := f(parent, field)
+	return &JoinSpec{
+		Type:        joinType,
+		Target:      joinTarget,
+		Constraints: constraints,
+		Select:      selectionField,
+	}
+}
+
+// strategy returns the JoinStrategy for op, preferring Strategy over
+// Join when both are set.
+func (op JoinOp) strategy() JoinStrategy {
+	if op.Strategy != nil {
+		return op.Strategy
+	}
+	if op.Join != nil {
+		return op.Join
+	}
+	return nil
+}
+
+// addJoinField joins the field mapped by m using its JoinStrategy.
+func (plan *QueryPlan) addJoinField(m *fieldColumnMap) {
+	spec := m.join.Join(m.parent, m.field)
+	if spec != nil && spec.Batch != nil {
+		m.doSelect = false
+		plan.batches = append(plan.batches, batchJoin{field: m.field, spec: spec.Batch})
+		return
+	}
+	if spec == nil || spec.Target == nil {
+		// This means to not bother joining.
+		m.doSelect = false
+		return
+	}
+	joinType := spec.Type
+	if joinType == "" {
+		joinType = plan.specJoinType(m.field)
+	}
+	start := len(plan.colMap)
+	plan.JoinType(joinType, spec.Target).On(spec.Constraints...)
+	if spec.Alias != "" {
+		plan.aliasJoin(start, spec.Alias)
+	}
+	if len(spec.Fields) > 0 {
+		for _, joined := range plan.colMap[start:] {
+			joined.doSelect = false
+		}
+		for _, field := range spec.Fields {
+			joined, err := plan.colMap.joinMapForPointer(field)
+			if err != nil {
+				plan.Errors = append(plan.Errors, err)
+				continue
+			}
+			joined.doSelect = true
+		}
+	}
+	if spec.Select != nil {
+		m.selectTarget = spec.Select
+	}
+}
+
+// aliasJoin changes the alias of the plan's current join to alias,
+// along with the columns mapped for it, which start at index start of
+// the plan's column map.
+func (plan *QueryPlan) aliasJoin(start int, alias string) {
+	join, ok := plan.filters.(*filters.JoinFilter)
+	if !ok || start == len(plan.colMap) {
+		return
+	}
+	if strings.Contains(join.QuotedJoinTable, " ") {
+		plan.Errors = append(plan.Errors, errors.New("gorq: Joined sub-queries can't be given an alias by a JoinSpec"))
+		return
+	}
+	quoted := plan.quoteField(alias)
+	join.QuotedAlias = quoted
+	for _, m := range plan.colMap[start:] {
+		m.quotedTable = quoted
+		m.tableName = alias
+		if _, isComputed := m.selectTarget.(computedColumn); isComputed {
+			m.selectTarget, _ = plan.computedExpr(m.column, quoted)
+		}
+	}
+}
+
+// WithJoinOps registers ops for the plan's fields, in addition to the
+// JoinOp values that the plan was created with.  An op replaces any
+// strategy already registered for its column, and an op with neither
+// Join nor Strategy removes it, so that the field is selected as-is.
+// Ops only affect fields added (using AddField) after WithJoinOps is
+// called.  Since plans are modified in place, a base plan shared
+// between callers should be copied (see Retarget) before each caller
+// registers its own ops, e.g.
+//
+//     q, err := base.Retarget(dbMap, dbMap)
+//     if err != nil {
+//         return err
+//     }
+//     q.WithJoinOps(plans.JoinOp{Table: table, Column: column, Strategy: loadOwner})
+//     q.AddField(&ref.Owner)
+func (plan *QueryPlan) WithJoinOps(ops ...JoinOp) *QueryPlan {
+	for _, op := range ops {
+		found := false
+		for _, m := range plan.colMap {
+			if m.column == op.Column && op.Column != nil {
+				m.join = op.strategy()
+				found = true
+			}
+		}
+		if !found {
+			plan.Errors = append(plan.Errors, errors.New("gorq: No field of the plan is mapped to the JoinOp's column"))
+		}
+	}
+	return plan
+}
+
+// AutoJoin joins target, choosing the join type from the references
+// found when References is called: a left outer join if any of the
+// referencing fields are nullable (pointers, or types like
+// sql.NullInt64), or an inner join otherwise.  For example,
+//
+//     q := dbMap.Query(ref).(*plans.QueryPlan)
+//     q.AutoJoin(&ref.Manager).References()
+//
+// keeps rows whose ManagerId is null, where Join would drop them.  If
+// References isn't called, the join is an inner join.  See
+// Options.ReferenceJoinType.
+func (plan *QueryPlan) AutoJoin(target interface{}) interfaces.JoinQuery {
+	return plan.JoinType("", target)
+}
+
+// AutoJoinType is a value for Options.ReferenceJoinType which makes
+// the joins for JoinSpecs without a Type choose their join type in
+// the same way as AutoJoin.
+const AutoJoinType = "auto"
+
+// specJoinType returns the join type to use for a JoinSpec without a
+// Type, joining the field that fieldPtr points to.
+func (plan *QueryPlan) specJoinType(fieldPtr interface{}) string {
+	switch plan.refJoinType {
+	case "":
+		return "inner"
+	case AutoJoinType:
+		return plan.autoJoinType(fieldPtr)
+	}
+	return plan.refJoinType
+}
+
+// autoJoinType returns the join type to use for a join on the fields
+// that fieldPtrs point to, when the join type wasn't chosen
+// explicitly.
+func (plan *QueryPlan) autoJoinType(fieldPtrs ...interface{}) string {
+	if plan.refJoinType != "" && plan.refJoinType != AutoJoinType {
+		return plan.refJoinType
+	}
+	for _, fieldPtr := range fieldPtrs {
+		if isNullable(reflect.TypeOf(fieldPtr).Elem()) {
+			return "left outer"
+		}
+	}
+	return "inner"
+}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// isNullable returns whether or not a field of type t can hold null:
+// pointers, interfaces, maps, and slices, as well as structs like
+// sql.NullInt64 which scan nulls into a Valid field.
+func isNullable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return true
+	case reflect.Struct:
+		valid, ok := t.FieldByName("Valid")
+		return ok && valid.Type.Kind() == reflect.Bool && reflect.PtrTo(t).Implements(scannerType)
+	}
+	return false
+}
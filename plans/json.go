@@ -0,0 +1,43 @@
+package plans
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// A JSONEncoder encodes values as JSON.  Most third party JSON
+// packages can be used directly, e.g.
+//
+//     options.JSONEncoder = jsoniter.ConfigCompatibleWithStandardLibrary
+//
+// or, for packages that only provide a function,
+//
+//     options.JSONEncoder = plans.JSONEncoderFunc(gojson.Marshal)
+type JSONEncoder interface {
+	Marshal(v interface{}) ([]byte, error)
+}
+
+// JSONEncoderFunc is a function that implements JSONEncoder.
+type JSONEncoderFunc func(v interface{}) ([]byte, error)
+
+// Marshal calls f(v).
+func (f JSONEncoderFunc) Marshal(v interface{}) ([]byte, error) {
+	return f(v)
+}
+
+// A JSONHook encodes values of a single type as JSON, in place of the
+// plan's JSONEncoder.
+type JSONHook func(value interface{}) ([]byte, error)
+
+// marshalJSON encodes value using the plan's hook for value's type if
+// it has one, or its JSONEncoder otherwise.  Plans with neither use
+// encoding/json.
+func (plan *QueryPlan) marshalJSON(value interface{}) ([]byte, error) {
+	if hook, ok := plan.jsonHooks[reflect.TypeOf(value)]; ok {
+		return hook(value)
+	}
+	if plan.jsonEncoder != nil {
+		return plan.jsonEncoder.Marshal(value)
+	}
+	return json.Marshal(value)
+}
@@ -0,0 +1,83 @@
+package plans
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// isLazy returns whether or not col, a column of a table mapped from
+// structType, has been marked as lazy for this plan, either in its
+// Options or with a `select:"-"` tag on its field.
+func (plan *QueryPlan) isLazy(structType reflect.Type, col *gorp.ColumnMap) bool {
+	if structType.FieldByIndex(col.FieldIndex()).Tag.Get("select") == "-" {
+		return true
+	}
+	for _, lazy := range plan.lazyCols {
+		if lazy == col {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadFields selects the columns for fieldPtrs, which must point to
+// fields of row, from the row of row's table with the same primary
+// key as row, and stores their values in row.  It is mostly useful
+// for loading lazy columns (see Options.LazyColumns) on demand:
+//
+//     listing := results[0].(*Listing)
+//     err := plans.LoadFields(dbMap, dbMap, options, listing, &listing.Description)
+//
+// sql.ErrNoRows is returned if the row no longer exists.
+func LoadFields(m *gorp.DbMap, exec gorp.SqlExecutor, options Options, row interface{}, fieldPtrs ...interface{}) error {
+	if len(fieldPtrs) == 0 {
+		return nil
+	}
+	plan, ok := QueryWithOptions(m, exec, row, options).(*QueryPlan)
+	if !ok {
+		return fmt.Errorf("gorq: Cannot load fields of %T", row)
+	}
+	if len(plan.Errors) > 0 {
+		return plan.Errors[0]
+	}
+	keyCols := plan.keyColumns()
+	if len(keyCols) == 0 {
+		return errors.New("gorq: Fields can only be loaded for tables with a primary key")
+	}
+	indexes := make([][]int, 0, len(fieldPtrs))
+	for _, fieldPtr := range fieldPtrs {
+		index, err := plan.fieldIndex(fieldPtr)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, index)
+	}
+	plan.Fields(fieldPtrs...)
+	for _, col := range keyCols {
+		key := fieldByIndex(plan.target.Elem(), col.FieldIndex())
+		plan.Filter(filters.Equal(key.Addr().Interface(), key.Interface()))
+	}
+	results, err := plan.Select()
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return sql.ErrNoRows
+	}
+	loaded := reflect.ValueOf(results[0]).Elem()
+	for _, index := range indexes {
+		field := fieldByIndex(plan.target.Elem(), index)
+		value := fieldOrNilByIndex(loaded, index)
+		if value.Type() != field.Type() {
+			// The value was behind a nil pointer in the result.
+			value = reflect.Zero(field.Type())
+		}
+		field.Set(value)
+	}
+	return nil
+}
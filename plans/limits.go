@@ -0,0 +1,162 @@
+package plans
+
+import (
+	"fmt"
+
+	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// Limits are used to reject pathological statements before they are
+// sent to the database.  Any limit that is zero (or negative) is not
+// enforced.
+type Limits struct {
+	// MaxJoins is the maximum number of tables that may be joined
+	// to the plan's table.
+	MaxJoins int
+
+	// MaxArgs is the maximum number of bind arguments that a
+	// statement may have.
+	MaxArgs int
+
+	// MaxInItems is the maximum number of values in any single IN or
+	// NOT IN filter.
+	MaxInItems int
+
+	// MaxStatementLength is the maximum length, in bytes, of the
+	// generated SQL.
+	MaxStatementLength int
+
+	// MaxRows is the maximum number of rows that a select statement
+	// may return.  Limits above it (and missing limits) are capped,
+	// so that no more than MaxRows+1 rows are read; if the extra row
+	// exists, the select returns a *LimitError, or if TruncateRows is
+	// set, returns the first MaxRows rows and marks the plan as
+	// truncated (see QueryPlan.Truncated).  Plans can override it
+	// using MaxRows.
+	MaxRows      int
+	TruncateRows bool
+}
+
+// A LimitError is returned when a plan exceeds one of its Limits.
+type LimitError struct {
+	// Limit is the name of the field in Limits that was exceeded.
+	Limit string
+
+	// Max is the value of the limit, and Actual is the value that
+	// the plan generated.
+	Max    int
+	Actual int
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("gorq: Query exceeds %s (%d > %d)", err.Limit, err.Actual, err.Max)
+}
+
+// checkLimit returns a *LimitError if max is enforced and actual
+// exceeds it.
+func checkLimit(limit string, max, actual int) error {
+	if max > 0 && actual > max {
+		return &LimitError{Limit: limit, Max: max, Actual: actual}
+	}
+	return nil
+}
+
+// checkLimits checks a generated statement against the plan's
+// limits.  MaxJoins is checked as joins are added, since it doesn't
+// depend on the rest of the statement.
+func (plan *QueryPlan) checkLimits(query string, args []interface{}) error {
+	if err := checkLimit("MaxStatementLength", plan.limits.MaxStatementLength, len(query)); err != nil {
+		return err
+	}
+	if err := checkLimit("MaxArgs", plan.limits.MaxArgs, len(args)); err != nil {
+		return err
+	}
+	if plan.limits.MaxInItems <= 0 {
+		return nil
+	}
+	for _, join := range plan.joins {
+		if err := plan.checkInItems(join); err != nil {
+			return err
+		}
+	}
+	if where := plan.whereFilter(); where != nil {
+		return plan.checkInItems(where)
+	}
+	return nil
+}
+
+// checkInItems checks every IN and NOT IN filter within filter
+// against MaxInItems.
+func (plan *QueryPlan) checkInItems(filter filters.Filter) error {
+	switch src := filter.(type) {
+	case subFilterer:
+		for _, sub := range src.SubFilters() {
+			if err := plan.checkInItems(sub); err != nil {
+				return err
+			}
+		}
+	case *filters.InFilter, *filters.NotInFilter:
+		// The first value is the expression being compared.
+		return checkLimit("MaxInItems", plan.limits.MaxInItems, len(src.ActualValues())-1)
+	}
+	return nil
+}
+
+// prepare checks, logs, and reports any warnings about a statement
+// that is about to be executed, returning it with the plan's SQL
+// comment (if any) appended, as rewritten by the plan's rewriters
+// along with its arguments.
+func (plan *QueryPlan) prepare(query string, args []interface{}) (string, []interface{}, error) {
+	if err := plan.checkLimits(query, args); err != nil {
+		return "", nil, err
+	}
+	statement := query
+	query, args, err := plan.rewrite(query+plan.sqlComment(), args)
+	if err != nil {
+		return "", nil, err
+	}
+	plan.adviseIndexes(statement, query, args)
+	plan.log(query, args)
+	plan.reportWarnings(query)
+	return query, args, nil
+}
+
+// MaxRows overrides the maximum number of rows that the plan's select
+// statements may return.  See Limits.MaxRows.
+func (plan *QueryPlan) MaxRows(n int) interfaces.SelectQuery {
+	plan.maxRows = n
+	return plan
+}
+
+// Truncated returns whether or not the results of the plan's last
+// select statement were truncated at its maximum number of rows.  See
+// Limits.MaxRows.
+func (plan *QueryPlan) Truncated() bool {
+	return plan.truncated
+}
+
+// rowLimit returns the maximum number of rows that the plan's select
+// statements may return, or zero if there is no maximum.
+func (plan *QueryPlan) rowLimit() int {
+	if plan.maxRows > 0 {
+		return plan.maxRows
+	}
+	return plan.limits.MaxRows
+}
+
+// checkRows checks the number of rows that a select statement
+// returned against the plan's maximum, returning the number of them
+// that should be kept.
+func (plan *QueryPlan) checkRows(rows int) (int, error) {
+	max := plan.rowLimit()
+	plan.truncated = false
+	if max <= 0 || rows <= max {
+		return rows, nil
+	}
+	if !plan.limits.TruncateRows {
+		return 0, &LimitError{Limit: "MaxRows", Max: max, Actual: rows}
+	}
+	plan.truncated = true
+	return max, nil
+}
@@ -0,0 +1,246 @@
+package plans
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// Redacted is logged in place of any argument that is bound against
+// a sensitive column.
+const Redacted = "<redacted>"
+
+// A Logger is used to log the statements that a plan executes.  It
+// matches gorp.GorpLogger, so the same logger can be used for both.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// subFilterer is implemented by filters that are made up of other
+// filters, such as filters.AndFilter and filters.NotFilter.
+type subFilterer interface {
+	SubFilters() []filters.Filter
+}
+
+// isSensitive returns whether or not col has been marked as
+// sensitive for this plan.
+func (plan *QueryPlan) isSensitive(col *gorp.ColumnMap) bool {
+	for _, sensitive := range plan.sensitiveCols {
+		if sensitive == col {
+			return true
+		}
+	}
+	return false
+}
+
+// refersToSensitive returns whether or not any of the passed in
+// values (or the values that they wrap) are pointers to fields which
+// map to sensitive columns.
+func (plan *QueryPlan) refersToSensitive(values ...interface{}) bool {
+	for _, value := range values {
+		switch src := value.(type) {
+		case filters.SqlWrapper:
+			if plan.refersToSensitive(src.ActualValue()) {
+				return true
+			}
+		case filters.MultiSqlWrapper:
+			if plan.refersToSensitive(src.ActualValues()...) {
+				return true
+			}
+		default:
+			for _, m := range plan.colMap {
+				if m.field == value && plan.isSensitive(m.column) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// sensitiveValues returns a slice matching filter.ActualValues(),
+// where each element is true if the value is being compared against
+// a sensitive column.
+func (plan *QueryPlan) sensitiveValues(filter filters.Filter) []bool {
+	if combined, ok := filter.(subFilterer); ok {
+		var sensitive []bool
+		for _, sub := range combined.SubFilters() {
+			sensitive = append(sensitive, plan.sensitiveValues(sub)...)
+		}
+		return sensitive
+	}
+	values := filter.ActualValues()
+	sensitive := make([]bool, len(values))
+	if len(plan.sensitiveCols) > 0 && plan.refersToSensitive(values...) {
+		for i := range sensitive {
+			sensitive[i] = true
+		}
+	}
+	return sensitive
+}
+
+// filterValues converts the actual values of filter to the strings
+// that should be used to represent them in the query, marking any
+// arguments that are compared against sensitive columns.
+//
+// The returned slice is only valid until the plan generates its next
+// statement (see sqlValues), so it must not be held on to.
+func (plan *QueryPlan) filterValues(filter filters.Filter) ([]string, error) {
+	if err := plan.checkOperators(filter); err != nil {
+		return nil, err
+	}
+	args := filter.ActualValues()
+	var sensitive []bool
+	if len(plan.sensitiveCols) > 0 {
+		sensitive = plan.sensitiveValues(filter)
+	}
+	plan.filtering = true
+	defer func() { plan.filtering = false }()
+	return plan.sqlValues(args, sensitive)
+}
+
+// sqlValues converts values to the strings that should be used to
+// represent them in the query (see argOrColumn), marking the
+// arguments of values whose index is true in sensitive.
+//
+// Rather than allocating a slice for each filter and wrapper, the
+// strings are pushed on to the plan's value stack, which is emptied
+// by resetArgs and keeps its capacity between statements.  The
+// returned slice is part of the stack, and is only valid until the
+// plan generates its next statement.
+func (plan *QueryPlan) sqlValues(values []interface{}, sensitive []bool) ([]string, error) {
+	start := len(plan.vals)
+	for i, value := range values {
+		argStart := plan.argCount()
+		sqlValue, err := plan.argOrColumn(value)
+		if err != nil {
+			plan.vals = plan.vals[:start]
+			return nil, err
+		}
+		if i < len(sensitive) && sensitive[i] {
+			plan.markSensitive(argStart, plan.argCount())
+		}
+		// Any values nested in value (e.g. wrapped values) were
+		// pushed after the previous value while generating sqlValue,
+		// and have already been used.
+		plan.vals = append(plan.vals[:start+i], sqlValue)
+	}
+	end := len(plan.vals)
+	return plan.vals[start:end:end], nil
+}
+
+// markSensitive marks the arguments from index start up to (but not
+// including) end as sensitive.
+func (plan *QueryPlan) markSensitive(start, end int) {
+	if plan.sensitiveArgs == nil {
+		plan.sensitiveArgs = make(map[int]bool)
+	}
+	for i := start; i < end; i++ {
+		plan.sensitiveArgs[i] = true
+	}
+}
+
+// log logs query and args to the plan's logger, if it has one.
+// Sensitive arguments will be replaced with Redacted.
+func (plan *QueryPlan) log(query string, args []interface{}) {
+	if plan.logger == nil {
+		return
+	}
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	for i, arg := range args {
+		if i > 0 {
+			buffer.WriteString(" ")
+		}
+		if plan.sensitiveArgs[i] {
+			arg = Redacted
+		}
+		fmt.Fprintf(buffer, "%d:%#v", i+1, arg)
+	}
+	plan.logger.Printf("%s%s [%s]", plan.logPrefix, query, buffer.String())
+	bufPool.Put(buffer)
+}
+
+// exec checks, logs, and executes a statement that returns no rows.
+func (plan *QueryPlan) exec(query string, args ...interface{}) (sql.Result, error) {
+	query, args, err := plan.prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	done, err := plan.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	res, err := plan.executor.Exec(query, args...)
+	return res, classifyError(err)
+}
+
+// selectTo checks, logs, and executes a statement, scanning the resulting rows
+// into target.
+func (plan *QueryPlan) selectTo(target interface{}, query string, args ...interface{}) ([]interface{}, error) {
+	query, args, err := plan.prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	done, err := plan.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	results, err := plan.executor.Select(target, query, args...)
+	return results, classifyError(err)
+}
+
+// selectInt checks, logs, and executes a statement that returns a single
+// integer.
+func (plan *QueryPlan) selectInt(query string, args ...interface{}) (int64, error) {
+	query, args, err := plan.prepare(query, args)
+	if err != nil {
+		return -1, err
+	}
+	done, err := plan.begin()
+	if err != nil {
+		return -1, err
+	}
+	defer done()
+	count, err := plan.executor.SelectInt(query, args...)
+	return count, classifyError(err)
+}
+
+// selectScalar checks, logs, and executes a statement that returns a
+// single value, scanning it into dest.
+func (plan *QueryPlan) selectScalar(dest interface{}, query string, args ...interface{}) error {
+	query, args, err := plan.prepare(query, args)
+	if err != nil {
+		return err
+	}
+	done, err := plan.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	querier, ok := plan.executor.(rowQuerier)
+	if !ok {
+		return errors.New("gorq: The plan's executor does not support scanning values")
+	}
+	rows, err := querier.Query(query, args...)
+	if err != nil {
+		return classifyError(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return classifyError(err)
+		}
+		return sql.ErrNoRows
+	}
+	if err := rows.Scan(dest); err != nil {
+		return err
+	}
+	return classifyError(rows.Close())
+}
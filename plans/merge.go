@@ -0,0 +1,153 @@
+package plans
+
+import (
+	"errors"
+
+	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// Merge combines other, which must be a plan for the same target
+// type, into plan.  This allows a base query to be refined by code
+// that doesn't have access to the base query's reference struct:
+//
+//     base := dbMap.Query(ref).Where().True(&ref.Active)
+//     ...
+//     refined := dbMap.Query(otherRef).Where().Equal(&otherRef.OwnerId, id)
+//     results, err := base.(*plans.QueryPlan).Merge(refined.(*plans.QueryPlan)).Select()
+//
+// Fields from other's reference structs may be used with plan after
+// merging.  Conflicts are resolved as follows:
+//
+//   - Where clauses are combined using AND.
+//   - Joins from other are added, or merged into plan's join to the
+//     same table with the same alias if plan has one.
+//   - A column is selected if it is selected by either plan.
+//   - Other's order by and group by clauses come after plan's.
+//   - Plan's limit, offset, distinct, for update, and bound
+//     parameters take precedence; other's are only used where plan has
+//     none.
+//
+// Errors from other are added to plan's Errors.
+func (plan *QueryPlan) Merge(other *QueryPlan) interfaces.WhereQuery {
+	plan.Errors = append(plan.Errors, other.Errors...)
+	if plan.table != other.table || plan.target.Type() != other.target.Type() {
+		plan.Errors = append(plan.Errors, errors.New("gorq: Cannot merge plans for different target types"))
+		return plan
+	}
+	plan.storeJoin()
+	other.storeJoin()
+
+	for _, join := range other.joins {
+		// Copy the join, so that merging conditions into it doesn't
+		// modify other.
+		copied := &filters.JoinFilter{Type: join.Type, QuotedJoinTable: join.QuotedJoinTable, QuotedAlias: join.QuotedAlias}
+		copied.Add(join.SubFilters()...)
+		plan.addJoin(copied)
+	}
+	for table, sub := range other.joinedSubQueries {
+		if plan.joinedSubQueries == nil {
+			plan.joinedSubQueries = make(map[string]joinedSubQuery)
+		}
+		plan.joinedSubQueries[table] = sub
+	}
+	for _, table := range other.tables {
+		if !plan.hasTable(table.TableName) {
+			plan.tables = append(plan.tables, table)
+		}
+	}
+	plan.mergeColumns(other)
+
+	if where := other.whereBranches(); where != nil && !isEmpty(where) {
+		plan.andWhere(where)
+	}
+
+	plan.orderBy = append(plan.orderBy, other.orderBy...)
+	for _, groupBy := range other.groupBy {
+		if !contains(plan.groupBy, groupBy) {
+			plan.groupBy = append(plan.groupBy, groupBy)
+		}
+	}
+	plan.having = append(plan.having, other.having...)
+	if plan.limit == 0 {
+		plan.limit = other.limit
+	}
+	if plan.offset == 0 {
+		plan.offset = other.offset
+	}
+	if len(plan.distinctFields) == 0 {
+		plan.distinctFields = other.distinctFields
+	}
+	if !plan.forUpdate {
+		plan.forUpdate = other.forUpdate
+		plan.forUpdateOf = other.forUpdateOf
+	}
+	for name, value := range other.params {
+		if _, ok := plan.params[name]; !ok {
+			if plan.params == nil {
+				plan.params = make(map[string]interface{})
+			}
+			plan.params[name] = value
+		}
+	}
+	return plan
+}
+
+// hasTable returns whether or not a table named tableName has been
+// mapped for plan.
+func (plan *QueryPlan) hasTable(tableName string) bool {
+	for _, table := range plan.tables {
+		if table.TableName == tableName {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeColumns maps the fields of other's reference structs in plan.
+// Fields which refer to a column that plan has already mapped are
+// added as aliases of plan's mapping, so that they are never selected
+// twice; any others (from joins that only other has) are copied.
+func (plan *QueryPlan) mergeColumns(other *QueryPlan) {
+	for _, m := range other.colMap {
+		existing := plan.colMap.forColumn(m.quotedTable, m.quotedColumn, m.prefix)
+		if existing == nil {
+			copied := *m
+			plan.colMap = append(plan.colMap, &copied)
+			continue
+		}
+		if m.doSelect {
+			existing.doSelect = true
+		}
+		alias := *existing
+		alias.field = m.field
+		alias.parent = m.parent
+		if existing.selectTarget == existing.field {
+			alias.selectTarget = m.field
+		}
+		alias.doSelect = false
+		alias.merged = true
+		plan.colMap = append(plan.colMap, &alias)
+	}
+}
+
+// forColumn returns the mapping for the column quotedColumn of the
+// table quotedTable, or nil if it has not been mapped.
+func (structMap structColumnMap) forColumn(quotedTable, quotedColumn, prefix string) *fieldColumnMap {
+	for _, m := range structMap {
+		if !m.merged && m.quotedTable == quotedTable && m.quotedColumn == quotedColumn && m.prefix == prefix {
+			return m
+		}
+	}
+	return nil
+}
+
+// contains returns whether or not s is in values.
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
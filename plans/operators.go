@@ -0,0 +1,96 @@
+package plans
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+var (
+	// StandardOperators are the operators that filters.Op may use
+	// with any dialect.
+	StandardOperators = []string{
+		"=", "<>", "!=", "<", "<=", ">", ">=",
+		"like", "not like",
+		"is distinct from", "is not distinct from",
+	}
+
+	// PostgresOperators are the operators, in addition to
+	// StandardOperators, that filters.Op may use with postgresql.
+	PostgresOperators = []string{
+		"~", "~*", "!~", "!~*",
+		"similar to", "not similar to",
+		"ilike", "not ilike",
+		"@>", "<@", "&&",
+		"&", "|", "#",
+	}
+
+	// MySQLOperators are the operators, in addition to
+	// StandardOperators, that filters.Op may use with MySQL.
+	MySQLOperators = []string{
+		"<=>",
+		"regexp", "not regexp", "rlike", "not rlike",
+		"sounds like",
+		"&", "|", "^",
+	}
+
+	// SqliteOperators are the operators, in addition to
+	// StandardOperators, that filters.Op may use with sqlite.
+	SqliteOperators = []string{
+		"is", "is not",
+		"glob", "not glob",
+		"regexp", "not regexp",
+		"match",
+		"&", "|",
+	}
+)
+
+// dialectOperators returns the operators that the plan's dialect
+// allows, not including StandardOperators.
+func (plan *QueryPlan) dialectOperators() []string {
+	switch plan.dialect.(type) {
+	case gorp.PostgresDialect:
+		return PostgresOperators
+	case dialects.MySQLDialect:
+		return MySQLOperators
+	case dialects.SqliteDialect:
+		return SqliteOperators
+	}
+	return nil
+}
+
+// operatorAllowed returns whether or not op may be used in a
+// filters.OperatorFilter for this plan.  Operators are compared
+// case-insensitively, ignoring extra whitespace.
+func (plan *QueryPlan) operatorAllowed(op string) bool {
+	op = strings.ToLower(strings.Join(strings.Fields(op), " "))
+	for _, allowed := range [][]string{StandardOperators, plan.dialectOperators(), plan.operators} {
+		for _, candidate := range allowed {
+			if op == strings.ToLower(candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOperators returns an error if filter contains any
+// filters.OperatorFilter values with operators that are not allowed.
+func (plan *QueryPlan) checkOperators(filter filters.Filter) error {
+	switch src := filter.(type) {
+	case subFilterer:
+		for _, sub := range src.SubFilters() {
+			if err := plan.checkOperators(sub); err != nil {
+				return err
+			}
+		}
+	case *filters.OperatorFilter:
+		if !plan.operatorAllowed(src.Operator) {
+			return fmt.Errorf("gorq: Operator %q is not allowed for this dialect", src.Operator)
+		}
+	}
+	return nil
+}
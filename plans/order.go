@@ -14,21 +14,29 @@ type order struct {
 	direction      string
 }
 
-func (o order) OrderBy(dialect gorp.Dialect, colMap structColumnMap, bindIdx int) (string, []interface{}, error) {
+func (o order) OrderBy(dialect gorp.Dialect, colMap structColumnMap, bindIdx int, bindLiterals bool) (string, []interface{}, error) {
 	var (
 		wrapper      filters.SqlWrapper
 		allFields    []interface{}
 		multiWrapper filters.MultiSqlWrapper
+		bound        LiteralWrapper
 	)
-	switch t := o.fieldOrWrapper.(type) {
-	case filters.SqlWrapper:
-		wrapper = t
-		allFields = []interface{}{wrapper.ActualValue()}
-	case filters.MultiSqlWrapper:
-		multiWrapper = t
-		allFields = multiWrapper.ActualValues()
-	default:
-		allFields = []interface{}{o.fieldOrWrapper}
+	if literals, ok := o.fieldOrWrapper.(LiteralWrapper); ok && bindLiterals {
+		if values := literals.BoundValues(dialect); values != nil {
+			bound, allFields = literals, values
+		}
+	}
+	if bound == nil {
+		switch t := o.fieldOrWrapper.(type) {
+		case filters.SqlWrapper:
+			wrapper = t
+			allFields = []interface{}{wrapper.ActualValue()}
+		case filters.MultiSqlWrapper:
+			multiWrapper = t
+			allFields = multiWrapper.ActualValues()
+		default:
+			allFields = []interface{}{o.fieldOrWrapper}
+		}
 	}
 	// OrderBy needs at least one reference to a column of some sort.
 	fieldFound := false
@@ -53,10 +61,12 @@ func (o order) OrderBy(dialect gorp.Dialect, colMap structColumnMap, bindIdx int
 			"a wrapper with at least one struct field pointer as an actual value.")
 	}
 	var orderStr string
-	if wrapper != nil {
+	if bound != nil {
+		orderStr = bound.WrapSqlBound(dialect, columnsAndFields...)
+	} else if wrapper != nil {
 		orderStr = wrapper.WrapSql(columnsAndFields[0])
 	} else if multiWrapper != nil {
-		orderStr = multiWrapper.WrapSql(columnsAndFields...)
+		orderStr = wrapMulti(dialect, multiWrapper, columnsAndFields)
 	} else {
 		orderStr = columnsAndFields[0]
 	}
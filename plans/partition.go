@@ -0,0 +1,224 @@
+package plans
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// partitions returns copies of the plan which each select the rows
+// in one of n ranges of the column that keyFieldPtr points to.  Key
+// columns with an integer type are split evenly between their
+// minimum and maximum values; key columns with a string type are
+// assumed to hold UUIDs, and are split evenly across the UUID space
+// between their minimum and maximum values.
+func (plan *QueryPlan) partitions(keyFieldPtr interface{}, n int) ([]*QueryPlan, error) {
+	if n < 1 {
+		return nil, errors.New("gorq: A partitioned scan needs at least one partition")
+	}
+	if plan.limit > 0 || plan.offset > 0 {
+		return nil, errors.New("gorq: Plans with a limit or offset cannot be partitioned")
+	}
+	if _, err := plan.colMap.fieldMapForPointer(keyFieldPtr); err != nil {
+		return nil, err
+	}
+	var bounds []interface{}
+	switch reflect.TypeOf(keyFieldPtr).Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var min, max int64
+		if err := plan.keyRange(keyFieldPtr, &min, &max); err != nil {
+			return nil, err
+		}
+		bounds = intBounds(min, max, n)
+	case reflect.String:
+		var min, max string
+		if err := plan.keyRange(keyFieldPtr, &min, &max); err != nil {
+			return nil, err
+		}
+		bounds = stringBounds(min, max, n)
+	default:
+		return nil, fmt.Errorf("gorq: Cannot partition by a key of type %T", keyFieldPtr)
+	}
+
+	parts := make([]*QueryPlan, 0, n)
+	for i := 0; i < len(bounds)-1; i++ {
+		part, err := plan.Retarget(plan.dbMap, plan.executor)
+		if err != nil {
+			return nil, err
+		}
+		upper := filters.Less(keyFieldPtr, bounds[i+1])
+		if i == len(bounds)-2 {
+			upper = filters.LessOrEqual(keyFieldPtr, bounds[i+1])
+		}
+		part.andWhere(filters.GreaterOrEqual(keyFieldPtr, bounds[i]), upper)
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// keyRange stores the minimum and maximum values of the key column
+// that keyFieldPtr points to, among the rows that the plan selects, in
+// min and max, which must both be *int64 or both be *string.  If the
+// plan selects no rows, they are set to zero values.
+func (plan *QueryPlan) keyRange(keyFieldPtr, min, max interface{}) error {
+	rangePlan, err := plan.Retarget(plan.dbMap, plan.executor)
+	if err != nil {
+		return err
+	}
+	rangePlan.orderBy = nil
+	column, err := rangePlan.colMap.LocateTableAndColumn(keyFieldPtr)
+	if err != nil {
+		return err
+	}
+	zero := "0"
+	if _, isString := min.(*string); isString {
+		zero = "''"
+	}
+	for _, agg := range []struct {
+		fn     string
+		result interface{}
+	}{{"min", min}, {"max", max}} {
+		rangePlan.resetArgs()
+		if err := rangePlan.checkPolicies(SelectOperation); err != nil {
+			return err
+		}
+		buffer := rangePlan.getBuffer()
+		buffer.WriteString("select coalesce(" + agg.fn + "(" + column + "), " + zero + ")")
+		if err := rangePlan.writeSelectSuffix(buffer); err != nil {
+			bufPool.Put(buffer)
+			return err
+		}
+		query := buffer.String()
+		rangePlan.putBuffer(buffer)
+		if result, ok := agg.result.(*int64); ok {
+			*result, err = rangePlan.selectInt(query, rangePlan.getArgs()...)
+		} else {
+			err = rangePlan.selectScalar(agg.result, query, rangePlan.getArgs()...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// intBounds splits the range from min to max (inclusive) into at
+// most n ranges, returning their boundaries.
+func intBounds(min, max int64, n int) []interface{} {
+	size := (max - min + 1) / int64(n)
+	if size < 1 {
+		size = 1
+	}
+	bounds := []interface{}{min}
+	for i := 1; i < n; i++ {
+		bound := min + size*int64(i)
+		if bound >= max {
+			break
+		}
+		bounds = append(bounds, bound)
+	}
+	return append(bounds, max)
+}
+
+// uuidBounds splits the UUID space into n ranges, returning their
+// boundaries.
+func uuidBounds(n int) []interface{} {
+	bounds := make([]interface{}, 0, n+1)
+	for i := 0; i < n; i++ {
+		prefix := uint64(i) * (1 << 32) / uint64(n)
+		bounds = append(bounds, fmt.Sprintf("%08x-0000-0000-0000-000000000000", prefix))
+	}
+	return append(bounds, "ffffffff-ffff-ffff-ffff-ffffffffffff")
+}
+
+// stringBounds splits the range of string keys from min to max
+// (inclusive) into at most n ranges, returning their boundaries.  The
+// boundaries between min and max are those of an even split of the
+// UUID space (see uuidBounds), so keys which aren't lower case UUIDs
+// (e.g. upper case or braced UUIDs) are still selected, though the
+// ranges that they fall in may not be even.
+func stringBounds(min, max string, n int) []interface{} {
+	bounds := []interface{}{min}
+	for _, bound := range uuidBounds(n)[1:n] {
+		if s := bound.(string); s > min && s < max {
+			bounds = append(bounds, s)
+		}
+	}
+	return append(bounds, max)
+}
+
+// SelectPartitioned executes the plan's select statement as n
+// concurrent statements, each selecting one range of the key column
+// that keyFieldPtr points to (see EachPartitioned for how ranges are
+// chosen).  Results are returned in order of their partition, so
+// results are only ordered within each partition.
+//
+// Partitions are executed concurrently, so the plan's executor must
+// be safe for concurrent use (e.g. a DbMap, not a Transaction).
+func (plan *QueryPlan) SelectPartitioned(keyFieldPtr interface{}, n int) ([]interface{}, error) {
+	parts, err := plan.partitions(keyFieldPtr, n)
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]interface{}, len(parts))
+	err = runPartitions(parts, func(i int, part *QueryPlan) (err error) {
+		results[i], err = part.Select()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var merged []interface{}
+	for _, partResults := range results {
+		merged = append(merged, partResults...)
+	}
+	return merged, nil
+}
+
+// EachPartitioned executes the plan's select statement as n
+// concurrent statements, passing each result to fn as rows are read.
+// Each statement selects one range of the key column that
+// keyFieldPtr points to: integer keys are split evenly between their
+// minimum and maximum values, while string keys are assumed to be
+// UUIDs and split evenly across the UUID space between their minimum
+// and maximum values.
+//
+// fn is called concurrently from each partition, so it must be safe
+// for concurrent use.  If fn (or any partition) returns an error, the
+// first error is returned once every partition has stopped.
+func (plan *QueryPlan) EachPartitioned(keyFieldPtr interface{}, n int, fn func(result interface{}) error) error {
+	parts, err := plan.partitions(keyFieldPtr, n)
+	if err != nil {
+		return err
+	}
+	return runPartitions(parts, func(_ int, part *QueryPlan) error {
+		return part.scanRows(func(result reflect.Value) error {
+			return fn(result.Interface())
+		})
+	})
+}
+
+// runPartitions runs fn for each partition concurrently, returning
+// the first error encountered.
+func runPartitions(parts []*QueryPlan, fn func(i int, part *QueryPlan) error) error {
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part *QueryPlan) {
+			defer wg.Done()
+			if err := fn(i, part); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(i, part)
+	}
+	wg.Wait()
+	return firstErr
+}
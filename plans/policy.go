@@ -0,0 +1,187 @@
+package plans
+
+import (
+	"context"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// An Operation is the type of statement that a plan is executing.
+type Operation string
+
+const (
+	SelectOperation   Operation = "select"
+	InsertOperation   Operation = "insert"
+	UpdateOperation   Operation = "update"
+	DeleteOperation   Operation = "delete"
+	TruncateOperation Operation = "truncate"
+)
+
+// A PolicyFunc is run before a plan executes any statement.  It may
+// inspect the statement using the passed in *PolicyRequest and add
+// filters to its where clause, or return an error to prevent the
+// statement from being executed at all.  Any error returned will be
+// returned from the plan's execution method (Select, Update, etc).
+type PolicyFunc func(req *PolicyRequest) error
+
+// A PolicyRequest describes a statement that a plan is about to
+// execute, for use in a PolicyFunc.
+type PolicyRequest struct {
+	plan *QueryPlan
+
+	// Operation is the type of statement being executed.  Count()
+	// and sub-queries are both treated as SelectOperation.
+	Operation Operation
+}
+
+// Context returns the context that the plan was created with, or
+// context.Background() if it was created without one.
+func (req *PolicyRequest) Context() context.Context {
+	if req.plan.ctx == nil {
+		return context.Background()
+	}
+	return req.plan.ctx
+}
+
+// Table returns the table that the statement is being executed
+// against.
+func (req *PolicyRequest) Table() *gorp.TableMap {
+	return req.plan.table
+}
+
+// Tables returns all tables that have been mapped for the statement,
+// including joined tables.
+func (req *PolicyRequest) Tables() []*gorp.TableMap {
+	return req.plan.tables
+}
+
+// Columns returns the columns that the statement will select (for
+// SelectOperation) or assign (for InsertOperation and
+// UpdateOperation).
+func (req *PolicyRequest) Columns() []*gorp.ColumnMap {
+	switch req.Operation {
+	case InsertOperation, UpdateOperation:
+		return req.plan.assignColMaps
+	case SelectOperation:
+		cols := make([]*gorp.ColumnMap, 0, len(req.plan.colMap))
+		for _, m := range req.plan.colMap {
+			if m.doSelect {
+				cols = append(cols, m.column)
+			}
+		}
+		return cols
+	}
+	return nil
+}
+
+// Filters returns the filters that have been added to the where
+// clause of the statement, or nil if there are none.  Filters added
+// using Filter are not included.
+func (req *PolicyRequest) Filters() filters.Filter {
+	return req.plan.whereBranches()
+}
+
+// FieldsFor returns the pointers to fields in the plan's reference
+// structs which map to col.  This is the easiest way to construct
+// filters against a column in a PolicyFunc, since it likely does not
+// have access to the reference structs.  If a table has been joined
+// more than once, there will be one field per join.
+func (req *PolicyRequest) FieldsFor(col *gorp.ColumnMap) []interface{} {
+	var fields []interface{}
+	for _, m := range req.plan.colMap {
+		if m.column == col && !m.merged {
+			fields = append(fields, m.field)
+		}
+	}
+	return fields
+}
+
+// Filter adds filters to the where clause of the statement.  They
+// will be combined with the plan's own filters using AND, and only
+// apply to the current execution of the plan.
+func (req *PolicyRequest) Filter(filters ...filters.Filter) {
+	req.plan.policyFilters = append(req.plan.policyFilters, filters...)
+}
+
+// FilterFor adds filters which restrict the rows of the table that
+// field (e.g. one of the fields returned by FieldsFor) belongs to.  If
+// that table was joined, the filters are added to the join's on
+// clause, so that left joins still return rows which have no match in
+// the joined table; otherwise, they are added to the where clause, as
+// with Filter.
+func (req *PolicyRequest) FilterFor(field interface{}, conditions ...filters.Filter) {
+	join := req.plan.joinFor(field)
+	if join == nil {
+		req.Filter(conditions...)
+		return
+	}
+	if req.plan.policyJoins == nil {
+		req.plan.policyJoins = make(map[*filters.JoinFilter][]filters.Filter)
+	}
+	req.plan.policyJoins[join] = append(req.plan.policyJoins[join], conditions...)
+}
+
+// joinFor returns the join for the table that field belongs to, or nil
+// if field belongs to the plan's own table (or isn't mapped at all).
+func (plan *QueryPlan) joinFor(field interface{}) *filters.JoinFilter {
+	m, err := plan.colMap.fieldMapForPointer(field)
+	if err != nil {
+		return nil
+	}
+	plan.storeJoin()
+	for _, join := range plan.joins {
+		if joinName(join) == m.quotedTable {
+			return join
+		}
+	}
+	return nil
+}
+
+// joinWithPolicies returns join, including any filters that policies
+// have added to its on clause.
+func (plan *QueryPlan) joinWithPolicies(join *filters.JoinFilter) *filters.JoinFilter {
+	extra := plan.policyJoins[join]
+	if len(extra) == 0 {
+		return join
+	}
+	scoped := &filters.JoinFilter{Type: join.Type, QuotedJoinTable: join.QuotedJoinTable, QuotedAlias: join.QuotedAlias}
+	scoped.Add(join.SubFilters()...)
+	scoped.Add(extra...)
+	return scoped
+}
+
+// checkPolicies runs the plan's policies for op, returning the first
+// error encountered.
+func (plan *QueryPlan) checkPolicies(op Operation) error {
+	plan.policyFilters = nil
+	plan.policyJoins = nil
+	req := &PolicyRequest{plan: plan, Operation: op}
+	for _, policy := range plan.policies {
+		if err := policy(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whereFilter returns the filter that should be used for the where
+// clause of the plan, including any filters added by policies.
+func (plan *QueryPlan) whereFilter() filters.Filter {
+	branches := plan.whereBranches()
+	if len(plan.policyFilters) == 0 {
+		return branches
+	}
+	where := make([]filters.Filter, 0, len(plan.policyFilters)+1)
+	if branches != nil && !isEmpty(branches) {
+		where = append(where, branches)
+	}
+	return filters.And(append(where, plan.policyFilters...)...)
+}
+
+// isEmpty returns whether or not filter is a combined filter with no
+// sub-filters.
+func isEmpty(filter filters.Filter) bool {
+	combined, ok := filter.(subFilterer)
+	return ok && len(combined.SubFilters()) == 0
+}
@@ -0,0 +1,99 @@
+package plans
+
+import (
+	"strings"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// unusedJoins returns the plan's left joins which can be left out of
+// its select statement without changing its results.  Since a left
+// join never removes rows, a join whose condition matches at most one
+// joined row (see pinsPrimaryKey) can be left out when none of its
+// columns are selected or used anywhere else in the statement.  Only
+// joins to tables (not sub-queries) are considered.
+func (plan *QueryPlan) unusedJoins() map[*filters.JoinFilter]bool {
+	plan.storeJoin()
+	joins := make([]*filters.JoinFilter, 0, len(plan.joins))
+	for _, join := range plan.joins {
+		joins = append(joins, plan.joinWithPolicies(join))
+	}
+	where := plan.whereFilter()
+	var unused map[*filters.JoinFilter]bool
+	for i, join := range plan.joins {
+		if !strings.HasPrefix(join.Type, "left") || strings.Contains(join.QuotedJoinTable, " ") {
+			continue
+		}
+		name := joinName(join)
+		if !plan.pinsPrimaryKey(join, name) || plan.tableReferenced(name, joins, i, where) {
+			continue
+		}
+		if unused == nil {
+			unused = make(map[*filters.JoinFilter]bool)
+		}
+		unused[join] = true
+	}
+	return unused
+}
+
+// joinName returns the quoted alias of join, or the quoted name of
+// its table if it has no alias.
+func joinName(join *filters.JoinFilter) string {
+	if join.QuotedAlias == "" || join.QuotedAlias == "-" {
+		return join.QuotedJoinTable
+	}
+	return join.QuotedAlias
+}
+
+// pinsPrimaryKey returns whether or not the condition of join (whose
+// table is quotedTable) compares every primary key column of the
+// joined table for equality with something outside of that table, so
+// that it matches at most one joined row.
+func (plan *QueryPlan) pinsPrimaryKey(join *filters.JoinFilter, quotedTable string) bool {
+	pinned := make(map[*gorp.ColumnMap]bool)
+	for _, filter := range join.SubFilters() {
+		comparison, ok := filter.(*filters.ComparisonFilter)
+		if !ok || strings.TrimSpace(comparison.Comparison) != "=" || comparison.RightMod != nil {
+			continue
+		}
+		if col := plan.keyColumnIn(comparison.Left, quotedTable); col != nil && !plan.inTable(comparison.Right, quotedTable) {
+			pinned[col] = true
+		}
+		if col := plan.keyColumnIn(comparison.Right, quotedTable); col != nil && !plan.inTable(comparison.Left, quotedTable) {
+			pinned[col] = true
+		}
+	}
+	keys := 0
+	for _, m := range plan.colMap {
+		if m.quotedTable != quotedTable || !isPrimaryKey(m.column) {
+			continue
+		}
+		if !pinned[m.column] {
+			return false
+		}
+		keys++
+	}
+	return keys > 0
+}
+
+// keyColumnIn returns the primary key column that value points to, if
+// it is a field for a primary key column of quotedTable.
+func (plan *QueryPlan) keyColumnIn(value interface{}, quotedTable string) *gorp.ColumnMap {
+	m, err := plan.colMap.fieldMapForPointer(value)
+	if err != nil || m.quotedTable != quotedTable || !isPrimaryKey(m.column) {
+		return nil
+	}
+	return m.column
+}
+
+// inTable returns whether or not value refers to any column of
+// quotedTable.
+func (plan *QueryPlan) inTable(value interface{}, quotedTable string) bool {
+	for _, column := range plan.referencedColumns(value) {
+		if columnInTable(column, quotedTable) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,11 +2,14 @@ package plans
 
 import (
 	"bytes"
+	"context"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/outdoorsy/gorp"
 	"github.com/outdoorsy/gorq/dialects"
@@ -27,14 +30,14 @@ var bufPool = sync.Pool{
 type tableAlias struct {
 	*gorp.TableMap
 	quotedFromClause string
-	dialect          gorp.Dialect
+	plan             *QueryPlan
 }
 
 func (t tableAlias) tableForFromClause() string {
 	if t.quotedFromClause != "" {
 		return t.quotedFromClause
 	}
-	return t.dialect.QuotedTableForQuery(t.SchemaName, t.TableName)
+	return t.plan.quoteTable(t.SchemaName, t.TableName)
 }
 
 // subQuery is provided to use plan types as sub-queries in from/join
@@ -46,6 +49,9 @@ type subQuery interface {
 	getColMap() structColumnMap
 	errors() []error
 	selectQuery() (string, error)
+	subSelectQuery(argOffset int) (string, []interface{}, error)
+	compoundSelect(argOffset int) (string, []interface{}, error)
+	selectedAliases() []string
 	getArgs() []interface{}
 }
 
@@ -57,12 +63,173 @@ type UnmappedSubQuery interface {
 	SelectQuery(table *gorp.TableMap, col *gorp.ColumnMap, tableAlias string, tablePrefix string) (query string, columns []string)
 }
 
+// A JoinFunc is the original, function-based form of a
+// JoinStrategy.  Its return values match the Type, Target, Select,
+// and Constraints fields of a JoinSpec.
 type JoinFunc func(parent, field interface{}) (joinType string, joinTarget, selectionField interface{}, constraints []filters.Filter)
 
+// A JoinOp registers a JoinStrategy for a column.  Either Join or
+// Strategy may be set; if both are, Strategy is used.
 type JoinOp struct {
-	Table  *gorp.TableMap
-	Column *gorp.ColumnMap
-	Join   JoinFunc
+	Table    *gorp.TableMap
+	Column   *gorp.ColumnMap
+	Join     JoinFunc
+	Strategy JoinStrategy
+}
+
+// Options contains settings that apply to a plan from the moment it
+// is created.  It is mostly useful for types (like gorq.DbMap) which
+// create many plans with the same settings.
+type Options struct {
+	// JoinOps are the JoinOp values that will be used to map the
+	// plan's fields.  See Query().
+	JoinOps []JoinOp
+
+	// Logger, if non-nil, will be passed every statement that the
+	// plan executes, along with its arguments, prefixed with
+	// LogPrefix.
+	Logger    Logger
+	LogPrefix string
+
+	// SensitiveColumns are columns whose values should never be
+	// logged.  Any argument bound against one of these columns, in
+	// either an assignment or a filter, will be logged as Redacted.
+	SensitiveColumns []*gorp.ColumnMap
+
+	// LazyColumns are left out of select statements unless their
+	// fields are requested using Fields or AddField.  Their values can
+	// be loaded on demand using LoadFields.  Fields may also be
+	// marked as lazy using a `select:"-"` tag, e.g.
+	//
+	//     Description string `db:"description" select:"-"`
+	LazyColumns []*gorp.ColumnMap
+
+	// Policies will be run, in order, before the plan executes any
+	// statement.  See PolicyFunc.
+	Policies []PolicyFunc
+
+	// Identifiers controls how the plan quotes table, column, and
+	// alias names.  See IdentifierPolicy.
+	Identifiers IdentifierPolicy
+
+	// Context is the context that the plan is being created for.  It
+	// is passed along to policies.
+	Context context.Context
+
+	// ChangeHooks will be called after the plan successfully
+	// executes an INSERT, UPDATE, or DELETE statement, even if it is
+	// executed within a transaction that hasn't been committed (see
+	// gorq.DbMap.OnChange for hooks that wait for commits).  See
+	// Change.
+	ChangeHooks []ChangeFunc
+
+	// WarningHooks will be called before the plan executes a
+	// statement while it has warnings.  See QueryPlan.Warnings.
+	WarningHooks []WarningFunc
+
+	// IndexAdvisor, if non-nil, explains each distinct statement
+	// that the plan executes and reports sequential scans of large
+	// tables.  It should only be set in development.
+	IndexAdvisor *IndexAdvisor
+
+	// Rewriters are applied, in order, to each statement that the
+	// plan executes, and may replace its SQL and arguments.  See
+	// Rewriter.
+	Rewriters []Rewriter
+
+	// Views maps structs to views, for types that the plan's DbMap
+	// doesn't map to a table.  Keeping views out of the DbMap stops
+	// gorp from creating tables for them.  Views can be selected from
+	// like tables; inserting, updating, and deleting rows relies on
+	// the database (e.g. INSTEAD OF triggers), and generated keys are
+	// not read back after inserts.
+	Views *gorp.DbMap
+
+	// Limits will cause the plan to return a *LimitError instead of
+	// executing statements that are too large.  See Limits.
+	Limits Limits
+
+	// Operators are allowed in filters.Op filters, in addition to
+	// the operators that are allowed for the plan's dialect (see
+	// StandardOperators, PostgresOperators, etc).
+	Operators []string
+
+	// HeavySemaphore limits how many plans marked with Heavy may
+	// execute statements at the same time.
+	HeavySemaphore Semaphore
+
+	// JSONEncoder, if non-nil, is used in place of encoding/json to
+	// encode exported values (see ExportNDJSON).  JSONHooks override
+	// it for values of specific types.
+	JSONEncoder JSONEncoder
+	JSONHooks   map[reflect.Type]JSONHook
+
+	// CommentTags are read from the plan's context and appended to
+	// each statement that it executes as an SQL comment, formatted
+	// according to CommentFormat, so that statements can be
+	// correlated with the requests that executed them (e.g. in
+	// pg_stat_activity).  Values are converted to strings using
+	// fmt.Sprint, and tags with no value in the context are left out.
+	CommentTags   []CommentTag
+	CommentFormat CommentFormat
+
+	// NoInlining causes values that wrappers usually inline into
+	// their SQL as literals (see LiteralWrapper) to be passed as bind
+	// variables instead, so that the text of the plan's statements
+	// only depends on their shape.
+	NoInlining bool
+
+	// ComputedColumns maps transient columns (i.e. fields tagged with
+	// db:"-") to SQL expressions, which are selected into those
+	// fields by default and used in place of a column when their
+	// fields are used in filters or ordering.  Other columns of the
+	// same table are referenced by name in braces, e.g.
+	//
+	//     {first_name} || ' ' || {last_name}
+	//
+	// and will be qualified with the table's name (or alias).
+	ComputedColumns map[*gorp.ColumnMap]string
+
+	// IndexExpressions map computed columns to the canonical form of
+	// their expressions in an expression index, using the same syntax
+	// as ComputedColumns.  When a computed column is used in a where
+	// or having clause, its index expression is used in place of its
+	// expression, so that the database can match the filter to the
+	// index.  For example, postgresql stores the index
+	//
+	//     create index on people (lower(first_name || ' ' || last_name))
+	//
+	// as lower(((first_name || ' '::text) || last_name)), which can
+	// be used with:
+	//
+	//     lower((({first_name} || ' '::text) || {last_name}))
+	IndexExpressions map[*gorp.ColumnMap]string
+
+	// DefaultLimit, if positive, is used as the limit of select
+	// statements which don't set their own (see Limit).  Counts and
+	// sub-queries are not limited.
+	DefaultLimit int64
+
+	// Timeout, if positive, limits how long each statement that the
+	// plan executes may run, by executing it with a context that is
+	// canceled after Timeout.
+	Timeout time.Duration
+
+	// RequireWhere causes UPDATE and DELETE statements without a
+	// where clause to return ErrNoWhere instead of executing.
+	RequireWhere bool
+
+	// ReadOnly causes every statement other than SELECT to return
+	// ErrReadOnly instead of executing.  See QueryPlan.ReadOnly.
+	ReadOnly bool
+
+	// ReferenceJoinType, if set, is the join type (e.g. "left
+	// outer") used for joins made by QueryPlan.AutoJoin and for
+	// JoinSpecs without a Type, which are otherwise inner joins.
+	// AutoJoinType makes both choose the join type by the nullability
+	// of the reference, which AutoJoin does by default.  Joins with an
+	// explicit type are unaffected.
+	ReferenceJoinType string
 }
 
 // A QueryPlan is a Query.  It returns itself on most method calls;
@@ -80,6 +247,20 @@ type JoinOp struct {
 //
 // For details about what you need in order to generate a query with
 // this logic, see DbMap.Query().
+//
+// The SQL that a QueryPlan generates is stable: two plans built with
+// the same method calls (in the same order, against the same table
+// mappings) will always generate byte-for-byte identical SQL, and
+// executing a plan more than once generates the same SQL each time.
+// Columns are selected in struct field order, tables are joined in
+// the order that they were added, and bind variables are numbered in
+// the order that their values appear in the statement.  Only the
+// arguments vary with the values passed in, so generated SQL is safe
+// to use as a key for statement metrics or in snapshot tests.  The
+// exceptions are the number of bind variables in an IN list, which
+// follows the number of values in it, and literals that wrappers
+// inline (like the fraction of a percentile), which are bound instead
+// if Options.NoInlining is set.
 type QueryPlan struct {
 	// Errors is a slice of error valuues encountered during query
 	// construction.  This is to allow cascading method calls, e.g.
@@ -101,51 +282,152 @@ type QueryPlan struct {
 
 	table          *gorp.TableMap
 	dbMap          *gorp.DbMap
+	dialect        gorp.Dialect
 	quotedTable    string
 	executor       gorp.SqlExecutor
 	target         reflect.Value
 	colMap         structColumnMap
 	joins          []*filters.JoinFilter
 	lastRefs       []filters.Filter
+	lastRefFields  []interface{}
 	assignCols     []string
 	assignBindVars []string
 	assignArgs     []interface{}
+	assignExprs    []*assignExpr
 	filters        filters.MultiFilter
 	orderBy        []order
 	groupBy        []string
+	having         []filters.Filter
 	limit          int64
 	offset         int64
 	args           []interface{}
 	argLen         int
+	argOffset      int
 	argLock        sync.RWMutex
 	tables         []*gorp.TableMap
 	distinctFields []interface{}
 	forUpdate      bool
 	forUpdateOf    string
+	logger         Logger
+	logPrefix      string
+	sensitiveCols  []*gorp.ColumnMap
+	sensitiveArgs  map[int]bool
+	lazyCols       []*gorp.ColumnMap
+	computedCols   map[*gorp.ColumnMap]string
+	indexExprs     map[*gorp.ColumnMap]string
+	filtering      bool
+	defaultLimit   int64
+	timeout        time.Duration
+	requireWhere   bool
+	readOnly       bool
+	refJoinType    string
+	nested         bool
+	maxRows        int
+	truncated      bool
+	commentTags    []CommentTag
+	commentFormat  CommentFormat
+	comments       []string
+	commonTables   []commonTable
+	trimmed        bool
+	prunedJoins    map[*filters.JoinFilter]bool
+	compounds      []compound
+	noInlining     bool
+	ctx            context.Context
+	policies       []PolicyFunc
+	policyFilters  []filters.Filter
+	policyJoins    map[*filters.JoinFilter][]filters.Filter
+	orBranches     []filters.Filter
+	params         map[string]interface{}
+	operators      []string
+	assignColMaps  []*gorp.ColumnMap
+	changeHooks    []ChangeFunc
+	warningHooks   []WarningFunc
+	indexAdvisor   *IndexAdvisor
+	rewriters      []Rewriter
+	views          *gorp.DbMap
+	identifiers    IdentifierPolicy
+	limits         Limits
+	heavy          bool
+	heavySemaphore Semaphore
+	jsonEncoder    JSONEncoder
+	jsonHooks      map[reflect.Type]JSONHook
+
+	// returningTarget is the pointer to a slice passed to
+	// ReturningInto, if any.
+	returningTarget reflect.Value
+
+	// conflictWhere and conflictConstraint narrow the conflict target
+	// of upserts.  See ConflictWhere and ConflictConstraint.
+	conflictWhere      []filters.Filter
+	conflictConstraint string
+
+	// joinedSubQueries maps the join tables of joined sub-queries that
+	// have arguments to the sub-queries, since their SQL must be
+	// generated with bind variables numbered for the statement that
+	// joins them.
+	joinedSubQueries map[string]joinedSubQuery
+
+	// batches are the to-many associations that are loaded after
+	// each select, for JoinSpecs with a BatchSpec.
+	batches []batchJoin
+
+	// vals is the stack of values used by sqlValues, and sizeHint is
+	// the length of the last statement generated, to cut down on
+	// allocations when a plan is executed more than once.
+	vals     []string
+	sizeHint int
 }
 
 // Query generates a Query for a target model.  The target that is
 // passed in must be a pointer to a struct, and will be used as a
-// reference for query construction.
+// reference for query construction.  m is not modified, so it is safe
+// to create plans while m is in use elsewhere; plans use the wrappers
+// from the dialects package (see dialects.Wrap) for their own SQL.
 func Query(m *gorp.DbMap, exec gorp.SqlExecutor, target interface{}, joinOps ...JoinOp) interfaces.Query {
-	// Handle non-standard dialects
-	switch src := m.Dialect.(type) {
-	case gorp.MySQLDialect:
-		m.Dialect = dialects.MySQLDialect{src}
-	case gorp.SqliteDialect:
-		m.Dialect = dialects.SqliteDialect{src}
-	default:
-	}
+	return QueryWithOptions(m, exec, target, Options{JoinOps: joinOps})
+}
+
+// QueryWithOptions is Query, but with more settings than just the
+// JoinOp values.  See Options for details.
+func QueryWithOptions(m *gorp.DbMap, exec gorp.SqlExecutor, target interface{}, options Options) interfaces.Query {
 	plan := &QueryPlan{
-		dbMap:    m,
-		executor: exec,
+		dbMap:          m,
+		dialect:        dialects.Wrap(m.Dialect),
+		executor:       exec,
+		logger:         options.Logger,
+		logPrefix:      options.LogPrefix,
+		sensitiveCols:  options.SensitiveColumns,
+		lazyCols:       options.LazyColumns,
+		computedCols:   options.ComputedColumns,
+		indexExprs:     options.IndexExpressions,
+		defaultLimit:   options.DefaultLimit,
+		timeout:        options.Timeout,
+		requireWhere:   options.RequireWhere,
+		readOnly:       options.ReadOnly,
+		refJoinType:    options.ReferenceJoinType,
+		commentTags:    options.CommentTags,
+		commentFormat:  options.CommentFormat,
+		noInlining:     options.NoInlining,
+		ctx:            options.Context,
+		policies:       options.Policies,
+		changeHooks:    options.ChangeHooks,
+		warningHooks:   options.WarningHooks,
+		indexAdvisor:   options.IndexAdvisor,
+		rewriters:      options.Rewriters,
+		views:          options.Views,
+		identifiers:    options.Identifiers,
+		limits:         options.Limits,
+		operators:      options.Operators,
+		heavySemaphore: options.HeavySemaphore,
+		jsonEncoder:    options.JSONEncoder,
+		jsonHooks:      options.JSONHooks,
 	}
 
 	targetVal := reflect.ValueOf(target)
 	if targetVal.Kind() != reflect.Ptr || targetVal.Elem().Kind() != reflect.Struct {
 		plan.Errors = append(plan.Errors, errors.New("A query target must be a pointer to struct"))
 	}
-	targetTable, _, err := plan.mapTable(targetVal, joinOps...)
+	targetTable, _, err := plan.mapTable(targetVal, options.JoinOps...)
 	if err != nil {
 		plan.Errors = append(plan.Errors, err)
 		return plan
@@ -179,6 +461,15 @@ func (plan *QueryPlan) getArgs() []interface{} {
 	plan.argLock.RUnlock()
 	return args
 }
+
+// argCount returns the number of arguments currently bound, without
+// copying them.
+func (plan *QueryPlan) argCount() int {
+	plan.argLock.RLock()
+	defer plan.argLock.RUnlock()
+	return len(plan.args)
+}
+
 func (plan *QueryPlan) appendArgs(args ...interface{}) {
 	plan.argLock.Lock()
 	plan.args = append(plan.args, args...)
@@ -188,13 +479,26 @@ func (plan *QueryPlan) appendArgs(args ...interface{}) {
 func (plan *QueryPlan) resetArgs() {
 	plan.argLock.Lock()
 	plan.args = nil
+	plan.vals = plan.vals[:0]
+	if plan.argOffset > 0 {
+		// Placeholders for the arguments of the statement that this
+		// plan is a sub-query of.
+		plan.args = make([]interface{}, plan.argOffset)
+	}
 	if len(plan.assignArgs) > 0 {
 		plan.args = append(plan.args, plan.assignArgs...)
 	}
 	if subQuery, ok := plan.target.Interface().(subQuery); ok {
-		plan.args = append(plan.args, subQuery.getArgs()...)
+		if _, isCommonTable := plan.commonTable(subQuery); !isCommonTable {
+			plan.args = append(plan.args, subQuery.getArgs()...)
+		}
 	}
 	plan.argLen = len(plan.args)
+	for i := range plan.sensitiveArgs {
+		if i >= len(plan.assignArgs) {
+			delete(plan.sensitiveArgs, i)
+		}
+	}
 	plan.argLock.Unlock()
 }
 
@@ -206,17 +510,53 @@ func (plan *QueryPlan) mapSubQuery(q subQuery) *tableAlias {
 	if len(q.errors()) != 0 {
 		plan.Errors = append(plan.Errors, q.errors()...)
 	}
-	query, err := q.selectQuery()
-	if err != nil {
-		plan.Errors = append(plan.Errors, err)
+	joined := plan.table != nil
+	commonTable, isCommonTable := plan.commonTable(q)
+	var query string
+	if !isCommonTable {
+		var err error
+		query, err = q.selectQuery()
+		if err != nil {
+			plan.Errors = append(plan.Errors, err)
+		}
+	}
+	name, alias := q.getTable().TableName, q.QuotedTable()
+	if joined && alias == plan.QuotedTable() {
+		// Joining a sub-query against its own table; it needs a
+		// distinct name.
+		name = fmt.Sprintf("%s_%d", name, len(plan.joins)+1)
+		alias = plan.quoteField(name)
 	}
-	alias := q.QuotedTable()
 	quotedFromClause := fmt.Sprintf("(%s) as %s", query, alias)
-	for _, m := range q.getColMap() {
-		m.quotedTable = alias
-		plan.colMap = append(plan.colMap, m)
+	if isCommonTable {
+		// Its query is in the WITH clause, along with its arguments.
+		quotedFromClause = plan.commonTableClause(commonTable, alias)
+	} else if joined && len(q.getArgs()) > 0 {
+		if plan.joinedSubQueries == nil {
+			plan.joinedSubQueries = make(map[string]joinedSubQuery)
+		}
+		plan.joinedSubQueries[quotedFromClause] = joinedSubQuery{query: q, alias: alias}
 	}
-	return &tableAlias{TableMap: q.getTable(), dialect: plan.dbMap.Dialect, quotedFromClause: quotedFromClause}
+	for _, m := range q.getColMap() {
+		if !m.doSelect {
+			// Only the columns that the sub-query selects can be
+			// referenced from outside of it.
+			continue
+		}
+		// Outside of the sub-query, its columns are referenced by
+		// alias, and any select wrappers or joins have already been
+		// applied.
+		subMap := *m
+		subMap.quotedTable = alias
+		subMap.quotedColumn = plan.quoteField(m.alias)
+		subMap.tableName = name
+		subMap.selectTarget = m.field
+		subMap.join = nil
+		subMap.doSelect = !joined
+		subMap.fromSubQuery = true
+		plan.colMap = append(plan.colMap, &subMap)
+	}
+	return &tableAlias{TableMap: q.getTable(), plan: plan, quotedFromClause: quotedFromClause}
 }
 
 func (plan *QueryPlan) mapTable(targetVal reflect.Value, joinOps ...JoinOp) (*tableAlias, string, error) {
@@ -289,7 +629,7 @@ func (plan *QueryPlan) mapTable(targetVal reflect.Value, joinOps ...JoinOp) (*ta
 	}
 
 	if targetTable == nil {
-		targetTable, err = plan.dbMap.TableFor(targetVal.Type().Elem(), false)
+		targetTable, err = plan.tableFor(targetVal.Type().Elem())
 		if err != nil {
 			return nil, "", err
 		}
@@ -297,6 +637,7 @@ func (plan *QueryPlan) mapTable(targetVal reflect.Value, joinOps ...JoinOp) (*ta
 	plan.tables = append(plan.tables, targetTable)
 
 	plan.lastRefs = make([]filters.Filter, 0, 2)
+	plan.lastRefFields = nil
 
 	if isSubQuery {
 		// Get the columns from the sub-query's select statement.
@@ -311,12 +652,12 @@ func (plan *QueryPlan) mapTable(targetVal reflect.Value, joinOps ...JoinOp) (*ta
 				}
 			}
 		}
-		return &tableAlias{TableMap: targetTable, dialect: plan.dbMap.Dialect, quotedFromClause: query}, alias, nil
+		return &tableAlias{TableMap: targetTable, plan: plan, quotedFromClause: query}, alias, nil
 	}
 	if err = plan.mapColumns(parentMap, targetVal.Interface(), targetTable, targetVal, prefix, joinOps...); err != nil {
 		return nil, "", err
 	}
-	return &tableAlias{TableMap: targetTable, dialect: plan.dbMap.Dialect}, alias, nil
+	return &tableAlias{TableMap: targetTable, plan: plan}, alias, nil
 }
 
 // fieldByIndex is a copy of v.FieldByIndex, except that it will
@@ -361,7 +702,7 @@ func fieldOrNilByIndex(v reflect.Value, index []int) reflect.Value {
 }
 
 type referenceFilter struct {
-	clause string
+	leftTable, leftCol, rightTable, rightCol string
 }
 
 func (filter *referenceFilter) ActualValues() []interface{} {
@@ -369,12 +710,15 @@ func (filter *referenceFilter) ActualValues() []interface{} {
 }
 
 func (filter *referenceFilter) Where(...string) string {
-	return filter.clause
+	return fmt.Sprintf("%s.%s = %s.%s", filter.leftTable, filter.leftCol, filter.rightTable, filter.rightCol)
 }
 
 func reference(leftTable, leftCol, rightTable, rightCol string) filters.Filter {
 	return &referenceFilter{
-		clause: fmt.Sprintf("%s.%s = %s.%s", leftTable, leftCol, rightTable, rightCol),
+		leftTable:  leftTable,
+		leftCol:    leftCol,
+		rightTable: rightTable,
+		rightCol:   rightCol,
 	}
 }
 
@@ -389,12 +733,14 @@ func (plan *QueryPlan) mapColumns(parentMap *fieldColumnMap, parent interface{},
 		plan.colMap = make(structColumnMap, 0, value.NumField())
 	}
 	queryableFields := 0
-	quotedTableName := plan.dbMap.Dialect.QuoteField(strings.TrimSuffix(prefix, "_"))
+	tableName := strings.TrimSuffix(prefix, "_")
+	quotedTableName := plan.quoteField(tableName)
 	if prefix == "" || prefix == "-" {
-		quotedTableName = plan.dbMap.Dialect.QuotedTableForQuery(table.SchemaName, table.TableName)
+		tableName = table.TableName
+		quotedTableName = plan.quoteTable(table.SchemaName, table.TableName)
 	}
 	for _, col := range table.Columns {
-		shouldSelect := !col.Transient && prefix != "-"
+		shouldSelect := !col.Transient && prefix != "-" && !plan.isLazy(value.Type(), col)
 		if value.Type().FieldByIndex(col.FieldIndex()).PkgPath != "" {
 			// TODO: What about anonymous fields?
 			// Don't map unexported fields
@@ -408,7 +754,7 @@ func (plan *QueryPlan) mapColumns(parentMap *fieldColumnMap, parent interface{},
 			colPrefix = prefix + col.JoinPrefix()
 		}
 		fieldRef := field.Addr().Interface()
-		quotedCol := plan.dbMap.Dialect.QuoteField(col.ColumnName)
+		quotedCol := plan.quoteField(col.ColumnName)
 		if prefix != "-" && prefix != "" {
 			// This means we're mapping an embedded struct, so we can
 			// sort of autodetect some reference columns.
@@ -419,6 +765,7 @@ func (plan *QueryPlan) mapColumns(parentMap *fieldColumnMap, parent interface{},
 				fieldMap, err := plan.colMap.fieldMapForPointer(fieldRef)
 				if err == nil {
 					plan.lastRefs = append(plan.lastRefs, reference(fieldMap.quotedTable, fieldMap.quotedColumn, quotedTableName, quotedCol))
+					plan.lastRefFields = append(plan.lastRefFields, fieldMap.field)
 					shouldSelect = false
 				}
 			}
@@ -433,16 +780,16 @@ func (plan *QueryPlan) mapColumns(parentMap *fieldColumnMap, parent interface{},
 			prefix:       colPrefix,
 			quotedTable:  quotedTableName,
 			quotedColumn: quotedCol,
+			tableName:    tableName,
 			doSelect:     shouldSelect,
 		}
-		for _, op := range joinOps {
-			if op.Table == table && op.Column == col {
-				fieldMap.join = op.Join
-			}
+		if computed, ok := plan.computedExpr(col, quotedTableName); ok {
+			fieldMap.selectTarget = computed
+			fieldMap.doSelect = prefix != "-" && !plan.isLazy(value.Type(), col)
 		}
 		for _, op := range joinOps {
 			if table == op.Table && col == op.Column {
-				fieldMap.join = op.Join
+				fieldMap.join = op.strategy()
 				break
 			}
 		}
@@ -475,7 +822,7 @@ func (plan *QueryPlan) mapColumns(parentMap *fieldColumnMap, parent interface{},
 // If you want to make your own extensions, just make sure to register
 // the constructor using RegisterExtension().
 func (plan *QueryPlan) Extend() interface{} {
-	extendedQuery, err := LoadExtension(plan.dbMap.Dialect, plan)
+	extendedQuery, err := LoadExtension(plan.dialect, plan)
 	if err != nil {
 		plan.Errors = append(plan.Errors, err)
 		return nil
@@ -484,8 +831,15 @@ func (plan *QueryPlan) Extend() interface{} {
 }
 
 // Fields restricts the columns being selected in a select query to
-// just those matching the passed in field pointers.
+// just those matching the passed in field pointers.  Left joins that
+// are left with no selected columns, and that nothing else in the
+// statement uses, are left out of it when their join condition
+// compares every primary key column of the joined table to a column
+// of another table (or a value), since they can match at most one row.
+// Only references made through fields count as uses of a join; raw
+// SQL which names a joined table's columns will not keep its join.
 func (plan *QueryPlan) Fields(fields ...interface{}) interfaces.SelectionQuery {
+	plan.trimmed = true
 	for _, field := range plan.colMap {
 		field.doSelect = false
 	}
@@ -511,18 +865,38 @@ func (plan *QueryPlan) AddField(fieldPtr interface{}) interfaces.SelectionQuery
 	}
 	m.doSelect = true
 	if m.join != nil {
-		joinType, joinTarget, joinField, constraints := m.join(m.parent, m.field)
-		if joinTarget == nil {
-			// This means to not bother joining.
-			m.doSelect = false
-			return plan
-		}
-		plan.JoinType(joinType, joinTarget).On(constraints...)
-		m.selectTarget = joinField
+		plan.addJoinField(m)
 	}
 	return plan
 }
 
+// SelectAs selects value in place of the column for fieldPtr, and
+// scans the result into that field.  The value may be a SqlWrapper
+// (e.g. an aggregate like gorq.Median), a MultiSqlWrapper, or a
+// pointer to another field.  Since the field's own column is not
+// selected, fields which are not mapped to a column (i.e. tagged with
+// db:"-") can be used to hold values which have no column, e.g.
+//
+//     type PriceStats struct {
+//         Category string
+//         Median   float64 `db:"-"`
+//     }
+//
+//     q := dbMap.Query(ref)
+//     q.Fields(&ref.Category)
+//     q.SelectAs(&ref.Median, gorq.Median(&ref.Price))
+//     q.GroupBy(&ref.Category)
+func (plan *QueryPlan) SelectAs(fieldPtr interface{}, value interface{}) interfaces.SelectionQuery {
+	m, err := plan.colMap.joinMapForPointer(fieldPtr)
+	if err != nil {
+		plan.Errors = append(plan.Errors, err)
+		return plan
+	}
+	m.selectTarget = value
+	m.doSelect = true
+	return plan
+}
+
 // Assign sets up an assignment operation to assign the passed in
 // value to the passed in field pointer.  This is used for creating
 // UPDATE or INSERT queries.
@@ -533,17 +907,47 @@ func (plan *QueryPlan) Assign(fieldPtr interface{}, value interface{}) interface
 
 func (plan *QueryPlan) storeJoin() {
 	if lastJoinFilter, ok := plan.filters.(*filters.JoinFilter); ok {
-		if plan.joins == nil {
-			plan.joins = make([]*filters.JoinFilter, 0, 2)
-		}
-		plan.joins = append(plan.joins, lastJoinFilter)
+		plan.addJoin(lastJoinFilter)
 		plan.filters = nil
 	}
 }
 
+// addJoin adds join to the plan.  If the plan already joins the same
+// table using the same alias (e.g. once through AddField and once
+// manually), the join conditions are merged into the existing join
+// instead of emitting a second join clause.  When the join types
+// differ, an inner join takes precedence, since it is the most
+// restrictive.
+func (plan *QueryPlan) addJoin(join *filters.JoinFilter) {
+	if join.Type == "" {
+		// An AutoJoin that References was never called for.
+		join.Type = "inner"
+	}
+	for _, existing := range plan.joins {
+		if existing.QuotedJoinTable != join.QuotedJoinTable || existing.QuotedAlias != join.QuotedAlias {
+			continue
+		}
+		if existing == join {
+			return
+		}
+		if join.Type == "inner" {
+			existing.Type = join.Type
+		}
+		existing.Add(join.SubFilters()...)
+		return
+	}
+	if plan.joins == nil {
+		plan.joins = make([]*filters.JoinFilter, 0, 2)
+	}
+	plan.joins = append(plan.joins, join)
+}
+
 func (plan *QueryPlan) JoinType(joinType string, target interface{}) (joinPlan interfaces.JoinQuery) {
 	joinPlan = &JoinQueryPlan{QueryPlan: plan}
 	plan.storeJoin()
+	if err := checkLimit("MaxJoins", plan.limits.MaxJoins, len(plan.joins)+1); err != nil {
+		plan.Errors = append(plan.Errors, err)
+	}
 	table, alias, err := plan.mapTable(reflect.ValueOf(target))
 
 	if err != nil {
@@ -552,10 +956,13 @@ func (plan *QueryPlan) JoinType(joinType string, target interface{}) (joinPlan i
 		plan.filters = &filters.JoinFilter{Type: joinType, QuotedJoinTable: "Error: no table found"}
 		return
 	}
-	quotedTable := plan.dbMap.Dialect.QuotedTableForQuery(table.SchemaName, table.TableName)
+	quotedTable := plan.quoteTable(table.SchemaName, table.TableName)
 	quotedAlias := ""
-	if alias != "" && alias != "-" {
-		quotedAlias = plan.dbMap.Dialect.QuoteField(alias)
+	if table.quotedFromClause != "" {
+		// Sub-queries include their alias in their from clause.
+		quotedTable = table.quotedFromClause
+	} else if alias != "" && alias != "-" {
+		quotedAlias = plan.quoteField(alias)
 	}
 	plan.filters = &filters.JoinFilter{Type: joinType, QuotedJoinTable: quotedTable, QuotedAlias: quotedAlias}
 	return
@@ -584,11 +991,73 @@ func (plan *QueryPlan) References() interfaces.JoinQuery {
 // passed to plan.Filter().
 func (plan *QueryPlan) Where(filterSlice ...filters.Filter) interfaces.WhereQuery {
 	plan.storeJoin()
+	plan.orBranches = nil
 	plan.filters = new(filters.AndFilter)
 	plan.Filter(filterSlice...)
 	return plan
 }
 
+// OrWhere starts a new branch of the where clause.  The filters in
+// each branch are combined using AND, and the branches are combined
+// using OR.  For example:
+//
+//     q.Where().
+//         Equal(&ref.A, 1).
+//         Equal(&ref.B, 2).
+//         OrWhere().
+//         Equal(&ref.C, 3).
+//         Equal(&ref.D, 4)
+//
+// will result in a where clause of (a = 1 and b = 2) or (c = 3 and d
+// = 4).  This allows branches to be added conditionally, without
+// building the whole filter tree up front using filters.Or.
+func (plan *QueryPlan) OrWhere(filterSlice ...filters.Filter) interfaces.WhereQuery {
+	plan.storeJoin()
+	if plan.filters != nil && !isEmpty(plan.filters) {
+		plan.orBranches = append(plan.orBranches, plan.filters)
+	}
+	plan.filters = new(filters.AndFilter)
+	plan.Filter(filterSlice...)
+	return plan
+}
+
+// whereBranches returns the plan's where clause filter, combining any
+// branches started by OrWhere.  Filters added by policies are not
+// included; see whereFilter.
+func (plan *QueryPlan) whereBranches() filters.Filter {
+	if _, isJoin := plan.filters.(*filters.JoinFilter); isJoin {
+		return nil
+	}
+	branches := plan.orBranches
+	if plan.filters != nil && !isEmpty(plan.filters) {
+		branches = append(branches[:len(branches):len(branches)], plan.filters)
+	}
+	switch len(branches) {
+	case 0:
+		if plan.filters == nil {
+			return nil
+		}
+		return plan.filters
+	case 1:
+		return branches[0]
+	}
+	return filters.Or(branches...)
+}
+
+// andWhere replaces the plan's where clause with one that combines
+// its existing where clause (including any OrWhere branches) and
+// extra using AND.
+func (plan *QueryPlan) andWhere(extra ...filters.Filter) {
+	plan.storeJoin()
+	where := plan.whereBranches()
+	plan.orBranches = nil
+	plan.filters = new(filters.AndFilter)
+	if where != nil && !isEmpty(where) {
+		plan.Filter(where)
+	}
+	plan.Filter(extra...)
+}
+
 // Filter will add a Filter to the list of filters on this query.  The
 // default method of combining filters on a query is by AND - if you
 // want OR, you can use the following syntax:
@@ -697,6 +1166,17 @@ func (plan *QueryPlan) GroupBy(fieldPtr interface{}) interfaces.SelectQuery {
 	return plan
 }
 
+// Having adds filters to the having clause of the query, which are
+// combined using AND.  They are usually comparisons against
+// aggregates, e.g.
+//
+//     q.GroupBy(&ref.PersonId).
+//         Having(filters.Greater(gorq.Median(&ref.Total), 100))
+func (plan *QueryPlan) Having(filters ...filters.Filter) interfaces.SelectQuery {
+	plan.having = append(plan.having, filters...)
+	return plan
+}
+
 // Limit sets the limit clause of the query.
 func (plan *QueryPlan) Limit(limit int64) interfaces.SelectQuery {
 	plan.limit = limit
@@ -722,74 +1202,164 @@ func (plan *QueryPlan) DiscardOffset() interfaces.SelectQuery {
 }
 
 func (plan *QueryPlan) whereClause() (string, error) {
-	if plan.filters == nil {
-		return "", nil
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufPool.Put(buffer)
+	if err := plan.writeWhereClause(buffer); err != nil {
+		return "", err
 	}
-	whereArgs := plan.filters.ActualValues()
-	whereVals := make([]string, 0, len(whereArgs))
-	for _, arg := range whereArgs {
-		val, err := plan.argOrColumn(arg)
-		if err != nil {
-			return "", err
-		}
-		whereVals = append(whereVals, val)
+	return buffer.String(), nil
+}
+
+// writeWhereClause writes the plan's where clause (if it has one)
+// to buffer.
+func (plan *QueryPlan) writeWhereClause(buffer *bytes.Buffer) error {
+	filter := plan.whereFilter()
+	if filter == nil {
+		return nil
+	}
+	where, err := plan.cachedWhere(filter)
+	if err != nil {
+		return err
 	}
-	where := plan.filters.Where(whereVals...)
 	if where != "" {
-		return " where " + where, nil
+		buffer.WriteString(" where ")
+		buffer.WriteString(where)
 	}
-	return "", nil
+	return nil
 }
 
-func (plan *QueryPlan) selectJoinClause() (string, error) {
-	buffer := bufPool.Get().(*bytes.Buffer)
-	buffer.Reset()
+// A joinedSubQuery is a joined sub-query with arguments, along with
+// the alias that it is joined as.
+type joinedSubQuery struct {
+	query subQuery
+	alias string
+}
+
+// joinTable returns the table that join joins.  For sub-queries with
+// arguments, it generates the sub-query for the plan's current
+// arguments and binds the sub-query's arguments.
+func (plan *QueryPlan) joinTable(join *filters.JoinFilter) (string, error) {
+	sub, ok := plan.joinedSubQueries[join.QuotedJoinTable]
+	if !ok {
+		return join.QuotedJoinTable, nil
+	}
+	query, args, err := sub.query.subSelectQuery(plan.argCount())
+	if err != nil {
+		return "", err
+	}
+	plan.appendArgs(args...)
+	return fmt.Sprintf("(%s) as %s", query, sub.alias), nil
+}
+
+// writeJoinClauses writes the join clauses for a select statement to
+// buffer.
+func (plan *QueryPlan) writeJoinClauses(buffer *bytes.Buffer) error {
 	for _, join := range plan.joins {
+		if plan.prunedJoins[join] {
+			continue
+		}
 		buffer.WriteString(" ")
-		joinArgs := join.ActualValues()
-		joinVals := make([]string, 0, len(joinArgs))
-		for _, arg := range joinArgs {
-			val, err := plan.argOrColumn(arg)
-			if err != nil {
-				bufPool.Put(buffer)
-				return "", err
-			}
-			joinVals = append(joinVals, val)
+		join = plan.joinWithPolicies(join)
+		table, err := plan.joinTable(join)
+		if err != nil {
+			return err
+		}
+		if table != join.QuotedJoinTable {
+			bound := *join
+			bound.QuotedJoinTable = table
+			join = &bound
+		}
+		joinVals, err := plan.filterValues(join)
+		if err != nil {
+			return err
 		}
-		joinClause := join.JoinClause(joinVals...)
-		buffer.WriteString(joinClause)
+		buffer.WriteString(join.JoinClause(joinVals...))
 	}
-	s := buffer.String()
+	return nil
+}
+
+// getBuffer returns a buffer from the pool, grown to fit a statement
+// the size of the last one that the plan generated.
+func (plan *QueryPlan) getBuffer() *bytes.Buffer {
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	buffer.Grow(plan.sizeHint)
+	return buffer
+}
+
+// putBuffer returns buffer to the pool, recording its length as the
+// size hint for the next statement.
+func (plan *QueryPlan) putBuffer(buffer *bytes.Buffer) {
+	plan.sizeHint = buffer.Len()
 	bufPool.Put(buffer)
-	return s, nil
 }
 
 // Truncate will run this query plan as a TRUNCATE TABLE statement.
 func (plan *QueryPlan) Truncate() error {
+	if err := plan.checkWritable(); err != nil {
+		return err
+	}
+	if err := plan.checkPolicies(TruncateOperation); err != nil {
+		return err
+	}
 	query := fmt.Sprintf("truncate table %s", plan.QuotedTable())
+	plan.log(query, nil)
 	_, err := plan.dbMap.Exec(query)
 	return err
 }
 
 // Select will run this query plan as a SELECT statement.
 func (plan *QueryPlan) Select() ([]interface{}, error) {
-	query, err := plan.selectQuery()
-	if err != nil {
-		return nil, err
+	identities := plan.identityMap()
+	if identities != nil && len(plan.Errors) == 0 {
+		if existing, ok := plan.identityLookup(identities); ok {
+			return []interface{}{existing}, nil
+		}
 	}
+	var res []interface{}
+	if plan.scansRows() {
+		var err error
+		if res, err = plan.selectScanned(); err != nil {
+			return nil, err
+		}
+	} else {
+		query, err := plan.selectQuery()
+		if err != nil {
+			return nil, err
+		}
 
-	target := plan.target.Interface()
-	if subQuery, ok := target.(subQuery); ok {
-		target = subQuery.getTarget().Interface()
+		target := plan.target.Interface()
+		if subQuery, ok := target.(subQuery); ok {
+			target = subQuery.getTarget().Interface()
+		}
+		res, err = plan.selectTo(target, query, plan.getArgs()...)
+		if err != nil {
+			return nil, err
+		}
+		keep, err := plan.checkRows(len(res))
+		if err != nil {
+			return nil, err
+		}
+		res = res[:keep]
 	}
-	res, err := plan.executor.Select(target, query, plan.getArgs()...)
-	if err != nil {
+	if err := plan.loadBatches(res); err != nil {
 		return nil, err
 	}
+	if identities != nil {
+		plan.identify(identities, res)
+	}
 
 	return res, nil
 }
 
+// Bind sets the values to use for any filters.Param values in the
+// query.  It replaces any values bound previously, so the same plan
+// may be executed again with different values.
+func (plan *QueryPlan) Bind(params map[string]interface{}) {
+	plan.params = params
+}
+
 // Distinct will make this query return only DISTINCT results
 func (plan *QueryPlan) Distinct(fields ...interface{}) {
 	plan.distinctFields = fields
@@ -804,61 +1374,135 @@ func (plan *QueryPlan) ForUpdate(of interface{}) {
 			plan.Errors = append(plan.Errors, err)
 			return
 		}
-		plan.forUpdateOf = plan.dbMap.Dialect.QuotedTableForQuery(table.SchemaName, table.TableName)
+		plan.forUpdateOf = plan.quoteTable(table.SchemaName, table.TableName)
 	}
 }
 
 // SelectToTarget will run this query plan as a SELECT statement, and
 // append results directly to the passed in slice pointer.
+//
+// The slice's element type doesn't have to be mapped to a table: if
+// it is a struct (or pointer to a struct) that isn't, columns are
+// matched to its fields by their db tags (or names), and columns
+// without a matching field are skipped.  This allows ad-hoc structs
+// for reporting queries, e.g.
+//
+//     type memoMedian struct {
+//         Memo   string  `db:"memo"`
+//         Median float64 `db:"total"`
+//     }
+//     var medians []memoMedian
+//     err := dbMap.Query(ref).
+//         Fields(&ref.Memo).
+//         SelectAs(&ref.Total, gorq.Median(&ref.Total)).
+//         GroupBy(&ref.Memo).
+//         SelectToTarget(&medians)
 func (plan *QueryPlan) SelectToTarget(target interface{}) error {
 	targetVal := reflect.ValueOf(target)
 	targetType := targetVal.Type()
 	if targetType.Kind() != reflect.Ptr || targetType.Elem().Kind() != reflect.Slice {
 		return errors.New("SelectToTarget must be run with a pointer to a slice as its target")
 	}
+	structType := targetType.Elem().Elem()
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	if structType.Kind() == reflect.Struct && !plan.isMapped(structType) {
+		if len(plan.Errors) > 0 {
+			return plan.Errors[0]
+		}
+		return plan.selectByTags(targetVal)
+	}
 	query, err := plan.selectQuery()
 	if err != nil {
 		return err
 	}
 
-	_, err = plan.executor.Select(target, query, plan.getArgs()...)
+	slice := targetVal.Elem()
+	start := slice.Len()
+	_, err = plan.selectTo(target, query, plan.getArgs()...)
 	if err != nil {
 		return err
 	}
-
-	return err
+	keep, err := plan.checkRows(slice.Len() - start)
+	if err != nil {
+		return err
+	}
+	slice.SetLen(start + keep)
+	if len(plan.batches) == 0 {
+		return nil
+	}
+	results := make([]interface{}, 0, keep)
+	for i := start; i < slice.Len(); i++ {
+		row := slice.Index(i)
+		if row.Kind() != reflect.Ptr {
+			row = row.Addr()
+		}
+		results = append(results, row.Interface())
+	}
+	return plan.loadBatches(results)
 }
 
 func (plan *QueryPlan) Count() (int64, error) {
 	plan.resetArgs()
-	buffer := bufPool.Get().(*bytes.Buffer)
-	buffer.Reset()
+	if err := plan.checkPolicies(SelectOperation); err != nil {
+		return -1, err
+	}
+	buffer := plan.getBuffer()
+	if len(plan.compounds) > 0 {
+		if err := plan.writeCompoundCount(buffer); err != nil {
+			bufPool.Put(buffer)
+			return -1, err
+		}
+		s := buffer.String()
+		plan.putBuffer(buffer)
+		return plan.selectInt(s, plan.getArgs()...)
+	}
+	if err := plan.writeWith(buffer); err != nil {
+		bufPool.Put(buffer)
+		return -1, err
+	}
 	buffer.WriteString("select count(*)")
 	if err := plan.writeSelectSuffix(buffer); err != nil {
 		bufPool.Put(buffer)
 		return -1, err
 	}
 	s := buffer.String()
-	bufPool.Put(buffer)
-	return plan.executor.SelectInt(s, plan.getArgs()...)
+	plan.putBuffer(buffer)
+	return plan.selectInt(s, plan.getArgs()...)
 }
 
 func (plan *QueryPlan) QuotedTable() string {
 	if plan.quotedTable == "" {
-		plan.quotedTable = plan.dbMap.Dialect.QuotedTableForQuery(plan.table.SchemaName, plan.table.TableName)
+		plan.quotedTable = plan.quoteTable(plan.table.SchemaName, plan.table.TableName)
 	}
 	return plan.quotedTable
 }
 
 func (plan *QueryPlan) selectQuery() (string, error) {
 	plan.resetArgs()
-	buffer := bufPool.Get().(*bytes.Buffer)
-	buffer.Reset()
+	if err := plan.checkPolicies(SelectOperation); err != nil {
+		return "", err
+	}
+	if plan.trimmed {
+		// Fields may have left some joins with nothing to do.
+		plan.prunedJoins = plan.unusedJoins()
+		defer func() { plan.prunedJoins = nil }()
+	}
+	buffer := plan.getBuffer()
 	if err := plan.writeSelectColumns(buffer); err != nil {
 		bufPool.Put(buffer)
 		return "", err
 	}
-	if err := plan.writeSelectSuffix(buffer); err != nil {
+	if err := plan.writeSelectBody(buffer); err != nil {
+		bufPool.Put(buffer)
+		return "", err
+	}
+	if err := plan.writeCompounds(buffer); err != nil {
+		bufPool.Put(buffer)
+		return "", err
+	}
+	if err := plan.writeSelectOrder(buffer); err != nil {
 		bufPool.Put(buffer)
 		return "", err
 	}
@@ -870,10 +1514,24 @@ func (plan *QueryPlan) selectQuery() (string, error) {
 		}
 	}
 	s := buffer.String()
-	bufPool.Put(buffer)
+	plan.putBuffer(buffer)
 	return s, nil
 }
 
+// subSelectQuery generates the plan's select statement for use as a
+// sub-query within a statement that already has argOffset arguments,
+// so that bind variables are numbered correctly.  It returns the
+// statement along with the sub-query's own arguments.
+func (plan *QueryPlan) subSelectQuery(argOffset int) (string, []interface{}, error) {
+	plan.argOffset, plan.nested = argOffset, true
+	defer func() { plan.argOffset, plan.nested = 0, false }()
+	query, err := plan.selectQuery()
+	if err != nil {
+		return "", nil, err
+	}
+	return query, plan.getArgs()[argOffset:], nil
+}
+
 func (plan *QueryPlan) ArgOrColumn(value interface{}) (sqlValue string, err error) {
 	return plan.argOrColumn(value)
 }
@@ -884,6 +1542,9 @@ func (plan *QueryPlan) ArgOrColumn(value interface{}) (sqlValue string, err erro
 // used as an argument, it will be appended to args and the returned
 // string will be the bind value.
 func (plan *QueryPlan) argOrColumn(value interface{}) (sqlValue string, err error) {
+	if wrapper, values := plan.boundValues(value); values != nil {
+		return plan.wrapBound(wrapper, values)
+	}
 	switch src := value.(type) {
 	case filters.SqlWrapper:
 		value = src.ActualValue()
@@ -893,38 +1554,76 @@ func (plan *QueryPlan) argOrColumn(value interface{}) (sqlValue string, err erro
 		}
 		return src.WrapSql(wrapperVal), nil
 	case filters.MultiSqlWrapper:
-		values := src.ActualValues()
-		wrapperVals := make([]string, 0, len(values))
-		for _, val := range values {
-			wrapperVal, err := plan.argOrColumn(val)
-			if err != nil {
-				return "", err
-			}
-			wrapperVals = append(wrapperVals, wrapperVal)
+		wrapperVals, err := plan.sqlValues(src.ActualValues(), nil)
+		if err != nil {
+			return "", err
+		}
+		return wrapMulti(plan.dialect, src, wrapperVals), nil
+	case RowWrapper:
+		return plan.wrapRow(src)
+	case computedColumn:
+		return src.sql(plan.filtering), nil
+	case filters.Param:
+		value, ok := plan.params[string(src)]
+		if !ok {
+			return "", fmt.Errorf("gorq: No value bound for parameter %q", string(src))
+		}
+		return plan.argOrColumn(value)
+	case subQuery:
+		query, args, err := src.subSelectQuery(plan.argCount())
+		if err != nil {
+			return "", err
 		}
-		return src.WrapSql(wrapperVals...), nil
+		plan.appendArgs(args...)
+		return "(" + query + ")", nil
 	default:
 		if reflect.TypeOf(value).Kind() == reflect.Ptr {
 			m, err := plan.colMap.fieldMapForPointer(value)
-			if err != nil {
-				return "", err
+			if err == nil {
+				if m.selectTarget != m.field && !m.resolving {
+					m.resolving = true
+					defer func() { m.resolving = false }()
+					return plan.argOrColumn(m.selectTarget)
+				}
+				return m.quotedTable + "." + m.quotedColumn, nil
 			}
-			if m.selectTarget != m.field {
-				return plan.argOrColumn(m.selectTarget)
+			if _, isValuer := value.(driver.Valuer); !isValuer {
+				return "", err
 			}
-			sqlValue = m.quotedTable + "." + m.quotedColumn
-		} else {
-			sqlValue = plan.dbMap.Dialect.BindVar(len(plan.getArgs()))
-			plan.appendArgs(value)
+			// Pointers to driver.Valuer types (e.g. pq.Array) are
+			// values, not fields.
+		}
+		value, err = plan.toDb(value)
+		if err != nil {
+			return "", err
 		}
+		sqlValue = plan.dialect.BindVar(plan.argCount())
+		plan.appendArgs(value)
 	}
 	return
 }
 
+// toDb converts value using the converter registered for its type
+// (see RegisterConverter), or else the DbMap's TypeConverter, if it
+// has one, so that values bound by gorq match the values that gorp
+// would bind for the same field.
+func (plan *QueryPlan) toDb(value interface{}) (interface{}, error) {
+	if converted, ok, err := convert(value); ok {
+		return converted, err
+	}
+	if plan.dbMap.TypeConverter == nil {
+		return value, nil
+	}
+	return plan.dbMap.TypeConverter.ToDb(value)
+}
+
 func (plan *QueryPlan) writeSelectColumns(buffer *bytes.Buffer) error {
 	if len(plan.Errors) > 0 {
 		return plan.Errors[0]
 	}
+	if err := plan.writeWith(buffer); err != nil {
+		return err
+	}
 	buffer.WriteString("select ")
 	if len(plan.distinctFields) != 0 {
 		buffer.WriteString("distinct on (")
@@ -939,7 +1638,7 @@ func (plan *QueryPlan) writeSelectColumns(buffer *bytes.Buffer) error {
 		if len(plan.distinctFields) == 1 {
 			buffer.WriteString(") ")
 		} else {
-			for _, df := range plan.distinctFields {
+			for _, df := range plan.distinctFields[1:] {
 				var name string
 				var err error
 				name, err = plan.argOrColumn(df)
@@ -952,120 +1651,174 @@ func (plan *QueryPlan) writeSelectColumns(buffer *bytes.Buffer) error {
 			buffer.WriteString(") ")
 		}
 	}
-	for index, m := range plan.colMap {
+	aliases := make(map[string]bool, len(plan.colMap))
+	selected := 0
+	for _, m := range plan.colMap {
 		if m.doSelect {
-			if index != 0 {
+			if selected != 0 {
 				buffer.WriteString(",")
 			}
-			var err error
-			selectClause := m.quotedTable + "." + m.quotedColumn
-			if m.selectTarget != m.field {
-				switch src := m.selectTarget.(type) {
-				case filters.SqlWrapper:
-					actualValue := src.ActualValue()
-					sqlValue, err := plan.argOrColumn(actualValue)
-					if err != nil {
-						return err
-					}
-					selectClause = src.WrapSql(sqlValue)
-				case filters.MultiSqlWrapper:
-					values := src.ActualValues()
-					sqlValues := make([]string, 0, len(values))
-					for _, v := range values {
-						sqlValue, err := plan.argOrColumn(v)
-						if err != nil {
-							return err
-						}
-						sqlValues = append(sqlValues, sqlValue)
-					}
-					selectClause = src.WrapSql(sqlValues...)
-				default:
-					selectClause, err = plan.argOrColumn(m.field)
-					if err != nil {
-						return err
-					}
-				}
+			selected++
+			selectClause, err := plan.selectClause(m)
+			if err != nil {
+				return err
 			}
 			buffer.WriteString(selectClause)
 			if m.alias != "" {
 				buffer.WriteString(" AS ")
-				buffer.WriteString(m.alias)
+				buffer.WriteString(plan.quoteField(uniqueAlias(aliases, m)))
 			}
 		}
 	}
 	return nil
 }
 
+// selectClause returns the SQL that should be selected for m.  While
+// m's select target is being resolved, references to m's own field
+// resolve to its column, so that a field can be selected as a wrapper
+// around itself (e.g. SelectAs(&ref.Total, gorq.Median(&ref.Total))).
+func (plan *QueryPlan) selectClause(m *fieldColumnMap) (string, error) {
+	if m.selectTarget == m.field {
+		return m.quotedTable + "." + m.quotedColumn, nil
+	}
+	m.resolving = true
+	defer func() { m.resolving = false }()
+	if wrapper, values := plan.boundValues(m.selectTarget); values != nil {
+		return plan.wrapBound(wrapper, values)
+	}
+	switch src := m.selectTarget.(type) {
+	case filters.SqlWrapper:
+		sqlValue, err := plan.argOrColumn(src.ActualValue())
+		if err != nil {
+			return "", err
+		}
+		return src.WrapSql(sqlValue), nil
+	case filters.MultiSqlWrapper:
+		sqlValues, err := plan.sqlValues(src.ActualValues(), nil)
+		if err != nil {
+			return "", err
+		}
+		return wrapMulti(plan.dialect, src, sqlValues), nil
+	default:
+		m.resolving = false
+		return plan.argOrColumn(m.field)
+	}
+}
+
 func (plan *QueryPlan) writeSelectSuffix(buffer *bytes.Buffer) error {
-	plan.storeJoin()
-	buffer.WriteString(" from ")
-	buffer.WriteString(plan.QuotedTable())
-	joinClause, err := plan.selectJoinClause()
-	if err != nil {
+	if err := plan.writeSelectBody(buffer); err != nil {
 		return err
 	}
-	buffer.WriteString(joinClause)
-	whereClause, err := plan.whereClause()
-	if err != nil {
+	return plan.writeSelectOrder(buffer)
+}
+
+// writeSelectBody writes the from, join, where, group by, and having
+// clauses of the plan's select statement to buffer.
+func (plan *QueryPlan) writeSelectBody(buffer *bytes.Buffer) error {
+	if err := plan.writeFromWhere(buffer); err != nil {
 		return err
 	}
-	buffer.WriteString(whereClause)
-	for index, orderBy := range plan.orderBy {
+	for index, groupBy := range plan.groupBy {
 		if index == 0 {
-			buffer.WriteString(" order by ")
+			buffer.WriteString(" group by ")
 		} else {
 			buffer.WriteString(", ")
 		}
-		orderStr, args, err := orderBy.OrderBy(plan.dbMap.Dialect, plan.colMap, plan.argLen)
+		buffer.WriteString(groupBy)
+	}
+	if len(plan.having) > 0 {
+		having := filters.And(plan.having...)
+		havingVals, err := plan.filterValues(having)
 		if err != nil {
 			return err
 		}
-		buffer.WriteString(orderStr)
-		plan.appendArgs(args...)
+		buffer.WriteString(" having ")
+		buffer.WriteString(having.Where(havingVals...))
 	}
-	for index, groupBy := range plan.groupBy {
+	return nil
+}
+
+// writeSelectOrder writes the order by, limit, and offset clauses of
+// the plan's select statement to buffer.
+func (plan *QueryPlan) writeSelectOrder(buffer *bytes.Buffer) error {
+	for index, orderBy := range plan.orderBy {
 		if index == 0 {
-			buffer.WriteString(" group by ")
+			buffer.WriteString(" order by ")
 		} else {
 			buffer.WriteString(", ")
 		}
-		buffer.WriteString(groupBy)
+		if len(plan.compounds) > 0 {
+			orderStr, err := plan.compoundOrderBy(orderBy)
+			if err != nil {
+				return err
+			}
+			buffer.WriteString(orderStr)
+			continue
+		}
+		orderStr, args, err := orderBy.OrderBy(plan.dialect, plan.colMap, plan.argLen, plan.noInlining)
+		if err != nil {
+			return err
+		}
+		buffer.WriteString(orderStr)
+		plan.appendArgs(args...)
 	}
 	// Nonstandard LIMIT clauses seem to have to come *before* the
 	// offset clause.
-	limiter, nonstandard := plan.dbMap.Dialect.(interfaces.NonstandardLimiter)
-	if plan.limit > 0 && nonstandard {
+	limit := plan.statementLimit()
+	limiter, nonstandard := plan.dialect.(interfaces.NonstandardLimiter)
+	if limit > 0 && nonstandard {
 		buffer.WriteString(" ")
-		buffer.WriteString(limiter.Limit(plan.dbMap.Dialect.BindVar(plan.argLen)))
-		plan.appendArgs(plan.limit)
+		buffer.WriteString(limiter.Limit(plan.dialect.BindVar(plan.argLen)))
+		plan.appendArgs(limit)
 	}
 	if plan.offset > 0 {
 		buffer.WriteString(" offset ")
-		buffer.WriteString(plan.dbMap.Dialect.BindVar(plan.argLen))
+		buffer.WriteString(plan.dialect.BindVar(plan.argLen))
 		plan.appendArgs(plan.offset)
 	}
 	// Standard FETCH NEXT (n) ROWS ONLY must come after the offset.
-	if plan.limit > 0 && !nonstandard {
+	if limit > 0 && !nonstandard {
 		// Many dialects seem to ignore the SQL standard when it comes
 		// to the limit clause.
 		buffer.WriteString(" fetch next (")
-		buffer.WriteString(plan.dbMap.Dialect.BindVar(plan.argLen))
-		plan.appendArgs(plan.limit)
+		buffer.WriteString(plan.dialect.BindVar(plan.argLen))
+		plan.appendArgs(limit)
 		buffer.WriteString(") rows only")
 	}
 	return nil
 }
 
+// writeFromWhere writes the from, join, and where clauses of the
+// plan's select statement to buffer.
+func (plan *QueryPlan) writeFromWhere(buffer *bytes.Buffer) error {
+	plan.storeJoin()
+	buffer.WriteString(" from ")
+	buffer.WriteString(plan.QuotedTable())
+	if err := plan.writeJoinClauses(buffer); err != nil {
+		return err
+	}
+	return plan.writeWhereClause(buffer)
+}
+
 // Insert will run this query plan as an INSERT statement.
 func (plan *QueryPlan) Insert() error {
+	if err := plan.checkWritable(); err != nil {
+		return err
+	}
 	plan.resetArgs()
 	if len(plan.Errors) > 0 {
 		return plan.Errors[0]
 	}
+	if err := plan.checkAssignExprs(); err != nil {
+		return err
+	}
+	if err := plan.checkPolicies(InsertOperation); err != nil {
+		return err
+	}
 	buffer := bufPool.Get().(*bytes.Buffer)
 	buffer.Reset()
 	buffer.WriteString("insert into ")
-	buffer.WriteString(plan.dbMap.Dialect.QuotedTableForQuery(plan.table.SchemaName, plan.table.TableName))
+	buffer.WriteString(plan.quoteTable(plan.table.SchemaName, plan.table.TableName))
 	buffer.WriteString(" (")
 	for i, col := range plan.assignCols {
 		if i > 0 {
@@ -1083,11 +1836,119 @@ func (plan *QueryPlan) Insert() error {
 	buffer.WriteString(")")
 	s := buffer.String()
 	bufPool.Put(buffer)
-	_, err := plan.executor.Exec(s, plan.getArgs()...)
+	return plan.execInsert(s)
+}
+
+// InsertDefaults will run this query plan as an INSERT statement
+// that assigns no values, e.g. INSERT INTO table DEFAULT VALUES.
+func (plan *QueryPlan) InsertDefaults() error {
+	if err := plan.checkWritable(); err != nil {
+		return err
+	}
+	plan.resetArgs()
+	if len(plan.Errors) > 0 {
+		return plan.Errors[0]
+	}
+	if err := plan.checkPolicies(InsertOperation); err != nil {
+		return err
+	}
+	defaults := "default values"
+	if valuer, ok := plan.dialect.(interfaces.NonstandardDefaultValuer); ok {
+		defaults = valuer.DefaultValues()
+	}
+	query := fmt.Sprintf("insert into %s %s", plan.quoteTable(plan.table.SchemaName, plan.table.TableName), defaults)
+	return plan.execInsert(query)
+}
 
+// execInsert executes an INSERT statement and notifies any change
+// hooks.  If the target's table has an auto-increment key that hasn't
+// been explicitly assigned, the generated value will be stored in the
+// target's field for that key, the same as gorp's Insert does.
+func (plan *QueryPlan) execInsert(query string) error {
+	if err := plan.insert(query); err != nil {
+		return err
+	}
+	if len(plan.changeHooks) > 0 {
+		keyCols := plan.keyColumns()
+		plan.notify(Change{
+			Operation:    InsertOperation,
+			KeyColumns:   keyCols,
+			Keys:         [][]interface{}{plan.insertedKeys(keyCols)},
+			RowsAffected: 1,
+		})
+	}
+	return nil
+}
+
+// insert executes an INSERT statement, storing any generated key in
+// the reference struct.
+func (plan *QueryPlan) insert(query string) error {
+	col := plan.autoIncrColumn()
+	if col == nil || plan.targetsView() {
+		_, err := plan.exec(query, plan.getArgs()...)
+		return err
+	}
+	field := fieldByIndex(plan.target.Elem(), col.FieldIndex())
+	switch inserter := plan.dialect.(type) {
+	case gorp.TargetedAutoIncrInserter:
+		query += plan.autoIncrInsertSuffix(col)
+		query, args, err := plan.prepare(query, plan.getArgs())
+		if err != nil {
+			return err
+		}
+		done, err := plan.begin()
+		if err != nil {
+			return err
+		}
+		defer done()
+		return classifyError(inserter.InsertAutoIncrToTarget(plan.executor, query, field.Addr().Interface(), args...))
+	case gorp.IntegerAutoIncrInserter:
+		query, args, err := plan.prepare(query, plan.getArgs())
+		if err != nil {
+			return err
+		}
+		done, err := plan.begin()
+		if err != nil {
+			return err
+		}
+		defer done()
+		id, err := inserter.InsertAutoIncr(plan.executor, query, args...)
+		if err != nil {
+			return classifyError(err)
+		}
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			field.SetInt(id)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			field.SetUint(uint64(id))
+		default:
+			return fmt.Errorf("gorp: Cannot set auto-increment value on non-integer column %s", col.ColumnName)
+		}
+		return nil
+	}
+	_, err := plan.exec(query, plan.getArgs()...)
 	return err
 }
 
+// autoIncrColumn returns the auto-increment key column of the plan's
+// table, or nil if the table has none or a value has already been
+// assigned to it.
+func (plan *QueryPlan) autoIncrColumn() *gorp.ColumnMap {
+	for _, col := range plan.table.Columns {
+		if !isAutoIncr(col) {
+			continue
+		}
+		quotedCol := plan.quoteField(col.ColumnName)
+		for _, assigned := range plan.assignCols {
+			if assigned == quotedCol {
+				return nil
+			}
+		}
+		return col
+	}
+	return nil
+}
+
 // joinFromAndWhereClause will return the from and where clauses for
 // joined tables, for use in UPDATE and DELETE statements.
 func (plan *QueryPlan) joinFromAndWhereClause() (from, where string, err error) {
@@ -1095,16 +1956,17 @@ func (plan *QueryPlan) joinFromAndWhereClause() (from, where string, err error)
 	whereBuffer := bufPool.Get().(*bytes.Buffer)
 	whereBuffer.Reset()
 	for _, join := range plan.joins {
-		fromSlice = append(fromSlice, join.QuotedJoinTable)
-		whereArgs := join.ActualValues()
-		whereVals := make([]string, 0, len(whereArgs))
-		for _, arg := range whereArgs {
-			val, err := plan.argOrColumn(arg)
-			if err != nil {
-				bufPool.Put(whereBuffer)
-				return "", "", err
-			}
-			whereVals = append(whereVals, val)
+		table, err := plan.joinTable(join)
+		if err != nil {
+			bufPool.Put(whereBuffer)
+			return "", "", err
+		}
+		fromSlice = append(fromSlice, table)
+		join = plan.joinWithPolicies(join)
+		whereVals, err := plan.filterValues(join)
+		if err != nil {
+			bufPool.Put(whereBuffer)
+			return "", "", err
 		}
 		whereClause := join.Where(whereVals...)
 		if err != nil {
@@ -1120,24 +1982,35 @@ func (plan *QueryPlan) joinFromAndWhereClause() (from, where string, err error)
 
 // Update will run this query plan as an UPDATE statement.
 func (plan *QueryPlan) Update() (int64, error) {
+	if err := plan.checkWritable(); err != nil {
+		return -1, err
+	}
 	plan.resetArgs()
 	if len(plan.Errors) > 0 {
 		return -1, plan.Errors[0]
 	}
+	if err := plan.checkWhere(); err != nil {
+		return -1, err
+	}
+	if err := plan.checkPolicies(UpdateOperation); err != nil {
+		return -1, err
+	}
 	buffer := bufPool.Get().(*bytes.Buffer)
 	buffer.Reset()
 	defer bufPool.Put(buffer)
+	if err := plan.writeMutationWith(buffer); err != nil {
+		return -1, err
+	}
 	buffer.WriteString("update ")
-	buffer.WriteString(plan.dbMap.Dialect.QuotedTableForQuery(plan.table.SchemaName, plan.table.TableName))
+	buffer.WriteString(plan.quoteTable(plan.table.SchemaName, plan.table.TableName))
 	buffer.WriteString(" set ")
 	for i, col := range plan.assignCols {
-		bindVar := plan.assignBindVars[i]
 		if i > 0 {
 			buffer.WriteString(", ")
 		}
 		buffer.WriteString(col)
 		buffer.WriteString("=")
-		buffer.WriteString(bindVar)
+		buffer.WriteString(plan.assignedValue(i))
 	}
 	joinTables, joinWhereClause, err := plan.joinFromAndWhereClause()
 	if err != nil {
@@ -1160,11 +2033,7 @@ func (plan *QueryPlan) Update() (int64, error) {
 		whereClause += joinWhereClause
 	}
 	buffer.WriteString(whereClause)
-	res, err := plan.executor.Exec(buffer.String(), plan.getArgs()...)
-	if err != nil {
-		return -1, err
-	}
-	rows, err := res.RowsAffected()
+	rows, err := plan.execChange(UpdateOperation, buffer.String())
 	if err != nil {
 		return -1, err
 	}
@@ -1181,15 +2050,27 @@ func (plan *QueryPlan) Update() (int64, error) {
 
 // Delete will run this query plan as a DELETE statement.
 func (plan *QueryPlan) Delete() (int64, error) {
+	if err := plan.checkWritable(); err != nil {
+		return -1, err
+	}
 	plan.resetArgs()
 	if len(plan.Errors) > 0 {
 		return -1, plan.Errors[0]
 	}
+	if err := plan.checkWhere(); err != nil {
+		return -1, err
+	}
+	if err := plan.checkPolicies(DeleteOperation); err != nil {
+		return -1, err
+	}
 	buffer := bufPool.Get().(*bytes.Buffer)
 	buffer.Reset()
 	defer bufPool.Put(buffer)
+	if err := plan.writeMutationWith(buffer); err != nil {
+		return -1, err
+	}
 	buffer.WriteString("delete from ")
-	buffer.WriteString(plan.dbMap.Dialect.QuotedTableForQuery(plan.table.SchemaName, plan.table.TableName))
+	buffer.WriteString(plan.quoteTable(plan.table.SchemaName, plan.table.TableName))
 	joinTables, joinWhereClause, err := plan.joinFromAndWhereClause()
 	if err != nil {
 		return -1, err
@@ -1211,16 +2092,7 @@ func (plan *QueryPlan) Delete() (int64, error) {
 		whereClause += joinWhereClause
 	}
 	buffer.WriteString(whereClause)
-	res, err := plan.executor.Exec(buffer.String(), plan.getArgs()...)
-	if err != nil {
-		return -1, err
-	}
-	rows, err := res.RowsAffected()
-	if err != nil {
-		return -1, err
-	}
-
-	return rows, nil
+	return plan.execChange(DeleteOperation, buffer.String())
 }
 
 // A JoinQueryPlan is a QueryPlan, except with some return values
@@ -1234,6 +2106,9 @@ func (plan *JoinQueryPlan) References() interfaces.JoinQuery {
 		plan.Errors = append(plan.Errors, errors.New("No references found to join with"))
 	}
 	plan.QueryPlan.Filter(plan.lastRefs...)
+	if join, ok := plan.filters.(*filters.JoinFilter); ok && join.Type == "" {
+		join.Type = plan.autoJoinType(plan.lastRefFields...)
+	}
 	return plan
 }
 
@@ -1315,14 +2190,30 @@ type AssignQueryPlan struct {
 }
 
 func (plan *AssignQueryPlan) Assign(fieldPtr interface{}, value interface{}) interfaces.AssignQuery {
-	column, err := plan.colMap.LocateColumn(fieldPtr)
+	value, err := plan.toDb(value)
 	if err != nil {
 		plan.Errors = append(plan.Errors, err)
 		return plan
 	}
-	plan.assignCols = append(plan.assignCols, column)
-	plan.assignBindVars = append(plan.assignBindVars, plan.dbMap.Dialect.BindVar(len(plan.assignArgs)))
+	return plan.assign(fieldPtr, value, nil)
+}
+
+// assign assigns value, which has already been converted, to the
+// column that fieldPtr points to, wrapped in expr if it is non-nil.
+func (plan *AssignQueryPlan) assign(fieldPtr interface{}, value interface{}, expr *assignExpr) interfaces.AssignQuery {
+	m, err := plan.colMap.fieldMapForPointer(fieldPtr)
+	if err != nil {
+		plan.Errors = append(plan.Errors, err)
+		return plan
+	}
+	if plan.isSensitive(m.column) {
+		plan.markSensitive(len(plan.assignArgs), len(plan.assignArgs)+1)
+	}
+	plan.assignColMaps = append(plan.assignColMaps, m.column)
+	plan.assignCols = append(plan.assignCols, m.quotedColumn)
+	plan.assignBindVars = append(plan.assignBindVars, plan.dialect.BindVar(len(plan.assignArgs)))
 	plan.assignArgs = append(plan.assignArgs, value)
+	plan.assignExprs = append(plan.assignExprs, expr)
 	return plan
 }
 
@@ -1331,6 +2222,11 @@ func (plan *AssignQueryPlan) Where(filters ...filters.Filter) interfaces.UpdateQ
 	return plan
 }
 
+func (plan *AssignQueryPlan) OrWhere(filters ...filters.Filter) interfaces.UpdateQuery {
+	plan.QueryPlan.OrWhere(filters...)
+	return plan
+}
+
 func (plan *AssignQueryPlan) Filter(filters ...filters.Filter) interfaces.UpdateQuery {
 	plan.QueryPlan.Filter(filters...)
 	return plan
@@ -1,10 +1,18 @@
 package plans
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
@@ -45,6 +53,18 @@ type Invoice struct {
 	IsPaid   bool
 }
 
+type AutoIncrInvoice struct {
+	Id   int64
+	Memo string
+}
+
+// TaggedAutoIncrInvoice is mapped to the same table as
+// AutoIncrInvoice, but with its memo left out of default selects.
+type TaggedAutoIncrInvoice struct {
+	Id   int64
+	Memo string `select:"-"`
+}
+
 type FakeEmbeddedInvoice struct {
 	Invoice        Invoice `db:",embed"`
 	SomeOtherField string
@@ -120,6 +140,7 @@ func (suite *DbTestSuite) SetupSuite() {
 	suite.Map.AddTable(ValidStruct{})
 	suite.Map.AddTable(OverriddenInvoice{}).SetKeys(false, "Id")
 	suite.Map.AddTable(FakeEmbeddedInvoice{}).SetKeys(false, "Invoice.Id")
+	suite.Map.AddTable(AutoIncrInvoice{}).SetKeys(true, "Id")
 	if err := suite.Map.CreateTablesIfNotExists(); !suite.NoError(err) {
 		suite.T().FailNow()
 	}
@@ -316,7 +337,7 @@ func (suite *QueryLanguageTestSuite) SetupTest() {
 func (suite *QueryLanguageTestSuite) TearDownTest() {
 	var err error
 	switch suite.Map.Dialect.(type) {
-	case dialects.SqliteDialect:
+	case gorp.SqliteDialect, dialects.SqliteDialect:
 		// SQLite3 doesn't have a TRUNCATE TABLE command.
 		_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Delete()
 	default:
@@ -408,275 +429,2797 @@ func (suite *QueryLanguageTestSuite) TestQueryLanguage_Update() {
 	}
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectSimple() {
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Select()
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_BulkUpdate() {
+	rows := []OverriddenInvoice{testInvoices[0], testInvoices[1]}
+	rows[0].Memo = "bulk_memo_1"
+	rows[1].Memo = "bulk_memo_2"
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		BulkUpdate(rows, []interface{}{&suite.Ref.Id}, []interface{}{&suite.Ref.Memo})
 	if suite.NoError(err) {
-		suite.Equal(len(testInvoices), len(invTest))
+		suite.Equal(2, count)
+	}
+	for _, row := range rows {
+		results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+			Where().
+			Equal(&suite.Ref.Id, row.Id).
+			Select()
+		if suite.NoError(err) && suite.Len(results, 1) {
+			suite.Equal(row.Memo, results[0].(*OverriddenInvoice).Memo)
+		}
 	}
-}
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_CountSimple() {
-	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Count()
+	count, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		True(&suite.Ref.IsPaid).
+		BulkUpdate(rows, []interface{}{&suite.Ref.Id}, []interface{}{&suite.Ref.Memo})
 	if suite.NoError(err) {
-		suite.Equal(len(testInvoices), count)
+		suite.Equal(0, count, "BulkUpdate should apply the plan's where clause")
 	}
+
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		BulkUpdate([]AutoIncrInvoice{{Id: 1}}, []interface{}{&suite.Ref.Id}, []interface{}{&suite.Ref.Memo})
+	suite.Error(err, "BulkUpdate should reject rows of other types")
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_OrderBy_ASC() {
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).OrderBy(&suite.Ref.Updated, "asc").Select()
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_InsertAll() {
+	rows := []OverriddenInvoice{testInvoices[0], testInvoices[1], testInvoices[2]}
+	for i := range rows {
+		rows[i].Id = fmt.Sprintf("%d", len(testInvoices)+i+1)
+		rows[i].Memo = "inserted_memo"
+	}
+	logger := new(recordingLogger)
+	options := Options{
+		Logger: logger,
+		// Room for two rows per statement.
+		Limits: Limits{MaxArgs: 12},
+	}
+	count, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).InsertAll(rows)
 	if suite.NoError(err) {
-		previous := invTest[0].(*OverriddenInvoice).Updated
-		for _, result := range invTest {
-			inv := result.(*OverriddenInvoice)
-			suite.True(previous <= inv.Updated, "OrderBy ASC means %d should be <= %d", previous, inv.Updated)
-			previous = inv.Updated
-		}
+		suite.Equal(int64(len(rows)), count)
 	}
-}
+	suite.Len(logger.lines, 2, "Rows should be split across statements to stay under MaxArgs")
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_OrderBy_DESC() {
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).OrderBy(&suite.Ref.Updated, "DESC").Select()
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Equal(&suite.Ref.Memo, "inserted_memo").
+		Select()
 	if suite.NoError(err) {
-		previous := invTest[0].(*OverriddenInvoice).Updated
-		for _, result := range invTest {
-			inv := result.(*OverriddenInvoice)
-			suite.True(previous >= inv.Updated, "OrderBy DESC means %d should be >= %d", previous, inv.Updated)
-			previous = inv.Updated
-		}
+		suite.Len(results, len(rows))
 	}
-}
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectLike() {
-	search := "another"
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return strings.Contains(inv.Memo, search)
-	})
-
-	matchSequence := "%"
-	if _, ok := suite.Map.Dialect.(gorp.MySQLDialect); ok {
-		// MySQL has non-standard everything
-		matchSequence = "\\%"
-	}
-	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-		Where().
-		Like(&suite.Ref.Memo, matchSequence+search+matchSequence).
-		Count()
+	count, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).InsertAll([]OverriddenInvoice{})
 	if suite.NoError(err) {
-		suite.Equal(expectedCount, count)
+		suite.Equal(int64(0), count)
 	}
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).InsertAll([]AutoIncrInvoice{{Id: 1}})
+	suite.Error(err, "InsertAll should reject rows of other types")
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectEqual() {
-	match := "test_memo"
-	expected := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return inv.Memo == match
-	})
+// KeyOnly has no columns to insert besides its auto-increment key.
+type KeyOnly struct {
+	Id   int64
+	Note string `db:"-"`
+}
 
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-		Where().
-		Equal(&suite.Ref.Memo, match).
-		Select()
-	if suite.NoError(err) {
-		suite.Equal(expected, len(invTest))
+func TestInsertAllWithoutColumns(t *testing.T) {
+	dbMap := &gorp.DbMap{Dialect: gorp.SqliteDialect{}}
+	dbMap.AddTable(KeyOnly{}).SetKeys(true, "Id")
+	_, err := Query(dbMap, dbMap, new(KeyOnly), JoinOp{}).(*QueryPlan).InsertAll([]KeyOnly{{}, {}})
+	if err == nil {
+		t.Error("InsertAll should reject tables with no columns to insert")
 	}
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectNotEqual() {
-	match := "test_memo"
-	expected := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return inv.Memo != match
-	})
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Aggregates() {
+	var sum, min, max int64
+	var count int
+	distinct := make(map[int64]bool)
+	for _, inv := range testInvoices {
+		if inv.PersonId != 1 {
+			continue
+		}
+		if count == 0 || inv.Updated < min {
+			min = inv.Updated
+		}
+		if inv.Updated > max {
+			max = inv.Updated
+		}
+		sum += inv.Updated
+		count++
+		distinct[inv.Updated] = true
+	}
+	query := func() interfaces.WhereQuery {
+		return Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+			Where().
+			Equal(&suite.Ref.PersonId, 1)
+	}
 
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-		Where().
-		NotEqual(&suite.Ref.Memo, match).
-		Select()
+	total, err := query().Sum(&suite.Ref.Updated)
 	if suite.NoError(err) {
-		suite.Equal(expected, len(invTest))
+		suite.Equal(float64(sum), total)
+	}
+	intTotal, err := query().SumInt(&suite.Ref.Updated)
+	if suite.NoError(err) {
+		suite.Equal(sum, intTotal, "SumInt should return an int64")
+	}
+	avg, err := query().Avg(&suite.Ref.Updated)
+	if suite.NoError(err) {
+		suite.InDelta(float64(sum)/float64(count), avg, 0.0001)
+	}
+	smallest, err := Min(query(), &suite.Ref.Updated)
+	if suite.NoError(err) && suite.NotNil(smallest) {
+		suite.Equal(min, *smallest, "Min should return a value of the field's type")
+	}
+	largest, err := Max(query(), &suite.Ref.Updated)
+	if suite.NoError(err) && suite.NotNil(largest) {
+		suite.Equal(max, *largest)
+	}
+	distinctCount, err := query().CountDistinct(&suite.Ref.Updated)
+	if suite.NoError(err) {
+		suite.Equal(int64(len(distinct)), distinctCount)
 	}
-}
-
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectLess() {
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return inv.Updated < 2
-	})
 
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+	none := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
 		Where().
-		Less(&suite.Ref.Updated, 2).
-		Select()
+		Equal(&suite.Ref.Memo, "no_such_memo")
+	total, err = none.Sum(&suite.Ref.Updated)
 	if suite.NoError(err) {
-		suite.Equal(expectedCount, len(invTest))
+		suite.Zero(total)
+	}
+	smallest, err = Min(none, &suite.Ref.Updated)
+	if suite.NoError(err) {
+		suite.Nil(smallest, "Min should return nil when there are no values")
 	}
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectLessOrEqual() {
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return inv.Updated <= 2
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_CopySource() {
+	rows := []*OverriddenInvoice{&testInvoices[0], &testInvoices[1]}
+	src, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).CopySource(rows)
+	if !suite.NoError(err) {
+		return
+	}
+	suite.Equal(2, src.Len())
+	suite.Len(src.Columns, 6)
+	var memos []interface{}
+	err = src.Each(func(values []interface{}) error {
+		suite.Len(values, len(src.Columns))
+		for i, col := range src.Columns {
+			if col == suite.Map.Dialect.QuoteField("Memo") {
+				memos = append(memos, values[i])
+			}
+		}
+		return nil
 	})
-
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-		Where().
-		LessOrEqual(&suite.Ref.Updated, 2).
-		Select()
 	if suite.NoError(err) {
-		suite.Equal(expectedCount, len(invTest))
+		suite.Equal([]interface{}{testInvoices[0].Memo, testInvoices[1].Memo}, memos)
 	}
-}
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectGreater() {
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return inv.Updated > 2
-	})
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).ReadOnly().CopySource(rows)
+	suite.Equal(ErrReadOnly, err)
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).CopySource([]AutoIncrInvoice{{Id: 1}})
+	suite.Error(err, "CopySource should reject rows of other types")
+}
 
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-		Where().
-		Greater(&suite.Ref.Updated, 2).
-		Select()
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_UpsertAll() {
+	rows := []OverriddenInvoice{testInvoices[0], testInvoices[1], testInvoices[2]}
+	rows[0].Memo = "upserted_memo"
+	rows[0].Updated = 0
+	rows[1].Id = "6"
+	rows[2].Memo = "kept_memo"
+	strategies := map[interface{}]MergeStrategy{
+		&suite.Ref.Updated: MergeGreatest,
+	}
+	logger := new(recordingLogger)
+	options := Options{
+		Logger: logger,
+		// Room for one row per statement.
+		Limits: Limits{MaxArgs: 6},
+	}
+	plan := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).(*QueryPlan)
+	upserted, err := plan.UpsertAll(rows[:2], []interface{}{&suite.Ref.Id}, strategies)
 	if suite.NoError(err) {
-		suite.Equal(expectedCount, len(invTest))
+		suite.Equal(int64(2), upserted, "UpsertAll should sum the rows affected by each statement")
 	}
-}
+	suite.Len(logger.lines, 2, "Rows should be split across statements to stay under MaxArgs")
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectGreater_OffsetAndLimit() {
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Count()
+	if suite.NoError(err) {
+		suite.Equal(len(testInvoices)+1, count, "UpsertAll should insert rows that do not conflict")
+	}
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
 		Where().
-		Greater(&suite.Ref.Updated, 1).
-		Offset(1).
-		Limit(1).
+		Equal(&suite.Ref.Id, rows[0].Id).
 		Select()
-	if suite.NoError(err) {
-		suite.Equal(1, len(invTest))
+	if suite.NoError(err) && suite.Len(results, 1) {
+		inv := results[0].(*OverriddenInvoice)
+		suite.Equal("upserted_memo", inv.Memo, "MergeOverwrite should replace existing values")
+		suite.Equal(testInvoices[0].Updated, inv.Updated, "MergeGreatest should keep the greater value")
 	}
-}
-
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectGreaterOrEqual() {
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return inv.Updated >= 2
-	})
 
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+	strategies = map[interface{}]MergeStrategy{&suite.Ref.Memo: MergeKeep}
+	plan = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan)
+	_, err = plan.UpsertAll(rows[2:], []interface{}{&suite.Ref.Id}, strategies)
+	suite.NoError(err)
+	results, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
 		Where().
-		GreaterOrEqual(&suite.Ref.Updated, 2).
+		Equal(&suite.Ref.Id, rows[2].Id).
 		Select()
-	if suite.NoError(err) {
-		suite.Equal(expectedCount, len(invTest))
+	if suite.NoError(err) && suite.Len(results, 1) {
+		suite.Equal(testInvoices[2].Memo, results[0].(*OverriddenInvoice).Memo, "MergeKeep should keep existing values")
 	}
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectTrue() {
-	suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return inv.IsPaid
-	})
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Upsert() {
+	upsert := func(id, memo string, updated int64, updateFieldPtrs ...interface{}) error {
+		_, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+			Assign(&suite.Ref.Id, id).
+			Assign(&suite.Ref.Memo, memo).
+			Assign(&suite.Ref.Updated, updated).
+			Assign(&suite.Ref.Created, int64(1)).
+			Assign(&suite.Ref.PersonId, int64(1)).
+			Assign(&suite.Ref.IsPaid, false).
+			Upsert([]interface{}{&suite.Ref.Id}, updateFieldPtrs...)
+		return err
+	}
+	find := func(id string) *OverriddenInvoice {
+		results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+			Where().
+			Equal(&suite.Ref.Id, id).
+			Select()
+		suite.Require().NoError(err)
+		suite.Require().Len(results, 1)
+		return results[0].(*OverriddenInvoice)
+	}
 
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-		Where().
-		True(&suite.Ref.IsPaid).
-		Limit(1).
-		Select()
+	suite.Require().NoError(upsert("6", "upserted_memo", 6))
+	suite.Equal("upserted_memo", find("6").Memo, "Upsert should insert rows that do not conflict")
+
+	suite.Require().NoError(upsert("1", "upserted_memo", 7))
+	inv := find("1")
+	suite.Equal("upserted_memo", inv.Memo, "Upsert should update every assigned column by default")
+	suite.Equal(int64(7), inv.Updated)
+
+	suite.Require().NoError(upsert("3", "upserted_memo", 8, &suite.Ref.Updated))
+	inv = find("3")
+	suite.Equal("test_memo", inv.Memo, "Upsert should only update the requested columns")
+	suite.Equal(int64(8), inv.Updated)
+
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Count()
 	if suite.NoError(err) {
-		suite.Equal(1, len(invTest))
+		suite.Equal(int64(len(testInvoices)+1), count)
 	}
+
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Assign(&suite.Ref.Id, "1").
+		Upsert([]interface{}{&suite.Ref.Id}, &suite.Ref.Memo)
+	suite.Error(err, "Upsert should not update columns without an assigned value")
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectFalse() {
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return !inv.IsPaid
-	})
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_UpsertConflictTargets() {
+	upsert := func(q *QueryPlan, id, memo string, updated int64) error {
+		_, err := q.Assign(&suite.Ref.Id, id).
+			Assign(&suite.Ref.Memo, memo).
+			Assign(&suite.Ref.Updated, updated).
+			Assign(&suite.Ref.Created, int64(1)).
+			Assign(&suite.Ref.PersonId, int64(1)).
+			Assign(&suite.Ref.IsPaid, true).
+			Upsert([]interface{}{&suite.Ref.Memo}, &suite.Ref.Updated)
+		return err
+	}
+	paid := filters.True(&suite.Ref.IsPaid)
+	switch suite.Map.Dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).ConflictWhere(paid)
+		suite.Error(upsert(q, "6", "another_test_memo", 6), "MySQL should not support conflict predicates")
+		return
+	}
 
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+	quote := suite.Map.Dialect.QuoteField
+	_, err := suite.Map.Exec("create unique index " + quote("idx_paid_memo") + " on " + quote("OverriddenInvoice") + " (" + quote("Memo") + ") where " + quote("IsPaid"))
+	suite.Require().NoError(err)
+	defer suite.Map.Exec("drop index " + quote("idx_paid_memo"))
+
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).ConflictWhere(paid)
+	suite.Require().NoError(upsert(q, "6", "another_test_memo", 6))
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
 		Where().
-		False(&suite.Ref.IsPaid).
+		Equal(&suite.Ref.Memo, "another_test_memo").
+		OrderBy(&suite.Ref.Id, "ASC").
 		Select()
-	if suite.NoError(err) {
-		suite.Equal(expectedCount, len(invTest))
+	suite.Require().NoError(err)
+	if suite.Len(results, 2, "A conflict on the partial index should update the existing row") {
+		suite.Equal(int64(6), results[1].(*OverriddenInvoice).Updated)
 	}
-}
-
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectFalseAndEqual() {
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return !inv.IsPaid && inv.Created == 2
-	})
 
+	q = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).ConflictConstraint("OverriddenInvoice_pkey")
+	_, err = q.Assign(&suite.Ref.Id, "1").
+		Assign(&suite.Ref.Memo, "constrained_memo").
+		Upsert(nil)
+	if _, ok := suite.Map.Dialect.(gorp.PostgresDialect); !ok {
+		suite.Error(err, "Only postgres should support conflict targets by name")
+		return
+	}
+	suite.Require().NoError(err)
 	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
 		Where().
-		False(&suite.Ref.IsPaid).
-		Equal(&suite.Ref.Created, 2).
+		Equal(&suite.Ref.Memo, "constrained_memo").
 		Count()
 	if suite.NoError(err) {
-		suite.Equal(expectedCount, count)
+		suite.Equal(int64(1), count)
 	}
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectWithFilter() {
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return inv.Memo == "another_test_memo" || inv.Updated == 3
-	})
-
-	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-		Where().
-		Filter(filters.Or(filters.Equal(&suite.Ref.Memo, "another_test_memo"), filters.Equal(&suite.Ref.Updated, 3))).
-		Select()
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Bucketize() {
+	var byWidth []Bucket
+	err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Bucketize(&suite.Ref.Updated, 2, &byWidth)
 	if suite.NoError(err) {
-		suite.Equal(expectedCount, len(invTest))
+		suite.Equal([]Bucket{{Bucket: 0, Count: 2}, {Bucket: 1, Count: 3}}, byWidth)
 	}
-}
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_Delete() {
-	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
-		return !inv.IsPaid
-	})
-
-	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+	var byEdges []Bucket
+	err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
 		Where().
 		False(&suite.Ref.IsPaid).
-		Delete()
+		Bucketize(&suite.Ref.Updated, []int64{2, 3}, &byEdges)
 	if suite.NoError(err) {
-		suite.Equal(expectedCount, count)
+		suite.Equal([]Bucket{{Bucket: 0, Count: 1}, {Bucket: 1, Count: 1}, {Bucket: 2, Count: 2}}, byEdges)
+	}
 
-		count, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-			Where().
-			False(&suite.Ref.IsPaid).
-			Count()
-		if suite.NoError(err) {
-			suite.Equal(0, count, "No unpaid invoices should exist after deleting all unpaid invoices")
+	err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Bucketize(&suite.Ref.Updated, "2", &byWidth)
+	suite.Error(err, "Bucketize should reject widths which aren't numbers")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_GroupByTime() {
+	plan := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan)
+	buckets, err := plan.GroupByTime(&suite.Ref.Created, time.Second, time.Unix(0, 0), time.Unix(4, 0))
+	if suite.NoError(err) && suite.Len(buckets, 4, "GroupByTime should return every interval, including empty ones") {
+		for i, expected := range []int64{0, 3, 2, 0} {
+			suite.Equal(time.Unix(int64(i), 0).UTC(), buckets[i].Time)
+			suite.Equal(expected, buckets[i].Count)
 		}
 	}
-}
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_FakeEmbed() {
-	testMemo := "This is a test of a fake embedded field"
-	fakeEmbed := new(FakeEmbeddedInvoice)
-	fakeEmbed.SomeOtherField = "test"
-	fakeEmbed.Invoice.IsPaid = true
-	fakeEmbed.Invoice.Memo = testMemo
-	suite.Map.Insert(fakeEmbed)
+	_, err = plan.GroupByTime(&suite.Ref.Memo, time.Second, time.Unix(0, 0), time.Unix(4, 0))
+	suite.Error(err, "GroupByTime should reject fields which aren't times")
+}
 
-	results, err := Query(suite.Map, suite.Map, fakeEmbed, JoinOp{}).
-		Where().
-		Equal(&fakeEmbed.Invoice.Memo, testMemo).
-		Select()
-	suite.Require().NoError(err)
-	suite.Require().Equal(1, len(results))
-	fe := results[0].(*FakeEmbeddedInvoice)
-	suite.Equal("test", fe.SomeOtherField)
-	suite.Equal(testMemo, fe.Invoice.Memo)
-	suite.Equal(true, fe.Invoice.IsPaid)
+// maxAggregate is a minimal aggregate wrapper, since the wrappers in
+// the gorq package can't be imported from here.
+type maxAggregate struct {
+	value interface{}
 }
 
-func (suite *QueryLanguageTestSuite) TestQueryLanguage_Truncate() {
-	// SQLite3 doesn't support TRUNCATE TABLE
-	if _, ok := suite.Map.Dialect.(dialects.SqliteDialect); ok {
-		return
+func (w maxAggregate) ActualValue() interface{}       { return w.value }
+func (w maxAggregate) WrapSql(sqlValue string) string { return "max(" + sqlValue + ")" }
+func (w maxAggregate) Aggregate()                     {}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectAsHaving() {
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan)
+	q.Fields(&suite.Ref.PersonId)
+	q.SelectAs(&suite.Ref.Updated, maxAggregate{&suite.Ref.Updated})
+	q.GroupBy(&suite.Ref.PersonId)
+	q.Having(filters.Greater(&suite.Ref.Updated, 2))
+	results, err := q.Select()
+	if suite.NoError(err) && suite.Len(results, 1) {
+		inv := results[0].(*OverriddenInvoice)
+		suite.Equal(int64(1), inv.PersonId)
+		suite.Equal(int64(3), inv.Updated)
 	}
-	expectedCount := 0
+}
 
-	err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
-		Truncate()
-	if !suite.NoError(err) {
-		suite.T().FailNow()
-	}
-	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+// recordingRowWrapper records the columns that a plan passes to
+// WrapRow.
+type recordingRowWrapper struct {
+	row   interface{}
+	key   *string
+	names *[]string
+}
+
+func (w recordingRowWrapper) ActualRow() interface{} { return w.row }
+
+func (w recordingRowWrapper) WrapRow(dialect gorp.Dialect, key string, names, sqlValues []string) string {
+	*w.key, *w.names = key, names
+	return "'row'"
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_RowWrapper() {
+	var (
+		key   string
+		names []string
+	)
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan)
+	q.Fields(&suite.Ref.Id)
+	q.SelectAs(&suite.Ref.TransientId, recordingRowWrapper{row: suite.Ref, key: &key, names: &names})
+	q.Where().Equal(&suite.Ref.Id, "1")
+	results, err := q.Select()
+	if suite.NoError(err) && suite.Len(results, 1) {
+		suite.Equal("row", results[0].(*OverriddenInvoice).TransientId)
+	}
+	suite.NotEmpty(key, "The primary key column should be passed to WrapRow")
+	suite.Contains(names, "Memo")
+	suite.Contains(names, "PersonId")
+	suite.NotContains(names, "TransientId")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_ComputedColumns() {
+	table, err := suite.Map.TableFor(reflect.TypeOf(OverriddenInvoice{}), false)
+	suite.Require().NoError(err)
+	options := Options{
+		ComputedColumns: map[*gorp.ColumnMap]string{table.ColMap("TransientId"): "lower({Memo})"},
+	}
+	results, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Equal(&suite.Ref.TransientId, "another_test_memo").
+		OrderBy(&suite.Ref.TransientId, "asc").
+		Select()
+	if suite.NoError(err) && suite.Len(results, 2) {
+		for _, result := range results {
+			suite.Equal("another_test_memo", result.(*OverriddenInvoice).TransientId)
+		}
+	}
+
+	spec, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).(*QueryPlan).Spec()
+	suite.Require().NoError(err)
+	fromSpec, err := QueryFromSpec(suite.Map, suite.Map, suite.Ref, spec, options)
+	suite.Require().NoError(err)
+	results, err = fromSpec.Select()
+	if suite.NoError(err) && suite.Len(results, len(testInvoices)) {
+		suite.NotEmpty(results[0].(*OverriddenInvoice).TransientId, "Plans built from a spec should select computed columns")
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_IndexExpressions() {
+	table, err := suite.Map.TableFor(reflect.TypeOf(OverriddenInvoice{}), false)
+	suite.Require().NoError(err)
+	col := table.ColMap("TransientId")
+	logger := new(recordingLogger)
+	options := Options{
+		Logger:           logger,
+		ComputedColumns:  map[*gorp.ColumnMap]string{col: "lower({Memo})"},
+		IndexExpressions: map[*gorp.ColumnMap]string{col: "lower(trim({Memo}))"},
+	}
+	results, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Equal(&suite.Ref.TransientId, "test_memo").
+		Select()
+	if suite.NoError(err) {
+		suite.Len(results, 3)
+	}
+	suite.Require().Len(logger.lines, 1)
+	suite.Equal(1, strings.Count(logger.lines[0], "lower(trim("), "The index expression should only be used in the where clause")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_DefaultOptions() {
+	options := Options{DefaultLimit: 2, RequireWhere: true, Timeout: time.Minute}
+	results, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Select()
+	if suite.NoError(err) {
+		suite.Len(results, 2, "Selects without a limit should use the default limit")
+	}
+	results, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Limit(3).Select()
+	if suite.NoError(err) {
+		suite.Len(results, 3, "Selects with a limit should not use the default limit")
+	}
+	count, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Count()
+	if suite.NoError(err) {
+		suite.Equal(int64(len(testInvoices)), count, "Counts should not use the default limit")
+	}
+
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Delete()
+	suite.Equal(ErrNoWhere, err)
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Assign(&suite.Ref.Memo, "unfiltered").
+		Update()
+	suite.Equal(ErrNoWhere, err)
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_ReadOnly() {
+	options := Options{ReadOnly: true}
+	results, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Select()
+	if suite.NoError(err) {
+		suite.Len(results, len(testInvoices))
+	}
+	count, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Count()
+	if suite.NoError(err) {
+		suite.Equal(int64(len(testInvoices)), count)
+	}
+
+	err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Assign(&suite.Ref.Id, "read-only").
+		Assign(&suite.Ref.Memo, "read-only").
+		Insert()
+	suite.Equal(ErrReadOnly, err)
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Assign(&suite.Ref.Memo, "read-only").
+		Where().
+		Equal(&suite.Ref.Memo, "test_memo").
+		Update()
+	suite.Equal(ErrReadOnly, err)
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Equal(&suite.Ref.Memo, "test_memo").
+		Delete()
+	suite.Equal(ErrReadOnly, err)
+	err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Truncate()
+	suite.Equal(ErrReadOnly, err)
+
+	q := Query(suite.Map, suite.Map, suite.Ref).(*QueryPlan).ReadOnly()
+	_, err = q.Delete()
+	suite.Equal(ErrReadOnly, err, "Plans marked with ReadOnly should not write")
+
+	count, err = Query(suite.Map, suite.Map, suite.Ref).Count()
+	if suite.NoError(err) {
+		suite.Equal(int64(len(testInvoices)), count, "Read-only plans should not have written anything")
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_MaxRows() {
+	options := Options{Limits: Limits{MaxRows: 3}}
+	_, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Select()
+	if limitErr, ok := err.(*LimitError); suite.True(ok, "Expected a *LimitError, got %v", err) {
+		suite.Equal("MaxRows", limitErr.Limit)
+	}
+
+	results, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Limit(2).Select()
+	if suite.NoError(err) {
+		suite.Len(results, 2)
+	}
+
+	q := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).(*QueryPlan)
+	results, err = q.MaxRows(len(testInvoices)).Select()
+	if suite.NoError(err) {
+		suite.Len(results, len(testInvoices))
+		suite.False(q.Truncated())
+	}
+
+	options.Limits.TruncateRows = true
+	q = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).(*QueryPlan)
+	results, err = q.Select()
+	if suite.NoError(err) {
+		suite.Len(results, 3)
+		suite.True(q.Truncated())
+	}
+}
+
+type commentKey string
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_CommentTags() {
+	ctx := context.WithValue(context.Background(), commentKey("route"), "/listings")
+	ctx = context.WithValue(ctx, commentKey("request"), "abc*/; drop table invoices")
+	logger := new(recordingLogger)
+	options := Options{
+		Context: ctx,
+		Logger:  logger,
+		CommentTags: []CommentTag{
+			{Name: "route", ContextKey: commentKey("route")},
+			{Name: "request_id", ContextKey: commentKey("request")},
+			{Name: "missing", ContextKey: commentKey("missing")},
+		},
+	}
+	_, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Select()
+	suite.Require().NoError(err)
+	suite.Require().Len(logger.lines, 1)
+	suite.Contains(logger.lines[0], " /* route=/listings, request_id=abc/; drop table invoices */ [")
+
+	options.CommentFormat = SQLCommenter
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Count()
+	suite.Require().NoError(err)
+	suite.Require().Len(logger.lines, 2)
+	suite.Contains(logger.lines[1], " /*request_id='abc%2A%2F%3B+drop+table+invoices',route='%2Flistings'*/ [")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Comment() {
+	logger := new(recordingLogger)
+	options := Options{Logger: logger}
+	q := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).(*QueryPlan).
+		Comment("feature: search").
+		Comment("owner */ drop table invoices; /* team\nsearch").
+		Comment(" ** ")
+	_, err := q.Select()
+	suite.Require().NoError(err)
+	suite.Require().Len(logger.lines, 1)
+	suite.Contains(logger.lines[0], " /* feature: search, owner / drop table invoices; / teamsearch */ [")
+
+	ctx := context.WithValue(context.Background(), commentKey("route"), "/listings")
+	options = Options{
+		Context:     ctx,
+		Logger:      logger,
+		CommentTags: []CommentTag{{Name: "route", ContextKey: commentKey("route")}},
+	}
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).(*QueryPlan).
+		Comment("feature: search").
+		Count()
+	suite.Require().NoError(err)
+	suite.Require().Len(logger.lines, 2)
+	suite.Contains(logger.lines[1], " /* feature: search */ /* route=/listings */ [", "Comments should come before the comment tags")
+}
+
+// prefixWrapper is a LiteralWrapper for the first length characters
+// of a string.
+type prefixWrapper struct {
+	value  interface{}
+	length int
+}
+
+func (w prefixWrapper) ActualValue() interface{} {
+	return w.value
+}
+
+func (w prefixWrapper) WrapSql(sqlValue string) string {
+	return fmt.Sprintf("substr(%s, 1, %d)", sqlValue, w.length)
+}
+
+func (w prefixWrapper) BoundValues(gorp.Dialect) []interface{} {
+	return []interface{}{w.value, w.length}
+}
+
+func (w prefixWrapper) WrapSqlBound(dialect gorp.Dialect, sqlValues ...string) string {
+	return fmt.Sprintf("substr(%s, 1, %s)", sqlValues[0], sqlValues[1])
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_NoInlining() {
+	logger := new(recordingLogger)
+	options := Options{Logger: logger}
+	query := func(length int) ([]interface{}, error) {
+		return QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+			Where().
+			Equal(prefixWrapper{&suite.Ref.Memo, length}, "test_memo"[:length]).
+			OrderBy(prefixWrapper{&suite.Ref.Memo, length}, "asc").
+			Select()
+	}
+	results, err := query(4)
+	suite.Require().NoError(err)
+	suite.Len(results, 3)
+	suite.Require().Len(logger.lines, 1)
+	suite.Contains(logger.lines[0], "substr(")
+	suite.Contains(logger.lines[0], ", 1, 4)")
+
+	options.NoInlining = true
+	results, err = query(4)
+	suite.Require().NoError(err)
+	suite.Len(results, 3)
+	results, err = query(5)
+	suite.Require().NoError(err)
+	suite.Len(results, 3)
+	suite.Require().Len(logger.lines, 3)
+	suite.NotContains(logger.lines[1], ", 1, 4)")
+	stmt := func(line string) string {
+		return line[:strings.LastIndex(line, " [")]
+	}
+	suite.Equal(stmt(logger.lines[1]), stmt(logger.lines[2]),
+		"Statements should not depend on the values of bound literals")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Rewriters() {
+	logger := new(recordingLogger)
+	options := Options{
+		Logger: logger,
+		Rewriters: []Rewriter{
+			func(query string, args []interface{}) (string, []interface{}, error) {
+				return "/* routed */ " + query, args, nil
+			},
+			func(query string, args []interface{}) (string, []interface{}, error) {
+				for i, arg := range args {
+					if arg == "placeholder" {
+						args[i] = "test_memo"
+					}
+				}
+				return query, args, nil
+			},
+		},
+	}
+	results, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Equal(&suite.Ref.Memo, "placeholder").
+		Select()
+	suite.Require().NoError(err)
+	suite.Len(results, 3, "Rewritten arguments should be used")
+	suite.Require().Len(logger.lines, 1)
+	suite.True(strings.HasPrefix(logger.lines[0], "/* routed */ "), "Rewritten statements should be logged")
+
+	rewriteErr := errors.New("rewrite failed")
+	options.Rewriters = []Rewriter{func(string, []interface{}) (string, []interface{}, error) {
+		return "", nil, rewriteErr
+	}}
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Select()
+	suite.Equal(rewriteErr, err)
+	suite.Len(logger.lines, 1, "Statements should not execute if a rewriter fails")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_AssignExpressions() {
+	var statement string
+	captured := errors.New("captured")
+	options := Options{
+		Rewriters: []Rewriter{func(query string, args []interface{}) (string, []interface{}, error) {
+			statement = query
+			return "", nil, captured
+		}},
+	}
+	_, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		AssignJSONPath(&suite.Ref.Memo, "address.city", "Portland").
+		Where().
+		Equal(&suite.Ref.Id, "1").
+		Update()
+	suite.Equal(captured, err)
+	quotedMemo := suite.Map.Dialect.QuoteField("Memo")
+	if _, ok := suite.Map.Dialect.(gorp.PostgresDialect); ok {
+		suite.Contains(statement, quotedMemo+"=jsonb_set(")
+		suite.Contains(statement, "'{address,city}'")
+	} else {
+		suite.Contains(statement, quotedMemo+"=json_set(")
+		suite.Contains(statement, `'$."address"."city"'`)
+	}
+
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		AssignArrayAppend(&suite.Ref.Memo, "tag").
+		Where().
+		Equal(&suite.Ref.Id, "1").
+		Update()
+	if _, ok := suite.Map.Dialect.(gorp.PostgresDialect); ok {
+		suite.Equal(captured, err)
+		suite.Contains(statement, quotedMemo+"=array_append(")
+	} else {
+		suite.Error(err, "Array appends should be rejected outside of postgresql")
+		suite.NotEqual(captured, err)
+	}
+
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		AssignJSONPath(&suite.Ref.Memo, "address.'city", "Portland").
+		Where().
+		Equal(&suite.Ref.Id, "1").
+		Update()
+	suite.Error(err, "JSON paths with invalid keys should be rejected")
+
+	err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Assign(&suite.Ref.Id, "6").
+		AssignJSONPath(&suite.Ref.Memo, "city", "Portland").
+		Insert()
+	suite.Error(err, "Inserts should reject path assignments")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_UpdateWhereCurrent() {
+	swap := func() (bool, error) {
+		return Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+			Where().
+			Equal(&suite.Ref.Id, "1").
+			UpdateWhereCurrent(&suite.Ref.Memo, "test_memo", "swapped_memo")
+	}
+	swapped, err := swap()
+	if suite.NoError(err) {
+		suite.True(swapped)
+	}
+	swapped, err = swap()
+	if suite.NoError(err) {
+		suite.False(swapped, "Rows that no longer hold the expected value should not be updated")
+	}
+
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Equal(&suite.Ref.Memo, "swapped_memo").
+		Select()
+	if suite.NoError(err) {
+		suite.Len(results, 1, "Only rows matching the plan's where clause should be swapped")
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_ContextMethods() {
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	results, err := q.SelectContext(context.Background())
+	suite.Require().NoError(err)
+	suite.Len(results, len(testInvoices))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = q.SelectContext(ctx)
+	suite.Error(err, "Statements should not run with a canceled context")
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).CountContext(ctx)
+	suite.Error(err)
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Equal(&suite.Ref.Memo, "test_memo").
+		DeleteContext(ctx)
+	suite.Error(err)
+
+	count, err := q.CountContext(context.Background())
+	suite.Require().NoError(err, "A plan's context should be restored after each call")
+	suite.Equal(int64(len(testInvoices)), count)
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectOne() {
+	ref := new(OverriddenInvoice)
+	err := Query(suite.Map, suite.Map, ref, JoinOp{}).
+		Where().
+		Equal(&ref.Id, "3").
+		SelectOne()
+	suite.Require().NoError(err)
+	suite.Equal(testInvoices[2], *ref, "SelectOne should scan the row into the reference struct")
+
+	q := Query(suite.Map, suite.Map, ref, JoinOp{}).
+		Where().
+		Equal(&ref.Memo, "another_test_memo").
+		OrderBy(&ref.Id, "DESC")
+	suite.Require().NoError(q.SelectOne())
+	suite.Equal("4", ref.Id, "SelectOne should select the first matching row")
+	results, err := q.Select()
+	if suite.NoError(err) {
+		suite.Len(results, 2, "SelectOne should not change the plan's limit")
+	}
+
+	err = Query(suite.Map, suite.Map, ref, JoinOp{}).
+		Where().
+		Equal(&ref.Id, "none").
+		SelectOne()
+	suite.Equal(ErrNotFound, err)
+}
+
+// invoiceMemo is not mapped to a table, so results are scanned into
+// it using its db tags.
+type invoiceMemo struct {
+	Id       string `db:"id"`
+	Memo     string
+	Person   int64  `db:"PersonId"`
+	Internal string `db:"-"`
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectToUnmappedTarget() {
+	var memos []invoiceMemo
+	err := Query(suite.Map, suite.Map, suite.Ref).
+		Where().
+		Equal(&suite.Ref.Memo, "test_memo").
+		OrderBy(&suite.Ref.Id, "ASC").
+		SelectToTarget(&memos)
+	suite.Require().NoError(err)
+	suite.Equal([]invoiceMemo{
+		{Id: "1", Memo: "test_memo", Person: 1},
+		{Id: "3", Memo: "test_memo", Person: 1},
+		{Id: "5", Memo: "test_memo", Person: 1},
+	}, memos)
+
+	var ptrs []*invoiceMemo
+	q := Query(suite.Map, suite.Map, suite.Ref).Fields(&suite.Ref.Memo).(*QueryPlan)
+	err = q.Where().
+		Equal(&suite.Ref.Id, "2").
+		SelectToTarget(&ptrs)
+	suite.Require().NoError(err)
+	suite.Equal([]*invoiceMemo{{Memo: "another_test_memo"}}, ptrs)
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectSimple() {
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Select()
+	if suite.NoError(err) {
+		suite.Equal(len(testInvoices), len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_CountSimple() {
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Count()
+	if suite.NoError(err) {
+		suite.Equal(len(testInvoices), count)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_OrderBy_ASC() {
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).OrderBy(&suite.Ref.Updated, "asc").Select()
+	if suite.NoError(err) {
+		previous := invTest[0].(*OverriddenInvoice).Updated
+		for _, result := range invTest {
+			inv := result.(*OverriddenInvoice)
+			suite.True(previous <= inv.Updated, "OrderBy ASC means %d should be <= %d", previous, inv.Updated)
+			previous = inv.Updated
+		}
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_OrderBy_DESC() {
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).OrderBy(&suite.Ref.Updated, "DESC").Select()
+	if suite.NoError(err) {
+		previous := invTest[0].(*OverriddenInvoice).Updated
+		for _, result := range invTest {
+			inv := result.(*OverriddenInvoice)
+			suite.True(previous >= inv.Updated, "OrderBy DESC means %d should be >= %d", previous, inv.Updated)
+			previous = inv.Updated
+		}
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectLike() {
+	search := "another"
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return strings.Contains(inv.Memo, search)
+	})
+
+	matchSequence := "%"
+	if _, ok := suite.Map.Dialect.(gorp.MySQLDialect); ok {
+		// MySQL has non-standard everything
+		matchSequence = "\\%"
+	}
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Like(&suite.Ref.Memo, matchSequence+search+matchSequence).
+		Count()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, count)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectEqual() {
+	match := "test_memo"
+	expected := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Memo == match
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Equal(&suite.Ref.Memo, match).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(expected, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectNotEqual() {
+	match := "test_memo"
+	expected := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Memo != match
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		NotEqual(&suite.Ref.Memo, match).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(expected, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectLess() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Updated < 2
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Less(&suite.Ref.Updated, 2).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectLessOrEqual() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Updated <= 2
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		LessOrEqual(&suite.Ref.Updated, 2).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectGreater() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Updated > 2
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Greater(&suite.Ref.Updated, 2).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectGreater_OffsetAndLimit() {
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Greater(&suite.Ref.Updated, 1).
+		Offset(1).
+		Limit(1).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(1, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectGreaterOrEqual() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Updated >= 2
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		GreaterOrEqual(&suite.Ref.Updated, 2).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectTrue() {
+	suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.IsPaid
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		True(&suite.Ref.IsPaid).
+		Limit(1).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(1, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectFalse() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return !inv.IsPaid
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		False(&suite.Ref.IsPaid).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectFalseAndEqual() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return !inv.IsPaid && inv.Created == 2
+	})
+
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		False(&suite.Ref.IsPaid).
+		Equal(&suite.Ref.Created, 2).
+		Count()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, count)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectWithFilter() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Memo == "another_test_memo" || inv.Updated == 3
+	})
+
+	invTest, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Filter(filters.Or(filters.Equal(&suite.Ref.Memo, "another_test_memo"), filters.Equal(&suite.Ref.Updated, 3))).
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(invTest))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_OrWhere() {
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Equal(&suite.Ref.PersonId, 1).
+		False(&suite.Ref.IsPaid).
+		OrWhere().
+		Equal(&suite.Ref.Id, "2")
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return (inv.PersonId == 1 && !inv.IsPaid) || inv.Id == "2"
+	})
+	results, err := q.Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+
+	// Empty branches should be ignored
+	q = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		OrWhere().
+		True(&suite.Ref.IsPaid)
+	expectedCount = suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.IsPaid
+	})
+	results, err = q.Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+}
+
+func TestJoinFuncStrategy(t *testing.T) {
+	target := new(Invoice)
+	constraint := filters.Equal(&target.Id, 1)
+	var strategy JoinStrategy = JoinFunc(func(parent, field interface{}) (string, interface{}, interface{}, []filters.Filter) {
+		return "left", target, &target.Memo, []filters.Filter{constraint}
+	})
+	spec := strategy.Join(nil, nil)
+	if spec.Type != "left" || spec.Target != target || spec.Select != &target.Memo || len(spec.Constraints) != 1 {
+		t.Errorf("JoinFunc should convert its return values to a JoinSpec; got %#v", spec)
+	}
+	if (JoinOp{}).strategy() != nil {
+		t.Error("A JoinOp with no Join or Strategy should have no strategy")
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_WithJoinOps() {
+	table, err := suite.Map.TableFor(reflect.TypeOf(OverriddenInvoice{}), false)
+	suite.Require().NoError(err)
+	skip := JoinFunc(func(parent, field interface{}) (string, interface{}, interface{}, []filters.Filter) {
+		return "", nil, nil, nil
+	})
+	ref := new(OverriddenInvoice)
+	plan := Query(suite.Map, suite.Map, ref, JoinOp{}).(*QueryPlan)
+	plan.WithJoinOps(JoinOp{Table: table, Column: table.ColMap("Memo"), Join: skip})
+	plan.Fields(&ref.Id, &ref.Memo)
+	memo, err := plan.colMap.fieldMapForPointer(&ref.Memo)
+	suite.Require().NoError(err)
+	suite.False(memo.doSelect, "Fields added after WithJoinOps should use its ops")
+
+	plan.WithJoinOps(JoinOp{Table: table, Column: table.ColMap("Memo")})
+	plan.AddField(&ref.Memo)
+	suite.True(memo.doSelect, "An op without a strategy should remove the column's strategy")
+
+	other, err := suite.Map.TableFor(reflect.TypeOf(AutoIncrInvoice{}), false)
+	suite.Require().NoError(err)
+	plan.WithJoinOps(JoinOp{Table: other, Column: other.ColMap("Id"), Join: skip})
+	suite.NotEmpty(plan.Errors, "Ops for columns that the plan doesn't map should be an error")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_JoinSpecAlias() {
+	table, err := suite.Map.TableFor(reflect.TypeOf(OverriddenInvoice{}), false)
+	suite.Require().NoError(err)
+	var joined *AutoIncrInvoice
+	strategy := JoinFunc(func(parent, field interface{}) (string, interface{}, interface{}, []filters.Filter) {
+		joined = new(AutoIncrInvoice)
+		return "left outer", joined, nil, []filters.Filter{filters.Equal(&joined.Memo, field)}
+	})
+	aliased := joinStrategyFunc(func(parent, field interface{}) *JoinSpec {
+		spec := strategy.Join(parent, field)
+		spec.Alias = "memo_match"
+		return spec
+	})
+	ref := new(OverriddenInvoice)
+	plan := Query(suite.Map, suite.Map, ref, JoinOp{Table: table, Column: table.ColMap("Memo"), Strategy: aliased}).(*QueryPlan)
+	plan.AddField(&ref.Memo)
+	query, err := plan.selectQuery()
+	suite.Require().NoError(err)
+	alias := plan.quoteField("memo_match")
+	suite.Contains(query, " as "+alias+" on "+alias+"."+plan.quoteField("Memo")+"=", "Aliased joins should be referred to by their alias")
+	_, err = plan.Select()
+	suite.NoError(err)
+}
+
+// RelatedInvoice is mapped to the same table as OverriddenInvoice,
+// with the invoices of the same person batched into Related.
+type RelatedInvoice struct {
+	Invoice
+	Id      string
+	Related []*OverriddenInvoice `db:"-"`
+}
+
+// joinStrategyFunc implements JoinStrategy for a function.
+type joinStrategyFunc func(parent, field interface{}) *JoinSpec
+
+func (f joinStrategyFunc) Join(parent, field interface{}) *JoinSpec { return f(parent, field) }
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_JoinSpecBatch() {
+	table := suite.Map.AddTableWithName(RelatedInvoice{}, "OverriddenInvoice").SetKeys(false, "Id")
+	statements := 0
+	batch := joinStrategyFunc(func(parent, field interface{}) *JoinSpec {
+		return &JoinSpec{Batch: &BatchSpec{
+			ParentKey: &parent.(*RelatedInvoice).PersonId,
+			Children: func() (interfaces.Selector, interface{}) {
+				statements++
+				child := new(OverriddenInvoice)
+				return Query(suite.Map, suite.Map, child, JoinOp{}), &child.PersonId
+			},
+		}}
+	})
+	ref := new(RelatedInvoice)
+	q := Query(suite.Map, suite.Map, ref, JoinOp{Table: table, Column: table.ColMap("Related"), Strategy: batch})
+	q.AddField(&ref.Related)
+	results, err := q.Select()
+	if suite.NoError(err) && suite.Len(results, len(testInvoices)) {
+		suite.Equal(1, statements, "Children should be loaded using one statement for every parent")
+		for _, result := range results {
+			inv := result.(*RelatedInvoice)
+			suite.Equal(suite.expectedLength(func(related OverriddenInvoice) bool {
+				return related.PersonId == inv.PersonId
+			}), len(inv.Related))
+		}
+	}
+
+	var targets []RelatedInvoice
+	if suite.NoError(q.(*QueryPlan).SelectToTarget(&targets)) && suite.NotEmpty(targets) {
+		suite.NotEmpty(targets[0].Related, "SelectToTarget should load batched children")
+	}
+}
+
+func TestSpecNumbers(t *testing.T) {
+	decoded := new(Spec)
+	encoded := `{"table": "invoice", "where": {"op": "=", "column": "PersonId", "values": [{"value": 9007199254740993}]}, "params": {"big": 9007199254740993}}`
+	if err := json.Unmarshal([]byte(encoded), decoded); err != nil {
+		t.Fatal(err)
+	}
+	value := decoded.Where.Values[0].Value
+	if literal := specLiteral(value, reflect.TypeOf(int64(0))); literal != int64(9007199254740993) {
+		t.Errorf("Large integers should be decoded without rounding; got %#v", literal)
+	}
+	if literal := specLiteral(value, reflect.TypeOf(int8(0))); literal != int64(9007199254740993) {
+		t.Errorf("Integers which overflow the field type should not be truncated; got %#v", literal)
+	}
+	if literal := specLiteral(json.Number("1.5"), reflect.TypeOf(int64(0))); literal != 1.5 {
+		t.Errorf("Fractions compared against integer fields should not be truncated; got %#v", literal)
+	}
+	if param := decoded.Params["big"]; param != json.Number("9007199254740993") {
+		t.Errorf("Large integer params should be decoded without rounding; got %#v", param)
+	}
+}
+
+func TestAutoIncrInsertSuffix(t *testing.T) {
+	col := &gorp.ColumnMap{ColumnName: "InvoiceId"}
+	plan := &QueryPlan{dialect: dialects.Wrap(gorp.PostgresDialect{}), identifiers: LowerIdentifiers}
+	if suffix := plan.autoIncrInsertSuffix(col); suffix != ` returning "invoiceid"` {
+		t.Errorf("Auto-increment columns should be written using the plan's IdentifierPolicy; got %q", suffix)
+	}
+	plan.identifiers = RawIdentifiers
+	if suffix := plan.autoIncrInsertSuffix(col); suffix != " returning InvoiceId" {
+		t.Errorf("Auto-increment columns should be written using the plan's IdentifierPolicy; got %q", suffix)
+	}
+}
+
+func TestAutoJoinType(t *testing.T) {
+	var (
+		id       int64
+		optional *int64
+		nullable sql.NullInt64
+		memo     string
+	)
+	plan := new(QueryPlan)
+	if joinType := plan.autoJoinType(&id, &memo); joinType != "inner" {
+		t.Errorf("References through NOT NULL fields should be inner joined; got %q", joinType)
+	}
+	if joinType := plan.autoJoinType(&id, &optional); joinType != "left outer" {
+		t.Errorf("References through pointer fields should be left outer joined; got %q", joinType)
+	}
+	if joinType := plan.autoJoinType(&nullable); joinType != "left outer" {
+		t.Errorf("References through sql.Null* fields should be left outer joined; got %q", joinType)
+	}
+	if joinType := plan.specJoinType(&optional); joinType != "inner" {
+		t.Errorf("JoinSpecs without a Type should be inner joined by default; got %q", joinType)
+	}
+	plan.refJoinType = "inner"
+	if joinType := plan.autoJoinType(&optional); joinType != "inner" {
+		t.Errorf("Options.ReferenceJoinType should override the automatic join type; got %q", joinType)
+	}
+	plan.refJoinType = AutoJoinType
+	if joinType := plan.specJoinType(&optional); joinType != "left outer" {
+		t.Errorf("AutoJoinType should choose JoinSpec join types by nullability; got %q", joinType)
+	}
+	if joinType := plan.autoJoinType(&optional); joinType != "left outer" {
+		t.Errorf("AutoJoinType should choose AutoJoin join types by nullability; got %q", joinType)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Merge() {
+	base := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	base.Where().Equal(&suite.Ref.PersonId, 1)
+
+	ref := new(OverriddenInvoice)
+	refinement := Query(suite.Map, suite.Map, ref, JoinOp{})
+	refinement.Where().False(&ref.IsPaid)
+	refinement.OrderBy(&ref.Created, "desc")
+
+	merged := base.(*QueryPlan).Merge(refinement.(*QueryPlan))
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.PersonId == 1 && !inv.IsPaid
+	})
+	results, err := merged.Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+
+	other := Query(suite.Map, suite.Map, new(AutoIncrInvoice), JoinOp{})
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).
+		Merge(other.(*QueryPlan)).
+		Select()
+	suite.Error(err, "Plans for different target types should not be merged")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectWithChildren() {
+	parent, child := new(OverriddenInvoice), new(OverriddenInvoice)
+	parents, children, err := SelectWithChildren[*OverriddenInvoice, *OverriddenInvoice](
+		Query(suite.Map, suite.Map, parent, JoinOp{}).Where().Equal(&parent.Id, "1"), &parent.PersonId,
+		Query(suite.Map, suite.Map, child, JoinOp{}), &child.PersonId)
+	if suite.NoError(err) && suite.Len(parents, 1) {
+		personId := parents[0].PersonId
+		suite.Len(children, 1, "Only the parents' children should be selected")
+		suite.Len(children[personId], suite.expectedLength(func(inv OverriddenInvoice) bool {
+			return inv.PersonId == personId
+		}))
+	}
+
+	ref := new(OverriddenInvoice)
+	logger := new(recordingLogger)
+	empty, err := SelectChildren[*OverriddenInvoice](QueryWithOptions(suite.Map, suite.Map, ref, Options{Logger: logger}), &ref.PersonId, nil)
+	if suite.NoError(err) {
+		suite.Empty(empty)
+		suite.Empty(logger.lines, "No statement should be executed without keys")
+	}
+
+	ids := make([]string, 0, len(testInvoices))
+	for _, inv := range testInvoices {
+		ids = append(ids, inv.Id)
+	}
+	options := Options{Logger: logger, Limits: Limits{MaxArgs: 2}}
+	byId, err := SelectChildren[*OverriddenInvoice](QueryWithOptions(suite.Map, suite.Map, ref, options), &ref.Id, ids)
+	if suite.NoError(err) {
+		suite.Len(byId, len(testInvoices), "Children from every chunk of keys should be returned")
+		suite.Len(logger.lines, (len(ids)+1)/2, "Keys should be split across statements to stay under MaxArgs")
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectGrouped() {
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	grouped, err := SelectGrouped[*OverriddenInvoice](q, &suite.Ref.PersonId)
+	if suite.NoError(err) {
+		for personId, invoices := range grouped {
+			expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+				return inv.PersonId == personId
+			})
+			suite.Equal(expectedCount, len(invoices))
+			for _, inv := range invoices {
+				suite.Equal(personId, inv.PersonId)
+			}
+		}
+	}
+
+	joined := new(AutoIncrInvoice)
+	q = Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	q.Join(joined).On(filters.Equal(&joined.Memo, &suite.Ref.Memo))
+	_, err = SelectGrouped[*OverriddenInvoice](q, &joined.Id)
+	suite.Error(err, "Results should not be grouped by fields of joined reference structs")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Params() {
+	byPerson := filters.Equal(&suite.Ref.PersonId, filters.Param("person"))
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where(byPerson)
+
+	_, err := q.Select()
+	suite.Error(err, "Select() should fail if a parameter has not been bound")
+
+	for _, personId := range []int64{1, 2} {
+		q.Bind(map[string]interface{}{"person": personId})
+		expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+			return inv.PersonId == personId
+		})
+		results, err := q.Select()
+		if suite.NoError(err) {
+			suite.Equal(expectedCount, len(results))
+		}
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Op() {
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where(filters.Op(&suite.Ref.Created, "<=", 1)).
+		Select()
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Created <= 1
+	})
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where(filters.Op(&suite.Ref.Created, "; drop table", 1)).
+		Select()
+	suite.Error(err, "Operators that have not been allowed should be rejected")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Tuples() {
+	keys := []interface{}{&suite.Ref.PersonId, &suite.Ref.Created}
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where(filters.TupleIn(keys, [][]interface{}{{1, 2}, {2, 2}})).
+		Select()
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Created == 2 && (inv.PersonId == 1 || inv.PersonId == 2)
+	})
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+
+	results, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where(filters.TupleGreater(keys, 1, 1)).
+		Select()
+	expectedCount = suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.PersonId > 1 || (inv.PersonId == 1 && inv.Created > 1)
+	})
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_AnyAndAll() {
+	if _, ok := dialects.Wrap(suite.Map.Dialect).(dialects.SqliteDialect); ok {
+		suite.T().Skip("SQLite3 doesn't support ANY or ALL comparisons")
+	}
+	sub := new(OverriddenInvoice)
+	subQuery := Query(suite.Map, suite.Map, sub, JoinOp{})
+	subQuery.Fields(&sub.Created)
+	subQuery.Where().Equal(&sub.PersonId, 2)
+
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Equal(&suite.Ref.Created, filters.AnyOf(subQuery)).
+		Select()
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Created == 2
+	})
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+
+	results, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Less(&suite.Ref.Created, filters.AllOf(subQuery)).
+		Select()
+	expectedCount = suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Created < 2
+	})
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Delete() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return !inv.IsPaid
+	})
+
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		False(&suite.Ref.IsPaid).
+		Delete()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, count)
+
+		count, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+			Where().
+			False(&suite.Ref.IsPaid).
+			Count()
+		if suite.NoError(err) {
+			suite.Equal(0, count, "No unpaid invoices should exist after deleting all unpaid invoices")
+		}
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_DeleteInBatches() {
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return !inv.IsPaid
+	})
+
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		False(&suite.Ref.IsPaid).
+		DeleteInBatches(3, time.Millisecond)
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, count)
+
+		count, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Count()
+		if suite.NoError(err) {
+			suite.Equal(len(testInvoices)-expectedCount, count, "Only unpaid invoices should be deleted")
+		}
+	}
+
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).DeleteInBatches(0, 0)
+	suite.Error(err, "DeleteInBatches should require a positive batch size")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_FakeEmbed() {
+	testMemo := "This is a test of a fake embedded field"
+	fakeEmbed := new(FakeEmbeddedInvoice)
+	fakeEmbed.SomeOtherField = "test"
+	fakeEmbed.Invoice.IsPaid = true
+	fakeEmbed.Invoice.Memo = testMemo
+	suite.Map.Insert(fakeEmbed)
+
+	results, err := Query(suite.Map, suite.Map, fakeEmbed, JoinOp{}).
+		Where().
+		Equal(&fakeEmbed.Invoice.Memo, testMemo).
+		Select()
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, len(results))
+	fe := results[0].(*FakeEmbeddedInvoice)
+	suite.Equal("test", fe.SomeOtherField)
+	suite.Equal(testMemo, fe.Invoice.Memo)
+	suite.Equal(true, fe.Invoice.IsPaid)
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectFields() {
+	ref := new(OverriddenInvoice)
+	results, err := Query(suite.Map, suite.Map, ref, JoinOp{}).
+		Fields(&ref.Memo).
+		Select()
+	suite.Require().NoError(err)
+	suite.Require().Equal(len(testInvoices), len(results))
+	for _, result := range results {
+		suite.Equal("", result.(*OverriddenInvoice).Id)
+		suite.NotEqual("", result.(*OverriddenInvoice).Memo)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectedColumns() {
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	q.Fields(&suite.Ref.Id, &suite.Ref.Memo)
+	columns := q.(*QueryPlan).SelectedColumns()
+	if suite.Len(columns, 2) {
+		suite.Equal("Id", columns[0].FieldName)
+		suite.Equal(&suite.Ref.Id, columns[0].Field)
+		suite.Equal("Memo", columns[1].FieldName)
+		suite.Equal(&suite.Ref.Memo, columns[1].Field)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectToChannel() {
+	results := make(chan *OverriddenInvoice)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).SelectToChannel(results)
+	}()
+	count := 0
+	for inv := range results {
+		suite.NotEqual("", inv.Id)
+		count++
+	}
+	suite.NoError(<-errs)
+	suite.Equal(len(testInvoices), count)
+
+	err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).SelectToChannel(make(chan *AutoIncrInvoice))
+	suite.Error(err, "SelectToChannel should reject channels of other types")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Iterate() {
+	var ids []string
+	err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		OrderBy(&suite.Ref.Id, "ASC").
+		Iterate(func(result interface{}) error {
+			ids = append(ids, result.(*OverriddenInvoice).Id)
+			return nil
+		})
+	suite.NoError(err)
+	suite.Equal([]string{"1", "2", "3", "4", "5"}, ids)
+
+	stop := errors.New("stop")
+	count := 0
+	err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).Iterate(func(result interface{}) error {
+		count++
+		return stop
+	})
+	suite.Equal(stop, err, "Iterate should return errors from its callback")
+	suite.Equal(1, count, "Iterate should stop reading rows after an error")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Rows() {
+	rows, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Equal(&suite.Ref.Memo, "test_memo").
+		OrderBy(&suite.Ref.Id, "DESC").
+		Rows()
+	suite.Require().NoError(err)
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		ids = append(ids, rows.Result().(*OverriddenInvoice).Id)
+	}
+	suite.NoError(rows.Err())
+	suite.Equal([]string{"5", "3", "1"}, ids)
+	suite.Nil(rows.Result())
+	suite.NoError(rows.Close(), "Closing rows twice should be harmless")
+
+	options := Options{Limits: Limits{MaxRows: 2, TruncateRows: true}}
+	q := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).(*QueryPlan)
+	rows, err = q.Rows()
+	suite.Require().NoError(err)
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	suite.NoError(rows.Err())
+	suite.Equal(2, count, "Rows should stop at the plan's maximum number of rows")
+	suite.True(q.Truncated())
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Partitioned() {
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).SelectPartitioned(&suite.Ref.Created, 3)
+	if suite.NoError(err) {
+		suite.Equal(len(testInvoices), len(results))
+	}
+
+	var (
+		lock sync.Mutex
+		seen = make(map[string]bool)
+	)
+	err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).EachPartitioned(&suite.Ref.Created, 4, func(result interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		seen[result.(*OverriddenInvoice).Id] = true
+		return nil
+	})
+	suite.NoError(err)
+	suite.Equal(len(testInvoices), len(seen), "Each row should be passed to fn exactly once")
+
+	results, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).SelectPartitioned(&suite.Ref.Id, 4)
+	suite.NoError(err)
+	suite.Equal(len(testInvoices), len(results), "String keys which aren't UUIDs should still be selected")
+
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	q.Limit(1)
+	_, err = q.SelectPartitioned(&suite.Ref.Created, 2)
+	suite.Error(err, "Plans with a limit should not be partitioned")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Export() {
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	q.Fields(&suite.Ref.Id, &suite.Ref.Memo)
+	csvOut := new(bytes.Buffer)
+	if suite.NoError(q.ExportCSV(csvOut)) {
+		lines := strings.Split(strings.TrimSpace(csvOut.String()), "\n")
+		suite.Equal(len(testInvoices)+1, len(lines), "ExportCSV should write a header and one line per row")
+	}
+
+	ndjsonOut := new(bytes.Buffer)
+	if suite.NoError(q.ExportNDJSON(ndjsonOut)) {
+		lines := strings.Split(strings.TrimSpace(ndjsonOut.String()), "\n")
+		suite.Equal(len(testInvoices), len(lines), "ExportNDJSON should write one line per row")
+		row := make(map[string]interface{})
+		suite.NoError(json.Unmarshal([]byte(lines[0]), &row))
+		suite.Len(row, 2)
+	}
+
+	encoded := 0
+	options := Options{
+		JSONEncoder: JSONEncoderFunc(func(v interface{}) ([]byte, error) {
+			encoded++
+			return json.Marshal(v)
+		}),
+		JSONHooks: map[reflect.Type]JSONHook{
+			reflect.TypeOf(""): func(interface{}) ([]byte, error) {
+				return []byte(`"hooked"`), nil
+			},
+		},
+	}
+	q = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options)
+	q.Fields(&suite.Ref.Memo, &suite.Ref.Created)
+	hookedOut := new(bytes.Buffer)
+	if suite.NoError(q.ExportNDJSON(hookedOut)) {
+		lines := strings.Split(strings.TrimSpace(hookedOut.String()), "\n")
+		suite.Contains(lines[0], `"hooked"`, "JSONHooks should encode values of their type")
+		suite.Equal(len(testInvoices), encoded, "JSONEncoder should encode values without a hook")
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_AliasCollisions() {
+	used := make(map[string]bool)
+	invoiceId := &fieldColumnMap{alias: "Id", tableName: "invoice"}
+	personId := &fieldColumnMap{alias: "id", tableName: "person"}
+	suite.Equal("Id", uniqueAlias(used, invoiceId))
+	suite.Equal("person_id", uniqueAlias(used, personId))
+	suite.Equal("person_id_2", uniqueAlias(used, personId),
+		"uniqueAlias should keep disambiguating aliases that collide after prefixing")
+
+	ref := new(OverriddenInvoice)
+	plan := Query(suite.Map, suite.Map, ref, JoinOp{}).(*QueryPlan)
+	plan.Fields(&ref.Id, &ref.Memo)
+	// Give memo the same alias as id, as a joined table's column can
+	// have, so that one of them is renamed.
+	memo, err := plan.colMap.fieldMapForPointer(&ref.Memo)
+	suite.Require().NoError(err)
+	memo.alias = "id"
+	suite.True(plan.scansRows(), "Plans with renamed aliases should scan their own results")
+	results, err := plan.Select()
+	if suite.NoError(err) && suite.Len(results, len(testInvoices)) {
+		for _, result := range results {
+			inv := result.(*OverriddenInvoice)
+			suite.NotEmpty(inv.Id, "Both colliding columns should be scanned into their fields")
+			suite.NotEmpty(inv.Memo, "Both colliding columns should be scanned into their fields")
+		}
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Validate() {
+	ref := new(OverriddenInvoice)
+	q := Query(suite.Map, suite.Map, ref, JoinOp{})
+	suite.Empty(q.Validate())
+
+	q = Query(suite.Map, suite.Map, ref, JoinOp{})
+	q.Fields(&ref.PersonId, &ref.Memo).
+		GroupBy(&ref.PersonId).
+		OrderBy(&ref.Created, "asc")
+	suite.Equal(2, len(q.Validate()),
+		"Validate() should warn about selecting and ordering by ungrouped columns")
+
+	joined := new(AutoIncrInvoice)
+	q = Query(suite.Map, suite.Map, ref, JoinOp{})
+	q.Join(joined).On(filters.Equal(&joined.Memo, &ref.Memo))
+	suite.Equal(1, len(q.Validate()),
+		"Validate() should warn about joined tables that are never used")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Warnings() {
+	ref := new(OverriddenInvoice)
+	q := Query(suite.Map, suite.Map, ref, JoinOp{})
+	q.Where(filters.Like(&ref.Memo, "test%"), filters.In(&ref.PersonId, 1, 2, 3))
+	suite.Empty(q.Warnings())
+
+	ids := make([]interface{}, warnInItems+1)
+	for i := range ids {
+		ids[i] = i
+	}
+	q = Query(suite.Map, suite.Map, ref, JoinOp{})
+	q.Where(filters.Like(&ref.Memo, "%memo"), filters.In(&ref.PersonId, ids...))
+	suite.Equal(2, len(q.Warnings()),
+		"Warnings() should warn about leading wildcards and huge IN lists")
+
+	joined := new(AutoIncrInvoice)
+	q = Query(suite.Map, suite.Map, ref, JoinOp{})
+	q.Join(joined).On(filters.Equal(&joined.Memo, "test_memo"))
+	suite.Equal(1, len(q.Warnings()),
+		"Warnings() should warn about join conditions that don't refer to other tables")
+
+	var reported []string
+	options := Options{WarningHooks: []WarningFunc{func(query string, warnings []string) {
+		suite.NotEmpty(query)
+		reported = append(reported, warnings...)
+	}}}
+	_, err := QueryWithOptions(suite.Map, suite.Map, ref, options).
+		Where(filters.Like(&ref.Memo, "%memo")).
+		Select()
+	suite.Require().NoError(err)
+	suite.Len(reported, 1, "Warnings should be reported to hooks when statements execute")
+	_, err = QueryWithOptions(suite.Map, suite.Map, ref, options).Select()
+	suite.Require().NoError(err)
+	suite.Len(reported, 1, "Hooks should not be called for plans without warnings")
+
+	table, err := suite.Map.TableFor(reflect.TypeOf(OverriddenInvoice{}), false)
+	suite.Require().NoError(err)
+	options = Options{SensitiveColumns: []*gorp.ColumnMap{table.ColMap("Memo")}}
+	q = QueryWithOptions(suite.Map, suite.Map, ref, options)
+	q.Where(filters.Like(&ref.Memo, "%super_secret_memo"))
+	if warnings := q.Warnings(); suite.Len(warnings, 1) {
+		suite.NotContains(warnings[0], "super_secret_memo", "Warnings should not include patterns for sensitive columns")
+		suite.Contains(warnings[0], Redacted)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_IndexAdvisor() {
+	var advice []IndexAdvice
+	advisor := &IndexAdvisor{
+		MinRows: 1,
+		Report:  func(a IndexAdvice) { advice = append(advice, a) },
+	}
+	options := Options{IndexAdvisor: advisor}
+	query := func() {
+		_, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+			Where().
+			Equal(&suite.Ref.Memo, "test_memo").
+			Select()
+		suite.Require().NoError(err)
+	}
+	query()
+	suite.Require().Len(advice, 1, "The advisor should report scans of unindexed columns")
+	suite.True(advice[0].Rows > 0, "The advisor should report the size of the scanned table")
+	suite.Contains(strings.ToLower(advice[0].Index), "memo")
+
+	query()
+	suite.Len(advice, 1, "The advisor should only explain each statement once")
+
+	advisor = &IndexAdvisor{MinRows: 1000, Report: advisor.Report}
+	options.IndexAdvisor = advisor
+	query()
+	suite.Len(advice, 1, "The advisor should not report scans of small tables")
+
+	suite.True(explainable("/* tagged */ select 1"))
+	suite.True(explainable("(select 1) union (select 2)"))
+	suite.False(explainable(`copy "invoice" ("id") from stdin`), "Statements that EXPLAIN rejects should not be explained")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_StableSQL() {
+	build := func() *QueryPlan {
+		ref := new(OverriddenInvoice)
+		joined := new(AutoIncrInvoice)
+		q := Query(suite.Map, suite.Map, ref, JoinOp{})
+		q.Join(joined).
+			On(filters.Equal(&joined.Memo, &ref.Memo)).
+			Where().
+			Equal(&ref.IsPaid, true).
+			In(&ref.PersonId, 1, 2).
+			OrderBy(&ref.Created, "desc")
+		return q.(*QueryPlan)
+	}
+	plan := build()
+	first, err := plan.selectQuery()
+	suite.Require().NoError(err)
+	second, err := plan.selectQuery()
+	suite.Require().NoError(err)
+	suite.Equal(first, second, "Executing a plan twice should generate the same SQL")
+
+	other, err := build().selectQuery()
+	suite.Require().NoError(err)
+	suite.Equal(first, other, "Identical plans should generate the same SQL")
+}
+
+// customFilter embeds a filter type from the filters package, and
+// so inherits its Shape method.
+type customFilter struct {
+	filters.ComparisonFilter
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_CachedWhere() {
+	where := func(personId int64) (string, []interface{}) {
+		ref := new(OverriddenInvoice)
+		plan := Query(suite.Map, suite.Map, ref, JoinOp{}).
+			Where().
+			Equal(&ref.PersonId, personId).
+			Less(&ref.Created, 10).(*QueryPlan)
+		clause, err := plan.whereClause()
+		suite.Require().NoError(err)
+		return clause, plan.getArgs()
+	}
+	first, firstArgs := where(1)
+	cached := len(whereCache.entries)
+	second, secondArgs := where(2)
+	suite.Equal(first, second, "Filters with the same shape should generate the same SQL")
+	suite.Equal(cached, len(whereCache.entries), "Filters with the same shape should reuse cached SQL")
+	suite.Equal([]interface{}{int64(1), 10}, firstArgs)
+	suite.Equal([]interface{}{int64(2), 10}, secondArgs)
+
+	for _, personId := range []int64{1, 2} {
+		results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+			Where().
+			Equal(&suite.Ref.PersonId, personId).
+			Select()
+		if suite.NoError(err) {
+			suite.Equal(suite.expectedLength(func(inv OverriddenInvoice) bool {
+				return inv.PersonId == personId
+			}), len(results))
+		}
+	}
+
+	key := new(bytes.Buffer)
+	suite.True(writeShape(key, filters.And(filters.Equal(&suite.Ref.Id, "1"))))
+	key.Reset()
+	suite.False(writeShape(key, filters.And(&customFilter{})),
+		"Filters from other packages should not be cached")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Retarget() {
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	q.Where().Equal(&suite.Ref.PersonId, 1)
+	plan := q.(*QueryPlan)
+	original, err := plan.selectQuery()
+	suite.Require().NoError(err)
+
+	warehouse := &gorp.DbMap{Dialect: gorp.MySQLDialect{}}
+	warehouse.AddTable(OverriddenInvoice{}).SetKeys(false, "Id")
+	retargeted, err := plan.Retarget(warehouse, warehouse)
+	suite.Require().NoError(err)
+	query, err := retargeted.selectQuery()
+	suite.Require().NoError(err)
+	suite.Contains(query, "`", "Retargeted plans should quote identifiers for the new dialect")
+	suite.Contains(query, "?", "Retargeted plans should use the new dialect's bind vars")
+
+	unchanged, err := plan.selectQuery()
+	suite.Require().NoError(err)
+	suite.Equal(original, unchanged, "Retargeting should not modify the original plan")
+
+	upsert := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).
+		ConflictWhere(filters.False(&suite.Ref.IsPaid))
+	retargeted, err = upsert.Retarget(suite.Map, suite.Map)
+	suite.Require().NoError(err)
+	suite.Equal(upsert.conflictWhere, retargeted.conflictWhere, "Retargeted plans should keep their conflict predicates")
+	constrained := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).ConflictConstraint("invoice_memo_key")
+	retargeted, err = constrained.Retarget(warehouse, warehouse)
+	suite.Require().NoError(err)
+	suite.Equal("invoice_memo_key", retargeted.conflictConstraint, "Retargeted plans should keep their conflict constraint")
+
+	var returned []OverriddenInvoice
+	returning := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).ReturningInto(&returned)
+	retargeted, err = returning.Retarget(warehouse, warehouse)
+	suite.Require().NoError(err)
+	suite.True(retargeted.returningTarget.IsValid(), "Retargeted plans should keep their returning target")
+
+	sub := new(OverriddenInvoice)
+	subQuery := Query(suite.Map, suite.Map, sub, JoinOp{}).Where().Equal(&sub.Memo, "test_memo")
+	ref := new(OverriddenInvoice)
+	with := Query(suite.Map, suite.Map, ref, JoinOp{}).(*QueryPlan).With("memos", subQuery)
+	with.Join(subQuery).On(filters.Equal(&sub.Id, &ref.Id))
+	_, err = with.Retarget(warehouse, warehouse)
+	suite.Error(err, "Plans with common tables can't be retargeted to another DbMap")
+	retargeted, err = with.Retarget(suite.Map, suite.Map)
+	suite.Require().NoError(err)
+	query, err = retargeted.selectQuery()
+	suite.Require().NoError(err)
+	suite.True(strings.HasPrefix(query, "with "), "Retargeted plans should keep their common tables")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Spec() {
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	q.Where().
+		Equal(&suite.Ref.PersonId, 1).
+		False(&suite.Ref.IsPaid).
+		In(&suite.Ref.Id, "1", "2", "3")
+	q.OrderBy(&suite.Ref.Created, "desc")
+	spec, err := q.(*QueryPlan).Spec()
+	suite.Require().NoError(err)
+	encoded, err := json.Marshal(spec)
+	suite.Require().NoError(err)
+
+	decoded := new(Spec)
+	suite.Require().NoError(json.Unmarshal(encoded, decoded))
+	ref := new(OverriddenInvoice)
+	worker, err := QueryFromSpec(suite.Map, suite.Map, ref, decoded, Options{})
+	suite.Require().NoError(err)
+	expected, err := q.Select()
+	suite.Require().NoError(err)
+	results, err := worker.Select()
+	if suite.NoError(err) {
+		suite.Equal(len(expected), len(results))
+	}
+
+	joined := new(AutoIncrInvoice)
+	q = Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	q.Join(joined).On(filters.Equal(&joined.Memo, &suite.Ref.Memo))
+	_, err = q.(*QueryPlan).Spec()
+	suite.Error(err, "Plans with joins cannot be described by a Spec")
+
+	grouped := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan)
+	grouped.GroupBy(&suite.Ref.PersonId)
+	_, err = grouped.Spec()
+	suite.Error(err, "Grouped plans cannot be described by a Spec")
+
+	distinct := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan)
+	distinct.Distinct(&suite.Ref.PersonId)
+	_, err = distinct.Spec()
+	suite.Error(err, "Distinct plans cannot be described by a Spec")
+
+	locked := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan)
+	locked.ForUpdate(nil)
+	_, err = locked.Spec()
+	suite.Error(err, "Plans which lock their rows cannot be described by a Spec")
+
+	union := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan)
+	union.Union(Query(suite.Map, suite.Map, suite.Ref, JoinOp{}))
+	_, err = union.Spec()
+	suite.Error(err, "Compound plans cannot be described by a Spec")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_JoinSubQuery() {
+	sub := new(OverriddenInvoice)
+	subQuery := Query(suite.Map, suite.Map, sub, JoinOp{}).
+		Where().
+		True(&sub.IsPaid)
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.IsPaid
+	})
+
+	ref := new(OverriddenInvoice)
+	q := Query(suite.Map, suite.Map, ref, JoinOp{})
+	q.Join(subQuery).
+		On(filters.Equal(&sub.Id, &ref.Id)).
+		Where().
+		NotNull(&sub.Memo).
+		OrderBy(&sub.Created, "desc")
+	plan := q.(*QueryPlan)
+	query, err := plan.selectQuery()
+	suite.Require().NoError(err)
+	subAlias := plan.quoteField("OverriddenInvoice_1")
+	suite.Contains(query, " as "+subAlias+" on ")
+	suite.Contains(query, "order by "+subAlias+"."+plan.quoteField("Created")+" desc")
+
+	results, err := q.Select()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+
+	memo := new(OverriddenInvoice)
+	memoQuery := Query(suite.Map, suite.Map, memo, JoinOp{}).
+		Where().
+		Equal(&memo.Memo, "test_memo")
+	ref = new(OverriddenInvoice)
+	q = Query(suite.Map, suite.Map, ref, JoinOp{})
+	q.Join(memoQuery).
+		On(filters.Equal(&memo.Id, &ref.Id)).
+		Where().
+		Equal(&ref.PersonId, 1)
+	expectedCount = suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Memo == "test_memo" && inv.PersonId == 1
+	})
+	results, err = q.Select()
+	if suite.NoError(err, "Sub-queries with arguments should be joined") {
+		suite.Equal(expectedCount, len(results))
+	}
+	count, err := q.Count()
+	if suite.NoError(err) {
+		suite.Equal(int64(expectedCount), count)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Compound() {
+	memos := func() *QueryPlan {
+		ref := new(OverriddenInvoice)
+		return Query(suite.Map, suite.Map, ref, JoinOp{}).Where().Equal(&ref.Memo, "test_memo").(*QueryPlan)
+	}
+	paid := new(OverriddenInvoice)
+	paidQuery := Query(suite.Map, suite.Map, paid, JoinOp{}).Where().True(&paid.IsPaid)
+
+	union := memos().Union(paidQuery)
+	query, err := union.selectQuery()
+	suite.Require().NoError(err)
+	suite.Contains(query, " union select ")
+	results, err := union.Select()
+	if suite.NoError(err) {
+		suite.Equal(suite.expectedLength(func(inv OverriddenInvoice) bool {
+			return inv.Memo == "test_memo" || inv.IsPaid
+		}), len(results))
+	}
+	count, err := union.Count()
+	if suite.NoError(err) {
+		suite.Equal(int64(len(results)), count)
+	}
+
+	first := new(OverriddenInvoice)
+	firstQuery := Query(suite.Map, suite.Map, first, JoinOp{}).Where().Equal(&first.Id, "1")
+	results, err = memos().UnionAll(firstQuery).Select()
+	if suite.NoError(err) {
+		suite.Equal(suite.expectedLength(func(inv OverriddenInvoice) bool {
+			return inv.Memo == "test_memo"
+		})+1, len(results), "UnionAll should keep duplicate rows")
+	}
+
+	orderedRef := new(OverriddenInvoice)
+	ordered := Query(suite.Map, suite.Map, orderedRef, JoinOp{}).Where().Equal(&orderedRef.Memo, "test_memo").(*QueryPlan)
+	ordered.Union(paidQuery).OrderBy(&orderedRef.Id, "desc").Limit(1)
+	results, err = ordered.Select()
+	if suite.NoError(err) && suite.Len(results, 1) {
+		suite.Equal("5", results[0].(*OverriddenInvoice).Id, "Ordering and limits should apply to the combined statement")
+	}
+
+	// MySQL only supports INTERSECT and EXCEPT as of 8.0.31.
+	if _, ok := suite.Map.Dialect.(gorp.MySQLDialect); !ok {
+		results, err = memos().Intersect(firstQuery).Select()
+		if suite.NoError(err) && suite.Len(results, 1) {
+			suite.Equal("1", results[0].(*OverriddenInvoice).Id)
+		}
+		results, err = memos().Except(firstQuery).Select()
+		if suite.NoError(err) {
+			suite.Equal(suite.expectedLength(func(inv OverriddenInvoice) bool {
+				return inv.Memo == "test_memo" && inv.Id != "1"
+			}), len(results))
+		}
+	}
+
+	ids := new(OverriddenInvoice)
+	idQuery := Query(suite.Map, suite.Map, ids, JoinOp{})
+	idQuery.Fields(&ids.Id)
+	_, err = memos().Union(idQuery).Select()
+	suite.Error(err, "Queries selecting different columns should not be combined")
+
+	limited := new(OverriddenInvoice)
+	limitedQuery := Query(suite.Map, suite.Map, limited, JoinOp{}).Limit(1)
+	_, err = memos().Union(limitedQuery).Select()
+	suite.Error(err, "Only the combined statement should be limited")
+
+	with := new(OverriddenInvoice)
+	withQuery := Query(suite.Map, suite.Map, with, JoinOp{}).(*QueryPlan).With("firsts", firstQuery)
+	_, err = memos().Union(withQuery).Select()
+	suite.Error(err, "Common tables of combined queries would be written in the middle of the statement")
+	_, err = memos().Union(withQuery).Count()
+	suite.Error(err, "Common tables of combined queries would be written in the middle of the count statement")
+
+	locked := new(OverriddenInvoice)
+	lockedQuery := Query(suite.Map, suite.Map, locked, JoinOp{}).(*QueryPlan)
+	lockedQuery.ForUpdate(nil)
+	_, err = memos().Union(lockedQuery).Select()
+	suite.Error(err, "Combined queries can't be locked")
+	lockedUnion := memos().Union(paidQuery)
+	lockedUnion.ForUpdate(nil)
+	_, err = lockedUnion.Select()
+	suite.Error(err, "Combined statements can't be locked")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_With() {
+	sub := new(OverriddenInvoice)
+	subQuery := Query(suite.Map, suite.Map, sub, JoinOp{}).
+		Where().
+		Equal(&sub.Memo, "test_memo")
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Memo == "test_memo"
+	})
+
+	ref := new(OverriddenInvoice)
+	plan := Query(suite.Map, suite.Map, ref, JoinOp{}).(*QueryPlan).With("memos", subQuery)
+	plan.Join(subQuery).
+		On(filters.Equal(&sub.Id, &ref.Id)).
+		Where().
+		Equal(&ref.IsPaid, false)
+	query, err := plan.selectQuery()
+	suite.Require().NoError(err)
+	memos := plan.quoteField("memos")
+	suite.True(strings.HasPrefix(query, "with "+memos+" as (select "), "The query should start with the WITH clause")
+	suite.Contains(query, " join "+memos+" as ")
+
+	results, err := plan.Select()
+	if suite.NoError(err) {
+		unpaid := suite.expectedLength(func(inv OverriddenInvoice) bool {
+			return inv.Memo == "test_memo" && !inv.IsPaid
+		})
+		suite.Equal(unpaid, len(results))
+	}
+
+	from := Query(suite.Map, suite.Map, subQuery, JoinOp{}).(*QueryPlan).With("memos", subQuery)
+	count, err := from.Count()
+	if suite.NoError(err) {
+		suite.Equal(int64(expectedCount), count)
+	}
+
+	suite.Error(Query(suite.Map, suite.Map, ref, JoinOp{}).(*QueryPlan).With("memos", ref).Errors[0])
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_WithStatements() {
+	memoQuery := func(memo string) (*OverriddenInvoice, interface{}) {
+		sub := new(OverriddenInvoice)
+		return sub, Query(suite.Map, suite.Map, sub, JoinOp{}).
+			Where().
+			Equal(&sub.Memo, memo)
+	}
+
+	sub, subQuery := memoQuery("test_memo")
+	ref := new(OverriddenInvoice)
+	grouped := Query(suite.Map, suite.Map, ref, JoinOp{}).(*QueryPlan).With("memos", subQuery)
+	grouped.Join(subQuery).On(filters.Equal(&sub.Id, &ref.Id))
+	buckets, err := grouped.GroupByTime(&ref.Created, time.Second, time.Unix(0, 0), time.Unix(4, 0))
+	if suite.NoError(err, "GroupByTime should write the plan's WITH clause") && suite.Len(buckets, 4) {
+		for i, bucket := range buckets {
+			suite.Equal(int64(suite.expectedLength(func(inv OverriddenInvoice) bool {
+				return inv.Memo == "test_memo" && inv.Created == int64(i)
+			})), bucket.Count)
+		}
+	}
+
+	node := new(OverriddenInvoice)
+	anchor := Query(suite.Map, suite.Map, node, JoinOp{}).
+		Where().
+		Equal(&node.Id, testInvoices[0].Id)
+	child := new(OverriddenInvoice)
+	step := Query(suite.Map, suite.Map, child, JoinOp{}).(*QueryPlan).With("tree", anchor)
+	step.Join(anchor).On(filters.Greater(&child.Created, &node.Created))
+	tree := Query(suite.Map, suite.Map, anchor, JoinOp{}).(*QueryPlan).WithRecursive("tree", anchor, step)
+	query, err := tree.selectQuery()
+	suite.Require().NoError(err)
+	suite.True(strings.HasPrefix(query, "with recursive "+tree.quoteField("tree")+" as (select "))
+	suite.Contains(query, " union all select ")
+	count, err := tree.Count()
+	if suite.NoError(err) {
+		later := suite.expectedLength(func(inv OverriddenInvoice) bool {
+			return inv.Created > testInvoices[0].Created
+		})
+		suite.Equal(int64(1+later), count)
+	}
+	unrelated := Query(suite.Map, suite.Map, new(OverriddenInvoice), JoinOp{}).(*QueryPlan)
+	suite.NotEmpty(unrelated.WithRecursive("tree", anchor, Query(suite.Map, suite.Map, child, JoinOp{})).Errors,
+		"Recursive steps which don't refer to the common table should be rejected")
+
+	switch suite.Map.Dialect.(type) {
+	case gorp.MySQLDialect:
+		// MySQL's multiple-table update and delete syntax isn't
+		// supported.
+		return
+	}
+	sub, subQuery = memoQuery("test_memo")
+	update := Query(suite.Map, suite.Map, ref, JoinOp{}).(*QueryPlan).With("memos", subQuery)
+	update.Assign(&ref.Memo, "updated_memo")
+	update.Join(subQuery).On(filters.Equal(&sub.Id, &ref.Id))
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Memo == "test_memo"
+	})
+	count, err = update.Update()
+	if suite.NoError(err, "Update should write the plan's WITH clause") {
+		suite.Equal(int64(expectedCount), count)
+	}
+
+	if _, ok := suite.Map.Dialect.(gorp.PostgresDialect); !ok {
+		// Only postgresql supports joins in delete statements.
+		return
+	}
+	sub, subQuery = memoQuery("updated_memo")
+	del := Query(suite.Map, suite.Map, ref, JoinOp{}).(*QueryPlan).With("memos", subQuery)
+	del.Join(subQuery).On(filters.Equal(&sub.Id, &ref.Id))
+	count, err = del.Delete()
+	if suite.NoError(err, "Delete should write the plan's WITH clause") {
+		suite.Equal(int64(expectedCount), count)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_PruneUnusedJoins() {
+	ref := new(OverriddenInvoice)
+	joined := new(AutoIncrInvoice)
+	q := Query(suite.Map, suite.Map, ref, JoinOp{})
+	q.LeftJoin(joined).On(filters.Equal(&joined.Id, &ref.Created))
+	plan := q.(*QueryPlan)
+	query, err := plan.selectQuery()
+	suite.Require().NoError(err)
+	suite.Contains(query, " left outer join ", "Joins should only be pruned once Fields has trimmed the selection")
+
+	plan.Fields(&ref.Id, &ref.Memo)
+	query, err = plan.selectQuery()
+	suite.Require().NoError(err)
+	suite.NotContains(query, " join ", "Left joins with nothing selected or filtered should be pruned")
+	results, err := plan.Select()
+	if suite.NoError(err) {
+		suite.Equal(len(testInvoices), len(results))
+	}
+
+	plan.Where().Null(&joined.Memo)
+	query, err = plan.selectQuery()
+	suite.Require().NoError(err)
+	suite.Contains(query, " left outer join ", "Left joins used by the where clause should be kept")
+
+	fanOut := Query(suite.Map, suite.Map, ref, JoinOp{})
+	fanOut.LeftJoin(joined).On(filters.Equal(&joined.Memo, &ref.Memo))
+	fanOut.Fields(&ref.Id)
+	query, err = fanOut.(*QueryPlan).selectQuery()
+	suite.Require().NoError(err)
+	suite.Contains(query, " left outer join ", "Left joins which may match more than one row should be kept")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_DuplicateJoins() {
+	first := new(AutoIncrInvoice)
+	second := new(AutoIncrInvoice)
+	q := Query(suite.Map, suite.Map, suite.Ref, JoinOp{})
+	q.LeftJoin(first).On(filters.Equal(&first.Memo, &suite.Ref.Memo))
+	q.Join(second).On(filters.Equal(&second.Id, &suite.Ref.Created))
+	plan := q.(*QueryPlan)
+	query, err := plan.selectQuery()
+	suite.Require().NoError(err)
+	suite.Equal(1, strings.Count(query, " join "), "Joining the same table twice should only produce one join clause")
+	suite.Contains(query, "inner join", "Inner joins should take precedence when merging joins")
+	suite.Len(plan.joins[0].SubFilters(), 2, "Merged joins should keep both conditions")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SubQueryComparison() {
+	sub := new(OverriddenInvoice)
+	subQuery := Query(suite.Map, suite.Map, sub, JoinOp{})
+	subQuery.Fields(&sub.Created)
+	subQuery.Where().Equal(&sub.Id, "1")
+
+	ref := new(OverriddenInvoice)
+	results, err := Query(suite.Map, suite.Map, ref, JoinOp{}).
+		Where().
+		Equal(&ref.IsPaid, false).
+		Greater(&ref.Created, subQuery).
+		Select()
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return !inv.IsPaid && inv.Created > testInvoices[0].Created
+	})
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_InsertAutoIncr() {
+	ref := new(AutoIncrInvoice)
+	err := Query(suite.Map, suite.Map, ref, JoinOp{}).
+		Assign(&ref.Memo, "auto increment").
+		Insert()
+	suite.Require().NoError(err)
+	suite.Require().NotZero(ref.Id, "Insert() should store the generated key in the reference struct")
+	id := ref.Id
+	inserted, err := Query(suite.Map, suite.Map, ref, JoinOp{}).
+		Where().
+		Equal(&ref.Id, id).
+		Select()
+	if suite.NoError(err) && suite.Len(inserted, 1) {
+		suite.Equal("auto increment", inserted[0].(*AutoIncrInvoice).Memo, "The stored key should match the inserted row")
+	}
+}
+
+// memo is converted to a string by memoConverter.
+type memo struct {
+	text string
+}
+
+type memoConverter struct{}
+
+func (memoConverter) ToDb(val interface{}) (interface{}, error) {
+	if m, ok := val.(memo); ok {
+		return m.text, nil
+	}
+	return val, nil
+}
+
+func (memoConverter) FromDb(target interface{}) (gorp.CustomScanner, bool) {
+	return gorp.CustomScanner{}, false
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_TypeConverter() {
+	suite.Map.TypeConverter = memoConverter{}
+	defer func() { suite.Map.TypeConverter = nil }()
+
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		Equal(&suite.Ref.Memo, memo{"test_memo"}).
+		Select()
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.Memo == "test_memo"
+	})
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+
+	ref := new(AutoIncrInvoice)
+	err = Query(suite.Map, suite.Map, ref, JoinOp{}).
+		Assign(&ref.Memo, memo{"converted"}).
+		Insert()
+	suite.NoError(err, "Assigned values should be converted before they are bound")
+}
+
+// personKey is a typed ID that is only bindable using a converter
+// registered with RegisterConverter.
+type personKey struct {
+	id int64
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_RegisterConverter() {
+	RegisterConverter(func(key personKey) (driver.Value, error) {
+		return key.id, nil
+	})
+
+	results, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Where().
+		In(&suite.Ref.PersonId, personKey{1}, personKey{2}).
+		Select()
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.PersonId == 1 || inv.PersonId == 2
+	})
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, len(results))
+	}
+
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Assign(&suite.Ref.PersonId, personKey{3}).
+		Where().
+		Equal(&suite.Ref.PersonId, personKey{2}).
+		Update()
+	if suite.NoError(err, "Assigned values should be converted before they are bound") {
+		suite.Equal(int64(suite.expectedLength(func(inv OverriddenInvoice) bool {
+			return inv.PersonId == 2
+		})), count)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_ConstraintErrors() {
+	inv := testInvoices[0]
+	err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Assign(&suite.Ref.Id, inv.Id).
+		Assign(&suite.Ref.Created, inv.Created).
+		Assign(&suite.Ref.Updated, inv.Updated).
+		Assign(&suite.Ref.Memo, inv.Memo).
+		Assign(&suite.Ref.PersonId, inv.PersonId).
+		Assign(&suite.Ref.IsPaid, inv.IsPaid).
+		Insert()
+	suite.Require().Error(err)
+	suite.True(errors.Is(err, ErrUniqueViolation), "Duplicate keys should be reported as unique violations, not %v", err)
+	suite.False(errors.Is(err, ErrForeignKeyViolation))
+	var constraintErr *ConstraintError
+	if suite.True(errors.As(err, &constraintErr)) {
+		suite.Equal(UniqueConstraint, constraintErr.Kind)
+		suite.NotNil(errors.Unwrap(constraintErr), "The driver's error should be wrapped")
+	}
+
+	_, err = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Assign(&suite.Ref.Id, testInvoices[1].Id).
+		Where().
+		Equal(&suite.Ref.Id, inv.Id).
+		Update()
+	suite.True(errors.Is(err, ErrUniqueViolation), "Updates should also report unique violations, not %v", err)
+}
+
+// pgError, mysqlError, and sqliteError mimic the error types of
+// lib/pq, go-sql-driver/mysql, and mattn/go-sqlite3.
+type pgError struct {
+	Code       string
+	Constraint string
+}
+
+func (err *pgError) Error() string { return "pq: " + err.Code }
+
+type mysqlError struct {
+	Number  uint16
+	Message string
+}
+
+func (err *mysqlError) Error() string { return err.Message }
+
+type sqliteError struct {
+	Code         int
+	ExtendedCode int
+}
+
+func (err sqliteError) Error() string { return "database is locked" }
+
+func TestClassifyConflicts(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		kind ConflictKind
+	}{
+		{&pgError{Code: "40P01"}, Deadlock},
+		{&pgError{Code: "40001"}, SerializationFailure},
+		{fmt.Errorf("wrapped: %w", &pgError{Code: "55P03"}), LockTimeout},
+		{&mysqlError{Number: 1213, Message: "Deadlock found when trying to get lock"}, Deadlock},
+		{&mysqlError{Number: 1205, Message: "Lock wait timeout exceeded"}, LockTimeout},
+		{sqliteError{Code: 5, ExtendedCode: 5}, LockTimeout},
+	} {
+		err := classifyError(test.err)
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) || conflict.Kind != test.kind {
+			t.Errorf("%v should be classified as a %s, got %#v", test.err, test.kind, err)
+			continue
+		}
+		if !IsRetryable(err) || !errors.Is(err, test.err) {
+			t.Errorf("%v should be retryable and wrap the driver's error", test.err)
+		}
+	}
+	if !errors.Is(classifyError(&pgError{Code: "40P01"}), ErrDeadlock) {
+		t.Error("Deadlocks should match ErrDeadlock")
+	}
+	unique := classifyError(&pgError{Code: "23505", Constraint: "invoices_pkey"})
+	if IsRetryable(unique) || !errors.Is(unique, ErrUniqueViolation) {
+		t.Errorf("Constraint violations should not be retryable, got %#v", unique)
+	}
+	if err := errors.New("other"); classifyError(err) != err {
+		t.Error("Unknown errors should be returned as they are")
+	}
+}
+
+// InvoiceView is mapped to a view over OverriddenInvoice's table.
+type InvoiceView OverriddenInvoice
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Views() {
+	quote := suite.Map.Dialect.QuoteField
+	_, err := suite.Map.Exec("create view " + quote("InvoiceView") + " as select * from " + quote("OverriddenInvoice"))
+	suite.Require().NoError(err)
+	defer suite.Map.Exec("drop view " + quote("InvoiceView"))
+
+	views := &gorp.DbMap{Db: suite.Map.Db, Dialect: suite.Map.Dialect}
+	views.AddTableWithName(InvoiceView{}, "InvoiceView").SetKeys(false, "Id")
+	options := Options{Views: views}
+	ref := new(InvoiceView)
+	results, err := QueryWithOptions(suite.Map, suite.Map, ref, options).
+		Where().
+		Equal(&ref.Memo, "test_memo").
+		Select()
+	suite.Require().NoError(err)
+	suite.Len(results, 3)
+
+	_, err = Query(suite.Map, suite.Map, ref, JoinOp{}).Select()
+	suite.Error(err, "Views should only be found through Options.Views")
+
+	switch suite.Map.Dialect.(type) {
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		// Sqlite views can only be changed through INSTEAD OF
+		// triggers.
+		return
+	}
+	count, err := QueryWithOptions(suite.Map, suite.Map, ref, options).
+		Assign(&ref.IsPaid, true).
+		Where().
+		Equal(&ref.Memo, "test_memo").
+		Update()
+	suite.Require().NoError(err)
+	suite.Equal(int64(3), count)
+	deleted, err := QueryWithOptions(suite.Map, suite.Map, ref, options).
+		Where().
+		Equal(&ref.Memo, "another_test_memo").
+		DeleteInBatches(1, 0)
+	suite.Require().NoError(err)
+	suite.Equal(int64(2), deleted, "Batched deletes from views should use their primary key")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_InsertDefaults() {
+	ref := new(AutoIncrInvoice)
+	err := Query(suite.Map, suite.Map, ref, JoinOp{}).InsertDefaults()
+	if suite.NoError(err) {
+		suite.NotZero(ref.Id, "InsertDefaults() should store the generated key in the reference struct")
+	}
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_RedactSensitive() {
+	table, err := suite.Map.TableFor(reflect.TypeOf(OverriddenInvoice{}), false)
+	suite.Require().NoError(err)
+	logger := new(recordingLogger)
+	options := Options{
+		Logger:           logger,
+		SensitiveColumns: []*gorp.ColumnMap{table.ColMap("Memo")},
+	}
+	secret := "super_secret_memo"
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Equal(&suite.Ref.Memo, secret).
+		Equal(&suite.Ref.Created, 1).
+		Select()
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, len(logger.lines))
+	suite.NotContains(logger.lines[0], secret)
+	suite.Contains(logger.lines[0], Redacted)
+	suite.Contains(logger.lines[0], "2:1")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_LazyColumns() {
+	table, err := suite.Map.TableFor(reflect.TypeOf(OverriddenInvoice{}), false)
+	suite.Require().NoError(err)
+	options := Options{LazyColumns: []*gorp.ColumnMap{table.ColMap("Memo")}}
+
+	results, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Equal(&suite.Ref.Id, testInvoices[0].Id).
+		Select()
+	suite.Require().NoError(err)
+	suite.Require().Len(results, 1)
+	inv := results[0].(*OverriddenInvoice)
+	suite.Equal("", inv.Memo, "Lazy columns should not be selected by default")
+	suite.Equal(testInvoices[0].Created, inv.Created)
+
+	if suite.NoError(LoadFields(suite.Map, suite.Map, options, inv, &inv.Memo)) {
+		suite.Equal(testInvoices[0].Memo, inv.Memo, "LoadFields should load lazy columns")
+	}
+
+	q := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options)
+	q.AddField(&suite.Ref.Memo)
+	results, err = q.Select()
+	if suite.NoError(err) && suite.NotEmpty(results) {
+		suite.NotEqual("", results[0].(*OverriddenInvoice).Memo, "AddField should select lazy columns")
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_SelectTag() {
+	suite.Map.AddTableWithName(TaggedAutoIncrInvoice{}, "AutoIncrInvoice").SetKeys(true, "Id")
+	ref := new(TaggedAutoIncrInvoice)
+	err := Query(suite.Map, suite.Map, ref).
+		Assign(&ref.Memo, "tagged memo").
+		Insert()
+	suite.Require().NoError(err)
+
+	results, err := Query(suite.Map, suite.Map, ref).
+		Where().
+		Equal(&ref.Id, ref.Id).
+		Select()
+	suite.Require().NoError(err)
+	suite.Require().Len(results, 1)
+	inv := results[0].(*TaggedAutoIncrInvoice)
+	suite.Equal("", inv.Memo, `Fields tagged with select:"-" should not be selected by default`)
+
+	if suite.NoError(LoadFields(suite.Map, suite.Map, Options{}, inv, &inv.Memo)) {
+		suite.Equal("tagged memo", inv.Memo)
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Policies() {
+	table, err := suite.Map.TableFor(reflect.TypeOf(OverriddenInvoice{}), false)
+	suite.Require().NoError(err)
+	paidCol := table.ColMap("IsPaid")
+	errNoDeletes := errors.New("deletes are not allowed")
+	options := Options{
+		Policies: []PolicyFunc{
+			func(req *PolicyRequest) error {
+				if req.Operation == DeleteOperation {
+					return errNoDeletes
+				}
+				for _, field := range req.FieldsFor(paidCol) {
+					req.Filter(filters.True(field))
+				}
+				return nil
+			},
+		},
+	}
+	expectedCount := suite.expectedLength(func(inv OverriddenInvoice) bool {
+		return inv.IsPaid
+	})
+
+	count, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Count()
+	if suite.NoError(err) {
+		suite.Equal(expectedCount, count)
+	}
+
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Delete()
+	suite.Equal(errNoDeletes, err)
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Limits() {
+	options := Options{Limits: Limits{MaxInItems: 2}}
+	_, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		In(&suite.Ref.Id, "1", "2", "3").
+		Select()
+	if limitErr, ok := err.(*LimitError); suite.True(ok, "Expected a *LimitError, got %v", err) {
+		suite.Equal("MaxInItems", limitErr.Limit)
+		suite.Equal(3, limitErr.Actual)
+	}
+
+	results, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		In(&suite.Ref.Id, "1", "2").
+		Select()
+	if suite.NoError(err) {
+		suite.Equal(2, len(results))
+	}
+
+	options = Options{Limits: Limits{MaxArgs: 1}}
+	_, err = QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Equal(&suite.Ref.Memo, "test_memo").
+		Equal(&suite.Ref.IsPaid, false).
+		Select()
+	if limitErr, ok := err.(*LimitError); suite.True(ok, "Expected a *LimitError, got %v", err) {
+		suite.Equal("MaxArgs", limitErr.Limit)
+	}
+}
+
+func TestIdentityKeyFor(t *testing.T) {
+	plan := new(QueryPlan)
+	if plan.identityKeyFor([]interface{}{"ab", "c"}) == plan.identityKeyFor([]interface{}{"a", "bc"}) {
+		t.Error("Composite keys with different values should have different identity keys")
+	}
+	if plan.identityKeyFor([]interface{}{int64(1), "a"}) != plan.identityKeyFor([]interface{}{1, "a"}) {
+		t.Error("Keys should not depend on the integer type of their values")
+	}
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_IdentityMap() {
+	logger := new(recordingLogger)
+	options := Options{Context: WithIdentityMap(context.Background()), Logger: logger}
+	all, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Select()
+	suite.Require().NoError(err)
+	again, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).Select()
+	suite.Require().NoError(err)
+	suite.Require().Equal(len(all), len(again))
+	for i := range all {
+		suite.True(all[i] == again[i], "Rows selected twice should return the same instance")
+	}
+
+	logged := len(logger.lines)
+	inv := all[0].(*OverriddenInvoice)
+	byId, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Equal(&suite.Ref.Id, inv.Id).
+		Select()
+	if suite.NoError(err) && suite.Len(byId, 1) {
+		suite.True(inv == byId[0], "Primary key lookups should return the existing instance")
+		suite.Equal(logged, len(logger.lines), "Primary key lookups of known rows should not query the database")
+	}
+
+	negated, err := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).
+		Where().
+		Filter(filters.Not(filters.Equal(&suite.Ref.Id, inv.Id))).
+		Select()
+	if suite.NoError(err) {
+		suite.Len(negated, len(all)-1, "Negated primary key lookups should select every other row")
+		for _, row := range negated {
+			suite.True(row != inv, "Negated primary key lookups should not return the excluded row")
+		}
+	}
+
+	q := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options)
+	q.Fields(&suite.Ref.Id)
+	partial, err := q.Select()
+	if suite.NoError(err) && suite.NotEmpty(partial) {
+		suite.True(partial[0] != all[0], "Partial rows should not use the identity map")
+	}
+
+	union := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options).(*QueryPlan)
+	union.Union(Query(suite.Map, suite.Map, suite.Ref, JoinOp{}))
+	suite.Nil(union.identityMap(), "Compound plans should not use the identity map")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Budget() {
+	ctx := WithBudget(context.Background(), Budget{MaxQueries: 1})
+	options := Options{Context: ctx, HeavySemaphore: NewSemaphore(1)}
+	q := QueryWithOptions(suite.Map, suite.Map, suite.Ref, options)
+	q.(*QueryPlan).Heavy()
+	_, err := q.Select()
+	suite.NoError(err)
+	_, err = q.Count()
+	var budgetErr *BudgetError
+	if suite.True(errors.As(err, &budgetErr), "Queries beyond the budget should return a *BudgetError") {
+		suite.Equal("MaxQueries", budgetErr.Exceeded)
+	}
+	queries, _ := BudgetUsage(ctx)
+	suite.Equal(2, queries)
+	suite.Len(options.HeavySemaphore, 0, "Heavy queries should release the semaphore when they complete")
+
+	ctx = WithBudget(context.Background(), Budget{MaxQueries: 1})
+	ref := new(AutoIncrInvoice)
+	options = Options{Context: ctx}
+	suite.NoError(QueryWithOptions(suite.Map, suite.Map, ref, options).Assign(&ref.Memo, "budgeted").Insert())
+	err = QueryWithOptions(suite.Map, suite.Map, ref, options).Assign(&ref.Memo, "over budget").Insert()
+	suite.True(errors.As(err, &budgetErr), "Auto-increment inserts should count against the budget")
+
+	suite.Nil(NewSemaphore(0), "Semaphores without any slots should not limit heavy queries")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_ChangeHooks() {
+	var changes []Change
+	options := Options{
+		ChangeHooks: []ChangeFunc{func(c Change) {
+			changes = append(changes, c)
+		}},
+	}
+	ref := new(AutoIncrInvoice)
+	err := QueryWithOptions(suite.Map, suite.Map, ref, options).
+		Assign(&ref.Memo, "change hooks").
+		Insert()
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, len(changes))
+	suite.Equal(InsertOperation, changes[0].Operation)
+	suite.Equal([][]interface{}{{ref.Id}}, changes[0].Keys)
+
+	count, err := QueryWithOptions(suite.Map, suite.Map, ref, options).
+		Where().
+		Equal(&ref.Id, ref.Id).
+		Delete()
+	suite.Require().NoError(err)
+	suite.Require().Equal(2, len(changes))
+	suite.Equal(DeleteOperation, changes[1].Operation)
+	suite.Equal(count, changes[1].RowsAffected)
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_ReturningInto() {
+	var returned []*OverriddenInvoice
+	plan := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).ReturningInto(&returned)
+	plan.Where().False(&suite.Ref.IsPaid)
+	_, isPostgres := suite.Map.Dialect.(gorp.PostgresDialect)
+	count, err := plan.Delete()
+	if !isPostgres {
+		suite.Error(err, "ReturningInto should only be supported for dialects with RETURNING clauses")
+		return
+	}
+	if suite.NoError(err) {
+		suite.Equal(len(returned), count)
+		suite.Equal(suite.expectedLength(func(inv OverriddenInvoice) bool {
+			return !inv.IsPaid
+		}), count)
+		for _, inv := range returned {
+			suite.False(inv.IsPaid)
+		}
+	}
+
+	var wrongType []AutoIncrInvoice
+	plan = Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).(*QueryPlan).ReturningInto(&wrongType)
+	suite.NotEmpty(plan.Errors, "ReturningInto should reject slices of other types")
+}
+
+func (suite *QueryLanguageTestSuite) TestQueryLanguage_Truncate() {
+	// SQLite3 doesn't support TRUNCATE TABLE
+	if _, ok := suite.Map.Dialect.(dialects.SqliteDialect); ok {
+		return
+	}
+	expectedCount := 0
+
+	err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
+		Truncate()
+	if !suite.NoError(err) {
+		suite.T().FailNow()
+	}
+	count, err := Query(suite.Map, suite.Map, suite.Ref, JoinOp{}).
 		Count()
 	if !suite.NoError(err) {
 		suite.T().FailNow()
@@ -803,3 +3346,117 @@ func (suite *QueryLanguageTestSuite) TestQueryLanguage_WhereClauseIn() {
 // 		}
 // 	}
 // }
+
+// concatWrapper is a minimal multi-value wrapper, for testing values
+// nested in other values.
+type concatWrapper []interface{}
+
+func (w concatWrapper) ActualValues() []interface{} { return w }
+func (w concatWrapper) WrapSql(sqlValues ...string) string {
+	return "concat(" + strings.Join(sqlValues, ", ") + ")"
+}
+
+func TestSqlValuesNested(t *testing.T) {
+	dbMap := &gorp.DbMap{Dialect: gorp.PostgresDialect{}}
+	dbMap.AddTable(OverriddenInvoice{}).SetKeys(false, "Id")
+	ref := new(OverriddenInvoice)
+	plan := Query(dbMap, dbMap, ref, JoinOp{}).(*QueryPlan)
+	plan.resetArgs()
+	vals, err := plan.sqlValues([]interface{}{concatWrapper{&ref.Memo, concatWrapper{"a", "b"}}, 5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memo := plan.QuotedTable() + "." + plan.quoteField("Memo")
+	expected := []string{"concat(" + memo + ", concat($1, $2))", "$3"}
+	if !reflect.DeepEqual(vals, expected) {
+		t.Errorf("Values nested in wrappers should not replace the values that follow them; got %v", vals)
+	}
+}
+
+func TestNullTimeScan(t *testing.T) {
+	expected := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, value := range []interface{}{expected, "2020-01-02 03:04:05+00:00", []byte("2020-01-02T03:04:05Z")} {
+		var scanned nullTime
+		if err := scanned.Scan(value); err != nil {
+			t.Errorf("%#v should be scanned: %s", value, err)
+		} else if !scanned.Valid || !scanned.Time.Equal(expected) {
+			t.Errorf("%#v should be scanned as %v, not %v", value, expected, scanned.Time)
+		}
+	}
+	var scanned nullTime
+	if err := scanned.Scan(nil); err != nil || scanned.Valid {
+		t.Errorf("Null values should be scanned as invalid times")
+	}
+}
+
+func TestCopyInto(t *testing.T) {
+	type joined struct {
+		Memo string
+	}
+	type row struct {
+		Id     int64
+		Joined *joined
+	}
+	existing := &joined{Memo: "old"}
+	dst := row{Joined: existing}
+	copyInto(reflect.ValueOf(&dst).Elem(), reflect.ValueOf(row{Id: 1, Joined: &joined{Memo: "new"}}))
+	if dst.Id != 1 || dst.Joined != existing || existing.Memo != "new" {
+		t.Errorf("Pointers to structs should be kept and copied into; got %+v", dst)
+	}
+	copyInto(reflect.ValueOf(&dst).Elem(), reflect.ValueOf(row{Id: 2}))
+	if dst.Id != 2 || dst.Joined != nil {
+		t.Errorf("Pointers which are nil in the source should be left nil; got %+v", dst)
+	}
+}
+
+func TestStringBounds(t *testing.T) {
+	min, max := "0A1B2C3D-0000-0000-0000-000000000000", "BFFFFFFF-FFFF-FFFF-FFFF-FFFFFFFFFFFF"
+	bounds := stringBounds(min, max, 4)
+	expected := []interface{}{min, "40000000-0000-0000-0000-000000000000", "80000000-0000-0000-0000-000000000000", max}
+	if !reflect.DeepEqual(bounds, expected) {
+		t.Errorf("Bounds should run from the minimum to the maximum key; got %v", bounds)
+	}
+	if bounds := stringBounds("", "", 4); len(bounds) != 2 {
+		t.Errorf("Tables without rows should have a single partition; got %v", bounds)
+	}
+}
+
+// BenchmarkSelectQuery measures the allocations of generating a
+// plan's select statement again, which reuses the plan's buffers.
+func BenchmarkSelectQuery(b *testing.B) {
+	dbMap := &gorp.DbMap{Dialect: gorp.PostgresDialect{}}
+	dbMap.AddTable(OverriddenInvoice{}).SetKeys(false, "Id")
+	dbMap.AddTable(AutoIncrInvoice{}).SetKeys(true, "Id")
+	ref := new(OverriddenInvoice)
+	joined := new(AutoIncrInvoice)
+	q := Query(dbMap, dbMap, ref, JoinOp{})
+	q.Join(joined).On(filters.Equal(&joined.Memo, &ref.Memo), filters.NotEqual(&joined.Id, 0))
+	plan := q.Where().
+		Equal(&ref.PersonId, 1).
+		In(&ref.Id, "1", "2", "3").
+		Less(&ref.Created, concatWrapper{&ref.Updated, 1}).(*QueryPlan)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := plan.selectQuery(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWhereClause(b *testing.B) {
+	dbMap := &gorp.DbMap{Dialect: gorp.PostgresDialect{}}
+	dbMap.AddTable(OverriddenInvoice{}).SetKeys(false, "Id")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ref := new(OverriddenInvoice)
+		plan := Query(dbMap, dbMap, ref, JoinOp{}).
+			Where().
+			Equal(&ref.PersonId, int64(i)).
+			In(&ref.Id, "1", "2", "3").
+			Less(&ref.Created, i).(*QueryPlan)
+		if _, err := plan.whereClause(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package plans
+
+import (
+	"errors"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// Retarget returns a copy of the plan which generates its SQL for,
+// and executes against, dbMap and exec instead of the DbMap and executor
+// that the plan was created with.  This allows a plan to be built once
+// and run against databases with different dialects (e.g. a primary
+// postgresql database and a reporting warehouse).  The reference
+// struct type must be mapped in dbMap, as results are scanned using
+// dbMap.
+//
+// The original plan is not modified, and may still be executed.
+// Plans that select from or join to sub-queries, or that have common
+// tables (see With), can only be retargeted to the DbMap that they were
+// created with, since the sub-queries generate their SQL for their own
+// DbMap; sub-queries used as filter values also continue to use their
+// own dialect.
+func (plan *QueryPlan) Retarget(dbMap *gorp.DbMap, exec gorp.SqlExecutor) (*QueryPlan, error) {
+	sameMap := dbMap == plan.dbMap
+	if _, isSubQuery := plan.target.Interface().(subQuery); isSubQuery && !sameMap {
+		return nil, errors.New("gorq: Cannot retarget a plan which selects from a sub-query")
+	}
+	if len(plan.commonTables) > 0 && !sameMap {
+		return nil, errors.New("gorq: Cannot retarget a plan with common tables to another DbMap")
+	}
+	if len(plan.compounds) > 0 {
+		return nil, errors.New("gorq: Cannot retarget a plan which is combined with other queries")
+	}
+	plan.storeJoin()
+	retargeted := &QueryPlan{
+		Errors:         append([]error(nil), plan.Errors...),
+		table:          plan.table,
+		dbMap:          dbMap,
+		dialect:        dialects.Wrap(dbMap.Dialect),
+		executor:       exec,
+		target:         plan.target,
+		orderBy:        plan.orderBy,
+		limit:          plan.limit,
+		offset:         plan.offset,
+		assignArgs:     plan.assignArgs,
+		assignColMaps:  plan.assignColMaps,
+		assignExprs:    plan.assignExprs,
+		tables:         plan.tables,
+		distinctFields: plan.distinctFields,
+		commonTables:   append([]commonTable(nil), plan.commonTables...),
+		forUpdate:      plan.forUpdate,
+		trimmed:        plan.trimmed,
+		logger:         plan.logger,
+		logPrefix:      plan.logPrefix,
+		sensitiveCols:  plan.sensitiveCols,
+		lazyCols:       plan.lazyCols,
+		computedCols:   plan.computedCols,
+		indexExprs:     plan.indexExprs,
+		defaultLimit:   plan.defaultLimit,
+		timeout:        plan.timeout,
+		requireWhere:   plan.requireWhere,
+		readOnly:       plan.readOnly,
+		refJoinType:    plan.refJoinType,
+		maxRows:        plan.maxRows,
+		commentTags:    plan.commentTags,
+		commentFormat:  plan.commentFormat,
+		comments:       plan.comments,
+		noInlining:     plan.noInlining,
+		ctx:            plan.ctx,
+		policies:       plan.policies,
+		orBranches:     append([]filters.Filter(nil), plan.orBranches...),
+		having:         append([]filters.Filter(nil), plan.having...),
+		params:         plan.params,
+		operators:      plan.operators,
+		changeHooks:    plan.changeHooks,
+		warningHooks:   plan.warningHooks,
+		indexAdvisor:   plan.indexAdvisor,
+		rewriters:      plan.rewriters,
+		views:          plan.views,
+		identifiers:    plan.identifiers,
+		limits:         plan.limits,
+		heavy:          plan.heavy,
+		heavySemaphore: plan.heavySemaphore,
+		jsonEncoder:    plan.jsonEncoder,
+		jsonHooks:      plan.jsonHooks,
+
+		returningTarget:  plan.returningTarget,
+		joinedSubQueries: plan.joinedSubQueries,
+		batches:          plan.batches,
+	}
+	for i := range plan.sensitiveArgs {
+		if i < len(plan.assignArgs) {
+			retargeted.markSensitive(i, i+1)
+		}
+	}
+	if plan.filters != nil {
+		where := new(filters.AndFilter)
+		if combined, ok := plan.filters.(subFilterer); ok {
+			where.Add(combined.SubFilters()...)
+		} else {
+			where.Add(plan.filters)
+		}
+		retargeted.filters = where
+	}
+
+	// Map every identifier that the plan has quoted to the same
+	// identifier quoted for the new dialect.
+	renamed := make(map[string]string)
+	for _, table := range plan.tables {
+		renamed[plan.quoteTable(table.SchemaName, table.TableName)] = retargeted.quoteTable(table.SchemaName, table.TableName)
+	}
+	for _, m := range plan.colMap {
+		if m.fromSubQuery && !sameMap {
+			return nil, errors.New("gorq: Cannot retarget a plan which joins to a sub-query")
+		}
+		renamed[plan.quoteField(m.column.ColumnName)] = retargeted.quoteField(m.column.ColumnName)
+		if _, ok := renamed[m.quotedTable]; !ok {
+			renamed[m.quotedTable] = retargeted.quoteField(m.tableName)
+		}
+	}
+	rename := func(quoted string) string {
+		if r, ok := renamed[quoted]; ok {
+			return r
+		}
+		return quoted
+	}
+
+	retargeted.quotedTable = rename(plan.QuotedTable())
+	retargeted.colMap = make(structColumnMap, 0, len(plan.colMap))
+	copies := make(map[*fieldColumnMap]*fieldColumnMap, len(plan.colMap))
+	for _, m := range plan.colMap {
+		copied := *m
+		copied.quotedTable = rename(m.quotedTable)
+		copied.quotedColumn = rename(m.quotedColumn)
+		copies[m] = &copied
+		retargeted.colMap = append(retargeted.colMap, &copied)
+	}
+	for _, m := range retargeted.colMap {
+		if m.parentMap != nil {
+			m.parentMap = copies[m.parentMap]
+		}
+	}
+	for _, join := range plan.joins {
+		copied := &filters.JoinFilter{
+			Type:            join.Type,
+			QuotedJoinTable: rename(join.QuotedJoinTable),
+			QuotedAlias:     rename(join.QuotedAlias),
+		}
+		for _, filter := range join.SubFilters() {
+			if ref, ok := filter.(*referenceFilter); ok {
+				filter = reference(rename(ref.leftTable), rename(ref.leftCol), rename(ref.rightTable), rename(ref.rightCol))
+			}
+			copied.Add(filter)
+		}
+		retargeted.joins = append(retargeted.joins, copied)
+	}
+	for _, groupBy := range plan.groupBy {
+		for _, m := range plan.colMap {
+			if groupBy == m.quotedTable+"."+m.quotedColumn {
+				groupBy = rename(m.quotedTable) + "." + rename(m.quotedColumn)
+				break
+			}
+		}
+		retargeted.groupBy = append(retargeted.groupBy, groupBy)
+	}
+	for i, col := range plan.assignCols {
+		retargeted.assignCols = append(retargeted.assignCols, rename(col))
+		retargeted.assignBindVars = append(retargeted.assignBindVars, retargeted.dialect.BindVar(i))
+	}
+	for _, filter := range plan.conflictWhere {
+		if ref, ok := filter.(*referenceFilter); ok {
+			filter = reference(rename(ref.leftTable), rename(ref.leftCol), rename(ref.rightTable), rename(ref.rightCol))
+		}
+		retargeted.conflictWhere = append(retargeted.conflictWhere, filter)
+	}
+	retargeted.conflictConstraint = plan.conflictConstraint
+	retargeted.forUpdateOf = rename(plan.forUpdateOf)
+	return retargeted, nil
+}
@@ -0,0 +1,23 @@
+package plans
+
+// A Rewriter is called with each statement that a plan is about to
+// execute, after it has been generated, checked, and commented, and
+// returns the statement and arguments to execute in its place.  It
+// gives operators a way to adjust generated SQL (e.g. adding
+// optimizer hints or routing comments, or moving tables to another
+// schema) without changing how queries are built.  Returning an error
+// prevents the statement from executing.
+type Rewriter func(query string, args []interface{}) (string, []interface{}, error)
+
+// rewrite passes query and args through each of the plan's rewriters
+// in turn (see Options.Rewriters).
+func (plan *QueryPlan) rewrite(query string, args []interface{}) (string, []interface{}, error) {
+	for _, rewriter := range plan.rewriters {
+		var err error
+		query, args, err = rewriter(query, args)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return query, args, nil
+}
@@ -0,0 +1,287 @@
+package plans
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// hasPostGet matches gorp's HasPostGet, which gorp calls after
+// scanning each result of a select.
+type hasPostGet interface {
+	PostGet(gorp.SqlExecutor) error
+}
+
+// A rowScanner scans the rows of a plan's select statement into new
+// values of a struct type: usually the plan's reference struct type,
+// or an unmapped struct for selectByTags.
+type rowScanner struct {
+	plan       *QueryPlan
+	targetType reflect.Type
+	indexes    [][]int
+	wrappers   []ScanWrapper
+	dest       []interface{}
+	scanners   []gorp.CustomScanner
+	read       int
+}
+
+// rowScanner returns a rowScanner for the plan's selected columns.
+func (plan *QueryPlan) rowScanner() (*rowScanner, error) {
+	if _, isSubQuery := plan.target.Interface().(subQuery); isSubQuery {
+		return nil, errors.New("gorq: Cannot stream the results of a plan which selects from a sub-query")
+	}
+	var (
+		indexes  [][]int
+		wrappers []ScanWrapper
+	)
+	for _, m := range plan.colMap {
+		if !m.doSelect {
+			continue
+		}
+		index, err := plan.fieldIndex(m.field)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+		wrapper, _ := m.selectTarget.(ScanWrapper)
+		wrappers = append(wrappers, wrapper)
+	}
+	return plan.newRowScanner(plan.target.Type().Elem(), indexes, wrappers), nil
+}
+
+// newRowScanner returns a rowScanner which scans each column into the
+// field of targetType at the same position in indexes (skipping
+// columns whose index is nil), using the ScanWrapper at the same
+// position in wrappers, if there is one.
+func (plan *QueryPlan) newRowScanner(targetType reflect.Type, indexes [][]int, wrappers []ScanWrapper) *rowScanner {
+	return &rowScanner{
+		plan:       plan,
+		targetType: targetType,
+		indexes:    indexes,
+		wrappers:   wrappers,
+		dest:       make([]interface{}, len(indexes)),
+		scanners:   make([]gorp.CustomScanner, 0, len(indexes)),
+	}
+}
+
+// scan scans the current row of rows into a new value of the
+// reference struct type.  Values are converted using the DbMap's
+// TypeConverter (or the ScanWrapper they were selected with), and
+// PostGet hooks are run, just as gorp does when selecting.  It
+// returns false, and no result, once the plan's maximum number of
+// rows have been read (see checkRows).
+func (scanner *rowScanner) scan(rows *sql.Rows) (reflect.Value, bool, error) {
+	plan := scanner.plan
+	scanner.read++
+	if keep, err := plan.checkRows(scanner.read); err != nil {
+		return reflect.Value{}, false, err
+	} else if keep < scanner.read {
+		return reflect.Value{}, false, nil
+	}
+	result := reflect.New(scanner.targetType)
+	scanners := scanner.scanners[:0]
+	dest := scanner.dest
+	for i, index := range scanner.indexes {
+		if index == nil {
+			dest[i] = new(interface{})
+			continue
+		}
+		dest[i] = fieldByIndex(result.Elem(), index).Addr().Interface()
+		if wrapper := scanner.wrappers[i]; wrapper != nil {
+			s := wrapper.Scanner(dest[i])
+			dest[i] = s.Holder
+			scanners = append(scanners, s)
+			continue
+		}
+		if plan.dbMap.TypeConverter != nil {
+			if s, ok := plan.dbMap.TypeConverter.FromDb(dest[i]); ok {
+				dest[i] = s.Holder
+				scanners = append(scanners, s)
+			}
+		}
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return reflect.Value{}, false, err
+	}
+	for _, s := range scanners {
+		if err := s.Binder(s.Holder, s.Target); err != nil {
+			return reflect.Value{}, false, err
+		}
+	}
+	if hook, ok := result.Interface().(hasPostGet); ok {
+		if err := hook.PostGet(plan.executor); err != nil {
+			return reflect.Value{}, false, err
+		}
+	}
+	return result, true, nil
+}
+
+// scanRows executes the plan's select statement, scanning each row
+// into a new value of the plan's reference struct type and passing
+// it to fn as rows are read.
+func (plan *QueryPlan) scanRows(fn func(result reflect.Value) error) error {
+	scanner, err := plan.rowScanner()
+	if err != nil {
+		return err
+	}
+	rows, done, err := plan.queryRows()
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer rows.Close()
+	plan.truncated = false
+	for rows.Next() {
+		result, ok, err := scanner.scan(rows)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Iterate executes the plan's select statement and calls fn with each
+// result (a pointer to a new value of the reference struct type) as
+// rows are read from the database, so that large results don't have
+// to be held in memory at once.  If fn returns an error, no more rows
+// are read, and the error is returned.  Example:
+//
+//     ref := new(Invoice)
+//     err := dbMap.Query(ref).Where().True(&ref.IsPaid).Iterate(func(result interface{}) error {
+//         return w.Write(invoiceRecord(result.(*Invoice)))
+//     })
+func (plan *QueryPlan) Iterate(fn func(result interface{}) error) error {
+	return plan.scanRows(func(result reflect.Value) error {
+		return fn(result.Interface())
+	})
+}
+
+// Rows is a cursor over the results of a plan's select statement,
+// returned by QueryPlan.Rows.  Like sql.Rows, it must be closed once
+// it is no longer needed, e.g.
+//
+//     rows, err := dbMap.Query(ref).Rows()
+//     if err != nil {
+//         return err
+//     }
+//     defer rows.Close()
+//     for rows.Next() {
+//         invoice := rows.Result().(*Invoice)
+//         ...
+//     }
+//     return rows.Err()
+type Rows struct {
+	rows    *sql.Rows
+	done    func()
+	scanner *rowScanner
+	result  reflect.Value
+	err     error
+	closed  bool
+}
+
+// Rows executes the plan's select statement and returns a cursor over
+// its results, which are read from the database (and scanned into new
+// values of the reference struct type) one at a time as the cursor is
+// advanced.  The plan's executor is in use until the cursor is
+// closed.
+func (plan *QueryPlan) Rows() (interfaces.Rows, error) {
+	scanner, err := plan.rowScanner()
+	if err != nil {
+		return nil, err
+	}
+	rows, done, err := plan.queryRows()
+	if err != nil {
+		return nil, err
+	}
+	plan.truncated = false
+	return &Rows{rows: rows, done: done, scanner: scanner}, nil
+}
+
+// Next scans the next result, returning false (and closing the
+// cursor) when there are no more results or an error occurred.
+func (r *Rows) Next() bool {
+	r.result = reflect.Value{}
+	if r.closed {
+		return false
+	}
+	if !r.rows.Next() {
+		r.err = r.rows.Err()
+		r.Close()
+		return false
+	}
+	result, ok, err := r.scanner.scan(r.rows)
+	if err != nil || !ok {
+		r.err = err
+		r.Close()
+		return false
+	}
+	r.result = result
+	return true
+}
+
+// Result returns the result scanned by the last call to Next, which
+// is a pointer to a new value of the reference struct type.
+func (r *Rows) Result() interface{} {
+	if !r.result.IsValid() {
+		return nil
+	}
+	return r.result.Interface()
+}
+
+// Err returns the error, if any, that ended the iteration.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close closes the cursor.  It is safe to call more than once.
+func (r *Rows) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.rows.Close()
+	r.done()
+	return err
+}
+
+// SelectToChannel executes the plan's select statement and sends each
+// result on ch as rows are read from the database, closing ch when it
+// is done (whether or not there was an error).  ch must be a channel
+// of pointers to the reference struct type (or of the reference struct
+// type itself).  If the plan's context is done before a result can be
+// sent, the context's error is returned.
+func (plan *QueryPlan) SelectToChannel(ch interface{}) error {
+	chVal := reflect.ValueOf(ch)
+	if chVal.Kind() != reflect.Chan || chVal.Type().ChanDir()&reflect.SendDir == 0 {
+		return errors.New("gorq: SelectToChannel must be run with a channel as its target")
+	}
+	defer chVal.Close()
+	elemType := chVal.Type().Elem()
+	targetType := plan.target.Type()
+	if elemType != targetType && elemType != targetType.Elem() {
+		return errors.New("gorq: SelectToChannel must be run with a channel of the reference struct type")
+	}
+	cases := []reflect.SelectCase{{Dir: reflect.SelectSend, Chan: chVal}}
+	if plan.ctx != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(plan.ctx.Done())})
+	}
+	return plan.scanRows(func(result reflect.Value) error {
+		if elemType != targetType {
+			result = result.Elem()
+		}
+		cases[0].Send = result
+		if chosen, _, _ := reflect.Select(cases); chosen != 0 {
+			return plan.ctx.Err()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+package plans
+
+import (
+	"errors"
+	"reflect"
+)
+
+// ErrNotFound is returned by SelectOne when no rows match the plan.
+var ErrNotFound = errors.New("gorq: No rows matched the query")
+
+// SelectOne runs this query plan as a SELECT statement limited to
+// one row, and scans that row into the plan's reference struct.  It
+// returns ErrNotFound if no rows match.  Example:
+//
+//     ref := new(Invoice)
+//     err := dbMap.Query(ref).Where().Equal(&ref.Id, id).SelectOne()
+//     if err == gorq.ErrNotFound {
+//         return nil, ErrNoSuchInvoice
+//     }
+//     return ref, err
+//
+// Since the row is copied into the existing reference struct (and
+// any structs that it points to), field pointers taken from it
+// before calling SelectOne still refer to the same fields, so the
+// plan can be executed again.
+func (plan *QueryPlan) SelectOne() error {
+	limit := plan.limit
+	plan.limit = 1
+	results, err := plan.Select()
+	plan.limit = limit
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return ErrNotFound
+	}
+	target := plan.target
+	if subQuery, ok := target.Interface().(subQuery); ok {
+		target = subQuery.getTarget()
+	}
+	copyInto(target.Elem(), reflect.ValueOf(results[0]).Elem())
+	return nil
+}
+
+// copyInto sets dst to src, except that pointers to structs which
+// are already set in dst are kept, and the structs that they point to
+// are copied into instead, so that pointers to their fields (e.g.
+// field pointers in joined structs) stay valid.  Pointers which are
+// nil in src (e.g. left joined structs without a matching row) are
+// left nil in dst.
+func copyInto(dst, src reflect.Value) {
+	type pointer struct {
+		index []int
+		value reflect.Value
+	}
+	var pointers []pointer
+	var find func(v reflect.Value, index []int)
+	find = func(v reflect.Value, index []int) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			fieldIndex := append(append([]int(nil), index...), i)
+			switch {
+			case field.Kind() == reflect.Struct:
+				find(field, fieldIndex)
+			case field.Kind() == reflect.Ptr && field.CanSet() && !field.IsNil() && field.Elem().Kind() == reflect.Struct:
+				pointers = append(pointers, pointer{index: fieldIndex, value: reflect.ValueOf(field.Interface())})
+			}
+		}
+	}
+	find(dst, nil)
+	dst.Set(src)
+	for _, p := range pointers {
+		field := dst.FieldByIndex(p.index)
+		loaded := reflect.ValueOf(field.Interface())
+		if loaded.IsNil() {
+			continue
+		}
+		field.Set(p.value)
+		copyInto(p.value.Elem(), loaded.Elem())
+	}
+}
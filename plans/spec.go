@@ -0,0 +1,467 @@
+package plans
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/interfaces"
+)
+
+// A Spec is a serializable description of a select query against a
+// single table.  Columns are referred to by name, so a Spec can be
+// encoded (e.g. as JSON) in one process and turned back into a plan
+// using QueryFromSpec in another process that maps the same table.
+type Spec struct {
+	// Table and Schema are the table that the query selects from.
+	Table  string `json:"table"`
+	Schema string `json:"schema,omitempty"`
+
+	// Fields are the names of the selected columns.
+	Fields []string `json:"fields,omitempty"`
+
+	// Where is the query's where clause, if it has one.
+	Where *FilterSpec `json:"where,omitempty"`
+
+	OrderBy []OrderSpec `json:"order_by,omitempty"`
+	Limit   int64       `json:"limit,omitempty"`
+	Offset  int64       `json:"offset,omitempty"`
+
+	// Params contains the values bound to filters.Param values.
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// A FilterSpec describes a filter in a Spec.  Op is one of "and",
+// "or", "not", "in", "not in", "null", "not null", "true", or a
+// comparison operator ("=", "<>", "<", "<=", ">", ">=", or "like").
+// Combined filters ("and", "or", and "not") use Filters; all others
+// filter on Column, using Values as the right hand side where needed.
+type FilterSpec struct {
+	Op      string       `json:"op"`
+	Column  string       `json:"column,omitempty"`
+	Values  []ValueSpec  `json:"values,omitempty"`
+	Filters []FilterSpec `json:"filters,omitempty"`
+}
+
+// A ValueSpec is a value in a FilterSpec.  Exactly one of Column (a
+// reference to another column), Param (a filters.Param), or Value (a
+// literal value) is used.
+type ValueSpec struct {
+	Column string      `json:"column,omitempty"`
+	Param  string      `json:"param,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+// UnmarshalJSON decodes spec, keeping numbers in its Params as
+// json.Number values, so that large integers aren't rounded to the
+// nearest float64.
+func (spec *Spec) UnmarshalJSON(data []byte) error {
+	type plainSpec Spec
+	return decodeNumbers(data, (*plainSpec)(spec))
+}
+
+// UnmarshalJSON decodes v, keeping a numeric Value as a json.Number,
+// so that large integers aren't rounded to the nearest float64.
+func (v *ValueSpec) UnmarshalJSON(data []byte) error {
+	type plainValueSpec ValueSpec
+	return decodeNumbers(data, (*plainValueSpec)(v))
+}
+
+// decodeNumbers decodes data into target using json.Decoder.UseNumber.
+func decodeNumbers(data []byte, target interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(target)
+}
+
+// An OrderSpec is an order by clause in a Spec.
+type OrderSpec struct {
+	Column    string `json:"column"`
+	Direction string `json:"direction,omitempty"`
+}
+
+// Spec returns a serializable description of the plan's select
+// statement.  Only plans against a single table can be described:
+// joins, sub-queries, SQL wrappers, and custom filter types all
+// return an error, since they can't be referred to by name.  So do
+// group by and having clauses, Distinct, ForUpdate, compound queries,
+// and common table expressions, which a Spec has no way to express.
+func (plan *QueryPlan) Spec() (*Spec, error) {
+	if len(plan.Errors) > 0 {
+		return nil, plan.Errors[0]
+	}
+	plan.storeJoin()
+	if len(plan.joins) > 0 {
+		return nil, errors.New("gorq: Cannot describe a plan with joins")
+	}
+	if _, isSubQuery := plan.target.Interface().(subQuery); isSubQuery {
+		return nil, errors.New("gorq: Cannot describe a plan which selects from a sub-query")
+	}
+	if len(plan.groupBy) > 0 {
+		return nil, errors.New("gorq: Cannot describe a plan with a group by clause")
+	}
+	if len(plan.having) > 0 {
+		return nil, errors.New("gorq: Cannot describe a plan with a having clause")
+	}
+	if len(plan.distinctFields) > 0 {
+		return nil, errors.New("gorq: Cannot describe a plan which selects distinct rows")
+	}
+	if plan.forUpdate {
+		return nil, errors.New("gorq: Cannot describe a plan which locks its rows")
+	}
+	if len(plan.compounds) > 0 {
+		return nil, errors.New("gorq: Cannot describe a compound query")
+	}
+	if len(plan.commonTables) > 0 {
+		return nil, errors.New("gorq: Cannot describe a plan with common table expressions")
+	}
+	spec := &Spec{
+		Table:  plan.table.TableName,
+		Schema: plan.table.SchemaName,
+		Limit:  plan.limit,
+		Offset: plan.offset,
+		Params: plan.params,
+	}
+	for _, m := range plan.colMap {
+		if m.doSelect {
+			if _, computed := m.selectTarget.(computedColumn); computed {
+				// gorp names every transient column "-", so
+				// computed columns can't be described by name.
+				// Plans built from a Spec always select them.
+				continue
+			}
+			if m.selectTarget != m.field {
+				return nil, fmt.Errorf("gorq: Cannot describe the selection of column %s", m.column.ColumnName)
+			}
+			spec.Fields = append(spec.Fields, m.column.ColumnName)
+		}
+	}
+	if where := plan.whereBranches(); where != nil && !isEmpty(where) {
+		filter, err := plan.filterSpec(where)
+		if err != nil {
+			return nil, err
+		}
+		spec.Where = &filter
+	}
+	for _, o := range plan.orderBy {
+		column, err := plan.specColumn(o.fieldOrWrapper)
+		if err != nil {
+			return nil, err
+		}
+		spec.OrderBy = append(spec.OrderBy, OrderSpec{Column: column, Direction: o.direction})
+	}
+	return spec, nil
+}
+
+// specColumn returns the name of the column that fieldPtr points to.
+func (plan *QueryPlan) specColumn(fieldPtr interface{}) (string, error) {
+	m, err := plan.colMap.fieldMapForPointer(fieldPtr)
+	if err != nil {
+		return "", err
+	}
+	return m.column.ColumnName, nil
+}
+
+// specValue returns the ValueSpec for value.
+func (plan *QueryPlan) specValue(value interface{}) (ValueSpec, error) {
+	switch src := value.(type) {
+	case filters.Param:
+		return ValueSpec{Param: string(src)}, nil
+	case filters.SqlWrapper, filters.MultiSqlWrapper, subQuery:
+		return ValueSpec{}, fmt.Errorf("gorq: Cannot describe a filter value of type %T", value)
+	}
+	if value != nil && reflect.TypeOf(value).Kind() == reflect.Ptr {
+		if _, err := plan.colMap.joinMapForPointer(value); err == nil {
+			column, err := plan.specColumn(value)
+			return ValueSpec{Column: column}, err
+		}
+	}
+	return ValueSpec{Value: value}, nil
+}
+
+// filterSpec returns the FilterSpec for filter.
+func (plan *QueryPlan) filterSpec(filter filters.Filter) (FilterSpec, error) {
+	var spec FilterSpec
+	switch src := filter.(type) {
+	case *filters.AndFilter, *filters.OrFilter, *filters.NotFilter:
+		spec.Op = "and"
+		if _, ok := src.(*filters.OrFilter); ok {
+			spec.Op = "or"
+		} else if _, ok := src.(*filters.NotFilter); ok {
+			spec.Op = "not"
+		}
+		for _, sub := range src.(subFilterer).SubFilters() {
+			subSpec, err := plan.filterSpec(sub)
+			if err != nil {
+				return spec, err
+			}
+			spec.Filters = append(spec.Filters, subSpec)
+		}
+		return spec, nil
+	case *filters.ComparisonFilter:
+		if src.RightMod != nil {
+			return spec, errors.New("gorq: Cannot describe a comparison with a modifier")
+		}
+		spec.Op = strings.TrimSpace(src.Comparison)
+	case *filters.InFilter:
+		spec.Op = "in"
+	case *filters.NotInFilter:
+		spec.Op = "not in"
+	case *filters.NullFilter:
+		spec.Op = "null"
+	case *filters.NotNullFilter:
+		spec.Op = "not null"
+	case *filters.TrueFilter:
+		spec.Op = "true"
+	default:
+		return spec, fmt.Errorf("gorq: Cannot describe a filter of type %T", filter)
+	}
+	values := filter.ActualValues()
+	column, err := plan.specColumn(values[0])
+	if err != nil {
+		return spec, err
+	}
+	spec.Column = column
+	for _, value := range values[1:] {
+		valueSpec, err := plan.specValue(value)
+		if err != nil {
+			return spec, err
+		}
+		spec.Values = append(spec.Values, valueSpec)
+	}
+	return spec, nil
+}
+
+// QueryFromSpec creates a plan for target (which must be a pointer to
+// a struct mapped to spec.Table) from a Spec, usually one that was
+// created by QueryPlan.Spec in another process.
+func QueryFromSpec(dbMap *gorp.DbMap, exec gorp.SqlExecutor, target interface{}, spec *Spec, options Options) (interfaces.SelectQuery, error) {
+	plan := QueryWithOptions(dbMap, exec, target, options).(*QueryPlan)
+	if len(plan.Errors) > 0 {
+		return nil, plan.Errors[0]
+	}
+	if plan.table.TableName != spec.Table || plan.table.SchemaName != spec.Schema {
+		return nil, fmt.Errorf("gorq: Spec is for table %s, but the target is mapped to %s", spec.Table, plan.table.TableName)
+	}
+	if len(spec.Fields) > 0 {
+		fields := make([]interface{}, 0, len(spec.Fields))
+		for _, name := range spec.Fields {
+			m, err := plan.specField(name)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, m.field)
+		}
+		plan.Fields(fields...)
+		for _, m := range plan.colMap {
+			if _, computed := m.selectTarget.(computedColumn); computed {
+				m.doSelect = true
+			}
+		}
+	}
+	plan.Where()
+	if spec.Where != nil {
+		filter, err := plan.specFilter(*spec.Where)
+		if err != nil {
+			return nil, err
+		}
+		plan.Filter(filter)
+	}
+	for _, o := range spec.OrderBy {
+		m, err := plan.specField(o.Column)
+		if err != nil {
+			return nil, err
+		}
+		plan.OrderBy(m.field, o.Direction)
+	}
+	plan.limit = spec.Limit
+	plan.offset = spec.Offset
+	params := make(map[string]interface{}, len(spec.Params))
+	for name, value := range spec.Params {
+		if n, ok := value.(json.Number); ok {
+			value = plainNumber(n)
+		}
+		params[name] = value
+	}
+	plan.Bind(params)
+	if len(plan.Errors) > 0 {
+		return nil, plan.Errors[0]
+	}
+	return plan, nil
+}
+
+// specField returns the mapping for the column named name in the
+// plan's table.
+func (plan *QueryPlan) specField(name string) (*fieldColumnMap, error) {
+	for _, m := range plan.colMap {
+		if m.parentMap == nil && m.column.ColumnName == name {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("gorq: No column named %s in table %s", name, plan.table.TableName)
+}
+
+// specFilter returns the filter described by spec.
+func (plan *QueryPlan) specFilter(spec FilterSpec) (filters.Filter, error) {
+	switch spec.Op {
+	case "and", "or", "not":
+		subFilters := make([]filters.Filter, 0, len(spec.Filters))
+		for _, sub := range spec.Filters {
+			filter, err := plan.specFilter(sub)
+			if err != nil {
+				return nil, err
+			}
+			subFilters = append(subFilters, filter)
+		}
+		switch spec.Op {
+		case "or":
+			return filters.Or(subFilters...), nil
+		case "not":
+			if len(subFilters) != 1 {
+				return nil, errors.New("gorq: A not filter must have exactly one sub-filter")
+			}
+			return filters.Not(subFilters[0]), nil
+		}
+		return filters.And(subFilters...), nil
+	}
+	m, err := plan.specField(spec.Column)
+	if err != nil {
+		return nil, err
+	}
+	fieldType := reflect.TypeOf(m.field).Elem()
+	values := make([]interface{}, 0, len(spec.Values))
+	for _, v := range spec.Values {
+		switch {
+		case v.Column != "":
+			other, err := plan.specField(v.Column)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, other.field)
+		case v.Param != "":
+			values = append(values, filters.Param(v.Param))
+		default:
+			values = append(values, specLiteral(v.Value, fieldType))
+		}
+	}
+	switch spec.Op {
+	case "in":
+		return filters.In(m.field, values...), nil
+	case "not in":
+		return filters.NotIn(m.field, values...), nil
+	case "null":
+		return filters.Null(m.field), nil
+	case "not null":
+		return filters.NotNull(m.field), nil
+	case "true":
+		return filters.True(m.field), nil
+	}
+	if len(values) != 1 {
+		return nil, fmt.Errorf("gorq: A %s filter must have exactly one value", spec.Op)
+	}
+	switch spec.Op {
+	case "=":
+		return filters.Equal(m.field, values[0]), nil
+	case "!=", "<>":
+		return filters.NotEqual(m.field, values[0]), nil
+	case "<":
+		return filters.Less(m.field, values[0]), nil
+	case "<=":
+		return filters.LessOrEqual(m.field, values[0]), nil
+	case ">":
+		return filters.Greater(m.field, values[0]), nil
+	case ">=":
+		return filters.GreaterOrEqual(m.field, values[0]), nil
+	case "like":
+		pattern, ok := values[0].(string)
+		if !ok {
+			return nil, errors.New("gorq: A like filter must have a string pattern")
+		}
+		return filters.Like(m.field, pattern), nil
+	}
+	return nil, fmt.Errorf("gorq: Unknown filter operation %q", spec.Op)
+}
+
+// specLiteral converts a literal value decoded from a Spec (e.g. a
+// json.Number or string decoded from JSON) to the type of the field it
+// is compared against, where that's possible.
+func specLiteral(value interface{}, fieldType reflect.Type) interface{} {
+	if value == nil {
+		return nil
+	}
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	if n, ok := value.(json.Number); ok {
+		return specNumber(n, fieldType)
+	}
+	if s, ok := value.(string); ok && fieldType == reflect.TypeOf(time.Time{}) {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t
+		}
+		return value
+	}
+	v := reflect.ValueOf(value)
+	switch fieldType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			isInt := fieldType.Kind() != reflect.Float32 && fieldType.Kind() != reflect.Float64
+			if isInt && v.Float() != float64(int64(v.Float())) {
+				// Don't silently truncate fractions.
+				return value
+			}
+			return v.Convert(fieldType).Interface()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return v.Convert(fieldType).Interface()
+		}
+	}
+	return value
+}
+
+// specNumber converts n, a number decoded from a Spec, to fieldType if
+// it is a numeric type that can hold n exactly, or else to an int64 or
+// float64.
+func specNumber(n json.Number, fieldType reflect.Type) interface{} {
+	converted := reflect.New(fieldType).Elem()
+	switch fieldType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil && !converted.OverflowInt(i) {
+			converted.SetInt(i)
+			return converted.Interface()
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil && !converted.OverflowUint(u) {
+			converted.SetUint(u)
+			return converted.Interface()
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, err := n.Float64(); err == nil && !converted.OverflowFloat(f) {
+			converted.SetFloat(f)
+			return converted.Interface()
+		}
+	}
+	return plainNumber(n)
+}
+
+// plainNumber converts n to an int64 if it is an integer that fits in
+// one, or else to a float64.
+func plainNumber(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n.String()
+}
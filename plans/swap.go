@@ -0,0 +1,34 @@
+package plans
+
+import "github.com/outdoorsy/gorq/filters"
+
+// UpdateWhereCurrent sets the column that fieldPtr points to to
+// newValue, but only in rows where it is still expectedValue, using a
+// single UPDATE statement.  It returns whether or not any rows were
+// updated, i.e. whether the swap happened.  This is useful for state
+// transitions which must not race with each other, e.g.
+//
+//     ref := new(Order)
+//     swapped, err := dbMap.Query(ref).
+//         Where().
+//         Equal(&ref.Id, id).
+//         UpdateWhereCurrent(&ref.State, "pending", "shipped")
+//
+// A nil expectedValue matches null.  The comparison is added to the
+// plan's where clause (and newValue to its assignments), so the plan
+// shouldn't be reused.  MySQL reports rows that already held newValue
+// as unchanged, so on MySQL, expectedValue and newValue should
+// differ.
+func (plan *QueryPlan) UpdateWhereCurrent(fieldPtr, expectedValue, newValue interface{}) (bool, error) {
+	current := filters.Equal(fieldPtr, expectedValue)
+	if expectedValue == nil {
+		current = filters.Null(fieldPtr)
+	}
+	plan.Assign(fieldPtr, newValue)
+	plan.andWhere(current)
+	updated, err := plan.Update()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
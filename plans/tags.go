@@ -0,0 +1,113 @@
+package plans
+
+import (
+	"reflect"
+	"strings"
+)
+
+// isMapped returns whether or not t is mapped to a table (or view).
+func (plan *QueryPlan) isMapped(t reflect.Type) bool {
+	_, err := plan.tableFor(t)
+	return err == nil
+}
+
+// selectByTags executes the plan's select statement and appends the
+// results to the slice that slicePtr points to, whose element type is
+// a struct (or pointer to a struct) that isn't mapped to a table.
+// Columns are matched to fields by name, using the same db tags that
+// gorp uses for mapped structs (or the field's name, if it has no
+// tag), ignoring case.  Unlike gorp, columns with no matching field
+// are skipped rather than treated as an error, so a struct may pick
+// out only the columns that it needs.
+func (plan *QueryPlan) selectByTags(slicePtr reflect.Value) error {
+	slice := slicePtr.Elem()
+	elemType := slice.Type().Elem()
+	structType := elemType
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	var wrappers []ScanWrapper
+	for _, m := range plan.colMap {
+		if m.doSelect {
+			wrapper, _ := m.selectTarget.(ScanWrapper)
+			wrappers = append(wrappers, wrapper)
+		}
+	}
+	rows, done, err := plan.queryRows()
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if len(wrappers) != len(columns) {
+		// The columns come from a sub-query that the plan didn't
+		// map, so there's no way to tell which wrappers go with them.
+		wrappers = make([]ScanWrapper, len(columns))
+	}
+	scanner := plan.newRowScanner(structType, tagIndexes(structType, columns), wrappers)
+	plan.truncated = false
+	for rows.Next() {
+		result, ok, err := scanner.scan(rows)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if elemType.Kind() != reflect.Ptr {
+			result = result.Elem()
+		}
+		slice.Set(reflect.Append(slice, result))
+	}
+	return rows.Err()
+}
+
+// tagIndexes returns the index of the field of structType that each
+// of columns should be scanned into, or nil for columns which don't
+// match any field.  Fields of embedded structs are matched as if they
+// were fields of structType, unless structType has a field with the
+// same name.
+func tagIndexes(structType reflect.Type, columns []string) [][]int {
+	fields := make(map[string][]int)
+	tagFields(structType, nil, fields)
+	indexes := make([][]int, len(columns))
+	for i, column := range columns {
+		indexes[i] = fields[strings.ToLower(column)]
+	}
+	return indexes
+}
+
+// tagFields adds the fields of structType, keyed by their lower case
+// column names, to fields.  Index is the index of structType itself,
+// if it is embedded.
+func tagFields(structType reflect.Type, index []int, fields map[string][]int) {
+	var embedded []reflect.StructField
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, field)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("db"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		name = strings.ToLower(name)
+		if _, ok := fields[name]; !ok {
+			fields[name] = append(append([]int(nil), index...), i)
+		}
+	}
+	for _, field := range embedded {
+		tagFields(field.Type, append(append([]int(nil), index...), field.Index...), fields)
+	}
+}
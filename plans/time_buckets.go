@@ -0,0 +1,173 @@
+package plans
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// A TimeBucket is the count of rows within one interval returned by
+// GroupByTime.
+type TimeBucket struct {
+	// Time is the start of the interval.
+	Time  time.Time `db:"bucket"`
+	Count int64     `db:"count"`
+}
+
+// floorDivInt returns a divided by b, rounded towards negative
+// infinity.
+func floorDivInt(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// epochExpr returns an expression for the number of seconds since
+// the unix epoch of a time.Time column.
+func (plan *QueryPlan) epochExpr(column string) string {
+	switch plan.dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		return "unix_timestamp(" + column + ")"
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		return "cast(strftime('%s', " + column + ") as integer)"
+	}
+	return "extract(epoch from " + column + ")"
+}
+
+// GroupByTime counts the rows matching the plan's where clause within
+// each interval from start up to end, returning one TimeBucket per
+// interval, including intervals with no rows.  Intervals are aligned
+// to the unix epoch, so the first bucket may start before start.  The
+// field that fieldPtr points to must be a time.Time, or an integer
+// holding seconds since the unix epoch.  Example:
+//
+//     // Signups per hour over the last day.
+//     buckets, err := dbMap.Query(ref).(*plans.QueryPlan).
+//         GroupByTime(&ref.Created, time.Hour, time.Now().Add(-24*time.Hour), time.Now())
+//
+// On postgresql, time.Time columns are counted against a
+// generate_series of the intervals; other dialects fill in empty
+// intervals after the counts are returned.  Intervals must be a whole
+// number of seconds.  The plan's order by, group by, limit, and offset
+// clauses are ignored.
+func (plan *QueryPlan) GroupByTime(fieldPtr interface{}, interval time.Duration, start, end time.Time) ([]TimeBucket, error) {
+	if len(plan.Errors) > 0 {
+		return nil, plan.Errors[0]
+	}
+	if interval < time.Second || interval%time.Second != 0 {
+		return nil, errors.New("gorq: Time intervals must be a whole number of seconds")
+	}
+	secs := int64(interval / time.Second)
+	first := floorDivInt(start.Unix(), secs)
+	last := -floorDivInt(-end.Unix(), secs)
+	if last <= first {
+		return nil, nil
+	}
+
+	fieldType := reflect.TypeOf(fieldPtr).Elem()
+	isTime := fieldType == reflect.TypeOf(time.Time{})
+	var lower, upper interface{}
+	switch {
+	case isTime:
+		lower, upper = time.Unix(first*secs, 0).UTC(), time.Unix(last*secs, 0).UTC()
+	case fieldType.Kind() >= reflect.Int && fieldType.Kind() <= reflect.Int64:
+		lower, upper = first*secs, last*secs
+	default:
+		return nil, fmt.Errorf("gorq: Cannot group by time using a field of type %s", fieldType)
+	}
+	scoped, err := plan.Retarget(plan.dbMap, plan.executor)
+	if err != nil {
+		return nil, err
+	}
+	scoped.andWhere(filters.GreaterOrEqual(fieldPtr, lower), filters.Less(fieldPtr, upper))
+	scoped.resetArgs()
+	if err := scoped.checkPolicies(SelectOperation); err != nil {
+		return nil, err
+	}
+	with := new(bytes.Buffer)
+	if err := scoped.writeWith(with); err != nil {
+		return nil, err
+	}
+	if _, ok := plan.dialect.(gorp.PostgresDialect); ok && isTime {
+		return scoped.timeSeries(with.String(), fieldPtr, secs, first, last)
+	}
+
+	column, err := scoped.argOrColumn(fieldPtr)
+	if err != nil {
+		return nil, err
+	}
+	if isTime {
+		column = scoped.epochExpr(column)
+	}
+	bucketExpr, err := scoped.floorDiv(column, secs)
+	if err != nil {
+		return nil, err
+	}
+	var counts []Bucket
+	if err := scoped.selectBuckets(with.String(), bucketExpr, &counts); err != nil {
+		return nil, err
+	}
+	buckets := make([]TimeBucket, 0, last-first)
+	for n := first; n < last; n++ {
+		bucket := TimeBucket{Time: time.Unix(n*secs, 0).UTC()}
+		for len(counts) > 0 && counts[0].Bucket <= n {
+			if counts[0].Bucket == n {
+				bucket.Count = counts[0].Count
+			}
+			counts = counts[1:]
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// timeSeries counts the plan's rows per interval by left joining them
+// to a postgresql generate_series of the intervals from bucket first
+// up to (but not including) bucket last.  with is the plan's WITH
+// clause.
+func (plan *QueryPlan) timeSeries(with string, fieldPtr interface{}, secs, first, last int64) ([]TimeBucket, error) {
+	series, counted, bucket := plan.quoteField("series"), plan.quoteField("counted"), plan.quoteField("bucket")
+	bind := func(value interface{}) string {
+		bindVar := plan.dialect.BindVar(plan.argCount())
+		plan.appendArgs(value)
+		return bindVar
+	}
+	buffer := plan.getBuffer()
+	buffer.WriteString(with)
+	buffer.WriteString("select " + series + "." + bucket + " as " + bucket)
+	buffer.WriteString(", count(" + counted + "." + bucket + ") as " + plan.quoteField("count"))
+	buffer.WriteString(" from generate_series(")
+	buffer.WriteString(bind(time.Unix(first*secs, 0).UTC()) + "::timestamptz, ")
+	buffer.WriteString(bind(time.Unix((last-1)*secs, 0).UTC()) + "::timestamptz, ")
+	buffer.WriteString(bind(strconv.FormatInt(secs, 10)+" seconds") + "::interval)")
+	buffer.WriteString(" as " + series + "(" + bucket + ")")
+	column, err := plan.argOrColumn(fieldPtr)
+	if err != nil {
+		bufPool.Put(buffer)
+		return nil, err
+	}
+	epoch := plan.epochExpr(column)
+	buffer.WriteString(" left join (select to_timestamp(floor(" + epoch + " / " + bind(secs) + ") * " + bind(secs) + ") as " + bucket)
+	if err := plan.writeFromWhere(buffer); err != nil {
+		bufPool.Put(buffer)
+		return nil, err
+	}
+	buffer.WriteString(") as " + counted + " on " + counted + "." + bucket + " = " + series + "." + bucket)
+	buffer.WriteString(" group by 1 order by 1")
+	query := buffer.String()
+	plan.putBuffer(buffer)
+	var buckets []TimeBucket
+	if _, err := plan.selectTo(&buckets, query, plan.getArgs()...); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
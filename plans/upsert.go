@@ -0,0 +1,481 @@
+package plans
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// A MergeStrategy decides what value a column is left with when an
+// upserted row conflicts with an existing row.
+type MergeStrategy int
+
+const (
+	// MergeOverwrite replaces the existing value with the new value.
+	// It is the default for columns without a strategy.
+	MergeOverwrite MergeStrategy = iota
+
+	// MergeKeep keeps the existing value.
+	MergeKeep
+
+	// MergeGreatest keeps the greater of the existing and new values.
+	MergeGreatest
+
+	// MergeCoalesce replaces the existing value with the new value,
+	// unless the new value is NULL.
+	MergeCoalesce
+)
+
+// upsertDialect describes how a dialect writes the conflict clause of
+// an upsert.
+type upsertDialect struct {
+	mysql    bool
+	greatest string
+}
+
+// upsertDialect returns the upsertDialect for the plan's dialect.
+func (plan *QueryPlan) upsertDialect() (upsertDialect, error) {
+	switch plan.dialect.(type) {
+	case gorp.PostgresDialect:
+		return upsertDialect{greatest: "greatest"}, nil
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		return upsertDialect{greatest: "max"}, nil
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		return upsertDialect{mysql: true, greatest: "greatest"}, nil
+	}
+	return upsertDialect{}, fmt.Errorf("gorq: Upserts are not supported for dialect %T", plan.dialect)
+}
+
+// insertColumns returns the columns of the plan's table that an
+// insert of a whole row should include: every mapped column, except
+// for auto-increment keys which are not in include.
+func (plan *QueryPlan) insertColumns(include []bulkColumn) []bulkColumn {
+	var cols []bulkColumn
+	structType := plan.target.Type().Elem()
+	for _, col := range plan.table.Columns {
+		if col.Transient || structType.FieldByIndex(col.FieldIndex()).PkgPath != "" {
+			continue
+		}
+		if isAutoIncr(col) && !containsColumn(include, col) {
+			continue
+		}
+		cols = append(cols, bulkColumn{
+			column: col,
+			quoted: plan.quoteField(col.ColumnName),
+			index:  col.FieldIndex(),
+		})
+	}
+	return cols
+}
+
+// containsColumn returns whether or not cols includes col.
+func containsColumn(cols []bulkColumn, col *gorp.ColumnMap) bool {
+	for _, c := range cols {
+		if c.column == col {
+			return true
+		}
+	}
+	return false
+}
+
+// UpsertAll inserts every element of rows (a slice of the plan's
+// reference struct type, or pointers to it) in a single statement.
+// Rows which conflict with an existing row on the columns for
+// conflictFieldPtrs update that row instead, merging each column
+// using its strategy in strategies (keyed by field pointer) or
+// MergeOverwrite if it has none.  Example:
+//
+//     ref := new(Listing)
+//     rows, err := dbMap.Query(ref).(*plans.QueryPlan).UpsertAll(listings,
+//         []interface{}{&ref.PartnerId, &ref.ExternalId},
+//         map[interface{}]plans.MergeStrategy{
+//             &ref.Created:   plans.MergeKeep,
+//             &ref.Updated:   plans.MergeGreatest,
+//             &ref.Thumbnail: plans.MergeCoalesce,
+//         })
+//
+// Postgresql and sqlite use ON CONFLICT, which requires a unique
+// index on exactly the conflict columns (see ConflictWhere and
+// ConflictConstraint for partial indexes and named constraints).
+// MySQL uses ON DUPLICATE KEY UPDATE, which ignores conflictFieldPtrs
+// and checks every unique index, and counts updated rows twice in the
+// returned row count.  As with InsertAll, rows are split across as few
+// statements as the limit on bind arguments allows, and the
+// statements are not executed in a transaction of their own.
+//
+// Conflicting rows are only updated if they match the filters added
+// by the plan's policies for UpdateOperation (e.g. gorq.TenantScope), so
+// upserts can't overwrite rows that the plan couldn't update.  MySQL
+// can't filter ON DUPLICATE KEY UPDATE, so its upserts fail if those
+// policies add any filters.
+func (plan *QueryPlan) UpsertAll(rows interface{}, conflictFieldPtrs []interface{}, strategies map[interface{}]MergeStrategy) (int64, error) {
+	if err := plan.checkWritable(); err != nil {
+		return -1, err
+	}
+	plan.resetArgs()
+	if len(plan.Errors) > 0 {
+		return -1, plan.Errors[0]
+	}
+	dialect, err := plan.upsertDialect()
+	if err != nil {
+		return -1, err
+	}
+	if err := plan.checkConflictTarget(dialect, conflictFieldPtrs); err != nil {
+		return -1, err
+	}
+	conflicts, err := plan.bulkColumns(conflictFieldPtrs)
+	if err != nil {
+		return -1, err
+	}
+	merge := make(map[*gorp.ColumnMap]MergeStrategy, len(strategies))
+	for fieldPtr, strategy := range strategies {
+		m, err := plan.colMap.fieldMapForPointer(fieldPtr)
+		if err != nil {
+			return -1, err
+		}
+		merge[m.column] = strategy
+	}
+	values, err := plan.bulkRows(rows)
+	if err != nil {
+		return -1, err
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	if err := plan.checkPolicies(InsertOperation); err != nil {
+		return -1, err
+	}
+
+	cols := plan.insertColumns(conflicts)
+	if len(cols) == 0 {
+		return -1, errors.New("gorq: Bulk upserts require at least one column that isn't an auto-increment key")
+	}
+	quotedTable := plan.quoteTable(plan.table.SchemaName, plan.table.TableName)
+	var sets []string
+	for _, col := range cols {
+		if containsColumn(conflicts, col.column) {
+			continue
+		}
+		existing, incoming := quotedTable+"."+col.quoted, dialect.incoming(col.quoted)
+		if dialect.mysql {
+			existing = col.quoted
+		}
+		switch merge[col.column] {
+		case MergeOverwrite:
+			sets = append(sets, col.quoted+"="+incoming)
+		case MergeGreatest:
+			sets = append(sets, col.quoted+"="+dialect.greatest+"("+existing+", "+incoming+")")
+		case MergeCoalesce:
+			sets = append(sets, col.quoted+"=coalesce("+incoming+", "+existing+")")
+		}
+	}
+
+	conflictFilters, err := plan.conflictPolicies(dialect, sets)
+	if err != nil {
+		return -1, err
+	}
+
+	// The conflict target's predicate and the update's policy filters
+	// may bind arguments of their own.
+	reserved := 0
+	for _, filter := range plan.conflictWhere {
+		reserved += len(filter.ActualValues())
+	}
+	for _, filter := range conflictFilters {
+		reserved += len(filter.ActualValues())
+	}
+	batchSize := (plan.maxBindArgs() - reserved) / len(cols)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var upserted int64
+	for start := 0; start < len(values); start += batchSize {
+		end := start + batchSize
+		if end > len(values) {
+			end = len(values)
+		}
+		count, err := plan.upsertBatch(values[start:end], cols, dialect, conflicts, sets, conflictFilters)
+		if err != nil {
+			return upserted, err
+		}
+		upserted += count
+	}
+	return upserted, nil
+}
+
+// upsertBatch upserts values using a single multi-row INSERT
+// statement with a conflict clause.
+func (plan *QueryPlan) upsertBatch(values []reflect.Value, cols []bulkColumn, dialect upsertDialect, conflicts []bulkColumn, sets []string, conflictFilters []filters.Filter) (int64, error) {
+	plan.resetArgs()
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufPool.Put(buffer)
+	if err := plan.writeInsertRows(buffer, values, cols); err != nil {
+		return -1, err
+	}
+	if err := plan.writeConflict(buffer, dialect, conflicts, sets, conflictFilters); err != nil {
+		return -1, err
+	}
+	return plan.execChange(InsertOperation, buffer.String())
+}
+
+// conflictPolicies runs the plan's policies for the update (using
+// sets) that an upsert makes to an existing row when it conflicts
+// with it, and returns the filters they add.  Only rows matching
+// those filters are updated, so that policies which scope updates
+// (such as tenant scopes) also scope upserts.  MySQL's ON DUPLICATE
+// KEY UPDATE can't be filtered, so upserts are rejected there if any
+// filters are added.
+func (plan *QueryPlan) conflictPolicies(dialect upsertDialect, sets []string) ([]filters.Filter, error) {
+	if len(sets) == 0 {
+		return nil, nil
+	}
+	if err := plan.checkPolicies(UpdateOperation); err != nil {
+		return nil, err
+	}
+	conflictFilters := plan.policyFilters
+	for _, extra := range plan.policyJoins {
+		conflictFilters = append(conflictFilters, extra...)
+	}
+	if len(conflictFilters) > 0 && dialect.mysql {
+		return nil, fmt.Errorf("gorq: Upserts cannot be filtered by update policies for dialect %T", plan.dialect)
+	}
+	return conflictFilters, nil
+}
+
+// incoming returns the expression for the value of a column in the
+// row that an upsert tried to insert.
+func (dialect upsertDialect) incoming(quotedCol string) string {
+	if dialect.mysql {
+		return "values(" + quotedCol + ")"
+	}
+	return "excluded." + quotedCol
+}
+
+// ConflictWhere adds filters to the conflict target of the plan's
+// upserts (see Upsert and UpsertAll), which are combined using AND.
+// A conflict target with a predicate matches partial unique indexes
+// whose predicates it implies, e.g. for a unique index on
+// users (email) where deleted_at is null:
+//
+//     q := dbMap.Query(ref).(*plans.QueryPlan).ConflictWhere(filters.Null(&ref.DeletedAt))
+//     _, err := q.Assign(&ref.Email, email).
+//         Assign(&ref.Name, name).
+//         Upsert([]interface{}{&ref.Email})
+//
+// Only postgresql and sqlite support predicates on conflict targets.
+func (plan *QueryPlan) ConflictWhere(filters ...filters.Filter) *QueryPlan {
+	plan.conflictWhere = append(plan.conflictWhere, filters...)
+	return plan
+}
+
+// ConflictConstraint sets the conflict target of the plan's upserts
+// (see Upsert and UpsertAll) to the named unique or exclusion
+// constraint, in place of conflict fields, which should be nil.  Only
+// postgresql supports conflict targets by name.
+func (plan *QueryPlan) ConflictConstraint(name string) *QueryPlan {
+	plan.conflictConstraint = name
+	return plan
+}
+
+// checkConflictTarget returns an error if the plan's upserts don't
+// have exactly one kind of conflict target, or use one that dialect
+// doesn't support.
+func (plan *QueryPlan) checkConflictTarget(dialect upsertDialect, conflictFieldPtrs []interface{}) error {
+	if plan.conflictConstraint != "" {
+		if len(conflictFieldPtrs) > 0 || len(plan.conflictWhere) > 0 {
+			return errors.New("gorq: Upserts cannot use both a constraint name and conflict fields")
+		}
+		if _, ok := plan.dialect.(gorp.PostgresDialect); !ok {
+			return fmt.Errorf("gorq: Upserts by constraint name are not supported for dialect %T", plan.dialect)
+		}
+		return nil
+	}
+	if len(conflictFieldPtrs) == 0 {
+		return errors.New("gorq: Upserts require at least one conflict field")
+	}
+	if dialect.mysql && len(plan.conflictWhere) > 0 {
+		return fmt.Errorf("gorq: Conflict predicates are not supported for dialect %T", plan.dialect)
+	}
+	return nil
+}
+
+// writeConflict writes the conflict clause of an upsert, which
+// updates the existing row using sets (or leaves it alone if there
+// are none) when it conflicts on the conflicts columns (or the plan's
+// conflict constraint and predicate) and matches conflictFilters.
+func (plan *QueryPlan) writeConflict(buffer *bytes.Buffer, dialect upsertDialect, conflicts []bulkColumn, sets []string, conflictFilters []filters.Filter) error {
+	if dialect.mysql {
+		if len(sets) == 0 {
+			// MySQL has no DO NOTHING, so assign a key column to
+			// itself instead.
+			sets = append(sets, conflicts[0].quoted+"="+conflicts[0].quoted)
+		}
+		buffer.WriteString(" on duplicate key update ")
+	} else {
+		if err := plan.writeConflictTarget(buffer, conflicts); err != nil {
+			return err
+		}
+		if len(sets) == 0 {
+			buffer.WriteString(" do nothing")
+		} else {
+			buffer.WriteString(" do update set ")
+		}
+	}
+	for i, set := range sets {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(set)
+	}
+	if len(sets) == 0 || len(conflictFilters) == 0 {
+		return nil
+	}
+	filter := filters.And(conflictFilters...)
+	vals, err := plan.filterValues(filter)
+	if err != nil {
+		return err
+	}
+	if where := filter.Where(vals...); where != "" {
+		buffer.WriteString(" where ")
+		buffer.WriteString(where)
+	}
+	return nil
+}
+
+// writeConflictTarget writes the ON CONFLICT clause of an upsert,
+// without its action.
+func (plan *QueryPlan) writeConflictTarget(buffer *bytes.Buffer, conflicts []bulkColumn) error {
+	if plan.conflictConstraint != "" {
+		buffer.WriteString(" on conflict on constraint ")
+		buffer.WriteString(plan.quoteField(plan.conflictConstraint))
+		return nil
+	}
+	buffer.WriteString(" on conflict (")
+	for i, col := range conflicts {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(col.quoted)
+	}
+	buffer.WriteString(")")
+	if len(plan.conflictWhere) == 0 {
+		return nil
+	}
+	filter := filters.And(plan.conflictWhere...)
+	vals, err := plan.filterValues(filter)
+	if err != nil {
+		return err
+	}
+	if where := filter.Where(vals...); where != "" {
+		buffer.WriteString(" where ")
+		buffer.WriteString(where)
+	}
+	return nil
+}
+
+// Upsert runs this query plan as an INSERT statement which, if the
+// inserted row conflicts with an existing row on the columns for
+// conflictFieldPtrs, updates that row's columns for updateFieldPtrs
+// to their assigned values instead.  If no update fields are passed,
+// every assigned column except for the conflict columns is updated.
+// Example:
+//
+//     rows, err := dbMap.Query(ref).
+//         Assign(&ref.Email, email).
+//         Assign(&ref.Name, name).
+//         Assign(&ref.Updated, now).
+//         Upsert([]interface{}{&ref.Email}, &ref.Updated)
+//
+// It returns the number of rows affected, which MySQL reports as 2
+// for updated rows.  Conflicts are handled the same way as UpsertAll:
+// postgresql and sqlite use ON CONFLICT, which requires a unique
+// index on exactly the conflict columns, and MySQL uses ON DUPLICATE
+// KEY UPDATE, which checks every unique index.  As with UpsertAll,
+// conflicting rows are only updated if they match the filters added
+// by the plan's update policies.
+func (plan *QueryPlan) Upsert(conflictFieldPtrs []interface{}, updateFieldPtrs ...interface{}) (int64, error) {
+	if err := plan.checkWritable(); err != nil {
+		return -1, err
+	}
+	plan.resetArgs()
+	if len(plan.Errors) > 0 {
+		return -1, plan.Errors[0]
+	}
+	if len(plan.assignCols) == 0 {
+		return -1, errors.New("gorq: Upserts require at least one assigned value")
+	}
+	if err := plan.checkAssignExprs(); err != nil {
+		return -1, err
+	}
+	dialect, err := plan.upsertDialect()
+	if err != nil {
+		return -1, err
+	}
+	if err := plan.checkConflictTarget(dialect, conflictFieldPtrs); err != nil {
+		return -1, err
+	}
+	conflicts, err := plan.bulkColumns(conflictFieldPtrs)
+	if err != nil {
+		return -1, err
+	}
+	var updates []bulkColumn
+	if len(updateFieldPtrs) > 0 {
+		if updates, err = plan.bulkColumns(updateFieldPtrs); err != nil {
+			return -1, err
+		}
+		for _, col := range updates {
+			if !plan.isAssigned(col.column) {
+				return -1, fmt.Errorf("gorq: Upserts can only update assigned columns, and %s is not assigned", col.column.ColumnName)
+			}
+		}
+	} else {
+		for i, col := range plan.assignColMaps {
+			if !containsColumn(conflicts, col) {
+				updates = append(updates, bulkColumn{column: col, quoted: plan.assignCols[i]})
+			}
+		}
+	}
+	if err := plan.checkPolicies(InsertOperation); err != nil {
+		return -1, err
+	}
+
+	buffer := bufPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufPool.Put(buffer)
+	buffer.WriteString("insert into ")
+	buffer.WriteString(plan.quoteTable(plan.table.SchemaName, plan.table.TableName))
+	buffer.WriteString(" (")
+	buffer.WriteString(strings.Join(plan.assignCols, ", "))
+	buffer.WriteString(") values (")
+	buffer.WriteString(strings.Join(plan.assignBindVars, ", "))
+	buffer.WriteString(")")
+	sets := make([]string, 0, len(updates))
+	for _, col := range updates {
+		sets = append(sets, col.quoted+"="+dialect.incoming(col.quoted))
+	}
+	conflictFilters, err := plan.conflictPolicies(dialect, sets)
+	if err != nil {
+		return -1, err
+	}
+	if err := plan.writeConflict(buffer, dialect, conflicts, sets, conflictFilters); err != nil {
+		return -1, err
+	}
+	return plan.execChange(InsertOperation, buffer.String())
+}
+
+// isAssigned returns whether or not the plan assigns a value to col.
+func (plan *QueryPlan) isAssigned(col *gorp.ColumnMap) bool {
+	for _, assigned := range plan.assignColMaps {
+		if assigned == col {
+			return true
+		}
+	}
+	return false
+}
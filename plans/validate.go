@@ -0,0 +1,159 @@
+package plans
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// Validate checks the plan for common mistakes that would otherwise
+// only be reported by the database (usually with a much less helpful
+// message), and returns a description of each one that it finds.  It
+// does not execute anything.  Errors encountered while building the
+// plan are not included; see the Errors field for those.
+//
+// Validate currently checks for:
+//
+//   - Selecting aggregate and non-aggregate values without a group by
+//     clause.
+//   - Selecting columns which are not in the group by clause of a
+//     grouped query.
+//   - Ordering a grouped query by a column which is not in the group
+//     by clause.
+//   - Joining a table which nothing in the query refers to.
+func (plan *QueryPlan) Validate() []string {
+	var warnings []string
+
+	grouped := make(map[string]bool, len(plan.groupBy))
+	for _, column := range plan.groupBy {
+		grouped[column] = true
+	}
+	var aggregates, plain []string
+	for _, m := range plan.colMap {
+		if !m.doSelect {
+			continue
+		}
+		column := m.quotedTable + "." + m.quotedColumn
+		if _, ok := m.selectTarget.(filters.Aggregate); ok {
+			aggregates = append(aggregates, column)
+			continue
+		}
+		if m.selectTarget != m.field {
+			// Non-aggregate wrappers may or may not be valid in a
+			// grouped query, depending on what they wrap.
+			continue
+		}
+		plain = append(plain, column)
+	}
+	if len(grouped) == 0 {
+		if len(aggregates) > 0 && len(plain) > 0 {
+			warnings = append(warnings, fmt.Sprintf("aggregate values (%s) are selected along with non-aggregate columns (%s) without a group by clause",
+				aggregates[0], plain[0]))
+		}
+	} else {
+		for _, column := range plain {
+			if !grouped[column] {
+				warnings = append(warnings, fmt.Sprintf("column %s is selected but not in the group by clause", column))
+			}
+		}
+		for _, o := range plan.orderBy {
+			for _, column := range plan.referencedColumns(o.fieldOrWrapper) {
+				if !grouped[column] {
+					warnings = append(warnings, fmt.Sprintf("column %s is used in the order by clause but not in the group by clause", column))
+				}
+			}
+		}
+	}
+
+	joins := plan.joins
+	where := plan.whereBranches()
+	if join, ok := plan.filters.(*filters.JoinFilter); ok {
+		joins = append(joins[:len(joins):len(joins)], join)
+	}
+	for i, join := range joins {
+		table := join.QuotedAlias
+		if table == "" {
+			table = join.QuotedJoinTable
+		}
+		if !plan.tableReferenced(table, joins, i, where) {
+			warnings = append(warnings, fmt.Sprintf("table %s is joined, but none of its columns are selected or used outside of its join clause", table))
+		}
+	}
+	return warnings
+}
+
+// tableReferenced returns whether or not any selected column or
+// value, where or having clause value, distinct or order by value,
+// group by column, or join clause (other than the join at joinIdx)
+// refers to the table quotedTable.
+func (plan *QueryPlan) tableReferenced(quotedTable string, joins []*filters.JoinFilter, joinIdx int, where filters.Filter) bool {
+	var values []interface{}
+	for _, m := range plan.colMap {
+		if !m.doSelect {
+			continue
+		}
+		if m.quotedTable == quotedTable {
+			return true
+		}
+		if m.selectTarget != m.field {
+			values = append(values, m.selectTarget)
+		}
+	}
+	if where != nil {
+		values = append(values, where.ActualValues()...)
+	}
+	for _, filter := range plan.having {
+		values = append(values, filter.ActualValues()...)
+	}
+	values = append(values, plan.distinctFields...)
+	for i, join := range joins {
+		if i != joinIdx {
+			values = append(values, join.ActualValues()...)
+		}
+	}
+	for _, o := range plan.orderBy {
+		values = append(values, o.fieldOrWrapper)
+	}
+	for _, column := range plan.referencedColumns(values...) {
+		if columnInTable(column, quotedTable) {
+			return true
+		}
+	}
+	for _, column := range plan.groupBy {
+		if columnInTable(column, quotedTable) {
+			return true
+		}
+	}
+	return false
+}
+
+// columnInTable returns whether or not column (a table-qualified,
+// quoted column name) belongs to quotedTable.
+func columnInTable(column, quotedTable string) bool {
+	return strings.HasPrefix(column, quotedTable+".")
+}
+
+// referencedColumns returns the table-qualified, quoted column names
+// of any field pointers in values, including those wrapped by
+// filters.SqlWrapper and filters.MultiSqlWrapper values.
+func (plan *QueryPlan) referencedColumns(values ...interface{}) []string {
+	var columns []string
+	for _, value := range values {
+		switch src := value.(type) {
+		case filters.SqlWrapper:
+			columns = append(columns, plan.referencedColumns(src.ActualValue())...)
+		case filters.MultiSqlWrapper:
+			columns = append(columns, plan.referencedColumns(src.ActualValues()...)...)
+		default:
+			if value == nil || reflect.TypeOf(value).Kind() != reflect.Ptr {
+				continue
+			}
+			if column, err := plan.colMap.LocateTableAndColumn(value); err == nil {
+				columns = append(columns, column)
+			}
+		}
+	}
+	return columns
+}
@@ -0,0 +1,32 @@
+package plans
+
+import (
+	"reflect"
+
+	"github.com/outdoorsy/gorp"
+)
+
+// tableFor returns the table that t is mapped to, falling back to the
+// plan's views (see Options.Views) if t isn't mapped to a table.
+func (plan *QueryPlan) tableFor(t reflect.Type) (*gorp.TableMap, error) {
+	table, err := plan.dbMap.TableFor(t, false)
+	if err != nil && plan.views != nil {
+		if view, viewErr := plan.views.TableFor(t, false); viewErr == nil {
+			return view, nil
+		}
+	}
+	return table, err
+}
+
+// targetsView returns whether or not the plan's target is mapped to
+// a view rather than a table.  Views have no physical row identifiers
+// (like ctid or rowid), and their INSTEAD OF triggers don't
+// necessarily return the rows that they change, so plans targeting
+// them avoid both.
+func (plan *QueryPlan) targetsView() bool {
+	if plan.views == nil || !plan.target.IsValid() {
+		return false
+	}
+	_, err := plan.dbMap.TableFor(plan.target.Type().Elem(), false)
+	return err != nil
+}
@@ -0,0 +1,125 @@
+package plans
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// warnInItems is the number of values that an IN list may have before
+// Warnings reports it.  Lists that long are slow to parse and plan,
+// and are usually better written as a join or a sub-select.
+const warnInItems = 1000
+
+// A WarningFunc is called with each statement that a plan executes
+// while it has warnings (see QueryPlan.Warnings), so that they can be
+// collected in one place, e.g. logged or counted in metrics.
+type WarningFunc func(query string, warnings []string)
+
+// Warnings checks the plan for issues that are likely to make its
+// statements slow, and returns a description of each one that it
+// finds.  It does not execute anything.  Unlike the mistakes reported
+// by Validate, these issues don't make a statement invalid, so they
+// usually go unnoticed until the statement shows up as a slow query.
+//
+// Warnings currently checks for:
+//
+//   - Joining a table without a join condition (an implicit cross
+//     join).
+//   - Joining a table on a condition which doesn't refer to any other
+//     table, which matches every joined row with every other row.
+//   - LIKE patterns with a leading wildcard, which can't use an index.
+//   - IN lists with more than 1000 values.
+func (plan *QueryPlan) Warnings() []string {
+	var warnings []string
+
+	joins := plan.joins
+	if join, ok := plan.filters.(*filters.JoinFilter); ok {
+		joins = append(joins[:len(joins):len(joins)], join)
+	}
+	for _, join := range joins {
+		table := join.QuotedAlias
+		if table == "" || table == "-" {
+			table = join.QuotedJoinTable
+		}
+		if isEmpty(join) {
+			warnings = append(warnings, fmt.Sprintf("table %s is joined without a join condition, which is an implicit cross join", table))
+			continue
+		}
+		if !plan.joinsOtherTable(join, table) {
+			warnings = append(warnings, fmt.Sprintf("the join condition for table %s does not refer to any other table, so every joined row is matched with every other row", table))
+		}
+		warnings = plan.filterWarnings(warnings, join)
+	}
+	if where := plan.whereFilter(); where != nil {
+		warnings = plan.filterWarnings(warnings, where)
+	}
+	return warnings
+}
+
+// joinsOtherTable returns whether or not the condition of join refers
+// to a column of a table other than quotedTable (the joined table).
+func (plan *QueryPlan) joinsOtherTable(join *filters.JoinFilter, quotedTable string) bool {
+	for _, column := range plan.referencedColumns(join.ActualValues()...) {
+		if !columnInTable(column, quotedTable) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterWarnings appends warnings about filter and its sub-filters to
+// warnings.
+func (plan *QueryPlan) filterWarnings(warnings []string, filter filters.Filter) []string {
+	switch src := filter.(type) {
+	case subFilterer:
+		for _, sub := range src.SubFilters() {
+			warnings = plan.filterWarnings(warnings, sub)
+		}
+	case *filters.InFilter, *filters.NotInFilter:
+		// The first value is the expression being compared.
+		values := filter.ActualValues()
+		if len(values)-1 > warnInItems {
+			warnings = append(warnings, fmt.Sprintf("an IN list for %s has %d values", plan.describe(values[0]), len(values)-1))
+		}
+	case *filters.ComparisonFilter:
+		if !strings.Contains(strings.ToLower(src.Comparison), "like") {
+			break
+		}
+		if pattern, ok := src.Right.(string); ok && strings.HasPrefix(pattern, "%") {
+			// Patterns compared with sensitive columns are
+			// redacted, since warnings are usually logged.
+			quoted := fmt.Sprintf("%q", pattern)
+			if plan.refersToSensitive(src.Left) {
+				quoted = Redacted
+			}
+			warnings = append(warnings, fmt.Sprintf("the LIKE pattern %s for %s starts with a wildcard, so it cannot use an index", quoted, plan.describe(src.Left)))
+		}
+	}
+	return warnings
+}
+
+// describe returns the column that value refers to, for use in
+// warnings, or a generic description if it isn't a field pointer.
+func (plan *QueryPlan) describe(value interface{}) string {
+	if columns := plan.referencedColumns(value); len(columns) > 0 {
+		return columns[0]
+	}
+	return "an expression"
+}
+
+// reportWarnings passes the plan's warnings, if it has any, to its
+// warning hooks (see Options.WarningHooks) along with query.
+func (plan *QueryPlan) reportWarnings(query string) {
+	if len(plan.warningHooks) == 0 {
+		return
+	}
+	warnings := plan.Warnings()
+	if len(warnings) == 0 {
+		return
+	}
+	for _, hook := range plan.warningHooks {
+		hook(query, warnings)
+	}
+}
@@ -0,0 +1,161 @@
+package plans
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// maxCachedWheres is the maximum number of where clauses that will be
+// cached.  Once the cache is full, where clauses for new shapes are
+// generated without being cached.
+const maxCachedWheres = 4096
+
+var (
+	filtersPkg = reflect.TypeOf(filters.AndFilter{}).PkgPath()
+
+	// whereCache maps the shapes of where filters (see whereShape) to
+	// their generated SQL.
+	whereCache = struct {
+		sync.RWMutex
+		entries map[string]string
+	}{entries: make(map[string]string)}
+)
+
+// writeShape writes a key describing the structure of filter to buf.
+// It returns false if the filter (or any of its sub-filters) can't
+// be described, in which case its SQL should not be cached.
+func writeShape(buf *bytes.Buffer, filter filters.Filter) bool {
+	shaper, ok := filter.(filters.Shaper)
+	if !ok {
+		return false
+	}
+	t := reflect.TypeOf(filter)
+	if t.Kind() != reflect.Ptr || t.Elem().PkgPath() != filtersPkg {
+		// Types outside of the filters package may embed a filter
+		// type (and its Shape method) while changing its SQL.
+		return false
+	}
+	buf.WriteString(t.Elem().Name())
+	buf.WriteString(":")
+	buf.WriteString(shaper.Shape())
+	if combined, ok := filter.(subFilterer); ok {
+		buf.WriteString("(")
+		for _, sub := range combined.SubFilters() {
+			if !writeShape(buf, sub) {
+				return false
+			}
+			buf.WriteString(",")
+		}
+		buf.WriteString(")")
+	}
+	return true
+}
+
+// shapeValue writes the part of a where clause's cache key that
+// describes value to buf.  Fields are described by their columns,
+// and plain values by a bind variable, since their SQL doesn't depend
+// on the value.  It returns whether value is bound as an argument,
+// and false for ok if its SQL can't be cached (e.g. sub-queries and
+// wrappers).
+func (plan *QueryPlan) shapeValue(buf *bytes.Buffer, value interface{}) (bind, ok bool) {
+	switch value.(type) {
+	case nil, filters.SqlWrapper, filters.MultiSqlWrapper, LiteralWrapper, RowWrapper,
+		computedColumn, filters.Param, subQuery:
+		return false, false
+	}
+	if reflect.TypeOf(value).Kind() == reflect.Ptr {
+		m, err := plan.colMap.fieldMapForPointer(value)
+		if err == nil {
+			if m.selectTarget != m.field {
+				return false, false
+			}
+			buf.WriteString(m.quotedTable)
+			buf.WriteString(".")
+			buf.WriteString(m.quotedColumn)
+			return false, true
+		}
+		if _, isValuer := value.(driver.Valuer); !isValuer {
+			return false, false
+		}
+	}
+	buf.WriteString("?")
+	return true, true
+}
+
+// cachedWhere returns the SQL for filter, binding its arguments to
+// the plan.  Filters with the same structure (see writeShape) and
+// the same fields share their generated SQL, so that only their
+// values are converted and bound for each query after the first.
+func (plan *QueryPlan) cachedWhere(filter filters.Filter) (string, error) {
+	if err := plan.checkOperators(filter); err != nil {
+		return "", err
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	if !writeShape(buf, filter) {
+		return plan.generateWhere(filter)
+	}
+	buf.WriteString(reflect.TypeOf(plan.dialect).String())
+	buf.WriteString(":")
+	buf.WriteString(strconv.Itoa(plan.argCount()))
+	args := filter.ActualValues()
+	bound := make([]int, 0, len(args))
+	for i, arg := range args {
+		buf.WriteByte(0)
+		bind, ok := plan.shapeValue(buf, arg)
+		if !ok {
+			return plan.generateWhere(filter)
+		}
+		if bind {
+			bound = append(bound, i)
+		}
+	}
+
+	whereCache.RLock()
+	where, ok := whereCache.entries[buf.String()]
+	whereCache.RUnlock()
+	if !ok {
+		key := buf.String()
+		where, err := plan.generateWhere(filter)
+		if err != nil {
+			return "", err
+		}
+		whereCache.Lock()
+		if len(whereCache.entries) < maxCachedWheres {
+			whereCache.entries[key] = where
+		}
+		whereCache.Unlock()
+		return where, nil
+	}
+
+	var sensitive []bool
+	if len(plan.sensitiveCols) > 0 {
+		sensitive = plan.sensitiveValues(filter)
+	}
+	for _, i := range bound {
+		value, err := plan.toDb(args[i])
+		if err != nil {
+			return "", err
+		}
+		if i < len(sensitive) && sensitive[i] {
+			plan.markSensitive(plan.argCount(), plan.argCount()+1)
+		}
+		plan.appendArgs(value)
+	}
+	return where, nil
+}
+
+// generateWhere returns the SQL for filter without using the cache.
+func (plan *QueryPlan) generateWhere(filter filters.Filter) (string, error) {
+	vals, err := plan.filterValues(filter)
+	if err != nil {
+		return "", err
+	}
+	return filter.Where(vals...), nil
+}
@@ -0,0 +1,153 @@
+package plans
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
+)
+
+// A DialectWrapper is a filters.MultiSqlWrapper whose SQL differs
+// between dialects, e.g. string aggregation, which is string_agg() in
+// postgresql and group_concat() in mysql and sqlite.  Plans will call
+// WrapSqlFor with their dialect in place of WrapSql.
+type DialectWrapper interface {
+	filters.MultiSqlWrapper
+	WrapSqlFor(dialect gorp.Dialect, sqlValues ...string) string
+}
+
+// wrapMulti wraps sqlValues using wrapper, taking dialect into
+// account if wrapper is a DialectWrapper.
+func wrapMulti(dialect gorp.Dialect, wrapper filters.MultiSqlWrapper, sqlValues []string) string {
+	if dialectWrapper, ok := wrapper.(DialectWrapper); ok {
+		return dialectWrapper.WrapSqlFor(dialect, sqlValues...)
+	}
+	return wrapper.WrapSql(sqlValues...)
+}
+
+// A LiteralWrapper is a wrapper that inlines some values into its SQL
+// as literals, e.g. the fraction of a percentile.  Plans with
+// Options.NoInlining set bind those values instead: BoundValues
+// returns the wrapper's actual values along with its literals, in the
+// order that they appear in its SQL, and the plan passes the SQL for
+// each of them to WrapSqlBound.  BoundValues should return nil for
+// dialects which require the literals to be inlined.
+type LiteralWrapper interface {
+	BoundValues(dialect gorp.Dialect) []interface{}
+	WrapSqlBound(dialect gorp.Dialect, sqlValues ...string) string
+}
+
+// boundValues returns the values that the plan should bind for
+// wrapper in place of its inlined literals, or nil if its literals
+// should be inlined as usual.
+func (plan *QueryPlan) boundValues(wrapper interface{}) (LiteralWrapper, []interface{}) {
+	if !plan.noInlining {
+		return nil, nil
+	}
+	literals, ok := wrapper.(LiteralWrapper)
+	if !ok {
+		return nil, nil
+	}
+	return literals, literals.BoundValues(plan.dialect)
+}
+
+// wrapBound returns the SQL for wrapper with values (see boundValues)
+// bound rather than inlined.
+func (plan *QueryPlan) wrapBound(wrapper LiteralWrapper, values []interface{}) (string, error) {
+	sqlValues, err := plan.sqlValues(values, nil)
+	if err != nil {
+		return "", err
+	}
+	return wrapper.WrapSqlBound(plan.dialect, sqlValues...), nil
+}
+
+// A ScanWrapper is a wrapper whose selected value has to be converted
+// before it can be stored in the field that it is selected into (see
+// SelectAs), e.g. an aggregated array which is read as JSON.  Scanner
+// is passed a pointer to that field, and returns the holder to scan
+// the value into along with the binder which converts it.
+type ScanWrapper interface {
+	Scanner(fieldPtr interface{}) gorp.CustomScanner
+}
+
+// scansRows returns whether or not the plan has to scan its own
+// results rather than leaving it to gorp, which can neither scan into
+// transient fields (see SelectAs), convert values selected using a
+// ScanWrapper, nor match columns whose aliases were renamed to avoid
+// a collision (see uniqueAlias) to their fields.
+func (plan *QueryPlan) scansRows() bool {
+	aliases := make(map[string]bool, len(plan.colMap))
+	for _, m := range plan.colMap {
+		if !m.doSelect {
+			continue
+		}
+		if _, ok := m.selectTarget.(ScanWrapper); ok || m.column.Transient {
+			return true
+		}
+		if m.alias != "" && uniqueAlias(aliases, m) != m.alias {
+			return true
+		}
+	}
+	return false
+}
+
+// selectScanned executes the plan's select statement using scanRows,
+// returning the results the same way gorp would.
+func (plan *QueryPlan) selectScanned() ([]interface{}, error) {
+	var results []interface{}
+	err := plan.scanRows(func(result reflect.Value) error {
+		results = append(results, result.Interface())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// A RowWrapper wraps every mapped column of a reference struct (e.g.
+// that of a joined table), rather than a single value.  Plans pass
+// WrapRow the JSON key for each column's field, along with the SQL
+// for each column and for one of the table's primary key columns (or
+// an empty string, if it has none), so that rows from the missing
+// side of an outer join can be told apart.
+type RowWrapper interface {
+	ActualRow() interface{}
+	WrapRow(dialect gorp.Dialect, key string, names, sqlValues []string) string
+}
+
+// jsonKey returns the key that encoding/json would use for field.
+func jsonKey(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return field.Name
+}
+
+// wrapRow converts wrapper to SQL using the mapped columns of its
+// reference struct.
+func (plan *QueryPlan) wrapRow(wrapper RowWrapper) (string, error) {
+	row := wrapper.ActualRow()
+	var (
+		key             string
+		names, sqlNames []string
+	)
+	for _, m := range plan.colMap {
+		if m.parent != row || m.column.Transient || m.merged {
+			continue
+		}
+		column := m.quotedTable + "." + m.quotedColumn
+		if key == "" && isPrimaryKey(m.column) {
+			key = column
+		}
+		field := reflect.TypeOf(row).Elem().FieldByIndex(m.column.FieldIndex())
+		names = append(names, jsonKey(field))
+		sqlNames = append(sqlNames, column)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("gorq: No columns are mapped for a reference struct of type %T", row)
+	}
+	return wrapper.WrapRow(plan.dialect, key, names, sqlNames), nil
+}
@@ -2,9 +2,16 @@ package gorq
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
 	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/plans"
 )
 
 type functionWrapper struct {
@@ -115,3 +122,721 @@ func When(comparison filters.Filter) Thener {
 		whenValues: []whenValue{{when: comparison}},
 	}
 }
+
+type operatorWrapper struct {
+	left, right interface{}
+	operator    string
+}
+
+func (wrapper operatorWrapper) ActualValues() []interface{} {
+	return []interface{}{wrapper.left, wrapper.right}
+}
+
+func (wrapper operatorWrapper) WrapSql(values ...string) string {
+	return fmt.Sprintf("(%s %s %s)", values[0], wrapper.operator, values[1])
+}
+
+// Plus returns a filters.MultiSqlWrapper for left + right.  Either
+// value may be a field pointer, a literal, or another wrapper, so it
+// can be used on the right hand side of a join or where clause
+// comparison.  Example:
+//
+//     results, err := dbMap.Query(ref).
+//         Join(parentRef).
+//         On().
+//         Equal(&parentRef.Id, &ref.ParentId).
+//         Greater(&ref.Total, Plus(&parentRef.Total, 10)).
+//         Select()
+func Plus(left, right interface{}) filters.MultiSqlWrapper {
+	return operatorWrapper{left: left, right: right, operator: "+"}
+}
+
+// Minus returns a filters.MultiSqlWrapper for left - right.  See
+// Plus.
+func Minus(left, right interface{}) filters.MultiSqlWrapper {
+	return operatorWrapper{left: left, right: right, operator: "-"}
+}
+
+// aggregateWrapper is a functionWrapper for an aggregate function.
+type aggregateWrapper struct {
+	functionWrapper
+}
+
+func (wrapper aggregateWrapper) Aggregate() {}
+
+// orderedSetWrapper wraps a value in an ordered-set aggregate, e.g.
+// percentile_cont(0.5) WITHIN GROUP (ORDER BY value).  fraction is
+// nil for aggregates without one (i.e. mode()).
+type orderedSetWrapper struct {
+	actualValue interface{}
+	function    string
+	fraction    *float64
+}
+
+func (wrapper orderedSetWrapper) ActualValue() interface{} {
+	return wrapper.actualValue
+}
+
+func (wrapper orderedSetWrapper) WrapSql(sqlValue string) string {
+	var fraction string
+	if wrapper.fraction != nil {
+		fraction = strconv.FormatFloat(*wrapper.fraction, 'g', -1, 64)
+	}
+	return fmt.Sprintf("%s(%s) WITHIN GROUP (ORDER BY %s)", wrapper.function, fraction, sqlValue)
+}
+
+// BoundValues implements plans.LiteralWrapper.
+func (wrapper orderedSetWrapper) BoundValues(gorp.Dialect) []interface{} {
+	if wrapper.fraction == nil {
+		return nil
+	}
+	return []interface{}{*wrapper.fraction, wrapper.actualValue}
+}
+
+// WrapSqlBound implements plans.LiteralWrapper.  The fraction is cast
+// because percentile functions are overloaded to accept arrays of
+// fractions.
+func (wrapper orderedSetWrapper) WrapSqlBound(dialect gorp.Dialect, values ...string) string {
+	return fmt.Sprintf("%s(CAST(%s AS double precision)) WITHIN GROUP (ORDER BY %s)", wrapper.function, values[0], values[1])
+}
+
+func (wrapper orderedSetWrapper) Aggregate() {}
+
+// PercentileCont returns a filters.SqlWrapper for the continuous
+// percentile (interpolating between values if necessary) of value at
+// fraction, which must be between 0 and 1.  It is an aggregate, so it
+// is usually selected using SelectAs alongside GroupBy, or compared
+// in a having clause.  Example:
+//
+//     q := dbMap.Query(ref)
+//     q.Fields(&ref.Category)
+//     q.SelectAs(&ref.P95, gorq.PercentileCont(0.95, &ref.Price))
+//     q.GroupBy(&ref.Category)
+//
+// Ordered-set aggregates (percentiles and Mode) are only supported by
+// postgresql.
+func PercentileCont(fraction float64, value interface{}) filters.SqlWrapper {
+	return orderedSetWrapper{actualValue: value, function: "percentile_cont", fraction: &fraction}
+}
+
+// PercentileDisc returns a filters.SqlWrapper for the discrete
+// percentile (the first value whose position is at or above fraction)
+// of value.  See PercentileCont.
+func PercentileDisc(fraction float64, value interface{}) filters.SqlWrapper {
+	return orderedSetWrapper{actualValue: value, function: "percentile_disc", fraction: &fraction}
+}
+
+// Median returns a filters.SqlWrapper for the median of value, i.e.
+// PercentileCont(0.5, value).
+func Median(value interface{}) filters.SqlWrapper {
+	return PercentileCont(0.5, value)
+}
+
+// Mode returns a filters.SqlWrapper for the most frequent value of
+// value.  See PercentileCont.
+func Mode(value interface{}) filters.SqlWrapper {
+	return orderedSetWrapper{actualValue: value, function: "mode"}
+}
+
+// Stddev returns a filters.SqlWrapper for the sample standard
+// deviation of value.  It is an aggregate; see PercentileCont.
+func Stddev(value interface{}) filters.SqlWrapper {
+	return aggregateWrapper{functionWrapper{actualValue: value, functionName: "stddev_samp"}}
+}
+
+// Variance returns a filters.SqlWrapper for the sample variance of
+// value.  It is an aggregate; see PercentileCont.
+func Variance(value interface{}) filters.SqlWrapper {
+	return aggregateWrapper{functionWrapper{actualValue: value, functionName: "var_samp"}}
+}
+
+// stringAggWrapper concatenates the values of a column across a group
+// of rows.
+type stringAggWrapper struct {
+	value     interface{}
+	separator string
+	orderBy   []interface{}
+}
+
+func (wrapper stringAggWrapper) ActualValues() []interface{} {
+	return append([]interface{}{wrapper.value}, wrapper.orderBy...)
+}
+
+func (wrapper stringAggWrapper) WrapSql(values ...string) string {
+	return wrapper.WrapSqlFor(gorp.PostgresDialect{}, values...)
+}
+
+// WrapSqlFor implements plans.DialectWrapper.
+func (wrapper stringAggWrapper) WrapSqlFor(dialect gorp.Dialect, values ...string) string {
+	switch dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		separator := strings.Replace(wrapper.separator, `\`, `\\`, -1)
+		return wrapper.wrap(dialect, values[0], quoteString(separator), values[1:])
+	}
+	return wrapper.wrap(dialect, values[0], quoteString(wrapper.separator), values[1:])
+}
+
+// BoundValues implements plans.LiteralWrapper.  The separator can't
+// be bound in mysql, whose SEPARATOR clause only accepts literals.
+func (wrapper stringAggWrapper) BoundValues(dialect gorp.Dialect) []interface{} {
+	switch dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		return nil
+	}
+	return append([]interface{}{wrapper.value, wrapper.separator}, wrapper.orderBy...)
+}
+
+// WrapSqlBound implements plans.LiteralWrapper.
+func (wrapper stringAggWrapper) WrapSqlBound(dialect gorp.Dialect, values ...string) string {
+	return wrapper.wrap(dialect, values[0], values[1], values[2:])
+}
+
+func (wrapper stringAggWrapper) wrap(dialect gorp.Dialect, value, separator string, orderBy []string) string {
+	var orderClause string
+	if len(orderBy) > 0 {
+		orderClause = " ORDER BY " + strings.Join(orderBy, ", ")
+	}
+	switch dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		return fmt.Sprintf("group_concat(%s%s SEPARATOR %s)", value, orderClause, separator)
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		return fmt.Sprintf("group_concat(%s, %s%s)", value, separator, orderClause)
+	}
+	return fmt.Sprintf("string_agg(CAST(%s AS text), %s%s)", value, separator, orderClause)
+}
+
+func (wrapper stringAggWrapper) Aggregate() {}
+
+// quoteString returns value as a quoted SQL string literal.
+func quoteString(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// StringAgg returns a filters.MultiSqlWrapper which concatenates the
+// values of value across each group, separated by separator and
+// ordered by the values in orderBy (if any).  It uses string_agg() in
+// postgresql and group_concat() in mysql and sqlite, and can be
+// selected into a string field using SelectAs.  Example:
+//
+//     q := dbMap.Query(ref)
+//     q.Fields(&ref.Id)
+//     q.Join(childRef).On().Equal(&childRef.ParentId, &ref.Id)
+//     q.SelectAs(&ref.ChildNames, gorq.StringAgg(&childRef.Name, ", ", &childRef.Name))
+//     q.GroupBy(&ref.Id)
+//
+// Ordering within group_concat() requires sqlite 3.44 or newer.
+func StringAgg(value interface{}, separator string, orderBy ...interface{}) filters.MultiSqlWrapper {
+	return stringAggWrapper{value: value, separator: separator, orderBy: orderBy}
+}
+
+// arrayAggWrapper aggregates the values of a column across a group of
+// rows into a JSON array, so that it can be scanned into a slice.
+type arrayAggWrapper struct {
+	value interface{}
+}
+
+func (wrapper arrayAggWrapper) ActualValues() []interface{} {
+	return []interface{}{wrapper.value}
+}
+
+func (wrapper arrayAggWrapper) WrapSql(values ...string) string {
+	return wrapper.WrapSqlFor(gorp.PostgresDialect{}, values...)
+}
+
+// WrapSqlFor implements plans.DialectWrapper.
+func (wrapper arrayAggWrapper) WrapSqlFor(dialect gorp.Dialect, values ...string) string {
+	switch dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		return "json_arrayagg(" + values[0] + ")"
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		return "json_group_array(" + values[0] + ")"
+	}
+	return "array_to_json(array_agg(" + values[0] + "))"
+}
+
+func (wrapper arrayAggWrapper) Aggregate() {}
+
+// Scanner implements plans.ScanWrapper.
+func (wrapper arrayAggWrapper) Scanner(fieldPtr interface{}) gorp.CustomScanner {
+	return gorp.CustomScanner{Holder: new([]byte), Target: fieldPtr, Binder: bindJSONArray}
+}
+
+// bindJSONArray decodes the JSON array in holder (a *[]byte) into the
+// slice that target points to.  Null elements, which are aggregated
+// from the missing side of an outer join, are skipped.
+func bindJSONArray(holder, target interface{}) error {
+	slice := reflect.ValueOf(target).Elem()
+	if slice.Kind() != reflect.Slice {
+		return fmt.Errorf("gorq: Aggregated arrays can only be scanned into slices, not %s", slice.Type())
+	}
+	data := *holder.(*[]byte)
+	if data == nil {
+		slice.Set(reflect.Zero(slice.Type()))
+		return nil
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(data, &elems); err != nil {
+		return err
+	}
+	result := reflect.MakeSlice(slice.Type(), 0, len(elems))
+	for _, elem := range elems {
+		if string(elem) == "null" {
+			continue
+		}
+		value := reflect.New(slice.Type().Elem())
+		if err := json.Unmarshal(elem, value.Interface()); err != nil {
+			return err
+		}
+		result = reflect.Append(result, value.Elem())
+	}
+	slice.Set(result)
+	return nil
+}
+
+// ArrayAgg returns a filters.MultiSqlWrapper which aggregates the
+// values of value across each group, to be selected into a slice
+// field using SelectAs.  It is a lightweight alternative to joining
+// (and de-duplicating) rows for simple child collections.  Example:
+//
+//     type Author struct {
+//         Id      int64
+//         BookIds []int64 `db:"-"`
+//     }
+//
+//     q := dbMap.Query(ref)
+//     q.Fields(&ref.Id)
+//     q.LeftJoin(bookRef).On().Equal(&bookRef.AuthorId, &ref.Id)
+//     q.SelectAs(&ref.BookIds, gorq.ArrayAgg(&bookRef.Id))
+//     q.GroupBy(&ref.Id)
+//
+// Values are aggregated using array_agg() in postgresql.  Since
+// arrays aren't supported by every dialect (or driver), they are read
+// as JSON arrays everywhere (json_arrayagg() in mysql and
+// json_group_array() in sqlite), so elements are decoded into the
+// slice using encoding/json.  Nulls, e.g. from rows with no matches
+// in an outer join, are left out.
+func ArrayAgg(value interface{}) filters.MultiSqlWrapper {
+	return arrayAggWrapper{value: value}
+}
+
+// rowJSONWrapper converts every mapped column of a reference struct
+// to a JSON object.
+type rowJSONWrapper struct {
+	row interface{}
+}
+
+func (wrapper rowJSONWrapper) ActualRow() interface{} {
+	return wrapper.row
+}
+
+// WrapRow implements plans.RowWrapper.
+func (wrapper rowJSONWrapper) WrapRow(dialect gorp.Dialect, key string, names, values []string) string {
+	buffer := new(bytes.Buffer)
+	switch dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect, gorp.SqliteDialect, dialects.SqliteDialect:
+		buffer.WriteString("json_object(")
+	default:
+		buffer.WriteString("json_build_object(")
+	}
+	for i, name := range names {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(quoteString(name))
+		buffer.WriteString(", ")
+		buffer.WriteString(values[i])
+	}
+	buffer.WriteString(")")
+	if key == "" {
+		return buffer.String()
+	}
+	return "CASE WHEN " + key + " IS NULL THEN NULL ELSE " + buffer.String() + " END"
+}
+
+// Scanner implements plans.ScanWrapper.
+func (wrapper rowJSONWrapper) Scanner(fieldPtr interface{}) gorp.CustomScanner {
+	return gorp.CustomScanner{Holder: new([]byte), Target: fieldPtr, Binder: bindJSON}
+}
+
+// bindJSON decodes the JSON document in holder (a *[]byte) into
+// target, setting target to its zero value if holder is null.
+func bindJSON(holder, target interface{}) error {
+	data := *holder.(*[]byte)
+	if data == nil {
+		value := reflect.ValueOf(target).Elem()
+		value.Set(reflect.Zero(value.Type()))
+		return nil
+	}
+	return json.Unmarshal(data, target)
+}
+
+// RowToJSON returns a plans.RowWrapper which converts every mapped
+// column of row (a reference struct, usually of a joined table) to a
+// JSON object, keyed by field name (or json tag).  It can be selected
+// into a struct field using SelectAs, but is most useful inside of
+// JSONAgg.  If row's table has a primary key, rows from the missing
+// side of an outer join are converted to null rather than an object
+// full of nulls.
+//
+// Values are decoded using encoding/json, so fields must be types
+// that can be decoded from their JSON representation in the database.
+// Notably, postgresql converts timestamps without time zones to
+// strings which time.Time can't parse.
+func RowToJSON(row interface{}) plans.RowWrapper {
+	return rowJSONWrapper{row: row}
+}
+
+// jsonAggWrapper aggregates values across a group of rows into a JSON
+// array.
+type jsonAggWrapper struct {
+	value interface{}
+}
+
+func (wrapper jsonAggWrapper) ActualValues() []interface{} {
+	return []interface{}{wrapper.value}
+}
+
+func (wrapper jsonAggWrapper) WrapSql(values ...string) string {
+	return wrapper.WrapSqlFor(gorp.PostgresDialect{}, values...)
+}
+
+// WrapSqlFor implements plans.DialectWrapper.
+func (wrapper jsonAggWrapper) WrapSqlFor(dialect gorp.Dialect, values ...string) string {
+	switch dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		return "json_arrayagg(" + values[0] + ")"
+	case gorp.SqliteDialect, dialects.SqliteDialect:
+		if _, isRow := wrapper.value.(plans.RowWrapper); isRow {
+			// sqlite only treats values as JSON (rather than as
+			// strings) when they come directly from a JSON function.
+			return "json_group_array(json(" + values[0] + "))"
+		}
+		return "json_group_array(" + values[0] + ")"
+	}
+	return "json_agg(" + values[0] + ")"
+}
+
+func (wrapper jsonAggWrapper) Aggregate() {}
+
+// Scanner implements plans.ScanWrapper.
+func (wrapper jsonAggWrapper) Scanner(fieldPtr interface{}) gorp.CustomScanner {
+	return gorp.CustomScanner{Holder: new([]byte), Target: fieldPtr, Binder: bindJSONArray}
+}
+
+// JSONAgg returns a filters.MultiSqlWrapper which aggregates value
+// across each group into a JSON array, to be selected into a slice
+// field using SelectAs.  Combined with RowToJSON, it can be used to
+// fetch parents along with their children in a single query, without
+// the duplicated parent rows of a plain join.  Example:
+//
+//     type Author struct {
+//         Id    int64
+//         Name  string
+//         Books []Book `db:"-"`
+//     }
+//
+//     q := dbMap.Query(ref)
+//     q.Fields(&ref.Id, &ref.Name)
+//     q.LeftJoin(bookRef).On().Equal(&bookRef.AuthorId, &ref.Id)
+//     q.SelectAs(&ref.Books, gorq.JSONAgg(gorq.RowToJSON(bookRef)))
+//     q.GroupBy(&ref.Id)
+//     q.GroupBy(&ref.Name)
+//
+// It uses json_agg() in postgresql, json_arrayagg() in mysql, and
+// json_group_array() in sqlite.  Like ArrayAgg, nulls (including rows
+// from the missing side of an outer join) are left out of the slice.
+func JSONAgg(value interface{}) filters.MultiSqlWrapper {
+	return jsonAggWrapper{value: value}
+}
+
+// collateWrapper applies a collation to a value.
+type collateWrapper struct {
+	value     interface{}
+	collation string
+}
+
+func (wrapper collateWrapper) ActualValues() []interface{} {
+	return []interface{}{wrapper.value}
+}
+
+func (wrapper collateWrapper) WrapSql(values ...string) string {
+	return wrapper.WrapSqlFor(gorp.PostgresDialect{}, values...)
+}
+
+// WrapSqlFor implements plans.DialectWrapper.
+func (wrapper collateWrapper) WrapSqlFor(dialect gorp.Dialect, values ...string) string {
+	switch dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		return values[0] + " COLLATE `" + strings.Replace(wrapper.collation, "`", "``", -1) + "`"
+	}
+	// Dialects may lower case quoted fields, but collation names are
+	// case sensitive.
+	return values[0] + ` COLLATE "` + strings.Replace(wrapper.collation, `"`, `""`, -1) + `"`
+}
+
+// Collate returns a filters.MultiSqlWrapper which applies collation
+// to value, for locale-correct ordering and comparison of strings.
+// The collation name is quoted for the plan's dialect, so it must
+// match the database's name for it exactly (including case).  Example:
+//
+//     results, err := dbMap.Query(ref).
+//         Where().
+//         Equal(gorq.Collate(&ref.Title, "und-x-icu"), title).
+//         OrderBy(gorq.Collate(&ref.Title, "de-x-icu"), "asc").
+//         Select()
+//
+// Collation names differ between databases (e.g. "de-x-icu" in
+// postgresql, "utf8mb4_german2_ci" in mysql, or "NOCASE" in sqlite).
+func Collate(value interface{}, collation string) filters.MultiSqlWrapper {
+	return collateWrapper{value: value, collation: collation}
+}
+
+// foldWrapper folds the case (and, where supported, the accents) of a
+// value for case-insensitive comparisons.
+type foldWrapper struct {
+	value interface{}
+}
+
+func (wrapper foldWrapper) ActualValues() []interface{} {
+	return []interface{}{wrapper.value}
+}
+
+func (wrapper foldWrapper) WrapSql(values ...string) string {
+	return wrapper.WrapSqlFor(gorp.PostgresDialect{}, values...)
+}
+
+// WrapSqlFor implements plans.DialectWrapper.
+func (wrapper foldWrapper) WrapSqlFor(dialect gorp.Dialect, values ...string) string {
+	if _, ok := dialect.(gorp.PostgresDialect); ok {
+		return "lower(unaccent(" + values[0] + "))"
+	}
+	return "lower(" + values[0] + ")"
+}
+
+// Fold returns a filters.MultiSqlWrapper which folds value for
+// accent- and case-insensitive comparisons.  In postgresql, it wraps
+// value in lower(unaccent()), which requires the unaccent extension;
+// other dialects only use lower().  (mysql's default collations are
+// already accent-insensitive.)  Both sides of a comparison should be
+// folded; see FoldedEqual and FoldedLike.
+func Fold(value interface{}) filters.MultiSqlWrapper {
+	return foldWrapper{value: value}
+}
+
+// FoldedEqual returns a filter for fieldPtr = value, ignoring case and
+// (where supported) accents.  See Fold.
+func FoldedEqual(fieldPtr interface{}, value interface{}) filters.Filter {
+	return filters.Equal(Fold(fieldPtr), Fold(value))
+}
+
+// FoldedLike returns a filter for fieldPtr LIKE pattern, ignoring case
+// and (where supported) accents.  See Fold.  Example:
+//
+//     results, err := dbMap.Query(ref).
+//         Where(gorq.FoldedLike(&ref.City, "%montreal%")).
+//         Select()
+//
+// The above would match "Montréal" in postgresql.
+func FoldedLike(fieldPtr interface{}, pattern string) filters.Filter {
+	return &filters.ComparisonFilter{
+		Left:       Fold(fieldPtr),
+		Comparison: " like ",
+		Right:      Fold(pattern),
+	}
+}
+
+// mysqlCastTypes maps standard type names to the types that mysql
+// accepts in CAST expressions.
+var mysqlCastTypes = map[string]string{
+	"int":      "SIGNED",
+	"integer":  "SIGNED",
+	"bigint":   "SIGNED",
+	"smallint": "SIGNED",
+	"text":     "CHAR",
+	"varchar":  "CHAR",
+	"numeric":  "DECIMAL",
+	"real":     "DOUBLE",
+	"float":    "DOUBLE",
+}
+
+// castWrapper converts a value to another type.
+type castWrapper struct {
+	value   interface{}
+	sqlType string
+}
+
+func (wrapper castWrapper) ActualValues() []interface{} {
+	return []interface{}{wrapper.value}
+}
+
+func (wrapper castWrapper) WrapSql(values ...string) string {
+	return wrapper.WrapSqlFor(gorp.PostgresDialect{}, values...)
+}
+
+// WrapSqlFor implements plans.DialectWrapper.
+func (wrapper castWrapper) WrapSqlFor(dialect gorp.Dialect, values ...string) string {
+	sqlType := wrapper.sqlType
+	switch dialect.(type) {
+	case gorp.MySQLDialect, dialects.MySQLDialect:
+		if mysqlType, ok := mysqlCastTypes[strings.ToLower(sqlType)]; ok {
+			sqlType = mysqlType
+		}
+	}
+	return "CAST(" + values[0] + " AS " + sqlType + ")"
+}
+
+// Cast returns a filters.MultiSqlWrapper which converts value (a
+// field pointer, literal, or another wrapper) to sqlType.  It can be
+// used in select, where, and order by clauses.  Example:
+//
+//     results, err := dbMap.Query(ref).
+//         Where().
+//         Greater(gorq.Cast(&ref.ExternalId, "integer"), 100).
+//         OrderBy(gorq.Cast(&ref.ExternalId, "integer"), "asc").
+//         Select()
+//
+// sqlType is used as is, except in mysql, where common type names
+// which it doesn't accept in casts (e.g. integer or text) are
+// converted to the closest type that it does (e.g. SIGNED or CHAR).
+func Cast(value interface{}, sqlType string) filters.MultiSqlWrapper {
+	return castWrapper{value: value, sqlType: sqlType}
+}
+
+// A Window describes the rows that a window function is computed
+// over, i.e. its OVER (PARTITION BY ... ORDER BY ...) clause.  See
+// WindowFunction.Over.
+type Window struct {
+	partitionBy []interface{}
+	orderBy     []interface{}
+	directions  []string
+}
+
+// PartitionBy returns a Window partitioned by values, which may be
+// field pointers or wrappers around them.
+func PartitionBy(values ...interface{}) *Window {
+	return new(Window).PartitionBy(values...)
+}
+
+// PartitionBy adds values to the window's PARTITION BY clause.
+func (w *Window) PartitionBy(values ...interface{}) *Window {
+	w.partitionBy = append(w.partitionBy, values...)
+	return w
+}
+
+// OrderBy adds value to the window's ORDER BY clause.  Direction is
+// "asc", "desc", or empty (for the database's default); any other
+// direction is ignored.
+func (w *Window) OrderBy(value interface{}, direction string) *Window {
+	w.orderBy = append(w.orderBy, value)
+	w.directions = append(w.directions, strings.ToLower(direction))
+	return w
+}
+
+// A WindowFunction is a function, like row_number() or lag(), that is
+// computed for each row over a window of related rows.  It must be
+// given a window using Over before it is used.
+type WindowFunction struct {
+	function string
+	args     []interface{}
+	offset   *int
+}
+
+// RowNumber returns a WindowFunction for row_number(), the position
+// of each row within its partition.
+func RowNumber() *WindowFunction {
+	return &WindowFunction{function: "row_number"}
+}
+
+// Rank returns a WindowFunction for rank(), the position of each row
+// within its partition, with gaps after rows that tie.
+func Rank() *WindowFunction {
+	return &WindowFunction{function: "rank"}
+}
+
+// DenseRank returns a WindowFunction for dense_rank(), which is Rank
+// without gaps.
+func DenseRank() *WindowFunction {
+	return &WindowFunction{function: "dense_rank"}
+}
+
+// Lag returns a WindowFunction for lag(value, offset), the value of
+// value in the row offset rows before each row within its partition
+// (or null if there is none).
+func Lag(value interface{}, offset int) *WindowFunction {
+	return &WindowFunction{function: "lag", args: []interface{}{value}, offset: &offset}
+}
+
+// Lead returns a WindowFunction for lead(value, offset), which is Lag
+// for the rows after each row.
+func Lead(value interface{}, offset int) *WindowFunction {
+	return &WindowFunction{function: "lead", args: []interface{}{value}, offset: &offset}
+}
+
+// Over returns a filters.MultiSqlWrapper for the function computed
+// over window, which may be nil to use every row.  It is usually
+// selected using SelectAs.  Example:
+//
+//     q := dbMap.Query(ref)
+//     q.SelectAs(&ref.Position, gorq.RowNumber().Over(
+//         gorq.PartitionBy(&ref.PersonId).OrderBy(&ref.Created, "desc")))
+//
+// A plan like q can then be used as a sub-query, filtered on
+// Position, to select the latest row of each group.  Window functions
+// are supported by postgresql, MySQL 8, and SQLite 3.25 or later.
+func (f *WindowFunction) Over(window *Window) filters.MultiSqlWrapper {
+	if window == nil {
+		window = new(Window)
+	}
+	return windowWrapper{function: f, window: window}
+}
+
+// windowWrapper is a WindowFunction computed over a Window.
+type windowWrapper struct {
+	function *WindowFunction
+	window   *Window
+}
+
+func (wrapper windowWrapper) ActualValues() []interface{} {
+	values := make([]interface{}, 0, len(wrapper.function.args)+len(wrapper.window.partitionBy)+len(wrapper.window.orderBy))
+	values = append(values, wrapper.function.args...)
+	values = append(values, wrapper.window.partitionBy...)
+	return append(values, wrapper.window.orderBy...)
+}
+
+func (wrapper windowWrapper) WrapSql(values ...string) string {
+	f, w := wrapper.function, wrapper.window
+	args := values[:len(f.args)]
+	partitionBy := values[len(f.args) : len(f.args)+len(w.partitionBy)]
+	orderBy := values[len(f.args)+len(w.partitionBy):]
+
+	buf := bytes.NewBufferString(f.function)
+	buf.WriteString("(")
+	buf.WriteString(strings.Join(args, ", "))
+	if f.offset != nil {
+		buf.WriteString(", ")
+		buf.WriteString(strconv.Itoa(*f.offset))
+	}
+	buf.WriteString(") OVER (")
+	if len(partitionBy) > 0 {
+		buf.WriteString("PARTITION BY ")
+		buf.WriteString(strings.Join(partitionBy, ", "))
+	}
+	if len(orderBy) > 0 {
+		if len(partitionBy) > 0 {
+			buf.WriteString(" ")
+		}
+		buf.WriteString("ORDER BY ")
+		for i, value := range orderBy {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(value)
+			switch w.directions[i] {
+			case "asc", "desc":
+				buf.WriteString(" " + strings.ToUpper(w.directions[i]))
+			}
+		}
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
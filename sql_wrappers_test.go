@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/dialects"
+	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/plans"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -13,3 +17,161 @@ func TestLower(t *testing.T) {
 	assert.Equal(t, wrapper.ActualValue(), val)
 	assert.Equal(t, wrapper.WrapSql(val), fmt.Sprintf("lower(%s)", val))
 }
+
+func TestPlusAndMinus(t *testing.T) {
+	left, right := "left", 10
+	plus := Plus(left, right)
+	assert.Equal(t, []interface{}{left, right}, plus.ActualValues())
+	assert.Equal(t, "(a + b)", plus.WrapSql("a", "b"))
+	assert.Equal(t, "(a - b)", Minus(left, right).WrapSql("a", "b"))
+}
+
+func TestStatisticalAggregates(t *testing.T) {
+	val := "price"
+	assert.Equal(t, "percentile_cont(0.95) WITHIN GROUP (ORDER BY price)", PercentileCont(0.95, val).WrapSql(val))
+	assert.Equal(t, "percentile_disc(0.25) WITHIN GROUP (ORDER BY price)", PercentileDisc(0.25, val).WrapSql(val))
+	assert.Equal(t, "percentile_cont(0.5) WITHIN GROUP (ORDER BY price)", Median(val).WrapSql(val))
+	assert.Equal(t, "mode() WITHIN GROUP (ORDER BY price)", Mode(val).WrapSql(val))
+	assert.Equal(t, "stddev_samp(price)", Stddev(val).WrapSql(val))
+	assert.Equal(t, "var_samp(price)", Variance(val).WrapSql(val))
+	for _, wrapper := range []filters.SqlWrapper{Median(val), Mode(val), Stddev(val), Variance(val)} {
+		assert.Equal(t, val, wrapper.ActualValue())
+		assert.Implements(t, (*filters.Aggregate)(nil), wrapper)
+	}
+
+	bound := PercentileCont(0.95, val).(plans.LiteralWrapper)
+	assert.Equal(t, []interface{}{0.95, val}, bound.BoundValues(gorp.PostgresDialect{}))
+	assert.Equal(t, "percentile_cont(CAST($1 AS double precision)) WITHIN GROUP (ORDER BY price)",
+		bound.WrapSqlBound(gorp.PostgresDialect{}, "$1", val))
+	assert.Nil(t, Mode(val).(plans.LiteralWrapper).BoundValues(gorp.PostgresDialect{}))
+}
+
+func TestStringAgg(t *testing.T) {
+	name, created := "name", "created"
+	wrapper := StringAgg(&name, "; ", &created)
+	assert.Equal(t, []interface{}{&name, &created}, wrapper.ActualValues())
+	assert.Implements(t, (*filters.Aggregate)(nil), wrapper)
+
+	dialectWrapper := wrapper.(stringAggWrapper)
+	assert.Equal(t, "string_agg(CAST(name AS text), '; ' ORDER BY created)", wrapper.WrapSql(name, created))
+	assert.Equal(t, "group_concat(name ORDER BY created SEPARATOR '; ')",
+		dialectWrapper.WrapSqlFor(dialects.MySQLDialect{}, name, created))
+	assert.Equal(t, "group_concat(name, '; ' ORDER BY created)",
+		dialectWrapper.WrapSqlFor(gorp.SqliteDialect{}, name, created))
+	assert.Equal(t, "group_concat(name, 'it''s')",
+		StringAgg(&name, "it's").(stringAggWrapper).WrapSqlFor(gorp.SqliteDialect{}, name))
+
+	assert.Equal(t, []interface{}{&name, "; ", &created}, dialectWrapper.BoundValues(gorp.PostgresDialect{}))
+	assert.Equal(t, "string_agg(CAST(name AS text), $1 ORDER BY created)",
+		dialectWrapper.WrapSqlBound(gorp.PostgresDialect{}, name, "$1", created))
+	assert.Nil(t, dialectWrapper.BoundValues(dialects.MySQLDialect{}),
+		"mysql separators must be inlined")
+}
+
+func TestArrayAgg(t *testing.T) {
+	var ids []int64
+	wrapper := ArrayAgg(&ids).(arrayAggWrapper)
+	assert.Equal(t, "array_to_json(array_agg(id))", wrapper.WrapSql("id"))
+	assert.Equal(t, "json_arrayagg(id)", wrapper.WrapSqlFor(dialects.MySQLDialect{}, "id"))
+	assert.Equal(t, "json_group_array(id)", wrapper.WrapSqlFor(gorp.SqliteDialect{}, "id"))
+	assert.Implements(t, (*filters.Aggregate)(nil), wrapper)
+
+	scanner := wrapper.Scanner(&ids)
+	*scanner.Holder.(*[]byte) = []byte("[3, null, 1]")
+	if assert.NoError(t, scanner.Binder(scanner.Holder, scanner.Target)) {
+		assert.Equal(t, []int64{3, 1}, ids)
+	}
+	*scanner.Holder.(*[]byte) = nil
+	if assert.NoError(t, scanner.Binder(scanner.Holder, scanner.Target)) {
+		assert.Nil(t, ids)
+	}
+
+	var notSlice int64
+	scanner = wrapper.Scanner(&notSlice)
+	*scanner.Holder.(*[]byte) = []byte("[1]")
+	assert.Error(t, scanner.Binder(scanner.Holder, scanner.Target))
+}
+
+func TestJSONAggAndRowToJSON(t *testing.T) {
+	type child struct {
+		Id   int64
+		Name string `json:"name"`
+	}
+	row := RowToJSON(&child{})
+	names, values := []string{"Id", "name"}, []string{"c.id", "c.name"}
+	assert.Equal(t, "CASE WHEN c.id IS NULL THEN NULL ELSE json_build_object('Id', c.id, 'name', c.name) END",
+		row.WrapRow(gorp.PostgresDialect{}, "c.id", names, values))
+	assert.Equal(t, "json_object('Id', c.id, 'name', c.name)",
+		row.WrapRow(dialects.SqliteDialect{}, "", names, values))
+
+	agg := JSONAgg(row).(jsonAggWrapper)
+	assert.Equal(t, "json_agg(r)", agg.WrapSql("r"))
+	assert.Equal(t, "json_arrayagg(r)", agg.WrapSqlFor(dialects.MySQLDialect{}, "r"))
+	assert.Equal(t, "json_group_array(json(r))", agg.WrapSqlFor(gorp.SqliteDialect{}, "r"))
+	assert.Equal(t, "json_group_array(r)", JSONAgg("value").(jsonAggWrapper).WrapSqlFor(gorp.SqliteDialect{}, "r"))
+
+	var children []child
+	scanner := agg.Scanner(&children)
+	*scanner.Holder.(*[]byte) = []byte(`[{"Id": 1, "name": "a"}, null, {"Id": 2, "name": "b"}]`)
+	if assert.NoError(t, scanner.Binder(scanner.Holder, scanner.Target)) {
+		assert.Equal(t, []child{{1, "a"}, {2, "b"}}, children)
+	}
+
+	var single child
+	scanner = row.(rowJSONWrapper).Scanner(&single)
+	*scanner.Holder.(*[]byte) = []byte(`{"Id": 3, "name": "c"}`)
+	if assert.NoError(t, scanner.Binder(scanner.Holder, scanner.Target)) {
+		assert.Equal(t, child{3, "c"}, single)
+	}
+}
+
+func TestCollate(t *testing.T) {
+	title := "title"
+	wrapper := Collate(&title, "de-x-icu")
+	assert.Equal(t, []interface{}{&title}, wrapper.ActualValues())
+	assert.Equal(t, `t.title COLLATE "de-x-icu"`, wrapper.WrapSql("t.title"))
+	assert.Equal(t, "t.title COLLATE `utf8mb4_german2_ci`",
+		Collate(&title, "utf8mb4_german2_ci").(collateWrapper).WrapSqlFor(dialects.MySQLDialect{}, "t.title"))
+	assert.Equal(t, `t.title COLLATE "NOCASE"`,
+		Collate(&title, "NOCASE").(collateWrapper).WrapSqlFor(gorp.SqliteDialect{}, "t.title"))
+}
+
+func TestFold(t *testing.T) {
+	city := "city"
+	wrapper := Fold(&city).(foldWrapper)
+	assert.Equal(t, "lower(unaccent(c.city))", wrapper.WrapSql("c.city"))
+	assert.Equal(t, "lower(c.city)", wrapper.WrapSqlFor(gorp.SqliteDialect{}, "c.city"))
+
+	like := FoldedLike(&city, "%montreal%")
+	assert.Equal(t, []interface{}{Fold(&city), Fold("%montreal%")}, like.ActualValues())
+	assert.Equal(t, "a like b", like.Where("a", "b"))
+	assert.Equal(t, []interface{}{Fold(&city), Fold("Montréal")}, FoldedEqual(&city, "Montréal").ActualValues())
+}
+
+func TestCast(t *testing.T) {
+	id := "id"
+	wrapper := Cast(&id, "integer").(castWrapper)
+	assert.Equal(t, []interface{}{&id}, wrapper.ActualValues())
+	assert.Equal(t, "CAST(t.id AS integer)", wrapper.WrapSql("t.id"))
+	assert.Equal(t, "CAST(t.id AS SIGNED)", wrapper.WrapSqlFor(dialects.MySQLDialect{}, "t.id"))
+	assert.Equal(t, "CAST(t.id AS numeric(10, 2))", Cast(&id, "numeric(10, 2)").WrapSql("t.id"))
+}
+
+func TestWindowFunctions(t *testing.T) {
+	group, created, total := "group", "created", "total"
+	window := PartitionBy(&group).OrderBy(&created, "desc")
+	wrapper := RowNumber().Over(window)
+	assert.Equal(t, []interface{}{&group, &created}, wrapper.ActualValues())
+	assert.Equal(t, "row_number() OVER (PARTITION BY g ORDER BY c DESC)", wrapper.WrapSql("g", "c"))
+	_, isAggregate := wrapper.(filters.Aggregate)
+	assert.False(t, isAggregate, "Window functions should not be treated as aggregates")
+
+	assert.Equal(t, "rank() OVER (ORDER BY c)", Rank().Over(new(Window).OrderBy(&created, "")).WrapSql("c"))
+	assert.Equal(t, "dense_rank() OVER ()", DenseRank().Over(nil).WrapSql())
+
+	lag := Lag(&total, 1).Over(PartitionBy(&group, &created))
+	assert.Equal(t, []interface{}{&total, &group, &created}, lag.ActualValues())
+	assert.Equal(t, "lag(t, 1) OVER (PARTITION BY g, c)", lag.WrapSql("t", "g", "c"))
+	assert.Equal(t, "lead(t, 2) OVER (ORDER BY c ASC)",
+		Lead(&total, 2).Over(new(Window).OrderBy(&created, "ASC")).WrapSql("t", "c"))
+}
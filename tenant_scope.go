@@ -0,0 +1,81 @@
+package gorq
+
+import (
+	"errors"
+
+	"github.com/outdoorsy/gorp"
+	"github.com/outdoorsy/gorq/filters"
+	"github.com/outdoorsy/gorq/plans"
+)
+
+// ErrNoTenant is returned when a query against a tenant scoped table
+// is executed without a tenant in its context.
+var ErrNoTenant = errors.New("gorq: No tenant found in context for query against a tenant scoped table")
+
+// A TenantScope limits every select, update, and delete statement
+// against its scoped tables to rows belonging to a single tenant.
+// The tenant is read from the context that the query was created
+// with (see DbMap.QueryContext and Transaction.QueryContext).
+//
+// Example:
+//
+//     scope := gorq.NewTenantScope(tenantKey)
+//     scope.Scope(dbMap, Model{}, "TenantId")
+//     scope.Scope(dbMap, Other{}, "OwnerId")
+//     dbMap.AddPolicy(scope.Policy)
+//
+//     // where model.tenant_id = ? is added automatically
+//     ctx = context.WithValue(ctx, tenantKey, tenantId)
+//     results, err := dbMap.QueryContext(ctx, ref).Select()
+//
+// Queries against scoped tables with no tenant in their context will
+// return ErrNoTenant instead of executing.
+type TenantScope struct {
+	contextKey interface{}
+	columns    []*gorp.ColumnMap
+}
+
+// NewTenantScope returns a TenantScope that will look up tenants in
+// contexts using contextKey.
+func NewTenantScope(contextKey interface{}) *TenantScope {
+	return &TenantScope{contextKey: contextKey}
+}
+
+// Scope adds the table for target to the scope, using the column for
+// fieldPtrOrName as its tenant column.
+func (s *TenantScope) Scope(m *DbMap, target, fieldPtrOrName interface{}) error {
+	_, col, err := m.column(target, fieldPtrOrName)
+	if err != nil {
+		return err
+	}
+	s.columns = append(s.columns, col)
+	return nil
+}
+
+// Policy is a plans.PolicyFunc which adds a filter on the tenant
+// column of every scoped table in the statement.  Filters on joined
+// tables are added to their join's on clause (see
+// plans.PolicyRequest.FilterFor), so left joins to scoped tables still
+// return rows which have no matching rows for the tenant.
+func (s *TenantScope) Policy(req *plans.PolicyRequest) error {
+	if req.Operation == plans.InsertOperation {
+		return nil
+	}
+	for _, col := range s.columns {
+		fields := req.FieldsFor(col)
+		if len(fields) == 0 {
+			continue
+		}
+		if req.Operation == plans.TruncateOperation {
+			return errors.New("gorq: Cannot truncate a tenant scoped table")
+		}
+		tenant := req.Context().Value(s.contextKey)
+		if tenant == nil {
+			return ErrNoTenant
+		}
+		for _, field := range fields {
+			req.FilterFor(field, filters.Equal(field, tenant))
+		}
+	}
+	return nil
+}